@@ -0,0 +1,302 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Reconciles ePoxy Host records in Datastore with a YAML file",
+	Long: `
+USAGE:
+
+    Creates or updates the Datastore records for a given project to match the
+    hosts in a YAML file. Host fields use the same names as the records printed
+    by "list", e.g. Name, IPv4Addr, Boot, Update, ImagesVersion, UpdateEnabled.
+
+    Only configuration fields are applied: IPv4Addr, IPv6Addr, AllowedCIDRs,
+    MachineType, Boot, Update, Group, ImagesVersion, APIVersion, ChainChecksums,
+    ChainCommand, BootPolicy, UpdateEnabled, MaxUpdateAttempts,
+    Decommissioned, Extensions, and Message. A BootPolicy supersedes
+    UpdateEnabled. State reported by booting machines, e.g. session
+    IDs and collected information, is preserved.
+
+    With --prune, records for hosts missing from the file are deleted. With
+    --dry-run, apply lists the changes without modifying Datastore.
+
+EXAMPLE:
+
+    # hosts.yaml
+    hosts:
+    - Name: mlab1-abc01.mlab-sandbox.measurement-lab.org
+      IPv4Addr: 192.168.0.1
+      ImagesVersion: v1.2.3
+      Group: physical
+
+    epoxy_admin apply --project mlab-sandbox -f hosts.yaml --dry-run
+`,
+	Run: runApply,
+}
+
+// hostsFile is the format of the YAML file read by apply.
+type hostsFile struct {
+	Hosts []*storage.Host
+}
+
+func runApply(cmd *cobra.Command, args []string) {
+	f, err := os.Open(afFilename)
+	rtx.Must(err, "Failed to open hosts file")
+	defer f.Close()
+	desired, err := parseHostsFile(f)
+	rtx.Must(err, "Failed to parse hosts file: %s", afFilename)
+
+	// Setup Datastore client.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	ds := storage.NewDatastoreConfig(client)
+	current, err := ds.List()
+	rtx.Must(err, "Failed to list host records")
+
+	applyHosts(cmd.OutOrStdout(), ds, desired, current)
+}
+
+// parseHostsFile reads hosts from a YAML hosts file. Hosts are decoded like
+// the JSON records printed by "list", so field names match the storage.Host
+// fields. Unknown fields, missing names, duplicate names, invalid stage URLs,
+// invalid AllowedCIDRs, invalid extension names, and invalid boot policies
+// are errors.
+func parseHostsFile(r io.Reader) ([]*storage.Host, error) {
+	var raw interface{}
+	if err := yaml.NewDecoder(r).Decode(&raw); err != nil && err != io.EOF {
+		return nil, err
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var file hostsFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i, h := range file.Hosts {
+		switch {
+		case h == nil || h.Name == "":
+			return nil, fmt.Errorf("host %d has no Name", i)
+		case seen[storage.NormalizeName(h.Name)]:
+			return nil, fmt.Errorf("duplicate host: %s", h.Name)
+		}
+		seen[storage.NormalizeName(h.Name)] = true
+		for _, cidr := range h.AllowedCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, fmt.Errorf("host %s: %v", h.Name, err)
+			}
+		}
+		if err := storage.ValidateOperationNames(h.Extensions); err != nil {
+			return nil, fmt.Errorf("host %s: %v", h.Name, err)
+		}
+		if !storage.ValidBootPolicy(h.BootPolicy) {
+			return nil, fmt.Errorf("host %s: invalid boot policy: %q", h.Name, h.BootPolicy)
+		}
+		if err := validateBootConfig(h); err != nil {
+			return nil, fmt.Errorf("host %s: %v", h.Name, err)
+		}
+		for _, sequence := range []datastorex.Map{h.Boot, h.Update} {
+			for stage, u := range sequence {
+				if err := validateURL(u); err != nil {
+					return nil, fmt.Errorf("host %s stage %s: %v", h.Name, stage, err)
+				}
+			}
+		}
+	}
+	return file.Hosts, nil
+}
+
+// hostConfig returns a copy of the configuration fields of h that are managed
+// by apply. Empty maps and slices are returned as nil, so that values loaded
+// from Datastore and decoded from YAML compare equal.
+func hostConfig(h *storage.Host) *storage.Host {
+	c := &storage.Host{
+		Name:              storage.NormalizeName(h.Name),
+		IPv4Addr:          h.IPv4Addr,
+		IPv6Addr:          h.IPv6Addr,
+		MachineType:       h.MachineType,
+		Group:             h.Group,
+		ImagesVersion:     h.ImagesVersion,
+		APIVersion:        h.APIVersion,
+		ChainCommand:      h.ChainCommand,
+		UpdateEnabled:     h.UpdateEnabled,
+		MaxUpdateAttempts: h.MaxUpdateAttempts,
+		Decommissioned:    h.Decommissioned,
+		Message:           h.Message,
+	}
+	if h.BootPolicy != "" {
+		// The policy determines UpdateEnabled.
+		c.SetBootPolicy(h.BootPolicy)
+	}
+	if len(h.Boot) > 0 {
+		c.Boot = h.Boot
+	}
+	if len(h.Update) > 0 {
+		c.Update = h.Update
+	}
+	if len(h.ChainChecksums) > 0 {
+		c.ChainChecksums = h.ChainChecksums
+	}
+	if len(h.Extensions) > 0 {
+		c.Extensions = h.Extensions
+	}
+	if len(h.AllowedCIDRs) > 0 {
+		c.AllowedCIDRs = h.AllowedCIDRs
+	}
+	return c
+}
+
+// applyConfig copies the configuration fields managed by apply from src to
+// dst. Like "update", enabling updates resets the update attempts, and changed
+// sequences are snapshot for "rollback".
+func applyConfig(dst, src *storage.Host) {
+	if src.UpdateEnabled && !dst.UpdateEnabled {
+		dst.UpdateAttempts = 0
+	}
+	c := hostConfig(src)
+	if !reflect.DeepEqual(dst.Boot, c.Boot) || !reflect.DeepEqual(dst.Update, c.Update) {
+		dst.SnapshotSequences()
+	}
+	dst.IPv4Addr = c.IPv4Addr
+	dst.IPv6Addr = c.IPv6Addr
+	dst.AllowedCIDRs = c.AllowedCIDRs
+	dst.MachineType = c.MachineType
+	dst.Boot = c.Boot
+	dst.Update = c.Update
+	dst.Group = c.Group
+	dst.ImagesVersion = c.ImagesVersion
+	dst.APIVersion = c.APIVersion
+	dst.ChainChecksums = c.ChainChecksums
+	dst.ChainCommand = c.ChainCommand
+	if c.BootPolicy != "" {
+		dst.SetBootPolicy(c.BootPolicy)
+	} else {
+		dst.BootPolicy = ""
+		dst.UpdateEnabled = c.UpdateEnabled
+	}
+	dst.MaxUpdateAttempts = c.MaxUpdateAttempts
+	dst.Decommissioned = c.Decommissioned
+	dst.Extensions = c.Extensions
+	dst.Message = c.Message
+}
+
+// applyHosts creates and updates records so that the current hosts match the
+// desired hosts, according to the --prune and --dry-run flags, and writes a
+// line for each change to w. Hosts that already match are not saved.
+func applyHosts(w io.Writer, ds *storage.DatastoreConfig, desired, current []*storage.Host) {
+	audit := newAuditor(ds)
+	// Host names are case insensitive, so compare them in normalized form.
+	existing := map[string]*storage.Host{}
+	for _, h := range current {
+		existing[storage.NormalizeName(h.Name)] = h
+	}
+	wanted := map[string]bool{}
+	for _, d := range desired {
+		wanted[storage.NormalizeName(d.Name)] = true
+		h, found := existing[storage.NormalizeName(d.Name)]
+		switch {
+		case !found && afDryRun:
+			fmt.Fprintf(w, "Would create host: %s\n", d.Name)
+		case !found:
+			fmt.Fprintf(w, "Creating host: %s\n", d.Name)
+			n := &storage.Host{Name: d.Name, CollectedInformation: datastorex.Map{}}
+			applyConfig(n, d)
+			rtx.Must(ds.Save(n), "Failed to save host record: %s", d.Name)
+			audit.Record(fActor, storage.AuditCreate, nil, n)
+		case reflect.DeepEqual(hostConfig(h), hostConfig(d)):
+			continue
+		case afDryRun:
+			fmt.Fprintf(w, "Would update host: %s\n", d.Name)
+		default:
+			fmt.Fprintf(w, "Updating host: %s\n", d.Name)
+			var before *storage.Host
+			after, err := ds.Update(d.Name, func(h *storage.Host) error {
+				before = h.Clone()
+				applyConfig(h, d)
+				return nil
+			})
+			rtx.Must(err, "Failed to update host record: %s", d.Name)
+			audit.Record(fActor, storage.AuditUpdate, before, after)
+		}
+	}
+	if !afPrune {
+		return
+	}
+	// An empty file would select every host, so never prune everything.
+	if len(desired) == 0 {
+		fmt.Fprintf(w, "Refusing to prune all hosts for an empty hosts file\n")
+		return
+	}
+	var names []string
+	for name := range existing {
+		if !wanted[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if afDryRun {
+			fmt.Fprintf(w, "Would delete host: %s\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "Deleting host: %s\n", name)
+		rtx.Must(ds.Delete(name), "Failed to delete host record: %s", name)
+		audit.Record(fActor, storage.AuditDelete, existing[name], nil)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+
+	// Required local flags.
+	applyCmd.Flags().StringVarP(&afFilename, "filename", "f", "",
+		"YAML file listing the desired hosts.")
+	applyCmd.MarkFlagRequired("filename")
+
+	applyCmd.Flags().BoolVar(&afPrune, "prune", false,
+		"Delete records for hosts that are not in the file.")
+	applyCmd.Flags().BoolVar(&afDryRun, "dry-run", false,
+		"List the changes without modifying Datastore.")
+}
@@ -0,0 +1,304 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/storage"
+)
+
+const testHostsYAML = `
+hosts:
+- Name: mlab1-abc01
+  IPv4Addr: 192.168.0.1
+  ImagesVersion: v2.0.0
+  UpdateEnabled: true
+  Boot:
+    stage1.ipxe: https://example.com/stage1to2.ipxe
+- Name: mlab2-abc01
+  IPv4Addr: 192.168.0.2
+  ImagesVersion: v1.0.0
+- Name: mlab4-abc01
+  IPv4Addr: 192.168.0.4
+  Extensions: [allocate_k8s_token]
+`
+
+func TestApply_parseHostsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			content: testHostsYAML,
+			want:    []string{"mlab1-abc01", "mlab2-abc01", "mlab4-abc01"},
+		},
+		{
+			name:    "success-empty",
+			content: "",
+			want:    []string{},
+		},
+		{
+			name:    "error-unknown-field",
+			content: "hosts:\n- Name: mlab1-abc01\n  IPv4Address: 192.168.0.1\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-missing-name",
+			content: "hosts:\n- IPv4Addr: 192.168.0.1\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-duplicate-name",
+			content: "hosts:\n- Name: mlab1-abc01\n- Name: mlab1-abc01\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-duplicate-name-case",
+			content: "hosts:\n- Name: mlab1-abc01\n- Name: MLAB1-ABC01\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-stage-url",
+			content: "hosts:\n- Name: mlab1-abc01\n  Boot:\n    stage2: example.com/stage2.json\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-cidr",
+			content: "hosts:\n- Name: mlab1-abc01\n  AllowedCIDRs: [192.168.0.8/33]\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-extension",
+			content: "hosts:\n- Name: mlab1-abc01\n  Extensions: [allocate_k8s_token, ../token]\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-boot-policy",
+			content: "hosts:\n- Name: mlab1-abc01\n  BootPolicy: sometimes\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-message",
+			content: "hosts:\n- Name: mlab1-abc01\n  Message: 'down || shell'\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-api-version",
+			content: "hosts:\n- Name: mlab1-abc01\n  APIVersion: foo\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-chain-command",
+			content: "hosts:\n- Name: mlab1-abc01\n  ChainCommand: imgfetch\n",
+			wantErr: true,
+		},
+		{
+			name: "error-invalid-chain-checksum",
+			content: "hosts:\n- Name: mlab1-abc01\n  ChainChecksums:\n" +
+				"    https://example.com/stage2.json: abc123\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-yaml",
+			content: "hosts: [",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := parseHostsFile(strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHostsFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []string{}
+			for _, h := range hosts {
+				got = append(got, h.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHostsFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply_runApply(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "hosts.yaml")
+	if err := os.WriteFile(fname, []byte(testHostsYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		prune       bool
+		dryRun      bool
+		want        string
+		wantHosts   []string
+		wantPuts    int
+		wantDeletes int
+		wantAudit   []string
+	}{
+		{
+			name: "create-and-update",
+			want: "Updating host: mlab1-abc01\nCreating host: mlab4-abc01\n",
+			wantHosts: []string{
+				"mlab1-abc01", "mlab2-abc01", "mlab3-abc01", "mlab4-abc01",
+			},
+			wantPuts: 2,
+			wantAudit: []string{
+				storage.AuditUpdate, storage.AuditUpdateEnabled, storage.AuditCreate,
+			},
+		},
+		{
+			name:  "prune",
+			prune: true,
+			want: "Updating host: mlab1-abc01\nCreating host: mlab4-abc01\n" +
+				"Deleting host: mlab3-abc01\n",
+			wantHosts:   []string{"mlab1-abc01", "mlab2-abc01", "mlab4-abc01"},
+			wantPuts:    2,
+			wantDeletes: 1,
+			wantAudit: []string{
+				storage.AuditUpdate, storage.AuditUpdateEnabled, storage.AuditCreate,
+				storage.AuditDelete,
+			},
+		},
+		{
+			name:   "dry-run",
+			prune:  true,
+			dryRun: true,
+			want: "Would update host: mlab1-abc01\nWould create host: mlab4-abc01\n" +
+				"Would delete host: mlab3-abc01\n",
+			wantHosts: []string{"mlab1-abc01", "mlab2-abc01", "mlab3-abc01"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			booted := storage.SessionIDs{Stage2ID: "01234"}
+			ds := newFakeDatastoreClient(
+				// Out of date, with state reported by the host.
+				&storage.Host{Name: "mlab1-abc01", IPv4Addr: "192.168.0.1", ImagesVersion: "v1.0.0",
+					UpdateAttempts: 2, CurrentSessionIDs: booted,
+					CollectedInformation: datastorex.Map{"serial": "ABC123"}},
+				// Already matches the file.
+				&storage.Host{Name: "mlab2-abc01", IPv4Addr: "192.168.0.2", ImagesVersion: "v1.0.0",
+					Boot: datastorex.Map{}, CollectedInformation: datastorex.Map{}},
+				// Missing from the file.
+				&storage.Host{Name: "mlab3-abc01", IPv4Addr: "192.168.0.3"},
+			)
+			defer useFakeDatastore(ds)()
+			afFilename, afPrune, afDryRun = fname, tt.prune, tt.dryRun
+			defer func() { afFilename, afPrune, afDryRun = "", false, false }()
+
+			var out bytes.Buffer
+			applyCmd.SetOut(&out)
+			defer applyCmd.SetOut(nil)
+			audit := useAuditBuffer()
+			defer func() { auditWriter = os.Stderr }()
+
+			runApply(applyCmd, nil)
+
+			if out.String() != tt.want {
+				t.Errorf("runApply() = %q, want %q", out.String(), tt.want)
+			}
+			if ds.puts != tt.wantPuts || ds.deletes != tt.wantDeletes {
+				t.Errorf("runApply() puts = %d, deletes = %d; want %d, %d",
+					ds.puts, ds.deletes, tt.wantPuts, tt.wantDeletes)
+			}
+			for _, name := range tt.wantHosts {
+				if _, ok := ds.hosts[name]; !ok {
+					t.Errorf("runApply() missing host %s", name)
+				}
+			}
+			if len(ds.hosts) != len(tt.wantHosts) {
+				t.Errorf("runApply() has %d hosts, want %d", len(ds.hosts), len(tt.wantHosts))
+			}
+			if got := auditActions(t, audit); !reflect.DeepEqual(got, tt.wantAudit) {
+				t.Errorf("runApply() audit actions = %q, want %q", got, tt.wantAudit)
+			}
+			if tt.dryRun {
+				return
+			}
+			// Updates apply the file and preserve state reported by the host.
+			h := ds.hosts["mlab1-abc01"]
+			if h.ImagesVersion != "v2.0.0" || !h.UpdateEnabled || h.UpdateAttempts != 0 ||
+				h.Boot[storage.Stage1IPXE] != "https://example.com/stage1to2.ipxe" {
+				t.Errorf("runApply() did not apply config: %s", h)
+			}
+			if h.CurrentSessionIDs != booted || h.CollectedInformation["serial"] != "ABC123" {
+				t.Errorf("runApply() did not preserve host state: %s", h)
+			}
+			if ext := ds.hosts["mlab4-abc01"].Extensions; !reflect.DeepEqual(ext, []string{"allocate_k8s_token"}) {
+				t.Errorf("runApply() created host with Extensions %v", ext)
+			}
+		})
+	}
+}
+
+func TestApply_runApplyMixedCase(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "hosts.yaml")
+	content := "hosts:\n" +
+		"- Name: MLAB1-ABC01.mlab-oti.measurement-lab.org\n  IPv4Addr: 192.168.0.1\n" +
+		"- Name: MLAB2-ABC01.mlab-oti.measurement-lab.org\n  IPv4Addr: 192.168.0.20\n"
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ds := newFakeDatastoreClient(
+		// Already matches the file.
+		&storage.Host{Name: "mlab1-abc01.mlab-oti.measurement-lab.org", IPv4Addr: "192.168.0.1",
+			CollectedInformation: datastorex.Map{}},
+		// Differs from the file only by address.
+		&storage.Host{Name: "mlab2-abc01.mlab-oti.measurement-lab.org", IPv4Addr: "192.168.0.2",
+			CollectedInformation: datastorex.Map{}},
+	)
+	defer useFakeDatastore(ds)()
+	afFilename, afPrune = fname, true
+	defer func() { afFilename, afPrune = "", false }()
+
+	var out bytes.Buffer
+	applyCmd.SetOut(&out)
+	defer applyCmd.SetOut(nil)
+	audit := useAuditBuffer()
+	defer func() { auditWriter = os.Stderr }()
+
+	runApply(applyCmd, nil)
+
+	// Names that differ only by case refer to the same host, so nothing is
+	// created or pruned.
+	want := "Updating host: MLAB2-ABC01.mlab-oti.measurement-lab.org\n"
+	if out.String() != want {
+		t.Errorf("runApply() = %q, want %q", out.String(), want)
+	}
+	if ds.puts != 1 || ds.deletes != 0 || len(ds.hosts) != 2 {
+		t.Errorf("runApply() puts = %d, deletes = %d, hosts = %d; want 1, 0, 2",
+			ds.puts, ds.deletes, len(ds.hosts))
+	}
+	if got, want := auditActions(t, audit), []string{storage.AuditUpdate}; !reflect.DeepEqual(got, want) {
+		t.Errorf("runApply() audit actions = %q, want %q", got, want)
+	}
+	if h := ds.hosts["mlab2-abc01.mlab-oti.measurement-lab.org"]; h == nil || h.IPv4Addr != "192.168.0.20" {
+		t.Errorf("runApply() did not update host: %s", h)
+	}
+}
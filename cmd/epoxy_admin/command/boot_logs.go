@@ -0,0 +1,86 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/spf13/cobra"
+)
+
+// bootLogsCmd represents the boot-logs command
+var bootLogsCmd = &cobra.Command{
+	Use:   "boot-logs",
+	Short: "Prints the most recent boot reports for an ePoxy Host",
+	Long: `
+USAGE:
+
+    Prints the most recent reports received from the Host named by the
+    --hostname flag, oldest first. Useful for debugging boot failures.
+
+EXAMPLE:
+
+    epoxy_admin boot-logs --project mlab-sandbox \
+        --hostname mlab1-abc01.mlab-sandbox.measurement-lab.org
+`,
+	Run: runBootLogs,
+}
+
+func runBootLogs(cmd *cobra.Command, args []string) {
+	// Setup Datastore client.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	ds := storage.NewDatastoreConfig(client)
+	h, err := ds.Load(bfHostname)
+	rtx.Must(err, "Failed to load host record: %q", bfHostname)
+
+	printBootLogs(cmd.OutOrStdout(), h)
+}
+
+// printBootLogs writes one line for each of the host's boot logs to w.
+func printBootLogs(w io.Writer, h *storage.Host) {
+	for _, l := range h.BootLogs {
+		result := "failure"
+		if l.Success {
+			result = "success"
+		}
+		fmt.Fprintf(w, "%s %s %s\n", l.Time.UTC().Format(time.RFC3339), result, l.Message)
+		// Indent command output below the report.
+		for _, line := range strings.Split(strings.TrimRight(l.Output, "\n"), "\n") {
+			if line != "" {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(bootLogsCmd)
+
+	// Required local flags.
+	bootLogsCmd.Flags().StringVar(&bfHostname, "hostname", "",
+		"Hostname of the record.")
+	bootLogsCmd.MarkFlagRequired("hostname")
+}
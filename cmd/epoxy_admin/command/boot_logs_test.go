@@ -0,0 +1,52 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+func TestBootLogs_runBootLogs(t *testing.T) {
+	received := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	h := &storage.Host{
+		Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+		BootLogs: []storage.BootLog{
+			{Time: received, Message: "error: flash failed", Success: false, Output: "flashing\nerror: no device\n"},
+			{Time: received.Add(time.Minute), Message: "success", Success: true},
+		},
+	}
+	ds := newFakeDatastoreClient(h, &storage.Host{Name: "mlab2-abc01.mlab-sandbox.measurement-lab.org"})
+	defer useFakeDatastore(ds)()
+
+	var out bytes.Buffer
+	bootLogsCmd.SetOut(&out)
+	defer bootLogsCmd.SetOut(nil)
+	bfHostname = h.Name
+	defer func() { bfHostname = "" }()
+
+	runBootLogs(bootLogsCmd, nil)
+
+	want := "2021-03-01T12:00:00Z failure error: flash failed\n" +
+		"    flashing\n" +
+		"    error: no device\n" +
+		"2021-03-01T12:01:00Z success success\n"
+	if out.String() != want {
+		t.Errorf("runBootLogs() = %q, want %q", out.String(), want)
+	}
+}
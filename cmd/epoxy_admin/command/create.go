@@ -18,11 +18,10 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-
 	"github.com/m-lab/epoxy/datastorex"
 	"github.com/m-lab/epoxy/storage"
 	"github.com/m-lab/go/rtx"
@@ -41,6 +40,11 @@ USAGE:
     Creates a new datastore Host record for ePoxy server. Calling "create" on
     an existing host will overwrite the original.
 
+    Without --extensions, new hosts enable the comma separated extensions
+    listed in the EPOXY_DEFAULT_EXTENSIONS environment variable, or
+    "allocate_k8s_token,bmc_store_password" if it is unset. The same default
+    applies to hosts added by "sync".
+
 EXAMPLE:
 
     # Use the default boot and update stage URLs:
@@ -51,37 +55,98 @@ EXAMPLE:
 	Run: runCreate,
 }
 
-// fmtURL formats (if needed) and parses the given string as a URL. If the
-// resulting URL is invalid, fmtURL panics.
+// defaultExtensionsEnv names the environment variable listing the extensions
+// enabled for new hosts that do not specify any.
+const defaultExtensionsEnv = "EPOXY_DEFAULT_EXTENSIONS"
+
+// builtinExtensions are enabled for new hosts when defaultExtensionsEnv is unset.
+var builtinExtensions = []string{"allocate_k8s_token", "bmc_store_password"}
+
+// defaultExtensions returns the extensions enabled for new hosts, from the
+// comma separated defaultExtensionsEnv. An empty value enables no extensions.
+func defaultExtensions() []string {
+	v, ok := os.LookupEnv(defaultExtensionsEnv)
+	if !ok {
+		return builtinExtensions
+	}
+	var extensions []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			extensions = append(extensions, e)
+		}
+	}
+	return extensions
+}
+
+// fmtURL formats (if needed) and validates the given string as a stage URL. If
+// the resulting URL is invalid, fmtURL panics.
 func fmtURL(urlStr string) string {
 	if strings.Contains(urlStr, "%s") {
 		urlStr = fmt.Sprintf(urlStr, fProject)
 	}
-	_, err := url.Parse(urlStr)
-	rtx.Must(err, "Failed to parse URL: %s", urlStr)
+	rtx.Must(validateURL(urlStr), "Invalid URL: %q", urlStr)
 	return urlStr
 }
 
-// TODO: add unit tests by masking out NewClient & NewDatstoreConfig. Consider
-// promoting the fake datastore types from storage/datastore_test.go to an
-// internal fake package.
+// validateURL returns an error unless urlStr is empty, for an unset stage, or
+// an absolute http or https URL with a host. url.Parse alone accepts relative
+// and scheme-less URLs that would only fail once a machine boots.
+func validateURL(urlStr string) error {
+	if urlStr == "" {
+		return nil
+	}
+	u, err := url.Parse(urlStr)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	case u.Host == "":
+		return fmt.Errorf("URL has no host")
+	}
+	return nil
+}
+
 func runCreate(cmd *cobra.Command, args []string) {
 	fmt.Println("Project:", fProject)
 	// Setup Datastore client.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	client, err := datastore.NewClient(ctx, fProject)
+	client, err := newDatastoreClient(ctx, fProject)
 	rtx.Must(err, "Failed to create new datastore client")
 
 	// Save the host record to Datstore.
 	ds := storage.NewDatastoreConfig(client)
+	h := newHost(cfHostname, cfAddress, cfIPv6Address, cfMachineType)
+
+	// Save the host record.
+	err = ds.Save(h)
+	rtx.Must(err, "Failed to save new host record")
+	newAuditor(ds).Record(fActor, storage.AuditCreate, nil, h)
+
+	// Retrieve the host record from Datastore to exercise the full save & load path.
+	h, err = ds.Load(h.Name)
+	rtx.Must(err, "Failed to save new host record")
+	fmt.Println(h.String())
+}
+
+// newHost creates a new Host record for the named machine, using the create
+// flags for all other fields. If the extensions are invalid, newHost panics.
+func newHost(hostname, ipv4, ipv6, machineType string) *storage.Host {
+	extensions := cfExtensions
+	if len(extensions) == 0 {
+		extensions = defaultExtensions()
+	}
+	rtx.Must(storage.ValidateOperationNames(extensions), "Invalid extensions")
 
 	h := &storage.Host{
-		Name:          cfHostname,
-		IPv4Addr:      cfAddress,
+		Name:          hostname,
+		IPv4Addr:      ipv4,
+		IPv6Addr:      ipv6,
+		MachineType:   machineType,
 		UpdateEnabled: cfUpdate,
-		Extensions:    cfExtensions,
+		Extensions:    extensions,
 		Boot: datastorex.Map{
 			storage.Stage1IPXE: fmtURL(cfBootStage1),
 			storage.Stage1JSON: fmtURL(cfBootStage1JSON),
@@ -97,15 +162,8 @@ func runCreate(cmd *cobra.Command, args []string) {
 		ImagesVersion:        cfImagesVersion,
 		CollectedInformation: datastorex.Map{},
 	}
-
-	// Save the host record.
-	err = ds.Save(h)
-	rtx.Must(err, "Failed to save new host record")
-
-	// Retrieve the host record from Datastore to exercise the full save & load path.
-	h, err = ds.Load(h.Name)
-	rtx.Must(err, "Failed to save new host record")
-	fmt.Println(h.String())
+	h.SetLabels(cfLabels)
+	return h
 }
 
 func init() {
@@ -118,10 +176,16 @@ func init() {
 		"IP address of hostname.")
 	createCmd.MarkFlagRequired("hostname")
 	createCmd.MarkFlagRequired("address")
+	createCmd.Flags().StringVar(&cfIPv6Address, "ipv6-address", "",
+		"IPv6 address of hostname.")
+	createCmd.Flags().StringVar(&cfMachineType, "machine-type", "",
+		"Machine type of hostname, e.g. physical or virtual.")
 
 	// Local flags which will only apply when "create" is called directly.
-	createCmd.Flags().StringSliceVar(&cfExtensions, "extensions", []string{"allocate_k8s_token",
-		"bmc_store_password"}, "List of extensions to enable.")
+	createCmd.Flags().StringSliceVar(&cfExtensions, "extensions", nil,
+		"List of extensions to enable. Defaults to $"+defaultExtensionsEnv+".")
+	createCmd.Flags().StringToStringVar(&cfLabels, "label", nil,
+		"Label of the host, e.g. owner=ops. May be repeated.")
 	createCmd.Flags().BoolVar(&cfUpdate, "update", false,
 		"Set Host.UpdateEnabled to true for an existing Host.")
 	createCmd.Flags().StringVar(&cfBootStage1, "boot-stage1",
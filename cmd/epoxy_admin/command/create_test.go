@@ -0,0 +1,140 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCreate_validateURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{
+			name: "empty-for-unset-stage",
+			url:  "",
+		},
+		{
+			name: "https",
+			url:  "https://storage.googleapis.com/epoxy-mlab-sandbox/stage1to2/stage1to2.ipxe",
+		},
+		{
+			name: "http-with-port",
+			url:  "http://localhost:8080/stage2.json",
+		},
+		{
+			name: "version-template",
+			url:  "https://storage.googleapis.com/epoxy-mlab-sandbox/{{VERSION}}/stage3.json",
+		},
+		{
+			name:    "missing-scheme",
+			url:     "storage.googleapis.com/epoxy-mlab-sandbox/stage2.json",
+			wantErr: true,
+		},
+		{
+			name:    "relative-path",
+			url:     "/stage1to2/stage1to2.ipxe",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported-scheme",
+			url:     "gs://epoxy-mlab-sandbox/stage2.json",
+			wantErr: true,
+		},
+		{
+			name:    "missing-host",
+			url:     "https:///stage2.json",
+			wantErr: true,
+		},
+		{
+			name:    "host-without-slashes",
+			url:     "https:storage.googleapis.com/stage2.json",
+			wantErr: true,
+		},
+		{
+			name:    "parse-error",
+			url:     "https://storage.googleapis.com/%zz",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("validateURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreate_runCreateExtensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		unset      bool
+		env        string
+		extensions []string
+		want       []string
+	}{
+		{
+			name:  "builtin-default",
+			unset: true,
+			want:  []string{"allocate_k8s_token", "bmc_store_password"},
+		},
+		{
+			name: "multi-extension-default",
+			env:  "allocate_k8s_token, bmc_store_password,,rotate_token",
+			want: []string{"allocate_k8s_token", "bmc_store_password", "rotate_token"},
+		},
+		{
+			name: "empty-default",
+			env:  "",
+		},
+		{
+			name:       "flag-overrides-default",
+			env:        "allocate_k8s_token,rotate_token",
+			extensions: []string{"bmc_store_password"},
+			want:       []string{"bmc_store_password"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Setenv restores the original value after the test.
+			t.Setenv(defaultExtensionsEnv, tt.env)
+			if tt.unset {
+				os.Unsetenv(defaultExtensionsEnv)
+			}
+			fProject = "mlab-sandbox"
+			cfHostname = "mlab1-abc01.mlab-sandbox.measurement-lab.org"
+			cfAddress = "192.168.0.1"
+			cfExtensions = tt.extensions
+			defer func() { cfExtensions = nil }()
+			ds := newFakeDatastoreClient()
+			defer useFakeDatastore(ds)()
+
+			runCreate(createCmd, nil)
+
+			h := ds.hosts[cfHostname]
+			if h == nil {
+				t.Fatalf("runCreate() did not save host %s", cfHostname)
+			}
+			if !reflect.DeepEqual(h.Extensions, tt.want) {
+				t.Errorf("runCreate() Extensions = %q, want %q", h.Extensions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/epoxy/template"
+	"github.com/m-lab/go/rtx"
+	"github.com/spf13/cobra"
+)
+
+// describeCmd represents the describe command
+var describeCmd = &cobra.Command{
+	Use:   "describe",
+	Short: "Prints the boot plan for an ePoxy Host",
+	Long: `
+USAGE:
+
+    Prints the boot plan for the Host named by the --hostname flag: the
+    selected boot sequence, the stage URLs and the URLs generated for the
+    current session, the enabled extensions, and the collected information.
+    Sequences inherited from a host group are included.
+
+    Session URLs are generated from the --base-url flag, which should match
+    the external base URL of the ePoxy server.
+
+EXAMPLE:
+
+    epoxy_admin describe --project mlab-sandbox \
+        --hostname mlab1-abc01.mlab-sandbox.measurement-lab.org
+`,
+	Run: runDescribe,
+}
+
+func runDescribe(cmd *cobra.Command, args []string) {
+	// Setup Datastore client.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	ds := storage.NewDatastoreConfig(client)
+	h, err := ds.Load(dfHostname)
+	rtx.Must(err, "Failed to load host record: %q", dfHostname)
+
+	// Apply the host group, as the ePoxy server does when generating configs.
+	var groupErr error
+	if h.Group != "" {
+		var g *storage.HostGroup
+		g, groupErr = ds.LoadGroup(h.Group)
+		if groupErr == nil {
+			h.Inherit(g)
+		}
+	}
+
+	baseURL := dfBaseURL
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("https://epoxy-boot-api.%s.measurementlab.net:4430", fProject)
+	}
+	printBootPlan(cmd.OutOrStdout(), h, groupErr, baseURL, dfAPIVersion)
+}
+
+// sequenceName returns the name of the host's current boot sequence, with the
+// reason that an enabled update is not used, if any.
+func sequenceName(h *storage.Host) string {
+	switch {
+	case h.EffectiveBootPolicy() == storage.BootPolicyHold:
+		return "none (held by boot policy)"
+	case h.UpdateSelected():
+		return "update"
+	case h.UpdateAttemptsExhausted() && h.UpdateEnabled:
+		return fmt.Sprintf("boot (update enabled, but all %d update attempts failed)",
+			h.MaxUpdateAttempts)
+	default:
+		return "boot"
+	}
+}
+
+// formatTime returns t in RFC3339 format, or "never" for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printBootPlan writes a human-readable summary of the boot plan for h to w.
+// If loading the host group failed, groupErr is reported with the group name.
+// Session URLs start with baseURL and use the Host APIVersion, or apiVersion.
+func printBootPlan(w io.Writer, h *storage.Host, groupErr error, baseURL, apiVersion string) {
+	fmt.Fprintf(w, "Host: %s\n", h.Name)
+	fmt.Fprintf(w, "IPv4Addr: %s\n", h.IPv4Addr)
+	if h.IPv6Addr != "" {
+		fmt.Fprintf(w, "IPv6Addr: %s\n", h.IPv6Addr)
+	}
+	if h.Firmware != "" {
+		fmt.Fprintf(w, "Firmware: %s (secure boot: %t)\n", h.Firmware, h.SecureBoot)
+	}
+	if h.Group != "" {
+		if groupErr != nil {
+			fmt.Fprintf(w, "Group: %s (failed to load: %v)\n", h.Group, groupErr)
+		} else {
+			fmt.Fprintf(w, "Group: %s\n", h.Group)
+		}
+	}
+	if h.Decommissioned {
+		fmt.Fprintf(w, "Decommissioned: true\n")
+	}
+	fmt.Fprintf(w, "Sequence: %s\n", sequenceName(h))
+	fmt.Fprintf(w, "ImagesVersion: %s\n", h.ImagesVersion)
+
+	fmt.Fprintf(w, "Stages:\n")
+	for _, stage := range []string{storage.Stage1IPXE, storage.Stage1JSON, storage.Stage2, storage.Stage3} {
+		chain := template.ChainURL(h, stage)
+		if chain == "" {
+			continue
+		}
+		fmt.Fprintf(w, "    %s: %s\n", stage, chain)
+		if sum := h.ChainChecksums[chain]; sum != "" {
+			fmt.Fprintf(w, "        sha256: %s\n", sum)
+		}
+	}
+
+	urls := template.SessionURLs(h, baseURL, apiVersion)
+	fmt.Fprintf(w, "Session URLs:\n")
+	for _, karg := range sortedKeys(urls) {
+		fmt.Fprintf(w, "    %s: %s\n", karg, urls[karg])
+	}
+
+	fmt.Fprintf(w, "Extensions:\n")
+	for _, operation := range h.Extensions {
+		service, ok := storage.Extensions.Get(operation)
+		if !ok {
+			service = "(unknown extension)"
+		}
+		fmt.Fprintf(w, "    %s: %s\n", operation, service)
+	}
+
+	fmt.Fprintf(w, "CollectedInformation:\n")
+	for _, key := range sortedKeys(h.CollectedInformation) {
+		fmt.Fprintf(w, "    %s: %s", key, h.CollectedInformation[key])
+		if collected := h.LastCollected[key]; collected != "" {
+			fmt.Fprintf(w, " (at %s)", collected)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "LastSessionCreation: %s\n", formatTime(h.LastSessionCreation))
+	fmt.Fprintf(w, "LastReport: %s\n", formatTime(h.LastReport))
+	fmt.Fprintf(w, "LastSuccess: %s\n", formatTime(h.LastSuccess))
+}
+
+func init() {
+	rootCmd.AddCommand(describeCmd)
+
+	// Required local flags.
+	describeCmd.Flags().StringVar(&dfHostname, "hostname", "",
+		"Hostname of the record.")
+	describeCmd.MarkFlagRequired("hostname")
+
+	describeCmd.Flags().StringVar(&dfBaseURL, "base-url", "",
+		"External base URL of the ePoxy server used for session URLs. "+
+			"Default is https://epoxy-boot-api.<project>.measurementlab.net:4430")
+	describeCmd.Flags().StringVar(&dfAPIVersion, "api-version", "",
+		"Default API version used for session URLs, unless the Host pins a version.")
+}
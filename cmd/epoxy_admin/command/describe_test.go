@@ -0,0 +1,134 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/storage"
+)
+
+func TestDescribe_runDescribe(t *testing.T) {
+	h := &storage.Host{
+		Name:          "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+		IPv4Addr:      "192.168.0.1",
+		Group:         "physical",
+		ImagesVersion: "v1.2.3",
+		UpdateEnabled: true,
+		Update: datastorex.Map{
+			storage.Stage1IPXE: "https://example.com/{{VERSION}}/update/stage1to2.ipxe",
+		},
+		ChainChecksums: datastorex.Map{
+			"https://example.com/v1.2.3/update/stage1to2.ipxe": "abcdef",
+		},
+		Extensions: []string{"allocate_k8s_token"},
+		CurrentSessionIDs: storage.SessionIDs{
+			Stage2ID:    "01234",
+			Stage3ID:    "56789",
+			ReportID:    "86420",
+			ExtensionID: "75319",
+		},
+		CollectedInformation: datastorex.Map{"serial": "ABC123"},
+		LastCollected:        datastorex.Map{"serial": "2021-03-01T12:00:00Z"},
+		LastSuccess:          time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC),
+	}
+	ds := newFakeDatastoreClient(h)
+	ds.groups = map[string]*storage.HostGroup{
+		"physical": {
+			Name: "physical",
+			Update: datastorex.Map{
+				storage.Stage1IPXE: "https://example.com/group/stage1to2.ipxe",
+				storage.Stage2:     "https://example.com/group/stage2to3.json",
+			},
+		},
+	}
+	defer useFakeDatastore(ds)()
+
+	var out bytes.Buffer
+	describeCmd.SetOut(&out)
+	defer describeCmd.SetOut(nil)
+	dfHostname = h.Name
+	dfBaseURL = "https://epoxy.example.com"
+	defer func() { dfHostname, dfBaseURL = "", "" }()
+
+	runDescribe(describeCmd, nil)
+
+	for _, want := range []string{
+		"Host: mlab1-abc01.mlab-sandbox.measurement-lab.org\n",
+		"Group: physical\n",
+		"Sequence: update\n",
+		// The host stage overrides the group, and the version is substituted.
+		"    stage1.ipxe: https://example.com/v1.2.3/update/stage1to2.ipxe\n        sha256: abcdef\n",
+		// Other stages are inherited from the group.
+		"    stage2: https://example.com/group/stage2to3.json\n",
+		"    epoxy.stage2: https://epoxy.example.com/v1/boot/mlab1-abc01.mlab-sandbox.measurement-lab.org/01234/stage2\n",
+		"    epoxy.report: https://epoxy.example.com/v1/boot/mlab1-abc01.mlab-sandbox.measurement-lab.org/86420/report\n",
+		"    epoxy.allocate_k8s_token: https://epoxy.example.com/v1/boot/" +
+			"mlab1-abc01.mlab-sandbox.measurement-lab.org/75319/extension/allocate_k8s_token\n",
+		"Extensions:\n    allocate_k8s_token: http://epoxy-extension-server",
+		"    serial: ABC123 (at 2021-03-01T12:00:00Z)\n",
+		"LastReport: never\n",
+		"LastSuccess: 2021-03-01T12:00:00Z\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("runDescribe() missing %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDescribe_sequenceName(t *testing.T) {
+	tests := []struct {
+		name string
+		h    *storage.Host
+		want string
+	}{
+		{
+			name: "boot",
+			h:    &storage.Host{},
+			want: "boot",
+		},
+		{
+			name: "update",
+			h:    &storage.Host{UpdateEnabled: true, MaxUpdateAttempts: 2, UpdateAttempts: 2},
+			want: "update",
+		},
+		{
+			name: "update-attempts-exhausted",
+			h:    &storage.Host{UpdateEnabled: true, MaxUpdateAttempts: 2, UpdateAttempts: 3},
+			want: "boot (update enabled, but all 2 update attempts failed)",
+		},
+		{
+			name: "update-always",
+			h:    &storage.Host{BootPolicy: storage.BootPolicyUpdateAlways, UpdateEnabled: true},
+			want: "update",
+		},
+		{
+			name: "hold",
+			h:    &storage.Host{BootPolicy: storage.BootPolicyHold, UpdateEnabled: true},
+			want: "none (held by boot policy)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sequenceName(tt.h); got != tt.want {
+				t.Errorf("sequenceName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
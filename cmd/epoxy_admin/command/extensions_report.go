@@ -0,0 +1,96 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/spf13/cobra"
+)
+
+// extensionsReportCmd represents the extensions-report command
+var extensionsReportCmd = &cobra.Command{
+	Use:   "extensions-report",
+	Short: "Counts the ePoxy Host records with each extension enabled",
+	Long: `
+USAGE:
+
+    Lists every extension operation enabled on any Host record in the given
+    project, along with the number of hosts that enable it.
+
+EXAMPLE:
+
+    epoxy_admin extensions-report --project mlab-sandbox
+`,
+	Run: runExtensionsReport,
+}
+
+func runExtensionsReport(cmd *cobra.Command, args []string) {
+	// Setup Datastore client.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	ds := storage.NewDatastoreConfig(client)
+	hosts, err := ds.List()
+	rtx.Must(err, "Failed to list host records")
+
+	printExtensionsReport(cmd.OutOrStdout(), hosts)
+}
+
+// countExtensions returns the number of hosts that enable each extension
+// operation. Operations listed more than once by a host are counted once.
+func countExtensions(hosts []*storage.Host) map[string]int {
+	counts := map[string]int{}
+	for _, h := range hosts {
+		seen := map[string]bool{}
+		for _, operation := range h.Extensions {
+			if seen[operation] {
+				continue
+			}
+			seen[operation] = true
+			counts[operation]++
+		}
+	}
+	return counts
+}
+
+// printExtensionsReport writes the extension counts for hosts to w, sorted by
+// operation name.
+func printExtensionsReport(w io.Writer, hosts []*storage.Host) {
+	counts := countExtensions(hosts)
+	operations := make([]string, 0, len(counts))
+	for operation := range counts {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	fmt.Fprintf(w, "Hosts: %d\n", len(hosts))
+	for _, operation := range operations {
+		fmt.Fprintf(w, "%s: %d\n", operation, counts[operation])
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(extensionsReportCmd)
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+func TestExtensionsReport_countExtensions(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []*storage.Host
+		want  map[string]int
+	}{
+		{
+			name:  "no-hosts",
+			hosts: nil,
+			want:  map[string]int{},
+		},
+		{
+			name: "multiple-extensions",
+			hosts: []*storage.Host{
+				{Name: "mlab1-abc01", Extensions: []string{"allocate_k8s_token", "bmc_store_password"}},
+				{Name: "mlab2-abc01", Extensions: []string{"allocate_k8s_token"}},
+				{Name: "mlab3-abc01"},
+			},
+			want: map[string]int{"allocate_k8s_token": 2, "bmc_store_password": 1},
+		},
+		{
+			name: "duplicate-extensions-count-once",
+			hosts: []*storage.Host{
+				{Name: "mlab1-abc01", Extensions: []string{"allocate_k8s_token", "allocate_k8s_token"}},
+			},
+			want: map[string]int{"allocate_k8s_token": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countExtensions(tt.hosts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("countExtensions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtensionsReport_runExtensionsReport(t *testing.T) {
+	ds := newFakeDatastoreClient(
+		&storage.Host{Name: "mlab1-abc01", Extensions: []string{"bmc_store_password", "allocate_k8s_token"}},
+		&storage.Host{Name: "mlab2-abc01", Extensions: []string{"allocate_k8s_token"}},
+		&storage.Host{Name: "mlab3-abc01"},
+	)
+	defer useFakeDatastore(ds)()
+
+	var out bytes.Buffer
+	extensionsReportCmd.SetOut(&out)
+	defer extensionsReportCmd.SetOut(nil)
+
+	runExtensionsReport(extensionsReportCmd, nil)
+
+	want := "Hosts: 3\nallocate_k8s_token: 2\nbmc_store_password: 1\n"
+	if out.String() != want {
+		t.Errorf("runExtensionsReport() = %q, want %q", out.String(), want)
+	}
+}
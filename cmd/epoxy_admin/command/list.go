@@ -20,7 +20,6 @@ import (
 	"regexp"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"github.com/m-lab/epoxy/storage"
 	"github.com/m-lab/go/rtx"
 	"github.com/spf13/cobra"
@@ -33,7 +32,15 @@ var listCmd = &cobra.Command{
 	Long: `
 USAGE:
 
-    TODO: implement list.
+    Lists Host records matching the regex pattern in the --hostname flag and
+    every --label, if given.
+
+EXAMPLE:
+
+    # List the mlab4 Host records owned by ops.
+    epoxy_admin list --project mlab-sandbox \
+        --hostname 'mlab4.*' \
+        --label owner=ops
 `,
 	Run: runList,
 }
@@ -43,7 +50,7 @@ func runList(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	client, err := datastore.NewClient(ctx, fProject)
+	client, err := newDatastoreClient(ctx, fProject)
 	rtx.Must(err, "Failed to create new datastore client")
 
 	// Save the host record to Datstore.
@@ -56,7 +63,7 @@ func runList(cmd *cobra.Command, args []string) {
 	rtx.Must(err, "Failed to compile given hostname pattern: %q", lfHostname)
 
 	for _, h := range hosts {
-		if !r.MatchString(h.Name) {
+		if !r.MatchString(h.Name) || !h.HasLabels(lfLabels) {
 			continue
 		}
 		fmt.Printf("Listing: %s\n", h.Name)
@@ -71,4 +78,6 @@ func init() {
 	listCmd.Flags().StringVar(&lfHostname, "hostname", "",
 		"Hostname of new record.")
 	listCmd.MarkFlagRequired("hostname")
+	listCmd.Flags().StringToStringVar(&lfLabels, "label", nil,
+		"Only list hosts with this label, e.g. owner=ops. May be repeated.")
 }
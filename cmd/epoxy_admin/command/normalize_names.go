@@ -0,0 +1,78 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/spf13/cobra"
+)
+
+// normalizeNamesCmd represents the normalize-names command
+var normalizeNamesCmd = &cobra.Command{
+	Use:   "normalize-names",
+	Short: "Migrates ePoxy Host records with mixed case names to lower case names",
+	Long: `
+USAGE:
+
+    Host names are case-insensitive, and the ePoxy server looks up every Host
+    record by its lower case name. normalize-names saves each record with a
+    mixed case name under its lower case name, and deletes the original record.
+    Records that conflict with an existing lower case record are not migrated.
+
+EXAMPLE:
+
+    epoxy_admin normalize-names --project mlab-sandbox
+`,
+	Run: runNormalizeNames,
+}
+
+func runNormalizeNames(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	ds := storage.NewDatastoreConfig(client)
+	rtx.Must(normalizeNames(cmd.OutOrStdout(), ds), "Failed to normalize host names")
+}
+
+// normalizeNames migrates the records with mixed case names in ds, and writes
+// a line for each migrated record to w.
+func normalizeNames(w io.Writer, ds *storage.DatastoreConfig) error {
+	audit := newAuditor(ds)
+	migrated, err := ds.NormalizeNames()
+	for _, name := range migrated {
+		fmt.Fprintf(w, "Renamed host %s to %s\n", name, storage.NormalizeName(name))
+		after, err := ds.Load(name)
+		if err != nil {
+			return err
+		}
+		before := after.Clone()
+		before.Name = name
+		audit.Record(fActor, storage.AuditUpdate, before, after)
+	}
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(normalizeNamesCmd)
+}
@@ -0,0 +1,100 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+func TestNormalizeNames_normalizeNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		hosts       []*storage.Host
+		wantHosts   []string
+		wantOutput  string
+		wantActions []string
+		wantErr     bool
+	}{
+		{
+			name: "migrates-mixed-case-names",
+			hosts: []*storage.Host{
+				{Name: "MLAB1-abc01.mlab-sandbox.measurement-lab.org", IPv4Addr: "192.168.0.1"},
+				{Name: "mlab2-abc01.mlab-sandbox.measurement-lab.org", IPv4Addr: "192.168.0.2"},
+			},
+			wantHosts: []string{
+				"mlab1-abc01.mlab-sandbox.measurement-lab.org",
+				"mlab2-abc01.mlab-sandbox.measurement-lab.org",
+			},
+			wantOutput:  "Renamed host MLAB1-abc01.mlab-sandbox.measurement-lab.org to mlab1-abc01.mlab-sandbox.measurement-lab.org\n",
+			wantActions: []string{storage.AuditUpdate},
+		},
+		{
+			name: "already-normalized",
+			hosts: []*storage.Host{
+				{Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+			},
+			wantHosts: []string{"mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+		},
+		{
+			name: "conflict-is-not-migrated",
+			hosts: []*storage.Host{
+				{Name: "MLAB1-abc01.mlab-sandbox.measurement-lab.org"},
+				{Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+			},
+			wantHosts: []string{
+				"MLAB1-abc01.mlab-sandbox.measurement-lab.org",
+				"mlab1-abc01.mlab-sandbox.measurement-lab.org",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDatastoreClient(tt.hosts...)
+			audit := useAuditBuffer()
+			defer func() { auditWriter = os.Stderr }()
+			var b bytes.Buffer
+
+			err := normalizeNames(&b, storage.NewDatastoreConfig(f))
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeNames() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			var got []string
+			for name, h := range f.hosts {
+				if h.Name != name {
+					t.Errorf("normalizeNames() saved %q with key %q", h.Name, name)
+				}
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantHosts) {
+				t.Errorf("normalizeNames() hosts = %q, want %q", got, tt.wantHosts)
+			}
+			if b.String() != tt.wantOutput {
+				t.Errorf("normalizeNames() output = %q, want %q", b.String(), tt.wantOutput)
+			}
+			if got := auditActions(t, audit); !reflect.DeepEqual(got, tt.wantActions) {
+				t.Errorf("normalizeNames() audit actions = %q, want %q", got, tt.wantActions)
+			}
+		})
+	}
+}
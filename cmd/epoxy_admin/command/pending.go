@@ -0,0 +1,89 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/spf13/cobra"
+)
+
+// pendingCmd represents the pending command
+var pendingCmd = &cobra.Command{
+	Use:   "pending",
+	Short: "Lists the ePoxy Host records with a pending update",
+	Long: `
+USAGE:
+
+    Lists every Host record in the given project with UpdateEnabled set, one
+    host per line with the host ImagesVersion. Hosts that exhausted their
+    update attempts, and now boot the Boot sequence, are marked.
+
+EXAMPLE:
+
+    epoxy_admin pending --project mlab-sandbox
+`,
+	Run: runPending,
+}
+
+func runPending(cmd *cobra.Command, args []string) {
+	// Setup Datastore client.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	ds := storage.NewDatastoreConfig(client)
+	hosts, err := ds.List()
+	rtx.Must(err, "Failed to list host records")
+
+	printPendingHosts(cmd.OutOrStdout(), pendingHosts(hosts))
+}
+
+// pendingHosts returns the hosts with UpdateEnabled, sorted by name.
+func pendingHosts(hosts []*storage.Host) []*storage.Host {
+	pending := []*storage.Host{}
+	for _, h := range hosts {
+		if h.UpdateEnabled {
+			pending = append(pending, h)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Name < pending[j].Name
+	})
+	return pending
+}
+
+// printPendingHosts writes one line for each pending host to w.
+func printPendingHosts(w io.Writer, pending []*storage.Host) {
+	for _, h := range pending {
+		fmt.Fprintf(w, "%s %s", h.Name, h.ImagesVersion)
+		if h.UpdateAttemptsExhausted() {
+			fmt.Fprintf(w, " (all %d update attempts failed)", h.MaxUpdateAttempts)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(pendingCmd)
+}
@@ -0,0 +1,86 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+func TestPending_pendingHosts(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []*storage.Host
+		want  []string
+	}{
+		{
+			name: "no-hosts",
+			want: []string{},
+		},
+		{
+			name: "mixed-fleet",
+			hosts: []*storage.Host{
+				{Name: "mlab3-abc01", UpdateEnabled: true},
+				{Name: "mlab2-abc01"},
+				{Name: "mlab1-abc01", UpdateEnabled: true},
+				{Name: "mlab4-abc01", Decommissioned: true},
+			},
+			want: []string{"mlab1-abc01", "mlab3-abc01"},
+		},
+		{
+			name: "no-pending-updates",
+			hosts: []*storage.Host{
+				{Name: "mlab1-abc01"},
+				{Name: "mlab2-abc01"},
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, h := range pendingHosts(tt.hosts) {
+				got = append(got, h.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pendingHosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPending_runPending(t *testing.T) {
+	ds := newFakeDatastoreClient(
+		&storage.Host{Name: "mlab1-abc01", UpdateEnabled: true, ImagesVersion: "v2.0.0"},
+		&storage.Host{Name: "mlab2-abc01", ImagesVersion: "v1.0.0"},
+		&storage.Host{Name: "mlab3-abc01", UpdateEnabled: true, ImagesVersion: "v2.0.0",
+			MaxUpdateAttempts: 2, UpdateAttempts: 3},
+	)
+	defer useFakeDatastore(ds)()
+
+	var out bytes.Buffer
+	pendingCmd.SetOut(&out)
+	defer pendingCmd.SetOut(nil)
+
+	runPending(pendingCmd, nil)
+
+	want := "mlab1-abc01 v2.0.0\nmlab3-abc01 v2.0.0 (all 2 update attempts failed)\n"
+	if out.String() != want {
+		t.Errorf("runPending() = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/go/siteinfo"
+	"github.com/spf13/cobra"
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Marks or deletes ePoxy Host records for machines removed from siteinfo",
+	Long: `
+USAGE:
+
+    Finds the Datastore records for a given project with no corresponding
+    machine in siteinfo. By default, prune only lists these records. With
+    --confirm, each record is marked as decommissioned. With --confirm and
+    --delete, each record is deleted from Datastore instead.
+
+EXAMPLE:
+
+    # Preview the hosts that prune would mark.
+    epoxy_admin prune --project mlab-sandbox
+
+    # Delete records for machines no longer in siteinfo.
+    epoxy_admin prune --project mlab-sandbox --delete --confirm
+`,
+	Run: runPrune,
+}
+
+func runPrune(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	siteinfo := newSiteinfo(fProject)
+	machines, err := siteinfo.Machines()
+	rtx.Must(err, "Failed to get siteinfo.Machines()")
+
+	// Setup Datastore client.
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	// Get all Datastore entities for the given project.
+	ds := storage.NewDatastoreConfig(client)
+	entities, err := ds.List()
+	rtx.Must(err, "Failed to get Datastore entities")
+
+	hosts, err := prunableHosts(machines, entities, fProject)
+	rtx.Must(err, "Failed to find prunable hosts")
+	pruneHosts(cmd.OutOrStdout(), ds, hosts)
+}
+
+// prunableHosts returns the hosts with no corresponding machine in the given
+// project. Because an empty or wrong siteinfo would select every host,
+// prunableHosts returns an error if siteinfo has no machines in the project.
+func prunableHosts(machines []siteinfo.Machine, hosts []*storage.Host, project string) ([]*storage.Host, error) {
+	active := map[string]bool{}
+	for _, machine := range machines {
+		// Only consider machines in the given project.
+		if machine.Project == project {
+			active[storage.NormalizeName(machine.Hostname)] = true
+		}
+	}
+	if len(active) == 0 {
+		return nil, fmt.Errorf("siteinfo has no machines in project %q", project)
+	}
+	var prunable []*storage.Host
+	for _, h := range hosts {
+		if !active[storage.NormalizeName(h.Name)] {
+			prunable = append(prunable, h)
+		}
+	}
+	return prunable, nil
+}
+
+// pruneHosts marks or deletes each of the given hosts, according to the
+// --delete and --confirm flags, and writes a line for each host to w.
+func pruneHosts(w io.Writer, ds *storage.DatastoreConfig, hosts []*storage.Host) {
+	audit := newAuditor(ds)
+	for _, h := range hosts {
+		switch {
+		case !pfConfirm && pfDelete:
+			fmt.Fprintf(w, "Would delete host from Datastore: %s\n", h.Name)
+		case !pfConfirm:
+			fmt.Fprintf(w, "Would mark host as decommissioned: %s\n", h.Name)
+		case pfDelete:
+			fmt.Fprintf(w, "Deleting host from Datastore: %s\n", h.Name)
+			rtx.Must(ds.Delete(h.Name), "Failed to delete host record: %s", h.Name)
+			audit.Record(fActor, storage.AuditDelete, h, nil)
+		case h.Decommissioned:
+			log.Printf("Host already marked as decommissioned: %s", h.Name)
+		default:
+			fmt.Fprintf(w, "Marking host as decommissioned: %s\n", h.Name)
+			var before *storage.Host
+			after, err := ds.Update(h.Name, func(h *storage.Host) error {
+				before = h.Clone()
+				h.Decommissioned = true
+				return nil
+			})
+			rtx.Must(err, "Failed to update host record: %s", h.Name)
+			audit.Record(fActor, storage.AuditUpdate, before, after)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().BoolVar(&pfDelete, "delete", false,
+		"Delete prunable hosts from Datastore instead of marking them as decommissioned.")
+	pruneCmd.Flags().BoolVar(&pfConfirm, "confirm", false,
+		"Modify Datastore. Without --confirm, prune only lists the hosts it would change.")
+}
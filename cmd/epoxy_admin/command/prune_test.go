@@ -0,0 +1,172 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/siteinfo"
+)
+
+// pruneMachines are the siteinfo machines used by prune tests.
+var pruneMachines = []siteinfo.Machine{
+	{Hostname: "mlab1-abc01.mlab-sandbox.measurement-lab.org", Project: "mlab-sandbox"},
+	{Hostname: "mlab2-abc01.mlab-sandbox.measurement-lab.org", Project: "mlab-sandbox"},
+	{Hostname: "mlab1-xyz01.mlab-staging.measurement-lab.org", Project: "mlab-staging"},
+}
+
+func TestPrune_prunableHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		machines []siteinfo.Machine
+		hosts    []*storage.Host
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "all-hosts-active",
+			machines: pruneMachines,
+			hosts: []*storage.Host{
+				{Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+				{Name: "mlab2-abc01.mlab-sandbox.measurement-lab.org"},
+			},
+		},
+		{
+			name:     "removed-hosts",
+			machines: pruneMachines,
+			hosts: []*storage.Host{
+				{Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+				{Name: "mlab3-abc01.mlab-sandbox.measurement-lab.org"},
+				{Name: "mlab1-old01.mlab-sandbox.measurement-lab.org"},
+			},
+			want: []string{
+				"mlab3-abc01.mlab-sandbox.measurement-lab.org",
+				"mlab1-old01.mlab-sandbox.measurement-lab.org",
+			},
+		},
+		{
+			name:     "mixed-case-hosts-active",
+			machines: pruneMachines,
+			hosts: []*storage.Host{
+				{Name: "MLAB1-ABC01.mlab-sandbox.measurement-lab.org"},
+			},
+		},
+		{
+			name:     "machines-in-other-projects-are-prunable",
+			machines: pruneMachines,
+			hosts: []*storage.Host{
+				{Name: "mlab1-xyz01.mlab-staging.measurement-lab.org"},
+			},
+			want: []string{"mlab1-xyz01.mlab-staging.measurement-lab.org"},
+		},
+		{
+			name:     "error-no-machines-in-project",
+			machines: pruneMachines[2:],
+			hosts: []*storage.Host{
+				{Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := prunableHosts(tt.machines, tt.hosts, "mlab-sandbox")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prunableHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, h := range hosts {
+				got = append(got, h.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prunableHosts() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrune_runPrune(t *testing.T) {
+	removed := "mlab3-abc01.mlab-sandbox.measurement-lab.org"
+	tests := []struct {
+		name               string
+		delete             bool
+		confirm            bool
+		wantDeletes        int
+		wantDecommissioned bool
+	}{
+		{
+			name: "dry-run-by-default",
+		},
+		{
+			name:   "dry-run-delete",
+			delete: true,
+		},
+		{
+			name:               "confirm-marks-hosts",
+			confirm:            true,
+			wantDecommissioned: true,
+		},
+		{
+			name:        "confirm-deletes-hosts",
+			delete:      true,
+			confirm:     true,
+			wantDeletes: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fProject = "mlab-sandbox"
+			pfDelete = tt.delete
+			pfConfirm = tt.confirm
+			defer func() {
+				pfDelete = false
+				pfConfirm = false
+			}()
+
+			ds := newFakeDatastoreClient(
+				&storage.Host{Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+				&storage.Host{Name: removed},
+			)
+			defer useFakeDatastore(ds)()
+			defer useFakeSiteinfo(&fakeSiteinfo{machines: pruneMachines})()
+
+			var out bytes.Buffer
+			pruneCmd.SetOut(&out)
+			defer pruneCmd.SetOut(nil)
+
+			runPrune(pruneCmd, nil)
+
+			if ds.deletes != tt.wantDeletes {
+				t.Errorf("runPrune() wrong number of deletes: got %d; want %d", ds.deletes, tt.wantDeletes)
+			}
+			if !tt.confirm && ds.puts != 0 {
+				t.Errorf("runPrune() saved records without --confirm: got %d puts", ds.puts)
+			}
+			if h, ok := ds.hosts[removed]; ok && h.Decommissioned != tt.wantDecommissioned {
+				t.Errorf("runPrune() wrong Decommissioned: got %t; want %t", h.Decommissioned, tt.wantDecommissioned)
+			}
+			// Active hosts are never changed.
+			if h := ds.hosts["mlab1-abc01.mlab-sandbox.measurement-lab.org"]; h == nil || h.Decommissioned {
+				t.Errorf("runPrune() changed active host: got %#v", h)
+			}
+			if !bytes.Contains(out.Bytes(), []byte(removed)) {
+				t.Errorf("runPrune() did not list prunable host: got %q", out.String())
+			}
+		})
+	}
+}
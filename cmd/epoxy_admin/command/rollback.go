@@ -0,0 +1,94 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/spf13/cobra"
+)
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Restores the previous boot sequences of ePoxy Host records",
+	Long: `
+USAGE:
+
+    Restores the Boot and Update sequences of Host records matching the regex
+    pattern in the --hostname flag to the sequences from before their most
+    recent change by "update" or "apply". The replaced sequences are kept as
+    the new snapshot, so a second rollback undoes the first. Hosts without a
+    snapshot are skipped.
+
+EXAMPLE:
+
+    epoxy_admin rollback --project mlab-sandbox \
+        --hostname mlab3.iad1t.measurement-lab.org
+`,
+	Run: runRollback,
+}
+
+func runRollback(cmd *cobra.Command, args []string) {
+	// Setup Datastore client.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newDatastoreClient(ctx, fProject)
+	rtx.Must(err, "Failed to create new datastore client")
+
+	ds := storage.NewDatastoreConfig(client)
+	hosts, err := ds.List()
+	rtx.Must(err, "Failed to list host records")
+
+	r, err := regexp.Compile(rfHostname)
+	rtx.Must(err, "Failed to compile given hostname pattern: %q", rfHostname)
+
+	w := cmd.OutOrStdout()
+	audit := newAuditor(ds)
+	for _, h := range hosts {
+		if !r.MatchString(h.Name) {
+			continue
+		}
+		// Roll back the latest host record within a transaction.
+		var before *storage.Host
+		after, err := ds.Update(h.Name, func(h *storage.Host) error {
+			before = h.Clone()
+			return h.Rollback()
+		})
+		if errors.Is(err, storage.ErrNoSnapshot) {
+			fmt.Fprintf(w, "Skipping host without previous sequences: %s\n", h.Name)
+			continue
+		}
+		rtx.Must(err, "Failed to roll back host record: %s", h.Name)
+		audit.Record(fActor, storage.AuditUpdate, before, after)
+		fmt.Fprintf(w, "Rolled back host: %s\n", h.Name)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+
+	// Required local flags.
+	rollbackCmd.Flags().StringVar(&rfHostname, "hostname", "",
+		"Regex pattern of hostnames to roll back.")
+	rollbackCmd.MarkFlagRequired("hostname")
+}
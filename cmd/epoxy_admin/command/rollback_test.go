@@ -0,0 +1,105 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/storage"
+	"github.com/spf13/pflag"
+)
+
+func TestRollback_runUpdateAndRollback(t *testing.T) {
+	good := datastorex.Map{storage.Stage2: "https://example.com/v1/stage2.json"}
+	update := datastorex.Map{storage.Stage2: "https://example.com/update/stage2.json"}
+	h := &storage.Host{
+		Name:   "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+		Boot:   datastorex.Map{storage.Stage2: good[storage.Stage2]},
+		Update: datastorex.Map{storage.Stage2: update[storage.Stage2]},
+	}
+	other := &storage.Host{
+		Name: "mlab2-abc01.mlab-sandbox.measurement-lab.org",
+		Boot: datastorex.Map{storage.Stage2: good[storage.Stage2]},
+	}
+	f := newFakeDatastoreClient(h, other)
+	defer useFakeDatastore(f)()
+	defer func() {
+		ufHostname = ""
+		ufBootStage2 = ""
+		ufMessage = ""
+		rfHostname = ""
+		updateCmd.Flags().VisitAll(func(f *pflag.Flag) { f.Changed = false })
+	}()
+	setFlags := func(flags map[string]string) {
+		for name, value := range flags {
+			if err := updateCmd.Flags().Set(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A risky change to the boot sequence snapshots the known good sequences.
+	setFlags(map[string]string{
+		"hostname":    h.Name,
+		"boot-stage2": "https://example.com/v2/stage2.json",
+	})
+	runUpdate(updateCmd, nil)
+	got := f.hosts[h.Name]
+	if got.Boot[storage.Stage2] != "https://example.com/v2/stage2.json" {
+		t.Fatalf("runUpdate() Boot = %v, want v2", got.Boot)
+	}
+	if !reflect.DeepEqual(got.PreviousBoot, good) || !reflect.DeepEqual(got.PreviousUpdate, update) {
+		t.Errorf("runUpdate() snapshot = %v, %v; want %v, %v", got.PreviousBoot, got.PreviousUpdate, good, update)
+	}
+
+	// Updates that do not change the sequences preserve the snapshot.
+	ufBootStage2 = ""
+	setFlags(map[string]string{"message": "testing v2"})
+	runUpdate(updateCmd, nil)
+	if got := f.hosts[h.Name]; !reflect.DeepEqual(got.PreviousBoot, good) {
+		t.Errorf("runUpdate() without sequence changes replaced snapshot: %v, want %v", got.PreviousBoot, good)
+	}
+
+	// Rollback restores the prior sequences, and skips hosts without a snapshot.
+	rfHostname = "mlab[12]-abc01"
+	var b bytes.Buffer
+	rollbackCmd.SetOut(&b)
+	defer rollbackCmd.SetOut(nil)
+	runRollback(rollbackCmd, nil)
+
+	got = f.hosts[h.Name]
+	if !reflect.DeepEqual(got.Boot, good) || !reflect.DeepEqual(got.Update, update) {
+		t.Errorf("runRollback() = %v, %v; want %v, %v", got.Boot, got.Update, good, update)
+	}
+	if got.Message != "testing v2" {
+		t.Errorf("runRollback() changed unrelated fields: %#v", got)
+	}
+	wantOut := []string{
+		"Rolled back host: " + h.Name,
+		"Skipping host without previous sequences: " + other.Name,
+	}
+	for _, want := range wantOut {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("runRollback() output = %q, want %q", b.String(), want)
+		}
+	}
+	if !reflect.DeepEqual(f.hosts[other.Name].Boot, good) {
+		t.Errorf("runRollback() changed host without snapshot: %v", f.hosts[other.Name].Boot)
+	}
+}
@@ -15,15 +15,25 @@
 package command
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"time"
 
+	"cloud.google.com/go/datastore"
+	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/epoxy/storage/iface"
+	"github.com/m-lab/go/siteinfo"
 	"github.com/spf13/cobra"
 )
 
 // Flag variables available to all subcommands.
 var (
-	fProject string
+	fProject        string
+	fActor          string
+	fAuditDatastore bool
 )
 
 // Flag variables used only by the create & update commands. Since flags and
@@ -33,6 +43,8 @@ var (
 	// Create flags.
 	cfHostname         string
 	cfAddress          string
+	cfIPv6Address      string
+	cfMachineType      string
 	cfExtensions       []string
 	cfUpdate           bool
 	cfBootStage1       string
@@ -44,29 +56,96 @@ var (
 	cfUpdateStage2     string
 	cfUpdateStage3     string
 	cfImagesVersion    string
+	cfLabels           map[string]string
 
 	// Update flags.
-	ufHostname         string
-	ufAddress          string
-	ufExtensions       []string
-	ufUpdate           bool
-	ufBootStage1       string
-	ufBootStage1JSON   string
-	ufBootStage2       string
-	ufBootStage3       string
-	ufUpdateStage1     string
-	ufUpdateStage1JSON string
-	ufUpdateStage2     string
-	ufUpdateStage3     string
-	ufImagesVersion    string
+	ufHostname          string
+	ufAddress           string
+	ufExtensions        []string
+	ufUpdate            bool
+	ufBootStage1        string
+	ufBootStage1JSON    string
+	ufBootStage2        string
+	ufBootStage3        string
+	ufUpdateStage1      string
+	ufUpdateStage1JSON  string
+	ufUpdateStage2      string
+	ufUpdateStage3      string
+	ufImagesVersion     string
+	ufAPIVersion        string
+	ufChainChecksums    map[string]string
+	ufHealthyWithin     time.Duration
+	ufMessage           string
+	ufChainCommand      string
+	ufMaxUpdateAttempts int
+	ufGroup             string
+	ufCommandTimeout    time.Duration
+	ufMaintenanceUntil  string
+	ufLabels            map[string]string
+	ufBootPolicy        string
 
 	// List flags.
 	lfHostname string
+	lfLabels   map[string]string
 
 	// Sync flags.
-	sfSiteinfo string
+	sfSiteinfo  string
+	sfDryRun    bool
+	sfWorkers   int
+	sfBatchSize int
+
+	// Boot logs flags.
+	bfHostname string
+
+	// Describe flags.
+	dfHostname   string
+	dfBaseURL    string
+	dfAPIVersion string
+
+	// Prune flags.
+	pfDelete  bool
+	pfConfirm bool
+
+	// Apply flags.
+	afFilename string
+	afPrune    bool
+	afDryRun   bool
+
+	// Rollback flags.
+	rfHostname string
 )
 
+// machineLister is the subset of the siteinfo client used by epoxy_admin.
+type machineLister interface {
+	Machines() ([]siteinfo.Machine, error)
+}
+
+// These variables provide indirection for external services. Each can be
+// reassigned with a fake implementation for unit tests.
+var (
+	newDatastoreClient = func(ctx context.Context, project string) (iface.DatastoreClient, error) {
+		client, err := datastore.NewClient(ctx, project)
+		if err != nil {
+			return nil, err
+		}
+		return iface.NewClient(client), nil
+	}
+	newSiteinfo = func(project string) machineLister {
+		return siteinfo.New(project, "v2", &http.Client{})
+	}
+	// auditWriter receives the audit events of all changes to Host records.
+	auditWriter io.Writer = os.Stderr
+)
+
+// newAuditor returns an Auditor for changes to Host records made with ds,
+// which also saves audit events to Datastore when --audit-datastore is set.
+func newAuditor(ds *storage.DatastoreConfig) *storage.Auditor {
+	if !fAuditDatastore {
+		ds = nil
+	}
+	return storage.NewAuditor(auditWriter, ds)
+}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "epoxy_admin",
@@ -92,4 +171,8 @@ func Execute() {
 func init() {
 	// Persistent flags, which will be global for all subcommands.
 	rootCmd.PersistentFlags().StringVar(&fProject, "project", "mlab-sandbox", "GCP project ID.")
+	rootCmd.PersistentFlags().StringVar(&fActor, "actor", os.Getenv("USER"),
+		"Name of the administrator recorded in audit events.")
+	rootCmd.PersistentFlags().BoolVar(&fAuditDatastore, "audit-datastore", false,
+		"Also save audit events to Datastore.")
 }
@@ -17,15 +17,12 @@ package command
 import (
 	"context"
 	"fmt"
-	"net/http"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/datastore"
-
 	"github.com/google/go-github/github"
 	"github.com/m-lab/epoxy/storage"
 	"github.com/m-lab/go/rtx"
-	"github.com/m-lab/go/siteinfo"
 
 	"github.com/spf13/cobra"
 )
@@ -40,11 +37,21 @@ USAGE:
     Syncs all active hosts in siteinfo with the Datastore records for a
     given project. The outcome should be that there are no sites in siteinfo for
     which Datastore records do not exist. NOTE: sync does not remove Datastore
-    records for retired sites, but merely adds missing ones.
+    records for retired sites, but merely adds missing ones. Use prune to
+    mark or remove records for retired machines.
+
+    With --dry-run, sync lists the hosts that would be added without saving
+    any records to Datastore.
+
+    Missing hosts are saved in batches of --batch-size records, with up to
+    --workers batches saved concurrently.
 
 EXAMPLE:
 
     epoxy_admin sync --project mlab-sandbox
+
+    # Preview the hosts that sync would add.
+    epoxy_admin sync --project mlab-sandbox --dry-run
 `,
 	Run: runSync,
 }
@@ -53,12 +60,12 @@ func runSync(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	siteinfo := siteinfo.New(fProject, "v2", &http.Client{})
+	siteinfo := newSiteinfo(fProject)
 	machines, err := siteinfo.Machines()
 	rtx.Must(err, "Failed to get siteinfo.Machines()")
 
 	// Setup Datastore client.
-	client, err := datastore.NewClient(ctx, fProject)
+	client, err := newDatastoreClient(ctx, fProject)
 	rtx.Must(err, "Failed to create new datastore client")
 
 	// Get all Datastore entities for the given project.
@@ -78,6 +85,7 @@ func runSync(cmd *cobra.Command, args []string) {
 		cfImagesVersion = *rel.TagName
 	}
 
+	var hosts []*storage.Host
 	for _, machine := range machines {
 		// Only operate on machines in the given project.
 		if machine.Project != fProject {
@@ -86,19 +94,74 @@ func runSync(cmd *cobra.Command, args []string) {
 		if isHostnameInDatastore(machine.Hostname, entities) {
 			continue
 		}
-		cfHostname = machine.Hostname
-		cfAddress = machine.IPv4
-
+		if sfDryRun {
+			fmt.Printf("Would add host to Datastore: %s\n", machine.Hostname)
+			continue
+		}
 		fmt.Printf("Adding host to Datastore: %s\n", machine.Hostname)
-		runCreate(cmd, args)
+		hosts = append(hosts, newHost(machine.Hostname, machine.IPv4, machine.IPv6, machine.Type))
+	}
+	err = addHosts(ds, newAuditor(ds), hosts, sfBatchSize, sfWorkers)
+	rtx.Must(err, "Failed to save new host records")
+}
+
+// addHosts saves hosts to ds in batches of up to batchSize records, using up to
+// workers concurrent saves. Every saved host is recorded by auditor. After any
+// error, no new batches are started, and the first error is returned.
+func addHosts(ds *storage.DatastoreConfig, auditor *storage.Auditor, hosts []*storage.Host, batchSize, workers int) error {
+	if batchSize < 1 || batchSize > storage.MaxSaveMulti {
+		batchSize = storage.MaxSaveMulti
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	batches := make(chan []*storage.Host)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := ds.SaveMulti(batch); err != nil {
+					errs <- err
+					return
+				}
+				for _, h := range batch {
+					auditor.Record(fActor, storage.AuditCreate, nil, h)
+				}
+			}
+		}()
+	}
+
+	var err error
+	for len(hosts) > 0 && err == nil {
+		n := len(hosts)
+		if n > batchSize {
+			n = batchSize
+		}
+		select {
+		case batches <- hosts[:n]:
+			hosts = hosts[n:]
+		case err = <-errs:
+		}
+	}
+	close(batches)
+	wg.Wait()
+	close(errs)
+	if err != nil {
+		return err
 	}
+	// Return any error from the final batches.
+	return <-errs
 }
 
 // isHostnameInDatastore looks for a given hostname in a slice of storage.Hosts
-// and returns true if it is found, else false.
+// and returns true if it is found, else false. Host names are compared
+// case-insensitively.
 func isHostnameInDatastore(hostname string, entities []*storage.Host) bool {
 	for _, entity := range entities {
-		if hostname == entity.Name {
+		if storage.NormalizeName(hostname) == storage.NormalizeName(entity.Name) {
 			return true
 		}
 	}
@@ -111,4 +174,10 @@ func init() {
 	syncCmd.Flags().StringVar(&sfSiteinfo, "siteinfo",
 		"https://siteinfo."+fProject+".measurementlab.net/v2/sites/projects.json",
 		"Absolute URL to siteinfo /v2/projects.json file.")
+	syncCmd.Flags().BoolVar(&sfDryRun, "dry-run", false,
+		"List the hosts that would be added without saving them to Datastore.")
+	syncCmd.Flags().IntVar(&sfWorkers, "workers", 4,
+		"Number of batches of hosts to save to Datastore concurrently.")
+	syncCmd.Flags().IntVar(&sfBatchSize, "batch-size", 100,
+		"Number of hosts to save to Datastore in each batch, at most 500.")
 }
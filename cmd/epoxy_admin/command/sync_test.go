@@ -15,11 +15,174 @@
 package command
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
 	"testing"
 
+	"cloud.google.com/go/datastore"
 	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/epoxy/storage/iface"
+	"github.com/m-lab/go/siteinfo"
 )
 
+// fakeDatastoreClient implements the iface.DatastoreClient interface for
+// testing. Host and HostGroup records are stored in memory, and every Host
+// saved by Put or PutMulti is counted.
+type fakeDatastoreClient struct {
+	hosts     map[string]*storage.Host
+	groups    map[string]*storage.HostGroup
+	puts      int
+	putMultis int
+	deletes   int
+	// putMultiErr, when not nil, is returned by every PutMulti.
+	putMultiErr error
+	// mu serializes transactions.
+	mu sync.Mutex
+}
+
+func newFakeDatastoreClient(hosts ...*storage.Host) *fakeDatastoreClient {
+	f := &fakeDatastoreClient{hosts: map[string]*storage.Host{}}
+	for _, h := range hosts {
+		f.hosts[h.Name] = h
+	}
+	return f
+}
+
+func (f *fakeDatastoreClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if g, ok := dst.(*storage.HostGroup); ok {
+		found, ok := f.groups[key.Name]
+		if !ok {
+			return datastore.ErrNoSuchEntity
+		}
+		*g = *found
+		return nil
+	}
+	h, ok := f.hosts[key.Name]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	*dst.(*storage.Host) = *h
+	return nil
+}
+
+func (f *fakeDatastoreClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	h := *src.(*storage.Host)
+	f.hosts[key.Name] = &h
+	f.puts++
+	return key, nil
+}
+
+func (f *fakeDatastoreClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.putMultiErr != nil {
+		return nil, f.putMultiErr
+	}
+	for i, h := range src.([]*storage.Host) {
+		c := *h
+		f.hosts[keys[i].Name] = &c
+	}
+	f.puts += len(keys)
+	f.putMultis++
+	return keys, nil
+}
+
+func (f *fakeDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	hosts := dst.(*[]*storage.Host)
+	for _, h := range f.hosts {
+		c := *h
+		*hosts = append(*hosts, &c)
+	}
+	return nil, nil
+}
+
+func (f *fakeDatastoreClient) Delete(ctx context.Context, key *datastore.Key) error {
+	delete(f.hosts, key.Name)
+	f.deletes++
+	return nil
+}
+
+func (f *fakeDatastoreClient) RunInTransaction(ctx context.Context, fn func(tx iface.Transaction) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fn(&fakeTransaction{client: f})
+}
+
+// fakeTransaction implements the iface.Transaction interface using the
+// operations of a fakeDatastoreClient.
+type fakeTransaction struct {
+	client *fakeDatastoreClient
+}
+
+func (t *fakeTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return t.client.Get(context.Background(), key, dst)
+}
+
+func (t *fakeTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	_, err := t.client.Put(context.Background(), key, src)
+	return nil, err
+}
+
+// useFakeDatastore replaces newDatastoreClient with one returning f, and
+// returns a function to restore the original.
+func useFakeDatastore(f *fakeDatastoreClient) func() {
+	orig := newDatastoreClient
+	newDatastoreClient = func(ctx context.Context, project string) (iface.DatastoreClient, error) {
+		return f, nil
+	}
+	return func() { newDatastoreClient = orig }
+}
+
+// useAuditBuffer replaces auditWriter with a new buffer, and returns the
+// buffer. The caller must restore auditWriter to os.Stderr.
+func useAuditBuffer() *bytes.Buffer {
+	var b bytes.Buffer
+	auditWriter = &b
+	return &b
+}
+
+// auditActions returns the actions of the audit events written to b.
+func auditActions(t *testing.T, b *bytes.Buffer) []string {
+	var actions []string
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		e := &storage.AuditEvent{}
+		if err := dec.Decode(e); err != nil {
+			t.Fatalf("Invalid audit event: %v", err)
+		}
+		if e.Actor != fActor || e.Host == "" {
+			t.Errorf("Audit event has actor %q and host %q", e.Actor, e.Host)
+		}
+		actions = append(actions, e.Action)
+	}
+	return actions
+}
+
+// fakeSiteinfo implements the machineLister interface for testing.
+type fakeSiteinfo struct {
+	machines []siteinfo.Machine
+	err      error
+}
+
+func (f *fakeSiteinfo) Machines() ([]siteinfo.Machine, error) {
+	return f.machines, f.err
+}
+
+// useFakeSiteinfo replaces newSiteinfo with one returning f, and returns a
+// function to restore the original.
+func useFakeSiteinfo(f *fakeSiteinfo) func() {
+	orig := newSiteinfo
+	newSiteinfo = func(project string) machineLister {
+		return f
+	}
+	return func() { newSiteinfo = orig }
+}
+
 func TestSync_isHostnameinDatastore(t *testing.T) {
 	entities := []*storage.Host{
 		{
@@ -49,6 +212,11 @@ func TestSync_isHostnameinDatastore(t *testing.T) {
 			hostname: "mlab4-usa02.mlab-staging.measurement-lab.org",
 			found:    true,
 		},
+		{
+			name:     "found-hostname-mixed-case",
+			hostname: "MLAB2-ABC01.mlab-sandbox.measurement-lab.org",
+			found:    true,
+		},
 		{
 			name:     "not-found-hostname",
 			hostname: "mlab9-ddd01.mlab-staging.measurement-lab.org",
@@ -68,3 +236,163 @@ func TestSync_isHostnameinDatastore(t *testing.T) {
 		}
 	}
 }
+
+func TestSync_runSync(t *testing.T) {
+	tests := []struct {
+		name     string
+		dryRun   bool
+		wantPuts int
+	}{
+		{
+			name:     "dry-run-saves-nothing",
+			dryRun:   true,
+			wantPuts: 0,
+		},
+		{
+			name:     "sync-adds-missing-hosts",
+			dryRun:   false,
+			wantPuts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fProject = "mlab-sandbox"
+			sfDryRun = tt.dryRun
+			defer func() { sfDryRun = false }()
+
+			ds := newFakeDatastoreClient(&storage.Host{
+				Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+			})
+			defer useFakeDatastore(ds)()
+			si := &fakeSiteinfo{
+				machines: []siteinfo.Machine{
+					{Hostname: "mlab1-abc01.mlab-sandbox.measurement-lab.org", IPv4: "192.168.0.1", Project: "mlab-sandbox"},
+					{Hostname: "mlab2-abc01.mlab-sandbox.measurement-lab.org", IPv4: "192.168.0.2", Project: "mlab-sandbox"},
+					{
+						Hostname: "mlab3-abc01.mlab-sandbox.measurement-lab.org",
+						IPv4:     "192.168.0.3",
+						IPv6:     "2001:db8::3",
+						Project:  "mlab-sandbox",
+						Type:     "physical",
+					},
+					{Hostname: "mlab1-xyz01.mlab-staging.measurement-lab.org", IPv4: "192.168.1.1", Project: "mlab-staging"},
+				},
+			}
+			defer useFakeSiteinfo(si)()
+
+			runSync(syncCmd, nil)
+
+			if ds.puts != tt.wantPuts {
+				t.Errorf("runSync() wrong number of saves: got %d; want %d", ds.puts, tt.wantPuts)
+			}
+			if !tt.dryRun {
+				h := ds.hosts["mlab3-abc01.mlab-sandbox.measurement-lab.org"]
+				if h == nil || h.IPv4Addr != "192.168.0.3" {
+					t.Fatalf("runSync() failed to add host: got %#v", h)
+				}
+				// Additional siteinfo fields are saved with the new host.
+				if h.IPv6Addr != "2001:db8::3" || h.MachineType != "physical" {
+					t.Errorf("runSync() failed to save siteinfo fields: got IPv6Addr=%q MachineType=%q",
+						h.IPv6Addr, h.MachineType)
+				}
+			}
+		})
+	}
+}
+
+func TestSync_runSyncManyHosts(t *testing.T) {
+	fProject = "mlab-sandbox"
+	origBatchSize, origWorkers := sfBatchSize, sfWorkers
+	sfBatchSize, sfWorkers = 100, 4
+	defer func() { sfBatchSize, sfWorkers = origBatchSize, origWorkers }()
+
+	useAuditBuffer()
+	defer func() { auditWriter = os.Stderr }()
+
+	ds := newFakeDatastoreClient()
+	defer useFakeDatastore(ds)()
+	si := &fakeSiteinfo{}
+	for i := 0; i < 250; i++ {
+		si.machines = append(si.machines, siteinfo.Machine{
+			Hostname: fmt.Sprintf("mlab1-abc%03d.mlab-sandbox.measurement-lab.org", i),
+			IPv4:     fmt.Sprintf("192.168.%d.%d", i/256, i%256),
+			Project:  "mlab-sandbox",
+		})
+	}
+	defer useFakeSiteinfo(si)()
+
+	runSync(syncCmd, nil)
+
+	// All missing hosts are added, in as few batches as possible.
+	if ds.puts != 250 || len(ds.hosts) != 250 {
+		t.Errorf("runSync() added %d hosts in %d saves; want 250", len(ds.hosts), ds.puts)
+	}
+	if ds.putMultis != 3 {
+		t.Errorf("runSync() used %d batches; want 3", ds.putMultis)
+	}
+	for _, m := range si.machines {
+		if h := ds.hosts[m.Hostname]; h == nil || h.IPv4Addr != m.IPv4 {
+			t.Errorf("runSync() failed to add host %s: got %#v", m.Hostname, h)
+		}
+	}
+}
+
+func TestSync_addHosts(t *testing.T) {
+	errSave := errors.New("fake save failure")
+	tests := []struct {
+		name      string
+		count     int
+		batchSize int
+		workers   int
+		err       error
+		wantAdded int
+		wantErr   error
+	}{
+		{
+			name:      "success-many-workers",
+			count:     25,
+			batchSize: 10,
+			workers:   8,
+			wantAdded: 25,
+		},
+		{
+			name:      "success-defaults",
+			count:     25,
+			wantAdded: 25,
+		},
+		{
+			name:      "failure",
+			count:     25,
+			batchSize: 10,
+			workers:   2,
+			err:       errSave,
+			wantErr:   errSave,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDatastoreClient()
+			f.putMultiErr = tt.err
+			ds := storage.NewDatastoreConfig(f)
+			b := useAuditBuffer()
+			defer func() { auditWriter = os.Stderr }()
+			var hosts []*storage.Host
+			for i := 0; i < tt.count; i++ {
+				hosts = append(hosts, &storage.Host{Name: fmt.Sprintf("mlab%d.abc01.measurement-lab.org", i)})
+			}
+
+			err := addHosts(ds, newAuditor(ds), hosts, tt.batchSize, tt.workers)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("addHosts() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(f.hosts) != tt.wantAdded {
+				t.Errorf("addHosts() added %d hosts, want %d", len(f.hosts), tt.wantAdded)
+			}
+			// Only saved hosts are audited.
+			if got := len(auditActions(t, b)); got != tt.wantAdded {
+				t.Errorf("addHosts() audited %d hosts, want %d", got, tt.wantAdded)
+			}
+		})
+	}
+}
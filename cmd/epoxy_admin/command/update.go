@@ -18,11 +18,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"reflect"
 	"regexp"
 	"time"
 
-	"cloud.google.com/go/datastore"
+	"github.com/m-lab/epoxy/datastorex"
 	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/epoxy/template"
 	"github.com/m-lab/go/rtx"
 	"github.com/spf13/cobra"
 )
@@ -36,6 +38,8 @@ USAGE:
     **ONLY FOR TESTING**
 
     Updates Host records matching the regex pattern in the --hostname flag.
+    Only fields named by the given flags are changed. Each Host record is
+    loaded, modified, and saved within a single transaction.
 
 EXAMPLE:
 
@@ -48,6 +52,17 @@ EXAMPLE:
     epoxy_admin update --project mlab-sandbox \
         --hostname 'mlab4.*' \
         --update
+
+    # Serve the update sequence for every boot of the Host.
+    epoxy_admin update --project mlab-sandbox \
+        --hostname mlab3.iad1t.measurement-lab.org \
+        --boot-policy update-always
+
+    # Only update mlab4 Host records that booted successfully in the last day.
+    epoxy_admin update --project mlab-sandbox \
+        --hostname 'mlab4.*' \
+        --healthy-within 24h \
+        --update
 `,
 	Run: runUpdate,
 }
@@ -59,48 +74,131 @@ func updateURL(url, original string) string {
 	return original
 }
 
-// TODO: add unit tests by masking out NewClient & NewDatstoreConfig. Consider
-// promoting the fake datastore types from storage/datastore_test.go to an
-// internal fake package.
 func runUpdate(cmd *cobra.Command, args []string) {
 	// Setup Datastore client.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	client, err := datastore.NewClient(ctx, fProject)
+	client, err := newDatastoreClient(ctx, fProject)
 	rtx.Must(err, "Failed to create new datastore client")
 
 	// Save the host record to Datstore.
 	ds := storage.NewDatastoreConfig(client)
 	hosts, err := ds.List()
 	rtx.Must(err, "Failed to list host records")
+	audit := newAuditor(ds)
 
 	// Compile given regex.
 	r, err := regexp.Compile(ufHostname)
 	rtx.Must(err, "Failed to compile given hostname pattern: %q", ufHostname)
 
+	err = validateBootConfig(&storage.Host{
+		APIVersion:     ufAPIVersion,
+		ChainCommand:   ufChainCommand,
+		ChainChecksums: ufChainChecksums,
+		Message:        ufMessage,
+	})
+	rtx.Must(err, "Invalid update flags")
+	if err := storage.ValidateOperationNames(ufExtensions); err != nil {
+		log.Fatalf("Invalid extensions: %v", err)
+	}
+	if _, err := parseMaintenanceUntil(ufMaintenanceUntil); err != nil {
+		log.Fatalf("Invalid maintenance time: %v", err)
+	}
+	if !storage.ValidBootPolicy(ufBootPolicy) {
+		log.Fatalf("Invalid boot policy: %q", ufBootPolicy)
+	}
+
+	now := time.Now()
 	for _, h := range hosts {
-		if !r.MatchString(h.Name) {
+		if !selectHost(h, r, ufHealthyWithin, now) {
 			continue
 		}
 		log.Printf("Updating: %s", h.Name)
 
-		handleUpdate(h)
-
-		// Save the host record.
-		err = ds.Save(h)
-		rtx.Must(err, "Failed to save new host record")
-
-		// Retrieve the host record from Datastore to exercise the full save & load path.
-		h, err = ds.Load(h.Name)
-		rtx.Must(err, "Failed to save new host record")
+		// Apply the changes to the latest host record within a transaction.
+		var before *storage.Host
+		h, err = ds.Update(h.Name, func(h *storage.Host) error {
+			before = h.Clone()
+			handleUpdate(cmd, h)
+			return nil
+		})
+		rtx.Must(err, "Failed to update host record")
+		audit.Record(fActor, storage.AuditUpdate, before, h)
 		fmt.Println(h.String())
 	}
 	return
 }
 
-func handleUpdate(h *storage.Host) {
-	h.UpdateEnabled = ufUpdate
+// selectHost returns true if the host name matches r and, when healthyWithin
+// is non-zero, the host reported a successful boot within healthyWithin of now.
+func selectHost(h *storage.Host, r *regexp.Regexp, healthyWithin time.Duration, now time.Time) bool {
+	if !r.MatchString(h.Name) {
+		return false
+	}
+	if healthyWithin > 0 && now.Sub(h.LastSuccess) > healthyWithin {
+		log.Printf("Skipping: %s; last success at %s", h.Name, h.LastSuccess)
+		return false
+	}
+	return true
+}
+
+// validateBootConfig returns an error if the fields of h that determine its
+// stage1 script and stage URLs would produce a script the host cannot boot.
+// Both update and apply validate these fields before saving them.
+func validateBootConfig(h *storage.Host) error {
+	switch {
+	case !template.ValidAPIVersion(h.APIVersion):
+		return fmt.Errorf("invalid API version: %q", h.APIVersion)
+	case !template.ValidChainCommand(h.ChainCommand):
+		return fmt.Errorf("invalid chain command: %q", h.ChainCommand)
+	case !template.ValidMessage(h.Message):
+		return fmt.Errorf("invalid message: %q", h.Message)
+	}
+	if err := validateChainChecksums(h.ChainChecksums); err != nil {
+		return fmt.Errorf("invalid chain checksums: %v", err)
+	}
+	return nil
+}
+
+// validChecksum matches hex encoded sha256 checksums.
+var validChecksum = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// validateChainChecksums returns an error if any checksum is not a hex encoded
+// sha256 checksum.
+func validateChainChecksums(checksums map[string]string) error {
+	for chain, checksum := range checksums {
+		if !validChecksum.MatchString(checksum) {
+			return fmt.Errorf("%s: checksum must be 64 hex digits: %q", chain, checksum)
+		}
+	}
+	return nil
+}
+
+// parseMaintenanceUntil parses an RFC3339 maintenance end time. An empty value
+// returns the zero time, which ends maintenance.
+func parseMaintenanceUntil(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// handleUpdate applies the flags given to cmd to h. Fields without a
+// corresponding flag are left unchanged.
+func handleUpdate(cmd *cobra.Command, h *storage.Host) {
+	if cmd.Flags().Changed("update") {
+		// Every newly enabled update starts with a full set of attempts.
+		h.SetUpdateEnabled(ufUpdate)
+	}
+
+	if cmd.Flags().Changed("boot-policy") {
+		h.SetBootPolicy(ufBootPolicy)
+	}
+
+	if cmd.Flags().Changed("max-update-attempts") {
+		h.MaxUpdateAttempts = ufMaxUpdateAttempts
+	}
 
 	if len(ufExtensions) > 0 {
 		h.Extensions = ufExtensions
@@ -109,6 +207,13 @@ func handleUpdate(h *storage.Host) {
 	if ufAddress != "" {
 		h.IPv4Addr = ufAddress
 	}
+
+	// Labels are added or replaced, and removed when given an empty value.
+	h.SetLabels(ufLabels)
+	// Snapshot the sequences for "rollback", but only keep the snapshot if
+	// the sequences change, so the last known good sequences are preserved.
+	previousBoot, previousUpdate := h.PreviousBoot, h.PreviousUpdate
+	h.SnapshotSequences()
 	h.Boot[storage.Stage1IPXE] = updateURL(fmtURL(ufBootStage1), h.Boot[storage.Stage1IPXE])
 	h.Boot[storage.Stage1JSON] = updateURL(fmtURL(ufBootStage1JSON), h.Boot[storage.Stage1JSON])
 	h.Boot[storage.Stage2] = updateURL(fmtURL(ufBootStage2), h.Boot[storage.Stage2])
@@ -117,10 +222,48 @@ func handleUpdate(h *storage.Host) {
 	h.Update[storage.Stage1JSON] = updateURL(fmtURL(ufUpdateStage1JSON), h.Update[storage.Stage1JSON])
 	h.Update[storage.Stage2] = updateURL(fmtURL(ufUpdateStage2), h.Update[storage.Stage2])
 	h.Update[storage.Stage3] = updateURL(fmtURL(ufUpdateStage3), h.Update[storage.Stage3])
+	if reflect.DeepEqual(h.Boot, h.PreviousBoot) && reflect.DeepEqual(h.Update, h.PreviousUpdate) {
+		h.PreviousBoot, h.PreviousUpdate = previousBoot, previousUpdate
+	}
 
 	if ufImagesVersion != "" {
 		h.ImagesVersion = ufImagesVersion
 	}
+
+	if ufAPIVersion != "" {
+		h.APIVersion = ufAPIVersion
+	}
+
+	if cmd.Flags().Changed("group") {
+		h.Group = ufGroup
+	}
+
+	if cmd.Flags().Changed("message") {
+		h.Message = ufMessage
+	}
+
+	if cmd.Flags().Changed("chain-command") {
+		h.ChainCommand = ufChainCommand
+	}
+
+	if cmd.Flags().Changed("command-timeout") {
+		h.CommandTimeout = ""
+		if ufCommandTimeout > 0 {
+			h.CommandTimeout = ufCommandTimeout.String()
+		}
+	}
+
+	if cmd.Flags().Changed("maintenance-until") {
+		// The value was already validated by runUpdate.
+		h.MaintenanceUntil, _ = parseMaintenanceUntil(ufMaintenanceUntil)
+	}
+
+	for chain, checksum := range ufChainChecksums {
+		if h.ChainChecksums == nil {
+			h.ChainChecksums = datastorex.Map{}
+		}
+		h.ChainChecksums[chain] = checksum
+	}
 }
 
 func init() {
@@ -130,14 +273,26 @@ func init() {
 	updateCmd.Flags().StringVar(&ufHostname, "hostname", "",
 		"Hostname of new record.")
 	updateCmd.MarkFlagRequired("hostname")
+	updateCmd.Flags().DurationVar(&ufHealthyWithin, "healthy-within", 0,
+		"Only update hosts with a successful boot within this duration, e.g. 24h. Zero selects all matching hosts.")
 
 	// Local flags which will only run when "update" is called directly.
 	updateCmd.Flags().StringSliceVar(&ufExtensions, "extensions", []string{},
 		"List of extensions to enable.")
 	updateCmd.Flags().StringVar(&ufAddress, "address", "",
 		"IP address of hostname.")
+	updateCmd.Flags().StringToStringVar(&ufLabels, "label", nil,
+		"Label to set on the host, e.g. owner=ops. An empty value, e.g. owner=, removes the label. May be repeated.")
 	updateCmd.Flags().BoolVar(&ufUpdate, "update", false,
 		"Set Host.UpdateEnabled to true for an existing Host.")
+	updateCmd.Flags().StringVar(&ufBootPolicy, "boot-policy", "",
+		"Boot policy of the host: normal, update-once, update-always, or hold. Empty uses --update.")
+	updateCmd.Flags().IntVar(&ufMaxUpdateAttempts, "max-update-attempts", 0,
+		"Number of failed update boots before falling back to the boot sequence. Zero allows unlimited attempts.")
+	updateCmd.Flags().DurationVar(&ufCommandTimeout, "command-timeout", 0,
+		"Time limit for each command run by epoxy_client, e.g. 4h. Zero uses the client default.")
+	updateCmd.Flags().StringVar(&ufGroup, "group", "",
+		"Name of a host group providing default boot and update stages. Empty removes the group.")
 	updateCmd.Flags().StringVar(&ufBootStage1, "boot-stage1", "",
 		"Absolute URL to an action definition to run during stage1 to stage2 boot.")
 	updateCmd.Flags().StringVar(&ufBootStage1JSON, "boot-stage1-json", "",
@@ -156,4 +311,14 @@ func init() {
 		"Absolute URL to an action definition to run after running stage3 update.")
 	updateCmd.Flags().StringVar(&ufImagesVersion, "images-version", "",
 		"Version of epoxy-images to use in each boot stage.")
+	updateCmd.Flags().StringVar(&ufAPIVersion, "api-version", "",
+		"Pin the ePoxy API version, e.g. v1, used in URLs generated for the host.")
+	updateCmd.Flags().StringToStringVar(&ufChainChecksums, "chain-checksums", map[string]string{},
+		"Expected sha256 checksums of chain URLs, e.g. https://example.com/stage2.json=<sha256>.")
+	updateCmd.Flags().StringVar(&ufMessage, "message", "",
+		"Banner displayed on the console during stage1, e.g. for planned maintenance. An empty value clears it.")
+	updateCmd.Flags().StringVar(&ufMaintenanceUntil, "maintenance-until", "",
+		"Hold the host in maintenance until this RFC3339 time, e.g. 2026-01-02T15:04:00Z. An empty value ends maintenance.")
+	updateCmd.Flags().StringVar(&ufChainCommand, "chain-command", "",
+		"iPXE command used by the stage1 script to chain to the stage1 URL, e.g. 'chain --autofree'. An empty value restores the default.")
 }
@@ -0,0 +1,256 @@
+// Copyright 2021 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/storage"
+	"github.com/spf13/pflag"
+)
+
+func TestUpdate_runUpdate(t *testing.T) {
+	h := &storage.Host{
+		Name:          "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+		IPv4Addr:      "192.168.0.1",
+		UpdateEnabled: true,
+		Extensions:    []string{"allocate_k8s_token"},
+		ImagesVersion: "v1.0",
+		Labels:        datastorex.Map{"owner": "ops", "ticket": "OPS-1"},
+		Boot:          datastorex.Map{storage.Stage2: "https://example.com/stage2.json"},
+		Update:        datastorex.Map{},
+	}
+	other := &storage.Host{
+		Name:          "mlab2-abc01.mlab-sandbox.measurement-lab.org",
+		ImagesVersion: "v1.0",
+		Boot:          datastorex.Map{},
+		Update:        datastorex.Map{},
+	}
+	f := newFakeDatastoreClient(h, other)
+	defer useFakeDatastore(f)()
+
+	// Change only the images version, command timeout, maintenance time, and
+	// labels of the first host.
+	flags := map[string]string{
+		"hostname":          h.Name,
+		"images-version":    "v2.0",
+		"command-timeout":   "4h",
+		"maintenance-until": "2026-01-02T15:04:00Z",
+		"label":             "ticket=,cost_center=42",
+	}
+	for name, value := range flags {
+		if err := updateCmd.Flags().Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		ufHostname = ""
+		ufImagesVersion = ""
+		ufCommandTimeout = 0
+		ufMaintenanceUntil = ""
+		ufLabels = nil
+		updateCmd.Flags().VisitAll(func(f *pflag.Flag) { f.Changed = false })
+	}()
+
+	runUpdate(updateCmd, nil)
+
+	got := f.hosts[h.Name]
+	if got.ImagesVersion != "v2.0" {
+		t.Errorf("runUpdate() ImagesVersion = %q, want v2.0", got.ImagesVersion)
+	}
+	if got.CommandTimeout != "4h0m0s" {
+		t.Errorf("runUpdate() CommandTimeout = %q, want 4h0m0s", got.CommandTimeout)
+	}
+	if want := time.Date(2026, 1, 2, 15, 4, 0, 0, time.UTC); !got.MaintenanceUntil.Equal(want) {
+		t.Errorf("runUpdate() MaintenanceUntil = %s, want %s", got.MaintenanceUntil, want)
+	}
+	if want := (datastorex.Map{"owner": "ops", "cost_center": "42"}); !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("runUpdate() Labels = %v, want %v", got.Labels, want)
+	}
+	// Fields without flags are unchanged.
+	if !got.UpdateEnabled || got.IPv4Addr != h.IPv4Addr || len(got.Extensions) != 1 ||
+		got.Boot[storage.Stage2] != h.Boot[storage.Stage2] {
+		t.Errorf("runUpdate() changed unrelated fields: got %#v, want %#v", got, h)
+	}
+	if f.hosts[other.Name].ImagesVersion != "v1.0" {
+		t.Errorf("runUpdate() changed non-matching host: %#v", f.hosts[other.Name])
+	}
+	if f.puts != 1 {
+		t.Errorf("runUpdate() wrong number of puts: got %d, want 1", f.puts)
+	}
+}
+
+func TestUpdate_handleUpdateBootPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		host        storage.Host
+		flags       map[string]string
+		wantPolicy  string
+		wantEnabled bool
+	}{
+		{
+			name:        "set-policy",
+			host:        storage.Host{UpdateAttempts: 2},
+			flags:       map[string]string{"boot-policy": storage.BootPolicyUpdateAlways},
+			wantPolicy:  storage.BootPolicyUpdateAlways,
+			wantEnabled: true,
+		},
+		{
+			name:       "hold",
+			host:       storage.Host{BootPolicy: storage.BootPolicyUpdateOnce, UpdateEnabled: true},
+			flags:      map[string]string{"boot-policy": storage.BootPolicyHold},
+			wantPolicy: storage.BootPolicyHold,
+		},
+		{
+			name:        "update-flag-selects-update-once",
+			host:        storage.Host{BootPolicy: storage.BootPolicyNormal},
+			flags:       map[string]string{"update": "true"},
+			wantPolicy:  storage.BootPolicyUpdateOnce,
+			wantEnabled: true,
+		},
+		{
+			name:        "update-flag-without-policy",
+			host:        storage.Host{},
+			flags:       map[string]string{"update": "true"},
+			wantEnabled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.flags {
+				if err := updateCmd.Flags().Set(name, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer func() {
+				ufBootPolicy = ""
+				ufUpdate = false
+				updateCmd.Flags().VisitAll(func(f *pflag.Flag) { f.Changed = false })
+			}()
+			h := tt.host
+			h.Boot = datastorex.Map{}
+			h.Update = datastorex.Map{}
+
+			handleUpdate(updateCmd, &h)
+
+			if h.BootPolicy != tt.wantPolicy || h.UpdateEnabled != tt.wantEnabled {
+				t.Errorf("handleUpdate() = %q, UpdateEnabled %t; want %q, %t",
+					h.BootPolicy, h.UpdateEnabled, tt.wantPolicy, tt.wantEnabled)
+			}
+			if tt.wantEnabled && h.UpdateAttempts != 0 {
+				t.Errorf("handleUpdate() UpdateAttempts = %d, want 0", h.UpdateAttempts)
+			}
+		})
+	}
+}
+
+func TestUpdate_validateChainChecksums(t *testing.T) {
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		name      string
+		checksums map[string]string
+		wantErr   bool
+	}{
+		{
+			name:      "valid",
+			checksums: map[string]string{"https://example.com/stage2.json": sum},
+		},
+		{
+			name: "empty",
+		},
+		{
+			name:      "error-too-short",
+			checksums: map[string]string{"https://example.com/stage2.json": sum[:63]},
+			wantErr:   true,
+		},
+		{
+			name:      "error-not-hex",
+			checksums: map[string]string{"https://example.com/stage2.json": "z" + sum[1:]},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateChainChecksums(tt.checksums); (err != nil) != tt.wantErr {
+				t.Errorf("validateChainChecksums() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdate_selectHost(t *testing.T) {
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	fleet := []*storage.Host{
+		{Name: "mlab1-abc01.mlab-sandbox.measurement-lab.org", LastSuccess: now.Add(-time.Hour)},
+		{Name: "mlab2-abc01.mlab-sandbox.measurement-lab.org", LastSuccess: now.Add(-48 * time.Hour)},
+		{Name: "mlab3-abc01.mlab-sandbox.measurement-lab.org"},
+		{Name: "mlab1-xyz01.mlab-sandbox.measurement-lab.org", LastSuccess: now.Add(-time.Minute)},
+	}
+	tests := []struct {
+		name          string
+		pattern       string
+		healthyWithin time.Duration
+		want          []string
+	}{
+		{
+			name:    "regex-only",
+			pattern: "abc01",
+			want: []string{
+				"mlab1-abc01.mlab-sandbox.measurement-lab.org",
+				"mlab2-abc01.mlab-sandbox.measurement-lab.org",
+				"mlab3-abc01.mlab-sandbox.measurement-lab.org",
+			},
+		},
+		{
+			name:          "healthy-within-day",
+			pattern:       "abc01",
+			healthyWithin: 24 * time.Hour,
+			want:          []string{"mlab1-abc01.mlab-sandbox.measurement-lab.org"},
+		},
+		{
+			name:          "healthy-within-week",
+			pattern:       ".*",
+			healthyWithin: 7 * 24 * time.Hour,
+			want: []string{
+				"mlab1-abc01.mlab-sandbox.measurement-lab.org",
+				"mlab2-abc01.mlab-sandbox.measurement-lab.org",
+				"mlab1-xyz01.mlab-sandbox.measurement-lab.org",
+			},
+		},
+		{
+			name:          "no-healthy-matches",
+			pattern:       "mlab3",
+			healthyWithin: 24 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := regexp.MustCompile(tt.pattern)
+			var got []string
+			for _, h := range fleet {
+				if selectHost(h, r, tt.healthyWithin, now) {
+					got = append(got, h.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectHost() selected %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
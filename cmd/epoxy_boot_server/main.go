@@ -37,9 +37,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/m-lab/go/prometheusx"
 
@@ -50,7 +59,11 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/m-lab/epoxy/handler"
 	"github.com/m-lab/epoxy/metrics"
+	"github.com/m-lab/epoxy/nextboot"
 	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/epoxy/storage/iface"
+	"github.com/m-lab/epoxy/template"
+	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/rtx"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -62,7 +75,8 @@ var (
 	// AppEngine and Docker containers. Using environment variables is encouraged
 	// for twelve-factor apps -- https://12factor.net/config
 
-	// projectID must be set using the GCLOUD_PROJECT environment variable.
+	// projectID should be set using the GCLOUD_PROJECT environment variable.
+	// When unset, the project ID is read from the GCE metadata server.
 	projectID = os.Getenv("GCLOUD_PROJECT")
 
 	// publicHostname must be set if *not* running in AppEngine. When running in
@@ -72,6 +86,12 @@ var (
 	// environment variable must be set instead.
 	publicHostname = os.Getenv("PUBLIC_HOSTNAME")
 
+	// publicBaseURL is the external base URL used in generated URLs, e.g. when
+	// clients reach ePoxy through a load balancer with a different hostname. It
+	// may be set using the PUBLIC_BASE_URL environment variable. By default,
+	// generated URLs use "https://" and publicHostname.
+	publicBaseURL = os.Getenv("PUBLIC_BASE_URL")
+
 	// bindAddress may be set using the LISTEN environment variable. By default,
 	// ePoxy listens on all available interfaces.
 	bindAddress = os.Getenv("LISTEN")
@@ -84,13 +104,167 @@ var (
 	// DEPRECATED.
 	allowForwardedRequests = false
 
+	// trustedProxies are the networks of load balancers allowed to forward
+	// requests. It may be set using the TRUSTED_PROXY_CIDRS environment
+	// variable, e.g. "35.191.0.0/16,130.211.0.0/22". When empty, forwarded
+	// requests are accepted from any proxy.
+	trustedProxies []*net.IPNet
+
+	// compactJSON controls whether JSON configs are served without indentation.
+	// It may be enabled by setting the COMPACT_JSON environment variable to "true".
+	compactJSON = false
+
+	// auditDatastore controls whether audit events, which are always written
+	// to stderr, are also saved to Datastore as children of the Host records.
+	// It may be enabled by setting the AUDIT_DATASTORE environment variable to
+	// "true".
+	auditDatastore = false
+
+	// autocertCacheDir is the directory where LetsEncrypt certificates are
+	// cached. It may be set using the AUTOCERT_CACHE_DIR environment variable.
+	autocertCacheDir = "/certs/autocert.cache"
+
 	// serverCert and serverKey are the filenames for the iPXE server certificate.
 	serverCert = os.Getenv("IPXE_CERT_FILE")
 	serverKey  = os.Getenv("IPXE_KEY_FILE")
 
+	// apiVersion is the default API version used in generated URLs. It may be set
+	// using the API_VERSION environment variable. Host records may override it.
+	apiVersion = os.Getenv("API_VERSION")
+
 	// storagePrefixURL is the prefix URL for storage proxy requests. If empty, the
 	// storage proxy is disabled.
 	storagePrefixURL = os.Getenv("STORAGE_PREFIX_URL")
+
+	// stage1FallbackURL is the absolute URL of a safe stage1to2 script served
+	// when a host's stage1 script cannot be generated normally. It may be set
+	// using the STAGE1_FALLBACK_URL environment variable.
+	stage1FallbackURL = os.Getenv("STAGE1_FALLBACK_URL")
+
+	// storageRegionPrefixURLs maps region names to storage prefix URLs. Requests
+	// naming one of these regions are proxied to the region prefix instead of
+	// storagePrefixURL. It may be set using the STORAGE_REGION_PREFIX_URLS
+	// environment variable, e.g. "europe=https://a.com/x,asia=https://b.com/y".
+	storageRegionPrefixURLs = flagx.KeyValue{}
+
+	// storageContentTypes maps file suffixes to the Content-Type returned by the
+	// storage proxy when the upstream type is generic. Defaults for iPXE scripts
+	// and JSON configs may be extended or overridden using the
+	// STORAGE_CONTENT_TYPES environment variable, e.g. ".sh=text/x-shellscript".
+	storageContentTypes = flagx.KeyValue{}
+
+	// adminCredentials maps administrator user names to passwords for the
+	// status page. It may be set using the ADMIN_CREDENTIALS environment
+	// variable, e.g. "oncall=@/secrets/oncall-password". When empty, the status
+	// page is disabled.
+	adminCredentials = flagx.KeyValue{}
+
+	// adminCertSubjects lists the subjects of verified client certificates
+	// accepted as administrators, as "CN=<common name>" or "O=<organization>".
+	// It may be set using the comma separated ADMIN_CERT_SUBJECTS environment
+	// variable, e.g. "CN=oncall,O=Ops". It requires CLIENT_CA_FILE.
+	adminCertSubjects []string
+
+	// extensionLatencyMetrics selects the metric types that record extension
+	// request latency. It may be set using the EXTENSION_LATENCY_METRICS
+	// environment variable to "histogram" (the default), "summary", or "both".
+	extensionLatencyMetrics = os.Getenv("EXTENSION_LATENCY_METRICS")
+
+	// extensionFields maps extension operation names to the request fields sent
+	// to that extension. Other extensions receive all fields. It may be set
+	// using the EXTENSION_FIELDS environment variable, with field names
+	// separated by ":", e.g. "bmc_store_password=hostname:ipv4_address".
+	extensionFields = map[string][]string{}
+
+	// extensionRetries maps idempotent extension operation names to the number
+	// of retries after 5xx responses. It may be set using the EXTENSION_RETRIES
+	// environment variable, e.g. "allocate_k8s_token=2".
+	extensionRetries = map[string]int{}
+
+	// extensionStatusMap maps extension response status codes to the status
+	// codes returned to clients. It may be set using the EXTENSION_STATUS_MAP
+	// environment variable, e.g. "404=502,500=502".
+	extensionStatusMap = map[int]int{}
+
+	// maxExtensionRequestBytes limits the size of extension requests forwarded
+	// to extension services. Zero is unlimited. It may be set using the
+	// EXTENSION_MAX_REQUEST_BYTES environment variable, e.g. "65536".
+	maxExtensionRequestBytes = 0
+
+	// extensionProbeInterval is the period between reachability checks of the
+	// registered extension services. It may be set using the
+	// EXTENSION_PROBE_INTERVAL environment variable, e.g. "30s".
+	extensionProbeInterval = time.Minute
+
+	// extensionFlushInterval is the period between flushes of extension
+	// responses to clients. Zero flushes after every write. It may be set using
+	// the EXTENSION_FLUSH_INTERVAL environment variable, e.g. "100ms".
+	extensionFlushInterval time.Duration
+
+	// extensionCAFile, extensionCertFile, and extensionKeyFile configure TLS for
+	// requests to https extension services. extensionCAFile names a PEM file of
+	// CAs trusted for extension servers, instead of the system CAs. The optional
+	// client certificate and key are used for extension servers requiring mTLS.
+	// They may be set using the EXTENSION_CA_FILE, EXTENSION_CERT_FILE, and
+	// EXTENSION_KEY_FILE environment variables.
+	extensionCAFile   = os.Getenv("EXTENSION_CA_FILE")
+	extensionCertFile = os.Getenv("EXTENSION_CERT_FILE")
+	extensionKeyFile  = os.Getenv("EXTENSION_KEY_FILE")
+
+	// configSigningKeyFile names a PEM file with the PKCS #8 Ed25519 private key
+	// used to sign generated JSON configs. It may be set using the
+	// CONFIG_SIGNING_KEY_FILE environment variable. When empty, configs are not
+	// signed.
+	configSigningKeyFile = os.Getenv("CONFIG_SIGNING_KEY_FILE")
+
+	// clientCAFile names a PEM file with the CA certificates used to verify
+	// client certificates presented to the iPXE server. It may be set using the
+	// CLIENT_CA_FILE environment variable. When set, the fingerprint of a
+	// verified client certificate is recorded with each successful report.
+	clientCAFile = os.Getenv("CLIENT_CA_FILE")
+
+	// reportExtension is the operation name of a registered extension called
+	// after each successful report, before the extension session is rotated. It
+	// may be set using the REPORT_EXTENSION environment variable.
+	reportExtension = os.Getenv("REPORT_EXTENSION")
+
+	// maxCollectedAge is the maximum age of information collected from booting
+	// machines. Older values are cleared when Host records are loaded. It may be
+	// set using the MAX_COLLECTED_AGE environment variable, e.g. "720h". By
+	// default, collected information never expires.
+	maxCollectedAge time.Duration
+
+	// saveRetries is the number of times a Host record save is retried after a
+	// transient Datastore error, e.g. contention. It may be set using the
+	// DATASTORE_SAVE_RETRIES environment variable. A negative value keeps the
+	// storage default.
+	saveRetries = -1
+
+	// drainGracePeriod is the time between SIGTERM, when the server starts
+	// refusing new boots, and shutdown, so that machines that already started
+	// a boot can complete it. It may be set using the DRAIN_GRACE_PERIOD
+	// environment variable, e.g. "5m".
+	drainGracePeriod = 2 * time.Minute
+
+	// sessionTTL limits how long session URLs are accepted after a stage1
+	// request. Zero disables expiry. It may be set using the SESSION_TTL
+	// environment variable, e.g. "8h".
+	sessionTTL time.Duration
+
+	// sessionReuseWindow is how long a stage1 session is reused by later stage1
+	// requests from the same host. Zero disables reuse. It may be set using the
+	// SESSION_REUSE_WINDOW environment variable, e.g. "30s".
+	sessionReuseWindow time.Duration
+
+	// metricsPageSize is the number of hosts read from Datastore in each
+	// query by the metrics collectors. Zero reads all hosts in one query. It
+	// may be set using the METRICS_LIST_PAGE_SIZE environment variable.
+	metricsPageSize int
+
+	// bootSuccessWindow is how recently a host must have booted successfully
+	// to count toward epoxy_boot_success_ratio. It may be set using the
+	// BOOT_SUCCESS_WINDOW environment variable, e.g. "12h".
+	bootSuccessWindow = 24 * time.Hour
 )
 
 const (
@@ -98,18 +272,168 @@ const (
 	tlsPort = "443"
 )
 
-// init checks the environment for configuration values.
-func init() {
-	// Only use the automatic public address if PUBLIC_HOSTNAME is not already set.
+// setAppEngineHostname sets publicHostname from GAE_SERVICE and projectID when
+// running in AppEngine. Only use the automatic public address if
+// PUBLIC_HOSTNAME is not already set.
+func setAppEngineHostname() {
 	if service := os.Getenv("GAE_SERVICE"); service != "" && projectID != "" && publicHostname == "" {
 		publicHostname = fmt.Sprintf("%s-dot-%s.appspot.com", service, projectID)
 	}
+}
+
+// init checks the environment for configuration values.
+func init() {
+	setAppEngineHostname()
 	if port := os.Getenv("PORT"); port != "" {
 		bindPort = port
 	}
+	if dir := os.Getenv("AUTOCERT_CACHE_DIR"); dir != "" {
+		autocertCacheDir = dir
+	}
 	if os.Getenv("ALLOW_FORWARDED_REQUESTS") == "true" {
 		allowForwardedRequests = true
 	}
+	if cidrs := os.Getenv("TRUSTED_PROXY_CIDRS"); cidrs != "" {
+		for _, cidr := range strings.Split(cidrs, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			rtx.Must(err, "Failed to parse TRUSTED_PROXY_CIDRS: %q", cidrs)
+			trustedProxies = append(trustedProxies, n)
+		}
+	}
+	if os.Getenv("AUDIT_DATASTORE") == "true" {
+		auditDatastore = true
+	}
+	if os.Getenv("COMPACT_JSON") == "true" {
+		compactJSON = true
+	}
+	if prefixes := os.Getenv("STORAGE_REGION_PREFIX_URLS"); prefixes != "" {
+		err := storageRegionPrefixURLs.Set(prefixes)
+		rtx.Must(err, "Failed to parse STORAGE_REGION_PREFIX_URLS: %q", prefixes)
+	}
+	storageContentTypes.Set(".ipxe=text/plain; charset=utf-8,.json=application/json")
+	if types := os.Getenv("STORAGE_CONTENT_TYPES"); types != "" {
+		err := storageContentTypes.Set(types)
+		rtx.Must(err, "Failed to parse STORAGE_CONTENT_TYPES: %q", types)
+	}
+	if creds := os.Getenv("ADMIN_CREDENTIALS"); creds != "" {
+		err := adminCredentials.Set(creds)
+		rtx.Must(err, "Failed to parse ADMIN_CREDENTIALS")
+	}
+	if subjects := os.Getenv("ADMIN_CERT_SUBJECTS"); subjects != "" {
+		for _, subject := range strings.Split(subjects, ",") {
+			adminCertSubjects = append(adminCertSubjects, strings.TrimSpace(subject))
+		}
+		rtx.Must(handler.ValidateCertSubjects(adminCertSubjects),
+			"Failed to parse ADMIN_CERT_SUBJECTS: %q", subjects)
+	}
+	if fields := os.Getenv("EXTENSION_FIELDS"); fields != "" {
+		kv := flagx.KeyValue{}
+		err := kv.Set(fields)
+		rtx.Must(err, "Failed to parse EXTENSION_FIELDS: %q", fields)
+		for operation, names := range kv.Get() {
+			extensionFields[operation] = strings.Split(names, ":")
+		}
+	}
+	if urls := os.Getenv("EXTENSION_URLS"); urls != "" {
+		// Extension service URLs replace the defaults. Operations may list
+		// several URLs, separated by "|", in failover order, e.g.
+		// "allocate_k8s_token=https://a.example.com/token|https://b.example.com/token".
+		kv := flagx.KeyValue{}
+		err := kv.Set(urls)
+		rtx.Must(err, "Failed to parse EXTENSION_URLS: %q", urls)
+		for operation, list := range kv.Get() {
+			err := storage.Extensions.SetURLs(operation, strings.Split(list, "|"))
+			rtx.Must(err, "Failed to parse EXTENSION_URLS: %q", urls)
+		}
+	}
+	if retries := os.Getenv("EXTENSION_RETRIES"); retries != "" {
+		kv := flagx.KeyValue{}
+		err := kv.Set(retries)
+		rtx.Must(err, "Failed to parse EXTENSION_RETRIES: %q", retries)
+		for operation, count := range kv.Get() {
+			n, err := strconv.Atoi(count)
+			rtx.Must(err, "Failed to parse EXTENSION_RETRIES: %q", retries)
+			extensionRetries[operation] = n
+		}
+	}
+	if statuses := os.Getenv("EXTENSION_STATUS_MAP"); statuses != "" {
+		kv := flagx.KeyValue{}
+		err := kv.Set(statuses)
+		rtx.Must(err, "Failed to parse EXTENSION_STATUS_MAP: %q", statuses)
+		for from, to := range kv.Get() {
+			f, err := strconv.Atoi(from)
+			rtx.Must(err, "Failed to parse EXTENSION_STATUS_MAP: %q", statuses)
+			t, err := strconv.Atoi(to)
+			rtx.Must(err, "Failed to parse EXTENSION_STATUS_MAP: %q", statuses)
+			extensionStatusMap[f] = t
+		}
+	}
+	if size := os.Getenv("EXTENSION_MAX_REQUEST_BYTES"); size != "" {
+		n, err := strconv.Atoi(size)
+		rtx.Must(err, "Failed to parse EXTENSION_MAX_REQUEST_BYTES: %q", size)
+		maxExtensionRequestBytes = n
+	}
+	if interval := os.Getenv("EXTENSION_PROBE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		rtx.Must(err, "Failed to parse EXTENSION_PROBE_INTERVAL: %q", interval)
+		extensionProbeInterval = d
+	}
+	if interval := os.Getenv("EXTENSION_FLUSH_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		rtx.Must(err, "Failed to parse EXTENSION_FLUSH_INTERVAL: %q", interval)
+		extensionFlushInterval = d
+	}
+	if age := os.Getenv("MAX_COLLECTED_AGE"); age != "" {
+		d, err := time.ParseDuration(age)
+		rtx.Must(err, "Failed to parse MAX_COLLECTED_AGE: %q", age)
+		maxCollectedAge = d
+	}
+	if grace := os.Getenv("DRAIN_GRACE_PERIOD"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		rtx.Must(err, "Failed to parse DRAIN_GRACE_PERIOD: %q", grace)
+		drainGracePeriod = d
+	}
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		rtx.Must(err, "Failed to parse SESSION_TTL: %q", ttl)
+		sessionTTL = d
+	}
+	if window := os.Getenv("SESSION_REUSE_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		rtx.Must(err, "Failed to parse SESSION_REUSE_WINDOW: %q", window)
+		sessionReuseWindow = d
+	}
+	if window := os.Getenv("BOOT_SUCCESS_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		rtx.Must(err, "Failed to parse BOOT_SUCCESS_WINDOW: %q", window)
+		bootSuccessWindow = d
+	}
+	if size := os.Getenv("METRICS_LIST_PAGE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		rtx.Must(err, "Failed to parse METRICS_LIST_PAGE_SIZE: %q", size)
+		metricsPageSize = n
+	}
+	if retries := os.Getenv("DATASTORE_SAVE_RETRIES"); retries != "" {
+		n, err := strconv.Atoi(retries)
+		rtx.Must(err, "Failed to parse DATASTORE_SAVE_RETRIES: %q", retries)
+		saveRetries = n
+	}
+	// Session IDs use storage.MinSessionByteCount random bytes encoded with the
+	// base64url alphabet, unless SESSION_ID_BYTES or SESSION_ID_ALPHABET ("hex")
+	// is set.
+	byteCount, alphabet := os.Getenv("SESSION_ID_BYTES"), os.Getenv("SESSION_ID_ALPHABET")
+	if byteCount != "" || alphabet != "" {
+		n := storage.MinSessionByteCount
+		if byteCount != "" {
+			var err error
+			n, err = strconv.Atoi(byteCount)
+			rtx.Must(err, "Failed to parse SESSION_ID_BYTES: %q", byteCount)
+		}
+		if alphabet == "" {
+			alphabet = storage.SessionAlphabetBase64URL
+		}
+		rtx.Must(storage.SetSessionIDFormat(n, alphabet), "Failed to configure session IDs")
+	}
 }
 
 // addRoute adds a new handler for a pattern-based URL target to a Gorilla mux.Router.
@@ -117,13 +441,25 @@ func addRoute(router *mux.Router, method, pattern string, handler http.Handler)
 	router.Methods(method).Path(pattern).Handler(handler)
 }
 
+// instrumentStage records the latency of requests to the given boot stage
+// handler in metrics.RequestDuration.
+func instrumentStage(stage string, handler http.HandlerFunc) http.Handler {
+	return promhttp.InstrumentHandlerDuration(
+		metrics.RequestDuration.MustCurryWith(prometheus.Labels{"stage": stage}), handler)
+}
+
 // newRouter creates and initializes all routes for the ePoxy boot server.
 func newRouter(env *handler.Env) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(addVersionHeader)
+	router.Use(handler.TraceContext)
 
 	// A health checker for running in Docker or AppEngine.
 	addRoute(router, "GET", "/_ah/health", http.HandlerFunc(checkHealth))
 
+	// The server build version, also reported in every response header.
+	addRoute(router, "GET", "/version", http.HandlerFunc(serveVersion))
+
 	///////////////////////////////////////////////////////////////////////////
 	// Boot stage targets.
 	//
@@ -135,12 +471,11 @@ func newRouter(env *handler.Env) *mux.Router {
 	// Stage1 scripts are always the first script fetched by a booting machine.
 	// "stage1.ipxe" is the target for ROM-based iPXE clients.
 	addRoute(router, "POST", "/v1/boot/{hostname}/stage1.ipxe",
-		promhttp.InstrumentHandlerDuration(metrics.RequestDuration,
-			http.HandlerFunc(env.GenerateStage1IPXE)))
+		instrumentStage("stage1.ipxe", env.GenerateStage1IPXE))
 
 	// "stage1.json" is the target for native ePoxy clients.
 	addRoute(router, "POST", "/v1/boot/{hostname}/stage1.json",
-		http.HandlerFunc(env.GenerateStage1JSON))
+		instrumentStage("stage1.json", env.GenerateStage1JSON))
 
 	// TODO: make the names stage2 and stage3 arbitrary when we need to support
 	// the case where not every machine has the same stage2 or stage3.
@@ -150,12 +485,15 @@ func newRouter(env *handler.Env) *mux.Router {
 
 	// Stage2, stage3, and report targets load after stage1 runs successfully. Stage2
 	// and stage3 targets return an epoxy action. The report target returns no content.
-	addRoute(router, "POST", "/v1/boot/{hostname}/{sessionID}/stage2",
-		http.HandlerFunc(env.GenerateJSONConfig))
-	addRoute(router, "POST", "/v1/boot/{hostname}/{sessionID}/stage3",
-		http.HandlerFunc(env.GenerateJSONConfig))
-	addRoute(router, "POST", "/v1/boot/{hostname}/{sessionID}/report",
-		http.HandlerFunc(env.ReceiveReport))
+	//
+	// Session-based targets are generated by the server using the API version
+	// configured for the server or Host. So, all API versions are accepted.
+	addRoute(router, "POST", "/{version:v[0-9]+}/boot/{hostname}/{sessionID}/stage2",
+		instrumentStage("stage2", env.GenerateJSONConfig))
+	addRoute(router, "POST", "/{version:v[0-9]+}/boot/{hostname}/{sessionID}/stage3",
+		instrumentStage("stage3", env.GenerateJSONConfig))
+	addRoute(router, "POST", "/{version:v[0-9]+}/boot/{hostname}/{sessionID}/report",
+		instrumentStage("report", env.ReceiveReport))
 
 	///////////////////////////////////////////////////////////////////////////
 	// Extension targets.
@@ -163,15 +501,86 @@ func newRouter(env *handler.Env) *mux.Router {
 	// Extension operations may be requested at any time during boot. The session
 	// is revoked after successful use. Extensions may return any content type
 	// supported by the extension service.
-	addRoute(router, "POST", "/v1/boot/{hostname}/{sessionID}/extension/{operation}",
-		http.HandlerFunc(env.HandleExtension))
+	addRoute(router, "POST", "/{version:v[0-9]+}/boot/{hostname}/{sessionID}/extension/{operation}",
+		instrumentStage("extension", env.HandleExtension))
 
 	// Add proxy for accessing storage, such as GCS.
 	addRoute(router, "GET", "/v1/storage/{path:.*}",
 		http.HandlerFunc(env.HandleStorageProxy))
+
+	// The JSON Schema of nextboot configs, for tooling that validates configs.
+	addRoute(router, "GET", "/v1/schema", http.HandlerFunc(handler.HandleSchema))
+
+	// An HTML overview of all hosts for administrators.
+	addRoute(router, "GET", "/status", http.HandlerFunc(env.HandleStatus))
+
+	// A JSON inventory of all hosts for dashboards, for administrators.
+	addRoute(router, "GET", "/v1/admin/inventory", http.HandlerFunc(env.HandleInventory))
+
+	// Stop accepting new boots before a deploy, for administrators.
+	addRoute(router, "POST", "/drain", http.HandlerFunc(env.HandleDrain))
+
+	// Describe the allowed methods of every route, e.g. for misconfigured clients.
+	addOptionsRoutes(router)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.NotFoundHandler = http.HandlerFunc(routeNotFound)
 	return router
 }
 
+// addOptionsRoutes adds an OPTIONS route for the path of every route in the
+// router, reporting the methods allowed for that path.
+func addOptionsRoutes(router *mux.Router) {
+	var paths []string
+	allowed := map[string][]string{}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		if _, ok := allowed[path]; !ok {
+			paths = append(paths, path)
+		}
+		allowed[path] = append(allowed[path], methods...)
+		return nil
+	})
+	for _, path := range paths {
+		methods := append(allowed[path], http.MethodOptions)
+		sort.Strings(methods)
+		addRoute(router, http.MethodOptions, path, allowMethods(path, methods))
+	}
+}
+
+// allowMethods returns a handler that reports the methods allowed for the
+// route path in the Allow header and response body.
+func allowMethods(path string, methods []string) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Allow", allow)
+		fmt.Fprintf(rw, "Allowed methods for %s: %s\n", path, allow)
+	})
+}
+
+// methodNotAllowed responds to requests for a known path using the wrong
+// method, and suggests how to find the allowed methods.
+func methodNotAllowed(rw http.ResponseWriter, req *http.Request) {
+	metrics.UnmatchedRequests.WithLabelValues(strconv.Itoa(http.StatusMethodNotAllowed)).Inc()
+	http.Error(rw, fmt.Sprintf("Method %s is not allowed for %s; send an OPTIONS request to list the allowed methods",
+		req.Method, req.URL.Path), http.StatusMethodNotAllowed)
+}
+
+// routeNotFound responds to requests for unknown paths, and describes the
+// boot targets, so that misconfigured machines log a useful hint.
+func routeNotFound(rw http.ResponseWriter, req *http.Request) {
+	metrics.UnmatchedRequests.WithLabelValues(strconv.Itoa(http.StatusNotFound)).Inc()
+	http.Error(rw, fmt.Sprintf("No route for %s %s; boot targets start with "+
+		"/v1/boot/{hostname}/stage1.ipxe or /v1/boot/{hostname}/stage1.json",
+		req.Method, req.URL.Path), http.StatusNotFound)
+}
+
 // checkHealth reports whether the server is healthy. checkHealth will
 // typically be registered as the http.Handler for the path "/_ah/health" when
 // running in Docker or AppEngine.
@@ -179,25 +588,81 @@ func checkHealth(rw http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(rw, "ok")
 }
 
+// version is the server build version, e.g. a git tag or commit. It is set at
+// build time using:
+//
+//	-ldflags "-X main.version=$(git describe --tags --always)"
+var version = "development"
+
+// versionHeader is the response header reporting the server build version.
+const versionHeader = "X-Epoxy-Version"
+
+// addVersionHeader is a middleware that reports the server version in the
+// versionHeader of every response.
+func addVersionHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(versionHeader, version)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// serveVersion returns the server build version.
+func serveVersion(rw http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(rw, version)
+}
+
+// metricsListTTL is how long the metrics collectors reuse a host list, which
+// is long enough to serve a single scrape cycle.
+const metricsListTTL = 10 * time.Second
+
 func setupMetrics(dsCfg *storage.DatastoreConfig) {
 	// Note: we use custom collectors to read directly from datastore rather than
 	// instrumenting http handlers because we want to guarantee that metrics are
 	// always available, even after an appengine server restart. These metrics will
 	// be critical for defining alerts on boot failures.
-	prometheus.Register(metrics.NewCollector("epoxy_last_boot", dsCfg))
-	prometheus.Register(metrics.NewCollector("epoxy_last_success", dsCfg))
+	// All collectors share one host list per scrape.
+	hosts := metrics.NewCachedConfig(dsCfg, metricsListTTL)
+	prometheus.Register(metrics.NewSuccessRatioCollector(hosts, bootSuccessWindow))
+	// For large fleets, per-host collectors read hosts in pages instead.
+	if metricsPageSize > 0 {
+		prometheus.Register(metrics.NewPagedCollector("epoxy_last_boot", dsCfg, metricsPageSize))
+		prometheus.Register(metrics.NewPagedCollector("epoxy_last_success", dsCfg, metricsPageSize))
+		return
+	}
+	prometheus.Register(metrics.NewCollector("epoxy_last_boot", hosts))
+	prometheus.Register(metrics.NewCollector("epoxy_last_success", hosts))
 }
 
-func setupLetsEncryptServer(addr string, r http.Handler, hostname string) *http.Server {
-	// We will listen on standard TLS port using LetsEncrypt certificates.
-	m := &autocert.Manager{
+// checkWritableDir creates dir if necessary, and returns an error if files
+// cannot be created in dir.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".writable")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// newCertManager creates a LetsEncrypt certificate manager for hostname that
+// caches certificates in cacheDir.
+func newCertManager(hostname, cacheDir string) *autocert.Manager {
+	return &autocert.Manager{
 		// Certificates are cached to a local directory.
-		Cache: autocert.DirCache("/certs/autocert.cache"),
+		Cache: autocert.DirCache(cacheDir),
 		// The "Let's Encrypt Terms of Service" are accepted automatically.
 		Prompt: autocert.AcceptTOS,
 		// The ePoxy server will only accept TLS host requests from given hostname.
 		HostPolicy: autocert.HostWhitelist(hostname),
 	}
+}
+
+func setupLetsEncryptServer(addr string, r http.Handler, hostname string) *http.Server {
+	// We will listen on standard TLS port using LetsEncrypt certificates.
+	m := newCertManager(hostname, autocertCacheDir)
 	// Server with custom TLS config.
 	return &http.Server{
 		Addr:      addr,
@@ -206,8 +671,15 @@ func setupLetsEncryptServer(addr string, r http.Handler, hostname string) *http.
 	}
 }
 
-func startMetricsServerAsync(dsCfg *storage.DatastoreConfig) {
+func startMetricsServerAsync(dsCfg *storage.DatastoreConfig, extTransport http.RoundTripper) {
 	setupMetrics(dsCfg)
+	// Periodically check that extension services are reachable, so that boot
+	// failures at the extension step are visible before machines reboot.
+	prober := metrics.NewExtensionProber(storage.Extensions.AllURLs(), 10*time.Second)
+	if extTransport != nil {
+		prober.Client.Transport = extTransport
+	}
+	go prober.Run(ctx, extensionProbeInterval)
 	*prometheusx.ListenAddress = ":9000"
 	prometheusx.MustServeMetrics()
 }
@@ -223,6 +695,8 @@ func startAppEngineServerAsync(addr string, router http.Handler) {
 
 func startTLSServerAsync(bindAddr string, router http.Handler, hostname string) {
 	tlsAddr := fmt.Sprintf("%s:%s", bindAddr, tlsPort)
+	err := checkWritableDir(autocertCacheDir)
+	rtx.Must(err, "AUTOCERT_CACHE_DIR must be a writable directory: %q", autocertCacheDir)
 	// Allocate and use LetsEncrypt certificates on given port.
 	tlsServer := setupLetsEncryptServer(tlsAddr, router, hostname)
 	// Certificates are already configured in the server.TLSConfig.
@@ -237,9 +711,32 @@ func startTLSServerAsync(bindAddr string, router http.Handler, hostname string)
 	if serverCert == "" || serverKey == "" {
 		log.Fatalln("WARNING: IPXE_CERT_FILE and IPXE_KEY_FILE were not specified.")
 	}
+	if clientCAFile != "" {
+		config, err := handler.NewClientCertTLSConfig(clientCAFile)
+		rtx.Must(err, "Failed to configure client certificate verification")
+		ipxeServer.TLSConfig = config
+	}
 	httpx.ListenAndServeTLSAsync(ipxeServer, serverCert, serverKey)
 }
 
+// drainOnSignal starts draining d after the first value is received from sigs,
+// then calls shutdown after grace. drainOnSignal returns without draining if
+// ctx is canceled first.
+func drainOnSignal(ctx context.Context, d *handler.Drainer, sigs <-chan os.Signal, grace time.Duration, shutdown func()) {
+	select {
+	case sig := <-sigs:
+		log.Printf("Received %s; shutting down in %s", sig, grace)
+	case <-ctx.Done():
+		return
+	}
+	d.Drain()
+	select {
+	case <-time.After(grace):
+	case <-ctx.Done():
+	}
+	shutdown()
+}
+
 var (
 	// Create a unified context and a cancel method for main(). Allows main to
 	// block until global context is canceled by integration tests.
@@ -247,31 +744,141 @@ var (
 
 	// datastoreNewClient allows unit testing without gcloud credentials.
 	datastoreNewClient = datastore.NewClient
+
+	// metadataProjectURL is the GCE metadata server URL for the project ID.
+	metadataProjectURL = "http://metadata.google.internal/computeMetadata/v1/project/project-id"
 )
 
+// metadataTimeout limits the time spent querying the metadata server, which is
+// unreachable outside of GCE and GKE.
+const metadataTimeout = 5 * time.Second
+
+// metadataProjectID reads the project ID from the GCE metadata server at
+// rawurl.
+func metadataProjectID(ctx context.Context, rawurl string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned status %d", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(b))
+	if id == "" {
+		return "", fmt.Errorf("metadata server returned an empty project ID")
+	}
+	return id, nil
+}
+
+// resolveProjectID reads projectID from the metadata server at rawurl when
+// GCLOUD_PROJECT is unset, and applies it to the configuration that init
+// derived from the environment before the project ID was known.
+func resolveProjectID(ctx context.Context, rawurl string) error {
+	if projectID != "" {
+		return nil
+	}
+	id, err := metadataProjectID(ctx, rawurl)
+	if err != nil {
+		return err
+	}
+	log.Printf("Using project ID %q from the metadata server", id)
+	projectID = id
+	storage.SetProject(projectID)
+	setAppEngineHostname()
+	return nil
+}
+
 func main() {
 	defer cancelCtx()
 
-	if projectID == "" {
-		log.Fatalf("Environment variable GCLOUD_PROJECT must specify a project ID for Datastore.")
+	if err := resolveProjectID(ctx, metadataProjectURL); err != nil {
+		log.Fatalf("Environment variable GCLOUD_PROJECT must specify a project ID for Datastore: %v", err)
 	}
 	if publicHostname == "" {
 		log.Fatalf("Environment variable PUBLIC_HOSTNAME must specify a public service name.")
 	}
+	if publicBaseURL != "" {
+		u, err := url.Parse(publicBaseURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			log.Fatalf("Environment variable PUBLIC_BASE_URL must be an absolute URL: %q", publicBaseURL)
+		}
+	}
+	if len(adminCertSubjects) > 0 && clientCAFile == "" {
+		log.Fatalf("Environment variable ADMIN_CERT_SUBJECTS requires CLIENT_CA_FILE to verify client certificates.")
+	}
+	if stage1FallbackURL != "" {
+		u, err := url.Parse(stage1FallbackURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			log.Fatalf("Environment variable STAGE1_FALLBACK_URL must be an absolute URL: %q", stage1FallbackURL)
+		}
+		template.FallbackStage1URL = stage1FallbackURL
+	}
 
 	client, err := datastoreNewClient(ctx, projectID)
 	rtx.Must(err, "Failed to create new datastore client")
 
-	dsCfg := storage.NewDatastoreConfig(client)
+	dsCfg := storage.NewDatastoreConfig(iface.NewClient(client))
+	dsCfg.MaxCollectedAge = maxCollectedAge
+	if saveRetries >= 0 {
+		dsCfg.SaveRetries = saveRetries
+	}
 	env := &handler.Env{
-		Config:                 dsCfg,
-		ServerAddr:             publicHostname,
-		AllowForwardedRequests: allowForwardedRequests,
-		Project:                projectID,
-		StoragePrefixURL:       storagePrefixURL,
+		Config:                   dsCfg,
+		Groups:                   dsCfg,
+		Hosts:                    dsCfg,
+		ServerAddr:               publicHostname,
+		BaseURL:                  publicBaseURL,
+		APIVersion:               apiVersion,
+		AllowForwardedRequests:   allowForwardedRequests,
+		TrustedProxies:           trustedProxies,
+		Project:                  projectID,
+		StoragePrefixURL:         storagePrefixURL,
+		StorageRegionPrefixURLs:  storageRegionPrefixURLs.Get(),
+		StorageContentTypes:      storageContentTypes.Get(),
+		AdminCredentials:         adminCredentials.Get(),
+		AdminCertSubjects:        adminCertSubjects,
+		ReportExtension:          reportExtension,
+		ExtensionLatencyMetrics:  extensionLatencyMetrics,
+		CompactJSON:              compactJSON,
+		ExtensionFields:          extensionFields,
+		ExtensionRetries:         extensionRetries,
+		ExtensionStatusMap:       extensionStatusMap,
+		MaxExtensionRequestBytes: maxExtensionRequestBytes,
+		ExtensionFlushInterval:   extensionFlushInterval,
+		SessionTTL:               sessionTTL,
+		SessionReuseWindow:       sessionReuseWindow,
+		Drainer:                  handler.NewDrainer(),
+	}
+	if extensionCAFile != "" || extensionCertFile != "" || extensionKeyFile != "" {
+		t, err := handler.NewExtensionTransport(extensionCAFile, extensionCertFile, extensionKeyFile)
+		rtx.Must(err, "Failed to configure extension TLS")
+		env.ExtensionTransport = t
+	}
+	// Audit events are always logged, and optionally saved to Datastore.
+	var auditCfg *storage.DatastoreConfig
+	if auditDatastore {
+		auditCfg = dsCfg
+	}
+	env.Auditor = storage.NewAuditor(os.Stderr, auditCfg)
+	if configSigningKeyFile != "" {
+		key, err := nextboot.LoadPrivateKey(configSigningKeyFile)
+		rtx.Must(err, "Failed to load config signing key")
+		env.SigningKey = key
 	}
 
-	startMetricsServerAsync(dsCfg)
+	startMetricsServerAsync(dsCfg, env.ExtensionTransport)
 	router := handlers.LoggingHandler(os.Stderr, newRouter(env))
 	if service := os.Getenv("GAE_SERVICE"); service != "" {
 		addr := fmt.Sprintf("%s:%s", bindAddress, bindPort)
@@ -281,7 +888,13 @@ func main() {
 		startTLSServerAsync(bindAddress, router, publicHostname)
 	}
 
+	// Refuse new boots after SIGTERM, e.g. during a deploy, and shut down once
+	// in-progress boots had time to complete.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	go drainOnSignal(ctx, env.Drainer, sigs, drainGracePeriod, cancelCtx)
+
 	// All HTTP servers are started asynchronously. Block until global context is
-	// canceled (used by integration tests).
+	// canceled (used by integration tests, and after draining).
 	<-ctx.Done()
 }
@@ -21,12 +21,23 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/gorilla/mux"
+	"github.com/m-lab/epoxy/handler"
+	"github.com/m-lab/epoxy/metrics"
 	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/epoxy/storage/iface"
 	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/api/option"
 )
 
@@ -44,6 +55,455 @@ func TestCheckHealth(t *testing.T) {
 	}
 }
 
+func Test_version(t *testing.T) {
+	origVersion := version
+	defer func() { version = origVersion }()
+	version = "v1.2.3"
+	router := newRouter(&handler.Env{})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+	}{
+		{
+			name:   "version",
+			method: "GET",
+			path:   "/version",
+			want:   "v1.2.3",
+		},
+		{
+			name:   "health",
+			method: "GET",
+			path:   "/_ah/health",
+			want:   "ok",
+		},
+		{
+			name:   "storage-proxy-not-implemented",
+			method: "GET",
+			path:   "/v1/storage/stage1/vmlinuz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if got := rec.Header().Get(versionHeader); got != "v1.2.3" {
+				t.Errorf("%s %s header %s = %q, want %q", tt.method, tt.path, versionHeader, got, "v1.2.3")
+			}
+			if tt.want != "" && rec.Body.String() != tt.want {
+				t.Errorf("%s %s = %q, want %q", tt.method, tt.path, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_newRouter(t *testing.T) {
+	router := newRouter(&handler.Env{})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		match  bool
+	}{
+		{
+			name:   "stage1-v1",
+			method: "POST",
+			path:   "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.ipxe",
+			match:  true,
+		},
+		{
+			name:   "stage2-v1",
+			method: "POST",
+			path:   "/v1/boot/mlab1.foo01.measurement-lab.org/01234/stage2",
+			match:  true,
+		},
+		{
+			name:   "stage2-v2",
+			method: "POST",
+			path:   "/v2/boot/mlab1.foo01.measurement-lab.org/01234/stage2",
+			match:  true,
+		},
+		{
+			name:   "extension-v2",
+			method: "POST",
+			path:   "/v2/boot/mlab1.foo01.measurement-lab.org/01234/extension/allocate_k8s_token",
+			match:  true,
+		},
+		{
+			name:   "schema",
+			method: "GET",
+			path:   "/v1/schema",
+			match:  true,
+		},
+		{
+			name:   "status",
+			method: "GET",
+			path:   "/status",
+			match:  true,
+		},
+		{
+			name:   "drain",
+			method: "POST",
+			path:   "/drain",
+			match:  true,
+		},
+		{
+			name:   "inventory",
+			method: "GET",
+			path:   "/v1/admin/inventory",
+			match:  true,
+		},
+		{
+			name:   "stage2-bad-version",
+			method: "POST",
+			path:   "/latest/boot/mlab1.foo01.measurement-lab.org/01234/stage2",
+			match:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			m := &mux.RouteMatch{}
+			// With a NotFoundHandler, Match succeeds without a Route for unknown paths.
+			if got := router.Match(req, m) && m.Route != nil; got != tt.match {
+				t.Errorf("newRouter() Match(%q) = %t, want %t", tt.path, got, tt.match)
+			}
+		})
+	}
+}
+
+func Test_metadataProjectID(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   "mlab-sandbox\n",
+			want:   "mlab-sandbox",
+		},
+		{
+			name:    "error-status",
+			status:  http.StatusNotFound,
+			wantErr: true,
+		},
+		{
+			name:    "empty-project",
+			status:  http.StatusOK,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The metadata server rejects requests without this header.
+				if r.Header.Get("Metadata-Flavor") != "Google" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer ts.Close()
+
+			got, err := metadataProjectID(context.Background(), ts.URL+"/computeMetadata/v1/project/project-id")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("metadataProjectID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("metadataProjectID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	// An unreachable metadata server is an error.
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	if _, err := metadataProjectID(context.Background(), ts.URL); err == nil {
+		t.Errorf("metadataProjectID() with unreachable server returned nil error")
+	}
+}
+
+func Test_resolveProjectID(t *testing.T) {
+	origProject, origHostname, origExtensions := projectID, publicHostname, storage.Extensions
+	defer func() {
+		projectID, publicHostname, storage.Extensions = origProject, origHostname, origExtensions
+	}()
+	// GCLOUD_PROJECT is unset, so init did not format extension URLs or derive
+	// the AppEngine hostname.
+	projectID, publicHostname = "", ""
+	storage.Extensions = storage.NewExtensionRegistry(map[string]string{
+		"allocate_k8s_token": "http://epoxy-extension-server.%s.measurementlab.net:8800/v2/allocate_k8s_token",
+	})
+	os.Setenv("GAE_SERVICE", "boot-api")
+	defer os.Unsetenv("GAE_SERVICE")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "mlab-sandbox")
+	}))
+	defer ts.Close()
+
+	if err := resolveProjectID(context.Background(), ts.URL); err != nil {
+		t.Fatalf("resolveProjectID() error = %v", err)
+	}
+	if projectID != "mlab-sandbox" {
+		t.Errorf("resolveProjectID() projectID = %q, want %q", projectID, "mlab-sandbox")
+	}
+	if want := "boot-api-dot-mlab-sandbox.appspot.com"; publicHostname != want {
+		t.Errorf("resolveProjectID() publicHostname = %q, want %q", publicHostname, want)
+	}
+	want := "http://epoxy-extension-server.mlab-sandbox.measurementlab.net:8800/v2/allocate_k8s_token"
+	if got, _ := storage.Extensions.Get("allocate_k8s_token"); got != want {
+		t.Errorf("resolveProjectID() extension URL = %q, want %q", got, want)
+	}
+
+	// A project ID from the environment is used without the metadata server.
+	ts.Close()
+	if err := resolveProjectID(context.Background(), ts.URL); err != nil {
+		t.Errorf("resolveProjectID() with project ID set returned error = %v", err)
+	}
+}
+
+func Test_newCertManager(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "autocert.cache")
+	if err := checkWritableDir(dir); err != nil {
+		t.Fatalf("checkWritableDir() = %v, want nil", err)
+	}
+	m := newCertManager("epoxy.example.com", dir)
+	if m.Cache != autocert.DirCache(dir) {
+		t.Fatalf("newCertManager() Cache = %#v, want %q", m.Cache, dir)
+	}
+	// Certificates are saved to the configured directory.
+	if err := m.Cache.Put(context.Background(), "epoxy.example.com", []byte("cert")); err != nil {
+		t.Fatalf("Cache.Put() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "epoxy.example.com")); err != nil {
+		t.Errorf("Cache.Put() did not write to %s: %v", dir, err)
+	}
+}
+
+func Test_checkWritableDir(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A file is not a directory.
+	if err := checkWritableDir(file); err == nil {
+		t.Errorf("checkWritableDir(%q) = nil, want error", file)
+	}
+	if err := checkWritableDir(t.TempDir()); err != nil {
+		t.Errorf("checkWritableDir() = %v, want nil", err)
+	}
+}
+
+func Test_drainOnSignal(t *testing.T) {
+	tests := []struct {
+		name         string
+		signal       bool
+		wantDraining bool
+		wantShutdown bool
+	}{
+		{
+			name:         "signal-drains-then-shuts-down",
+			signal:       true,
+			wantDraining: true,
+			wantShutdown: true,
+		},
+		{
+			name: "canceled-without-signal",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			d := handler.NewDrainer()
+			sigs := make(chan os.Signal, 1)
+			shutdown := false
+			if tt.signal {
+				sigs <- syscall.SIGTERM
+			} else {
+				cancel()
+			}
+
+			drainOnSignal(ctx, d, sigs, time.Millisecond, func() { shutdown = true })
+
+			if d.Draining() != tt.wantDraining || shutdown != tt.wantShutdown {
+				t.Errorf("drainOnSignal() draining = %t, shutdown = %t; want %t, %t",
+					d.Draining(), shutdown, tt.wantDraining, tt.wantShutdown)
+			}
+		})
+	}
+}
+
+func Test_newRouterStageMetrics(t *testing.T) {
+	// The fake fails every Get, so every stage responds with 404.
+	env := &handler.Env{
+		Config: storage.NewDatastoreConfig(&fakeDatastoreClient{}),
+	}
+	router := newRouter(env)
+	tests := []struct {
+		stage string
+		path  string
+	}{
+		{stage: "stage1.ipxe", path: "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.ipxe"},
+		{stage: "stage1.json", path: "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.json"},
+		{stage: "stage2", path: "/v1/boot/mlab1.foo01.measurement-lab.org/01234/stage2"},
+		{stage: "stage3", path: "/v1/boot/mlab1.foo01.measurement-lab.org/01234/stage3"},
+		{stage: "report", path: "/v1/boot/mlab1.foo01.measurement-lab.org/01234/report"},
+		{stage: "extension", path: "/v1/boot/mlab1.foo01.measurement-lab.org/01234/extension/op"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stage, func(t *testing.T) {
+			count := func() uint64 {
+				m := &dto.Metric{}
+				obs := metrics.RequestDuration.WithLabelValues(tt.stage, "404")
+				if err := obs.(prometheus.Histogram).Write(m); err != nil {
+					t.Fatal(err)
+				}
+				return m.GetHistogram().GetSampleCount()
+			}
+			before := count()
+			req := httptest.NewRequest("POST", tt.path, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("POST %s status = %d, want %d", tt.path, rec.Code, http.StatusNotFound)
+			}
+			if after := count(); after != before+1 {
+				t.Errorf("RequestDuration for %s recorded %d requests, want 1", tt.stage, after-before)
+			}
+		})
+	}
+}
+
+func Test_newRouterUnmatched(t *testing.T) {
+	router := newRouter(&handler.Env{})
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "unknown-path",
+			method:   "POST",
+			path:     "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.efi",
+			wantCode: http.StatusNotFound,
+			wantBody: "No route for POST /v1/boot/mlab1.foo01.measurement-lab.org/stage1.efi; " +
+				"boot targets start with /v1/boot/{hostname}/stage1.ipxe or /v1/boot/{hostname}/stage1.json\n",
+		},
+		{
+			name:     "wrong-method",
+			method:   "GET",
+			path:     "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.ipxe",
+			wantCode: http.StatusMethodNotAllowed,
+			wantBody: "Method GET is not allowed for /v1/boot/mlab1.foo01.measurement-lab.org/stage1.ipxe; " +
+				"send an OPTIONS request to list the allowed methods\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := metrics.UnmatchedRequests.WithLabelValues(fmt.Sprint(tt.wantCode))
+			before := testutil.ToFloat64(counter)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, rec.Code, tt.wantCode)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("%s %s body = %q, want %q", tt.method, tt.path, got, tt.wantBody)
+			}
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("UnmatchedRequests{code=%d} increased by %v, want 1", tt.wantCode, got)
+			}
+		})
+	}
+}
+
+func Test_newRouterOptions(t *testing.T) {
+	router := newRouter(&handler.Env{})
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantCode  int
+		wantAllow string
+	}{
+		{
+			name:      "stage1-ipxe",
+			method:    "OPTIONS",
+			path:      "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.ipxe",
+			wantCode:  http.StatusOK,
+			wantAllow: "OPTIONS, POST",
+		},
+		{
+			name:      "stage1-json",
+			method:    "OPTIONS",
+			path:      "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.json",
+			wantCode:  http.StatusOK,
+			wantAllow: "OPTIONS, POST",
+		},
+		{
+			name:      "stage2",
+			method:    "OPTIONS",
+			path:      "/v2/boot/mlab1.foo01.measurement-lab.org/01234/stage2",
+			wantCode:  http.StatusOK,
+			wantAllow: "OPTIONS, POST",
+		},
+		{
+			name:      "stage3",
+			method:    "OPTIONS",
+			path:      "/v1/boot/mlab1.foo01.measurement-lab.org/01234/stage3",
+			wantCode:  http.StatusOK,
+			wantAllow: "OPTIONS, POST",
+		},
+		{
+			name:      "storage",
+			method:    "OPTIONS",
+			path:      "/v1/storage/stage1/vmlinuz",
+			wantCode:  http.StatusOK,
+			wantAllow: "GET, OPTIONS",
+		},
+		{
+			name:     "wrong-method-suggests-options",
+			method:   "GET",
+			path:     "/v1/boot/mlab1.foo01.measurement-lab.org/01234/stage2",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "unknown-path",
+			method:   "OPTIONS",
+			path:     "/v1/unknown",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("%s %s Allow = %q, want %q", tt.method, tt.path, got, tt.wantAllow)
+			}
+			if tt.wantCode == http.StatusMethodNotAllowed && !strings.Contains(rec.Body.String(), "OPTIONS") {
+				t.Errorf("%s %s body = %q, want OPTIONS guidance", tt.method, tt.path, rec.Body.String())
+			}
+		})
+	}
+}
+
 // fakeDatastoreClient implements the datastoreClient interface for testing.
 // Every operation should be successful.
 type fakeDatastoreClient struct {
@@ -56,12 +516,21 @@ func (f *fakeDatastoreClient) Get(ctx context.Context, key *datastore.Key, dst i
 func (f *fakeDatastoreClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
 	return nil, fmt.Errorf("this fake does not support Put()")
 }
+func (f *fakeDatastoreClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return nil, fmt.Errorf("this fake does not support PutMulti()")
+}
 func (f *fakeDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
 	// Extract the pointer to a list of *storage.Host, and append f.host to the list.
 	hosts, _ := dst.(*[]*storage.Host)
 	*hosts = append(*hosts, f.host)
 	return nil, nil
 }
+func (f *fakeDatastoreClient) Delete(ctx context.Context, key *datastore.Key) error {
+	return fmt.Errorf("this fake does not support Delete()")
+}
+func (f *fakeDatastoreClient) RunInTransaction(ctx context.Context, fn func(tx iface.Transaction) error) error {
+	return fmt.Errorf("this fake does not support RunInTransaction()")
+}
 
 func Test_setupMetricsHandler(t *testing.T) {
 	dsCfg := &storage.DatastoreConfig{
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/epoxy/nextboot"
+)
+
+// logEvent is a single JSON log line written when -log-json is set.
+type logEvent struct {
+	Time     string  `json:"time"`
+	Message  string  `json:"message,omitempty"`
+	Stage    string  `json:"stage,omitempty"`
+	Action   string  `json:"action,omitempty"`
+	Result   string  `json:"result,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+}
+
+// jsonLogWriter writes log output as JSON lines. The log package calls Write
+// once for each message, so every message becomes one logEvent.
+type jsonLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write writes message p as a logEvent.
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	err := j.writeEvent(logEvent{Message: strings.TrimRight(string(p), "\n")})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeEvent writes e as a single JSON line, setting the current time.
+func (j *jsonLogWriter) writeEvent(e logEvent) error {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(append(b, '\n'))
+	return err
+}
+
+// jsonLog is the destination for structured logs, or nil for plaintext logs.
+var jsonLog *jsonLogWriter
+
+// setupLogging directs all log output to w. If asJSON is true, logs are
+// written as JSON lines. Otherwise, the standard plaintext format is used.
+func setupLogging(w io.Writer, asJSON bool) {
+	if !asJSON {
+		jsonLog = nil
+		log.SetOutput(w)
+		return
+	}
+	jsonLog = &jsonLogWriter{w: w}
+	// Timestamps are part of every logEvent.
+	log.SetFlags(0)
+	log.SetOutput(jsonLog)
+}
+
+// logResult logs the result and duration of running the given action.
+func logResult(c *nextboot.Config, action string, duration time.Duration, runErr error) {
+	result := "success"
+	if runErr != nil {
+		result = "error: " + runErr.Error()
+	}
+	if jsonLog == nil {
+		log.Printf("Action %s finished after %s: %s", action, duration, result)
+		return
+	}
+	jsonLog.writeEvent(logEvent{
+		Stage:    strings.TrimPrefix(action, "epoxy."),
+		Action:   nextboot.RedactKarg(action, c.Kargs[action]),
+		Result:   result,
+		Duration: duration.Seconds(),
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy/nextboot"
+)
+
+func Test_setupLogging(t *testing.T) {
+	tests := []struct {
+		name      string
+		runErr    error
+		wantEvent logEvent
+	}{
+		{
+			name:   "success",
+			runErr: nil,
+			wantEvent: logEvent{
+				Stage:    "stage2",
+				Action:   "https://epoxy.example.com/stage2",
+				Result:   "success",
+				Duration: 2,
+			},
+		},
+		{
+			name:   "error",
+			runErr: errors.New("download failed"),
+			wantEvent: logEvent{
+				Stage:    "stage2",
+				Action:   "https://epoxy.example.com/stage2",
+				Result:   "error: download failed",
+				Duration: 2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			setupLogging(&buf, true)
+			defer func() {
+				setupLogging(ioutil.Discard, false)
+				log.SetFlags(log.LstdFlags)
+			}()
+
+			c := &nextboot.Config{Kargs: map[string]string{"epoxy.stage2": "https://epoxy.example.com/stage2"}}
+			log.Print("Selected action: epoxy.stage2")
+			logResult(c, "epoxy.stage2", 2*time.Second, tt.runErr)
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("setupLogging() wrote %d lines, want 2: %q", len(lines), buf.String())
+			}
+			events := make([]logEvent, len(lines))
+			for i, line := range lines {
+				if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+					t.Fatalf("setupLogging() wrote invalid JSON line %q: %v", line, err)
+				}
+				if events[i].Time == "" {
+					t.Errorf("setupLogging() wrote line without time: %q", line)
+				}
+				events[i].Time = ""
+			}
+			if want := (logEvent{Message: "Selected action: epoxy.stage2"}); events[0] != want {
+				t.Errorf("setupLogging() message event = %#v, want %#v", events[0], want)
+			}
+			if events[1] != tt.wantEvent {
+				t.Errorf("logResult() event = %#v, want %#v", events[1], tt.wantEvent)
+			}
+		})
+	}
+}
+
+func Test_logResultRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	setupLogging(&buf, true)
+	defer func() {
+		setupLogging(ioutil.Discard, false)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	c := &nextboot.Config{Kargs: map[string]string{"epoxy.bmc_store_password": "s3cr3t"}}
+	logResult(c, "epoxy.bmc_store_password", time.Second, nil)
+
+	var event logEvent
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("logResult() wrote invalid JSON %q: %v", buf.String(), err)
+	}
+	if event.Action != "[REDACTED]" {
+		t.Errorf("logResult() action = %q, want %q", event.Action, "[REDACTED]")
+	}
+}
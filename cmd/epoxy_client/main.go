@@ -5,13 +5,22 @@
 // network is initialized, epoxy_client can complete actions for the current
 // boot stage. i.e. download config from epoxy, download kernel for stage3,
 // kexec kernel.
+//
+// For air-gapped or lab testing, the action and report kernel parameters may
+// name local files using "file://" URLs or absolute paths. In that case, the
+// whole boot flow runs without an ePoxy server and reports are skipped.
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/m-lab/epoxy/nextboot"
@@ -20,11 +29,18 @@ import (
 
 const timeout = 6 * time.Hour
 
+// retryDelay is the time to wait between failed attempts to run an action.
+var retryDelay = time.Minute
+
+// reportRetryDelay is the time to wait between failed attempts to report success.
+var reportRetryDelay = 10 * time.Second
+
 var (
 	flagCmdline = flag.String("cmdline", "/proc/cmdline",
 		"Read kernel cmdline parameters from the contents of this file.")
 	flagAction = flag.String("action", "epoxy.stage2",
-		"Execute the config loaded from the URL in this kernel parameter.")
+		"Execute the config loaded from the URL in this kernel parameter. "+
+			"The epoxy.run kernel parameter, e.g. epoxy.run=stage3, overrides this flag.")
 	flagAddKargs = flag.Bool("add-kargs", false,
 		"Combine the local kargs with those returned from the action url. "+
 			"Existing kargs are never replaced. Only useful for stage1.")
@@ -32,61 +48,315 @@ var (
 		"Report success or errors with the URL in this kernel parameter.")
 	flagDryrun = flag.Bool("dryrun", false,
 		"Request all configs but do not run commands. May change state in the ePoxy server.")
-	flagRetry = flag.Bool("retry", true, "Retry in case of failure.")
+	flagRetry          = flag.Bool("retry", true, "Retry in case of failure.")
+	flagReportProgress = flag.Bool("report-progress", false,
+		"Report progress with the -report URL after loading each chained config.")
+	flagFallback = flag.String("fallback", "epoxy.fallback",
+		"After repeated failures, execute the config loaded from the URL in this kernel "+
+			"parameter instead of rebooting, e.g. to boot a recovery environment.")
+	flagFallbackAfter = flag.Int("fallback-after", 3,
+		"Number of consecutive failures before running the -fallback action. Zero disables the fallback.")
+	flagRunExtensions = flag.Bool("run-extensions", false,
+		"Before the action, run the extensions listed in the epoxy.extensions kernel parameter, in order.")
+	flagMaxChainHops = flag.Int("max-chain-hops", nextboot.DefaultMaxChainHops,
+		"Maximum number of chained configs to load for one action.")
+	flagMaxConfigBytes = flag.Int64("max-config-bytes", nextboot.DefaultMaxConfigBytes,
+		"Maximum size of each config loaded for one action. Larger configs are rejected.")
+	flagReportMarker = flag.String("report-marker", "/tmp/epoxy_client.success",
+		"Record successful actions in this file until the report is delivered. Empty disables the marker.")
+	flagReportTimeout = flag.Duration("report-timeout", 10*time.Minute,
+		"Retry reporting success until this much time has passed.")
+	flagReportRequestTimeout = flag.Duration("report-request-timeout", nextboot.DefaultReportTimeout,
+		"Time limit for each report request, independent of action timeouts.")
+	flagLoadTimeout = flag.Duration("load-timeout", nextboot.DefaultLoadTimeout,
+		"Time limit for each config and manifest download.")
+	flagFatalReport = flag.String("fatal-report", "",
+		"Comma separated list of actions, e.g. epoxy.stage3, for which an undelivered success report is a failure.")
+	flagLogJSON = flag.Bool("log-json", false,
+		"Write logs as JSON lines, including the stage, action, result, and duration of each action run.")
+	flagPreflightTimeout = flag.Duration("preflight-timeout", 30*time.Second,
+		"Before each action, check that the action URL server is reachable within this time. Zero disables the check.")
+	flagCmdlineTimeout = flag.Duration("cmdline-timeout", 10*time.Second,
+		"Time limit for reading the -cmdline file.")
+	flagSelftest = flag.Bool("selftest", false,
+		"Check that configs can be evaluated and files downloaded in this environment, then exit without rebooting.")
+	flagPublicKey = flag.String("public-key", "",
+		"PEM file with the pinned Ed25519 public key of the ePoxy server. When set, unsigned or forged configs are rejected.")
 )
 
 func main() {
-	var result string
-	var runErr error
-
 	flag.Parse()
-	c := &nextboot.Config{}
+	setupLogging(os.Stderr, *flagLogJSON)
+	c := &nextboot.Config{
+		MaxChainHops:   *flagMaxChainHops,
+		MaxConfigBytes: *flagMaxConfigBytes,
+		ReportTimeout:  *flagReportRequestTimeout,
+		LoadTimeout:    *flagLoadTimeout,
+	}
+	if *flagReportProgress {
+		c.ProgressReport = *flagReport
+	}
+	if *flagPublicKey != "" {
+		key, err := nextboot.LoadPublicKey(*flagPublicKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.PublicKey = key
+	}
 
-	b, err := ioutil.ReadFile(*flagCmdline)
+	b, err := readCmdline(*flagCmdline, *flagCmdlineTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
 	// Read and parse parameters from *flagCmdline.
 	c.ParseCmdline(string(b))
 
-	deadline := time.Now().Add(timeout)
+	if *flagSelftest {
+		if err := selftest(os.Stdout, c.Kargs); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Kernel parameters may select a different action than the flag.
+	action := c.SelectAction(*flagAction)
+	log.Println("Selected action:", action)
+
+	// If the run step failed, reboot the machine
+	if runErr := run(c, action); runErr != nil {
+		reboot()
+	}
+}
+
+// run runs the given action with runActions, unless a previous run of the same
+// action already succeeded but the report was not delivered. In that case, run
+// only retries the success report.
+func run(c *nextboot.Config, action string) error {
+	if pendingReport(c, action) {
+		log.Println("Found success marker; retrying report")
+		err := reportSuccess(c, action, url.Values{"message": {"success"}})
+		return checkReport(action, err)
+	}
+	return runActions(c, action)
+}
 
+// runActions runs the given action, retrying after failures until it succeeds,
+// retries are disabled, or enough time has passed. If the -fallback kernel
+// parameter is present, the fallback action runs once after -fallback-after
+// consecutive failures, instead of retrying further. runActions returns the
+// error from the last action run. For actions listed in -fatal-report, an
+// undelivered success report is returned as an error, without retrying.
+func runActions(c *nextboot.Config, action string) error {
+	deadline := time.Now().Add(timeout)
+	failures := 0
 	for {
-		// Run the config loaded from the action URL.
-		runErr = c.Run(*flagAction, *flagAddKargs, *flagDryrun)
-		if runErr != nil {
-			// Define a successful result.
-			result = "error: " + runErr.Error()
-		} else {
-			result = "success"
+		// Run any extensions, then the config loaded from the action URL.
+		runErr := runExtensions(c)
+		if runErr == nil {
+			runErr = runAction(c, action, *flagAddKargs)
+		}
+		reportErr := report(c, action, runErr)
+		if runErr == nil {
+			return checkReport(action, reportErr)
+		}
+		failures++
+
+		_, hasFallback := c.Kargs[*flagFallback]
+		if hasFallback && *flagFallbackAfter > 0 && failures >= *flagFallbackAfter {
+			log.Printf("Running fallback action %s after %d consecutive failures",
+				*flagFallback, failures)
+			runErr = runAction(c, *flagFallback, false)
+			reportErr := report(c, *flagFallback, runErr)
+			if runErr == nil {
+				return checkReport(*flagFallback, reportErr)
+			}
+			return runErr
 		}
-		log.Println("Result:", result)
 
-		// Report a message to the ePoxy server after running.
-		values := url.Values{}
-		// TODO: report additional host information.
-		// TODO: log the evaluate state of c.V1 -- helpful especially for errors.
-		values.Set("message", result)
+		// Stop the retry loop if the -no-retry flag has been provided,
+		// or enough time has passed.
+		if !*flagRetry || time.Now().After(deadline) {
+			return runErr
+		}
+
+		log.Printf("Waiting %s before retrying...", retryDelay)
+		time.Sleep(retryDelay)
+	}
+}
 
-		err = c.Report(*flagReport, values, *flagDryrun)
+// runAction runs the config loaded from the URL in the action kernel parameter
+// and logs the result. When -preflight-timeout is set, runAction first checks
+// that the server of the action URL is reachable.
+func runAction(c *nextboot.Config, action string, addKargs bool) error {
+	start := time.Now()
+	var err error
+	if *flagPreflightTimeout > 0 {
+		err = preflight(c.Kargs[action], *flagPreflightTimeout)
 		if err != nil {
-			log.Print(err)
+			log.Printf("Pre-flight check failed for %s: %v", action, err)
 		}
+	}
+	if err == nil {
+		err = c.Run(action, addKargs, *flagDryrun)
+	}
+	logResult(c, action, time.Since(start), err)
+	return err
+}
 
-		// Stop the retry loop if the -no-retry flag has been provided,
-		// the last execution succeeded or enough time has passed.
-		if !*flagRetry || runErr == nil || time.Now().After(deadline) {
-			break
+// runExtensions runs the config loaded from the URL of each extension listed
+// in the epoxy.extensions kernel parameter, in order, if -run-extensions is
+// set. runExtensions stops at the first error.
+func runExtensions(c *nextboot.Config) error {
+	if !*flagRunExtensions {
+		return nil
+	}
+	for _, operation := range c.Extensions() {
+		log.Println("Running extension:", operation)
+		err := runAction(c, "epoxy."+operation, false)
+		if err != nil {
+			return fmt.Errorf("extension %s: %v", operation, err)
 		}
+	}
+	return nil
+}
 
-		log.Println("Waiting 1 minute before retrying...")
-		time.Sleep(1 * time.Minute)
+// fatalReport returns true if action is listed in the -fatal-report flag.
+func fatalReport(action string) bool {
+	for _, a := range strings.Split(*flagFatalReport, ",") {
+		if strings.TrimSpace(a) == action {
+			return true
+		}
 	}
+	return false
+}
 
-	// If the run step failed, reboot the machine
+// checkReport returns an error if reportErr is not nil and action is listed in
+// the -fatal-report flag. Otherwise the report error is ignored.
+func checkReport(action string, reportErr error) error {
+	if reportErr == nil || !fatalReport(action) {
+		return nil
+	}
+	return fmt.Errorf("failed to report success of %s: %v", action, reportErr)
+}
+
+// report sends the result of running action to the -report URL, and returns
+// any error from delivering the report.
+func report(c *nextboot.Config, action string, runErr error) error {
+	var result string
 	if runErr != nil {
-		reboot()
+		result = "error: " + runErr.Error()
+	} else {
+		// Define a successful result.
+		result = "success"
+	}
+	log.Println("Result:", result)
+
+	// Report a message to the ePoxy server after running.
+	values := url.Values{}
+	// TODO: report additional host information.
+	// TODO: log the evaluate state of c.V1 -- helpful especially for errors.
+	values.Set("message", result)
+	// Include the tail of output from a failed command.
+	var cmdErr *nextboot.CommandError
+	if errors.As(runErr, &cmdErr) {
+		values.Set("output", cmdErr.Output)
+	}
+
+	if runErr == nil {
+		// A lost success report leaves UpdateEnabled set in the ePoxy server,
+		// so retry until the report lands.
+		return reportSuccess(c, action, values)
+	}
+	err := c.Report(*flagReport, values, *flagDryrun)
+	if err != nil {
+		log.Print(err)
+	}
+	return err
+}
+
+// reportSuccess records the success of action in the -report-marker file, then
+// retries the report, independently of the action retry loop, until it is
+// delivered or -report-timeout has passed. The marker is removed once the
+// report lands.
+func reportSuccess(c *nextboot.Config, action string, values url.Values) error {
+	if *flagReportMarker != "" {
+		err := ioutil.WriteFile(*flagReportMarker, []byte(reportMarker(c, action)), 0644)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	deadline := time.Now().Add(*flagReportTimeout)
+	for {
+		err := c.Report(*flagReport, values, *flagDryrun)
+		if err == nil {
+			if *flagReportMarker != "" {
+				os.Remove(*flagReportMarker)
+			}
+			return nil
+		}
+		log.Print(err)
+		if time.Now().After(deadline) {
+			return err
+		}
+		log.Printf("Waiting %s before retrying report...", reportRetryDelay)
+		time.Sleep(reportRetryDelay)
+	}
+}
+
+// maxCmdlineBytes is the largest number of bytes read from the -cmdline file.
+const maxCmdlineBytes = 64 * 1024
+
+// readCmdline returns up to maxCmdlineBytes of the contents of the file at
+// path, or an error if the file cannot be read within timeout. On a broken
+// initramfs, reading /proc/cmdline could otherwise block forever.
+func readCmdline(path string, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		b   []byte
+		err error
+	}
+	// The channel is buffered so a blocked read does not leak a goroutine
+	// waiting to send after the timeout.
+	done := make(chan result, 1)
+	go func() {
+		f, err := os.Open(path)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer f.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(f, maxCmdlineBytes))
+		done <- result{b: b, err: err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to read kernel cmdline from %s: %w", path, r.err)
+		}
+		return r.b, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %s reading kernel cmdline from %s", timeout, path)
+	}
+}
+
+// reportMarker returns the contents of the -report-marker file for a successful
+// run of action. The marker names the action and the report URL, which is
+// unique to this boot session.
+func reportMarker(c *nextboot.Config, action string) string {
+	return action + "\n" + c.Kargs[*flagReport] + "\n"
+}
+
+// pendingReport returns true if the -report-marker file records a successful
+// run of action for the current report URL.
+func pendingReport(c *nextboot.Config, action string) bool {
+	if *flagReportMarker == "" {
+		return false
+	}
+	b, err := ioutil.ReadFile(*flagReportMarker)
+	if err != nil {
+		return false
 	}
+	_, ok := c.Kargs[*flagReport]
+	return ok && string(b) == reportMarker(c, action)
 }
 
 func reboot() {
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy/nextboot"
+)
+
+func init() {
+	// Disable log output.
+	log.SetOutput(ioutil.Discard)
+	// Do not wait between retries.
+	retryDelay = 0
+	reportRetryDelay = 0
+	// Do not write success markers, except in tests that set a path.
+	*flagReportMarker = ""
+}
+
+// newActionServer returns a server that counts requests in count and responds
+// with status and a minimal config that runs one command.
+func newActionServer(status int, count *int32) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(count, 1)
+			w.WriteHeader(status)
+			c := &nextboot.Config{V1: &nextboot.V1{Commands: []interface{}{"true"}}}
+			fmt.Fprint(w, c.String())
+		}))
+}
+
+func Test_runActions(t *testing.T) {
+	tests := []struct {
+		name          string
+		actionStatus  int
+		fallback      bool
+		retry         bool
+		wantActions   int32
+		wantFallbacks int32
+		wantErr       bool
+	}{
+		{
+			name:         "success-without-fallback",
+			actionStatus: http.StatusOK,
+			fallback:     true,
+			retry:        true,
+			wantActions:  1,
+		},
+		{
+			name:          "fallback-after-threshold",
+			actionStatus:  http.StatusInternalServerError,
+			fallback:      true,
+			retry:         true,
+			wantActions:   3,
+			wantFallbacks: 1,
+		},
+		{
+			name:         "no-retry-before-threshold",
+			actionStatus: http.StatusInternalServerError,
+			fallback:     true,
+			retry:        false,
+			wantActions:  1,
+			wantErr:      true,
+		},
+		{
+			name:         "no-fallback-karg",
+			actionStatus: http.StatusInternalServerError,
+			retry:        false,
+			wantActions:  1,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actions, fallbacks, reports int32
+			tsAction := newActionServer(tt.actionStatus, &actions)
+			defer tsAction.Close()
+			tsFallback := newActionServer(http.StatusOK, &fallbacks)
+			defer tsFallback.Close()
+			tsReport := newActionServer(http.StatusNoContent, &reports)
+			defer tsReport.Close()
+
+			*flagRetry = tt.retry
+			*flagFallbackAfter = 3
+			c := &nextboot.Config{
+				Kargs: map[string]string{
+					"epoxy.stage2": tsAction.URL,
+					"epoxy.report": tsReport.URL,
+				},
+			}
+			if tt.fallback {
+				c.Kargs["epoxy.fallback"] = tsFallback.URL
+			}
+
+			err := runActions(c, "epoxy.stage2")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runActions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if actions != tt.wantActions {
+				t.Errorf("runActions() ran action %d times, want %d", actions, tt.wantActions)
+			}
+			if fallbacks != tt.wantFallbacks {
+				t.Errorf("runActions() ran fallback %d times, want %d", fallbacks, tt.wantFallbacks)
+			}
+			// Every action and fallback run is reported.
+			if reports != tt.wantActions+tt.wantFallbacks {
+				t.Errorf("runActions() sent %d reports, want %d", reports, tt.wantActions+tt.wantFallbacks)
+			}
+		})
+	}
+}
+
+func Test_readCmdline(t *testing.T) {
+	dir := t.TempDir()
+	cmdline := filepath.Join(dir, "cmdline")
+	want := "epoxy.stage2=https://epoxy.example.com/v1/boot/stage2 epoxy.report=https://epoxy.example.com/v1/boot/report\n"
+	if err := ioutil.WriteFile(cmdline, []byte(want), 0644); err != nil {
+		t.Fatal(err)
+	}
+	large := filepath.Join(dir, "large")
+	if err := ioutil.WriteFile(large, make([]byte, 2*maxCmdlineBytes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		wantLen int
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			path:    cmdline,
+			wantLen: len(want),
+		},
+		{
+			name:    "large-file-is-truncated",
+			path:    large,
+			wantLen: maxCmdlineBytes,
+		},
+		{
+			name:    "missing-file",
+			path:    filepath.Join(dir, "missing"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := readCmdline(tt.path, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCmdline() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if len(b) != tt.wantLen {
+				t.Errorf("readCmdline() returned %d bytes; want %d", len(b), tt.wantLen)
+			}
+			if tt.path == cmdline && string(b) != want {
+				t.Errorf("readCmdline() = %q; want %q", b, want)
+			}
+		})
+	}
+}
+
+func Test_runExtensions(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			order = append(order, r.URL.Path)
+			mu.Unlock()
+			c := &nextboot.Config{V1: &nextboot.V1{Commands: []interface{}{"true"}}}
+			fmt.Fprint(w, c.String())
+		}))
+	defer ts.Close()
+
+	*flagRunExtensions = true
+	defer func() { *flagRunExtensions = false }()
+	c := &nextboot.Config{
+		Kargs: map[string]string{
+			"epoxy.extensions": "op2,op1,op3",
+			"epoxy.op1":        ts.URL + "/op1",
+			"epoxy.op2":        ts.URL + "/op2",
+			"epoxy.op3":        ts.URL + "/op3",
+		},
+	}
+
+	err := runExtensions(c)
+	if err != nil {
+		t.Fatalf("runExtensions() error = %v, want nil", err)
+	}
+	want := []string{"/op2", "/op1", "/op3"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("runExtensions() ran %q, want %q", order, want)
+	}
+
+	// A missing extension URL stops the sequence.
+	order = nil
+	delete(c.Kargs, "epoxy.op1")
+	err = runExtensions(c)
+	if err == nil {
+		t.Errorf("runExtensions() error = nil, want error")
+	}
+	if want := []string{"/op2"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("runExtensions() ran %q, want %q", order, want)
+	}
+}
+
+func Test_runActionsFatalReport(t *testing.T) {
+	tests := []struct {
+		name         string
+		fatalReport  string
+		reportStatus int
+		wantActions  int32
+		wantErr      bool
+	}{
+		{
+			name:         "report-failure-is-not-fatal-by-default",
+			reportStatus: http.StatusInternalServerError,
+			wantActions:  1,
+		},
+		{
+			name:         "report-failure-is-fatal-for-listed-action",
+			fatalReport:  "epoxy.stage1, epoxy.stage3",
+			reportStatus: http.StatusInternalServerError,
+			wantActions:  1,
+			wantErr:      true,
+		},
+		{
+			name:         "report-failure-is-not-fatal-for-other-actions",
+			fatalReport:  "epoxy.stage1",
+			reportStatus: http.StatusInternalServerError,
+			wantActions:  1,
+		},
+		{
+			name:         "report-success-for-listed-action",
+			fatalReport:  "epoxy.stage3",
+			reportStatus: http.StatusNoContent,
+			wantActions:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actions, reports int32
+			tsAction := newActionServer(http.StatusOK, &actions)
+			defer tsAction.Close()
+			tsReport := newActionServer(tt.reportStatus, &reports)
+			defer tsReport.Close()
+
+			*flagRetry = true
+			*flagReportTimeout = 0
+			*flagFatalReport = tt.fatalReport
+			defer func() { *flagFatalReport = "" }()
+			c := &nextboot.Config{
+				Kargs: map[string]string{
+					"epoxy.stage3": tsAction.URL,
+					"epoxy.report": tsReport.URL,
+				},
+			}
+
+			err := runActions(c, "epoxy.stage3")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runActions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// A failed report never re-runs a successful action.
+			if actions != tt.wantActions {
+				t.Errorf("runActions() ran action %d times, want %d", actions, tt.wantActions)
+			}
+			if reports != 1 {
+				t.Errorf("runActions() sent %d reports, want 1", reports)
+			}
+		})
+	}
+}
+
+func Test_reportSuccess(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int32
+		timeout      time.Duration
+		wantAttempts int32
+		wantMarker   bool
+		wantErr      bool
+	}{
+		{
+			name:         "success-first-attempt",
+			timeout:      time.Minute,
+			wantAttempts: 1,
+		},
+		{
+			name:         "success-after-transient-failures",
+			failures:     3,
+			timeout:      time.Minute,
+			wantAttempts: 4,
+		},
+		{
+			name:         "failure-after-deadline",
+			failures:     100,
+			timeout:      0,
+			wantAttempts: 1,
+			wantMarker:   true,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if atomic.AddInt32(&attempts, 1) <= tt.failures {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					w.WriteHeader(http.StatusNoContent)
+				}))
+			defer ts.Close()
+
+			dir, err := ioutil.TempDir("", "epoxy_client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			*flagReportMarker = filepath.Join(dir, "success")
+			defer func() { *flagReportMarker = "" }()
+			*flagReportTimeout = tt.timeout
+
+			c := &nextboot.Config{
+				Kargs: map[string]string{
+					"epoxy.report": ts.URL,
+				},
+			}
+			err = reportSuccess(c, "epoxy.stage2", url.Values{"message": {"success"}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("reportSuccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("reportSuccess() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			// An undelivered report leaves a marker for the current action
+			// and session only.
+			if got := pendingReport(c, "epoxy.stage2"); got != tt.wantMarker {
+				t.Errorf("pendingReport() = %t, want %t", got, tt.wantMarker)
+			}
+			if pendingReport(c, "epoxy.stage3") {
+				t.Errorf("pendingReport() = true for a different action")
+			}
+			c.Kargs["epoxy.report"] = ts.URL + "/other-session"
+			if pendingReport(c, "epoxy.stage2") {
+				t.Errorf("pendingReport() = true for a different report URL")
+			}
+		})
+	}
+}
+
+func Test_run(t *testing.T) {
+	tests := []struct {
+		name        string
+		marker      string
+		wantActions int32
+		wantReports int32
+	}{
+		{
+			name:        "no-marker-runs-action",
+			wantActions: 1,
+			wantReports: 1,
+		},
+		{
+			name:        "marker-for-action-only-reports",
+			marker:      "epoxy.stage3",
+			wantReports: 1,
+		},
+		{
+			name:        "stale-marker-for-other-action-runs-action",
+			marker:      "epoxy.stage2",
+			wantActions: 1,
+			wantReports: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actions, reports int32
+			tsAction := newActionServer(http.StatusOK, &actions)
+			defer tsAction.Close()
+			tsReport := newActionServer(http.StatusNoContent, &reports)
+			defer tsReport.Close()
+
+			*flagReportMarker = filepath.Join(t.TempDir(), "success")
+			defer func() { *flagReportMarker = "" }()
+			*flagReportTimeout = 0
+			c := &nextboot.Config{
+				Kargs: map[string]string{
+					"epoxy.stage3": tsAction.URL,
+					"epoxy.report": tsReport.URL,
+				},
+			}
+			if tt.marker != "" {
+				err := ioutil.WriteFile(*flagReportMarker, []byte(reportMarker(c, tt.marker)), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := run(c, "epoxy.stage3"); err != nil {
+				t.Errorf("run() error = %v", err)
+			}
+			if actions != tt.wantActions || reports != tt.wantReports {
+				t.Errorf("run() ran action %d times and sent %d reports, want %d and %d",
+					actions, reports, tt.wantActions, tt.wantReports)
+			}
+			// The marker is removed once the report lands.
+			if _, err := os.Stat(*flagReportMarker); !os.IsNotExist(err) {
+				t.Errorf("run() left the success marker: %v", err)
+			}
+		})
+	}
+}
+
+func Test_report(t *testing.T) {
+	tests := []struct {
+		name       string
+		runErr     error
+		wantOutput string
+	}{
+		{
+			name:       "command-error-includes-output",
+			runErr:     &nextboot.CommandError{Args: []string{"false"}, Err: errors.New("exit status 1"), Output: "flash failed\n"},
+			wantOutput: "flash failed\n",
+		},
+		{
+			name:   "other-error-without-output",
+			runErr: errors.New("download failed"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var form url.Values
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					r.ParseForm()
+					form = r.PostForm
+					w.WriteHeader(http.StatusNoContent)
+				}))
+			defer ts.Close()
+
+			c := &nextboot.Config{Kargs: map[string]string{"epoxy.report": ts.URL}}
+			report(c, "epoxy.stage2", tt.runErr)
+
+			if got := form.Get("message"); got != "error: "+tt.runErr.Error() {
+				t.Errorf("report() message = %q, want %q", got, "error: "+tt.runErr.Error())
+			}
+			if got := form.Get("output"); got != tt.wantOutput {
+				t.Errorf("report() output = %q, want %q", got, tt.wantOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Pre-flight check failures, by class. Each class suggests a different cause.
+var (
+	errPreflightDNS     = errors.New("DNS lookup failed")
+	errPreflightTCP     = errors.New("TCP connection failed")
+	errPreflightTLS     = errors.New("TLS handshake failed")
+	errPreflightTimeout = errors.New("timed out")
+)
+
+// preflightHints suggests what to check for each class of pre-flight failure.
+var preflightHints = map[error]string{
+	errPreflightDNS:     "check the DNS servers and domain in the network configuration",
+	errPreflightTCP:     "check the routes, firewalls, and that the ePoxy server is running",
+	errPreflightTLS:     "check the system clock and the trusted CA certificates",
+	errPreflightTimeout: "check the network link, gateway, and MTU",
+}
+
+// lookupHost resolves host names during pre-flight checks. Tests may replace it.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// preflightTLSConfig, when not nil, replaces the default TLS config for
+// pre-flight checks, e.g. to trust a test CA. ServerName is always set.
+var preflightTLSConfig *tls.Config
+
+// preflight verifies that the server named by the http or https URL rawurl
+// can be reached within timeout, by resolving the host, connecting, and, for
+// https, completing a TLS handshake. Other URLs, e.g. local files, are not
+// checked. The returned error wraps one of the errPreflight classes.
+func preflight(rawurl string, timeout time.Duration) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := lookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	if err != nil {
+		return preflightError(ctx, errPreflightDNS, host, err)
+	}
+	d := &net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addrs[0], port))
+	if err != nil {
+		return preflightError(ctx, errPreflightTCP, host, err)
+	}
+	defer conn.Close()
+	if u.Scheme != "https" {
+		return nil
+	}
+	config := &tls.Config{}
+	if preflightTLSConfig != nil {
+		config = preflightTLSConfig.Clone()
+	}
+	config.ServerName = host
+	err = tls.Client(conn, config).HandshakeContext(ctx)
+	if err != nil {
+		return preflightError(ctx, errPreflightTLS, host, err)
+	}
+	return nil
+}
+
+// preflightError returns an error of the given class for host, or of class
+// errPreflightTimeout if the check ran out of time.
+func preflightError(ctx context.Context, class error, host string, err error) error {
+	var netErr net.Error
+	if ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		class = errPreflightTimeout
+	}
+	return fmt.Errorf("%w: %s: %v (%s)", class, host, err, preflightHints[class])
+}
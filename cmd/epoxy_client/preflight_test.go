@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_preflight(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	httpServer := httptest.NewServer(http.NotFoundHandler())
+	defer httpServer.Close()
+	// A closed server refuses connections.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	// A listener that accepts connections but never completes a TLS handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(tlsServer.Certificate())
+
+	tests := []struct {
+		name       string
+		url        string
+		trustTest  bool
+		lookupFail bool
+		wantErr    error
+	}{
+		{
+			name:      "https-success",
+			url:       tlsServer.URL + "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.json",
+			trustTest: true,
+		},
+		{
+			name: "http-success",
+			url:  httpServer.URL + "/v1/boot/mlab1.foo01.measurement-lab.org/stage1.json",
+		},
+		{
+			name: "local-file-is-not-checked",
+			url:  "file:///tmp/stage2.json",
+		},
+		{
+			name: "missing-url-is-not-checked",
+			url:  "",
+		},
+		{
+			name:       "dns-failure",
+			url:        "https://epoxy.example.invalid/v1/boot",
+			lookupFail: true,
+			wantErr:    errPreflightDNS,
+		},
+		{
+			name:    "tcp-failure",
+			url:     closed.URL,
+			wantErr: errPreflightTCP,
+		},
+		{
+			name:    "tls-failure-untrusted-certificate",
+			url:     tlsServer.URL,
+			wantErr: errPreflightTLS,
+		},
+		{
+			name:      "timeout",
+			url:       "https://" + silent.Addr().String(),
+			trustTest: true,
+			wantErr:   errPreflightTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.trustTest {
+				preflightTLSConfig = &tls.Config{RootCAs: trusted}
+				defer func() { preflightTLSConfig = nil }()
+			}
+			if tt.lookupFail {
+				lookupHost = func(ctx context.Context, host string) ([]string, error) {
+					return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+				}
+				defer func() { lookupHost = net.DefaultResolver.LookupHost }()
+			}
+
+			err := preflight(tt.url, 200*time.Millisecond)
+
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Errorf("preflight() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
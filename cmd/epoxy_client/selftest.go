@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/m-lab/epoxy/nextboot"
+)
+
+// selftestKarg is the kernel parameter added for the self-test, so templates
+// can be evaluated even when the real cmdline has no parameters.
+const selftestKarg = "epoxy.selftest"
+
+// selftest checks that epoxy_client can evaluate config templates and
+// download files in the current environment, without contacting the ePoxy
+// server, running commands, or rebooting. kargs are the parameters parsed from
+// the kernel cmdline. The result of each step is written to w.
+func selftest(w io.Writer, kargs map[string]string) error {
+	fmt.Fprintf(w, "selftest: cmdline: ok, %d kernel parameters\n", len(kargs))
+
+	// A local file stands in for a download from the ePoxy server.
+	dir, err := ioutil.TempDir("", "epoxy-selftest-")
+	if err != nil {
+		return fmt.Errorf("selftest: download: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	content := []byte("epoxy_client selftest\n")
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, content, 0644); err != nil {
+		return fmt.Errorf("selftest: download: %w", err)
+	}
+	sum := sha256.Sum256(content)
+
+	c := &nextboot.Config{
+		Kargs: map[string]string{selftestKarg: "ok"},
+		V1: &nextboot.V1{
+			Vars: map[string]interface{}{
+				"result": "{{kargs `" + selftestKarg + "`}}",
+			},
+			Files: map[string]map[string]string{
+				"dummy": {
+					"url":    "file://" + source,
+					"sha256": hex.EncodeToString(sum[:]),
+				},
+			},
+			Env: map[string]string{
+				"SELFTEST_FILE": "{{.files.dummy.name}}",
+			},
+			Commands: []interface{}{
+				"echo {{.vars.result}} {{.files.dummy.name}}",
+			},
+		},
+	}
+	for k, v := range kargs {
+		if k != selftestKarg {
+			c.Kargs[k] = v
+		}
+	}
+	if err := c.Evaluate(); err != nil {
+		return fmt.Errorf("selftest: evaluate: %w", err)
+	}
+
+	name := c.V1.Files["dummy"]["name"]
+	if name == "" {
+		return fmt.Errorf("selftest: download: no local file name for %s", source)
+	}
+	fmt.Fprintf(w, "selftest: download: ok, %s\n", name)
+	if got := c.V1.Vars["result"]; got != "ok" {
+		return fmt.Errorf("selftest: vars: got %q, want %q", got, "ok")
+	}
+	fmt.Fprintln(w, "selftest: vars: ok")
+	if got := c.V1.Env["SELFTEST_FILE"]; got != name {
+		return fmt.Errorf("selftest: env: got %q, want %q", got, name)
+	}
+	fmt.Fprintln(w, "selftest: env: ok")
+	want := []interface{}{"echo", "ok", name}
+	if len(c.V1.Commands) != 1 || !reflect.DeepEqual(c.V1.Commands[0], want) {
+		return fmt.Errorf("selftest: commands: got %q, want %q", c.V1.Commands, want)
+	}
+	fmt.Fprintln(w, "selftest: commands: ok")
+	return nil
+}
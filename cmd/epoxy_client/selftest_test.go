@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/epoxy/nextboot"
+)
+
+func Test_selftest(t *testing.T) {
+	c := &nextboot.Config{}
+	if err := c.ParseCmdline("epoxy.stage2=https://epoxy.example.com/v1/boot/stage2 epoxy.selftest=bad"); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+
+	if err := selftest(&out, c.Kargs); err != nil {
+		t.Fatalf("selftest() = %v, want nil\n%s", err, out.String())
+	}
+
+	for _, step := range []string{"cmdline", "download", "vars", "env", "commands"} {
+		if !strings.Contains(out.String(), "selftest: "+step+": ok") {
+			t.Errorf("selftest() did not report step %q:\n%s", step, out.String())
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"cloud.google.com/go/datastore"
 	"github.com/m-lab/epoxy/datastorex"
 	"github.com/m-lab/epoxy/storage"
+	"github.com/m-lab/epoxy/storage/iface"
 	"github.com/m-lab/go/rtx"
 )
 
@@ -82,7 +83,7 @@ func main() {
 	oldHosts, err := oldList(client)
 	rtx.Must(err, "Failed to list old Host entities")
 
-	dsc := storage.NewDatastoreConfig(client)
+	dsc := storage.NewDatastoreConfig(iface.NewClient(client))
 
 	for _, old := range oldHosts {
 		// For each one copy to a new storage.Host
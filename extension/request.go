@@ -51,6 +51,44 @@ type V1 struct {
 	RawQuery string `json:"raw_query"`
 }
 
+// Filter returns a copy of v1 with only the fields named in fields set. Field
+// names are the JSON names, e.g. "hostname" or "ipv4_address". Unknown names
+// are ignored.
+func (v1 *V1) Filter(fields []string) *V1 {
+	f := &V1{}
+	for _, field := range fields {
+		switch field {
+		case "hostname":
+			f.Hostname = v1.Hostname
+		case "ipv4_address":
+			f.IPv4Address = v1.IPv4Address
+		case "ipv6_address":
+			f.IPv6Address = v1.IPv6Address
+		case "last_boot":
+			f.LastBoot = v1.LastBoot
+		case "raw_query":
+			f.RawQuery = v1.RawQuery
+		}
+	}
+	return f
+}
+
+// SampleRequest returns a Request with every field set to an example value.
+// Extension authors may use the encoded sample, e.g. SampleRequest().Encode(),
+// to test that their services decode requests from the ePoxy server. V1 is the
+// only version of the Request.
+func SampleRequest() *Request {
+	return &Request{
+		V1: &V1{
+			Hostname:    "mlab1.foo01.measurement-lab.org",
+			IPv4Address: "192.168.0.12",
+			IPv6Address: "2001:db8::12",
+			LastBoot:    time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
+			RawQuery:    "p=somevalue",
+		},
+	}
+}
+
 // Encode marshals a Request to JSON.
 func (req *Request) Encode() string {
 	// Errors only occur for non-UTF8 characters in strings or unmarshalable types (which we don't have).
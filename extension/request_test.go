@@ -17,6 +17,7 @@ package extension
 import (
 	"io"
 	"io/ioutil"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -65,6 +66,66 @@ func TestRequest_Encode(t *testing.T) {
 	}
 }
 
+func TestSampleRequest(t *testing.T) {
+	sample := SampleRequest()
+
+	// Every field should have an example value.
+	v := reflect.ValueOf(*sample.V1)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("SampleRequest() V1.%s has no example value", v.Type().Field(i).Name)
+		}
+	}
+
+	got := &Request{}
+	if err := got.Decode(strings.NewReader(sample.Encode())); err != nil {
+		t.Fatalf("Request.Decode() of sample failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, sample) {
+		t.Errorf("Request.Decode() of sample = %#v, want %#v", got.V1, sample.V1)
+	}
+}
+
+func TestV1_Filter(t *testing.T) {
+	v1 := &V1{
+		Hostname:    "mlab4.lga0t.measurement-lab.org",
+		IPv4Address: "192.168.0.12",
+		IPv6Address: "2001:db8::12",
+		LastBoot:    time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
+		RawQuery:    "p=somevalue",
+	}
+	tests := []struct {
+		name   string
+		fields []string
+		want   V1
+	}{
+		{
+			name:   "all-fields",
+			fields: []string{"hostname", "ipv4_address", "ipv6_address", "last_boot", "raw_query"},
+			want:   *v1,
+		},
+		{
+			name:   "omit-addresses",
+			fields: []string{"hostname", "last_boot", "unknown"},
+			want: V1{
+				Hostname: v1.Hostname,
+				LastBoot: v1.LastBoot,
+			},
+		},
+		{
+			name: "no-fields",
+			want: V1{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := v1.Filter(tt.fields); *got != tt.want {
+				t.Errorf("V1.Filter() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestRequest_Decode(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -0,0 +1,41 @@
+// Copyright 2016 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package extension
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+)
+
+// Response contains structured values that an extension service may include
+// in its response. The ePoxy server forwards extension responses to the client
+// unmodified; Response fields are only used by the ePoxy server. Responses
+// that are not JSON, or lack these fields, are still valid.
+type Response struct {
+	// Collected contains values to save in the Host CollectedInformation. Only
+	// keys allowed by the ePoxy server are saved.
+	Collected map[string]string `json:"collected,omitempty"`
+}
+
+// Decode parses the extension response from msg.
+func (resp *Response) Decode(msg io.Reader) error {
+	raw, err := ioutil.ReadAll(msg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, resp)
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+package extension
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResponse_Decode(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		wantErr  bool
+		expected map[string]string
+	}{
+		{
+			name:     "decode-collected",
+			msg:      `{"token": "abc", "collected": {"version": "1.2.3"}}`,
+			expected: map[string]string{"version": "1.2.3"},
+		},
+		{
+			name: "decode-without-collected",
+			msg:  `{"token": "abc"}`,
+		},
+		{
+			name:    "decode-failure",
+			msg:     `this is a plain text token`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &Response{}
+			err := resp.Decode(strings.NewReader(tt.msg))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Response.Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(resp.Collected, tt.expected) {
+				t.Errorf("Response.Decode() got %#v, want %#v", resp.Collected, tt.expected)
+			}
+		})
+	}
+}
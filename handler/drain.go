@@ -0,0 +1,89 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDrainRetryAfter is the delay suggested to machines whose stage1
+// request is refused while the server drains.
+const DefaultDrainRetryAfter = time.Minute
+
+// A Drainer tracks whether the server is draining before shutdown. While
+// draining, new boots are refused, but machines that already started a boot
+// session may request their remaining stage2, stage3, extension and report
+// targets. A Drainer is safe for concurrent use.
+type Drainer struct {
+	// RetryAfter is the delay suggested to machines refused while draining.
+	RetryAfter time.Duration
+
+	draining int32
+}
+
+// NewDrainer creates a new Drainer that suggests DefaultDrainRetryAfter to
+// refused machines.
+func NewDrainer() *Drainer {
+	return &Drainer{RetryAfter: DefaultDrainRetryAfter}
+}
+
+// Drain starts draining. Draining cannot be stopped.
+func (d *Drainer) Drain() {
+	if atomic.CompareAndSwapInt32(&d.draining, 0, 1) {
+		log.Println("Draining: refusing new boots")
+	}
+}
+
+// Draining returns true once Drain has been called. A nil Drainer never
+// drains.
+func (d *Drainer) Draining() bool {
+	return d != nil && atomic.LoadInt32(&d.draining) == 1
+}
+
+// refuseNewBoot responds with 503 Service Unavailable and returns true if the
+// server is draining.
+func (env *Env) refuseNewBoot(rw http.ResponseWriter) bool {
+	if !env.Drainer.Draining() {
+		return false
+	}
+	seconds := int(env.Drainer.RetryAfter / time.Second)
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(rw, "Server is draining; retry later", http.StatusServiceUnavailable)
+	return true
+}
+
+// HandleDrain starts draining the server, for administrators authenticated
+// with AdminCredentials or AdminCertSubjects, e.g. before a deploy. When
+// neither, or no Drainer, are configured, the drain endpoint is disabled.
+func (env *Env) HandleDrain(rw http.ResponseWriter, req *http.Request) {
+	if !env.adminConfigured() || env.Drainer == nil {
+		http.Error(rw, "Drain is not configured", http.StatusNotImplemented)
+		return
+	}
+	if !env.isAdmin(req) {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="epoxy"`)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	env.Drainer.Drain()
+	rw.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(rw, "draining")
+}
@@ -0,0 +1,185 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/storage"
+)
+
+func TestEnv_Drain(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage2: "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.ipxe",
+		},
+	}
+	tests := []struct {
+		name           string
+		handler        func(env *Env) http.HandlerFunc
+		path           string
+		vars           map[string]string
+		form           url.Values
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{
+			name:           "stage1-ipxe-is-refused",
+			handler:        func(env *Env) http.HandlerFunc { return env.GenerateStage1IPXE },
+			path:           "/v1/boot/" + h.Name + "/stage1.ipxe",
+			vars:           map[string]string{"hostname": h.Name},
+			wantStatus:     http.StatusServiceUnavailable,
+			wantRetryAfter: "60",
+		},
+		{
+			name:           "stage1-json-is-refused",
+			handler:        func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+			path:           "/v1/boot/" + h.Name + "/stage1.json",
+			vars:           map[string]string{"hostname": h.Name},
+			wantStatus:     http.StatusServiceUnavailable,
+			wantRetryAfter: "60",
+		},
+		{
+			name:       "stage2-continues",
+			handler:    func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+			path:       "/v1/boot/" + h.Name + "/12345/stage2",
+			vars:       map[string]string{"hostname": h.Name, "sessionID": "12345"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "report-continues",
+			handler:    func(env *Env) http.HandlerFunc { return env.ReceiveReport },
+			path:       "/v1/boot/" + h.Name + "/12345/report",
+			vars:       map[string]string{"hostname": h.Name, "sessionID": "12345"},
+			form:       url.Values{"message": []string{"success"}},
+			wantStatus: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.CurrentSessionIDs = storage.SessionIDs{Stage2ID: "12345", ReportID: "12345"}
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+				Drainer:                NewDrainer(),
+			}
+			env.Drainer.Drain()
+
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, tt.vars)
+			rec := httptest.NewRecorder()
+
+			tt.handler(env).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s during drain wrong HTTP status: got %d; want %d", tt.name, rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("%s during drain Retry-After = %q; want %q", tt.name, got, tt.wantRetryAfter)
+			}
+			// Sessions are never created while draining.
+			if tt.wantStatus == http.StatusServiceUnavailable && h.CurrentSessionIDs.Stage2ID != "12345" {
+				t.Errorf("%s during drain created a new session", tt.name)
+			}
+		})
+	}
+}
+
+func TestDrainer_Draining(t *testing.T) {
+	var nilDrainer *Drainer
+	if nilDrainer.Draining() {
+		t.Errorf("Draining() = true for nil Drainer")
+	}
+	d := NewDrainer()
+	if d.Draining() {
+		t.Errorf("Draining() = true before Drain()")
+	}
+	d.Drain()
+	d.Drain()
+	if !d.Draining() {
+		t.Errorf("Draining() = false after Drain()")
+	}
+}
+
+func TestEnv_HandleDrain(t *testing.T) {
+	tests := []struct {
+		name         string
+		creds        map[string]string
+		drainer      *Drainer
+		user         string
+		password     string
+		wantStatus   int
+		wantDraining bool
+	}{
+		{
+			name:       "disabled-without-credentials",
+			drainer:    NewDrainer(),
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "disabled-without-drainer",
+			creds:      map[string]string{"oncall": "secret"},
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "unauthorized",
+			creds:      map[string]string{"oncall": "secret"},
+			drainer:    NewDrainer(),
+			user:       "oncall",
+			password:   "wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "admin-starts-drain",
+			creds:        map[string]string{"oncall": "secret"},
+			drainer:      NewDrainer(),
+			user:         "oncall",
+			password:     "secret",
+			wantStatus:   http.StatusAccepted,
+			wantDraining: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{AdminCredentials: tt.creds, Drainer: tt.drainer}
+			req := httptest.NewRequest("POST", "/drain", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := httptest.NewRecorder()
+
+			env.HandleDrain(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("HandleDrain() wrong HTTP status: got %d; want %d", rec.Code, tt.wantStatus)
+			}
+			if got := env.Drainer.Draining(); got != tt.wantDraining {
+				t.Errorf("HandleDrain() Draining() = %t; want %t", got, tt.wantDraining)
+			}
+		})
+	}
+}
@@ -18,9 +18,18 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -31,23 +40,47 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/m-lab/epoxy/extension"
 	"github.com/m-lab/epoxy/metrics"
+	"github.com/m-lab/epoxy/nextboot"
 	"github.com/m-lab/epoxy/storage"
 	"github.com/m-lab/epoxy/template"
 	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Config provides access to Host records.
 type Config interface {
 	Save(host *storage.Host) error
 	Load(name string) (*storage.Host, error)
+	// Update atomically loads the named host, applies mutate, and saves it.
+	Update(name string, mutate func(host *storage.Host) error) (*storage.Host, error)
+}
+
+// GroupConfig provides access to HostGroup records.
+type GroupConfig interface {
+	LoadGroup(name string) (*storage.HostGroup, error)
 }
 
 // Env holds data necessary for executing handler functions.
 type Env struct {
 	// Config provides access to Host records.
 	Config Config
+	// Groups provides access to HostGroup records, for Hosts that inherit
+	// sequences from a group. When nil, no Host may name a group.
+	Groups GroupConfig
+	// Hosts lists all Host records for the status page. When nil, the status
+	// page is disabled.
+	Hosts HostLister
 	// ServerAddr is the host:port of the public service. Used to generate absolute URLs.
 	ServerAddr string
+	// BaseURL is the external base URL, e.g. "https://epoxy.example.com", used
+	// to generate absolute URLs when clients reach the service through a load
+	// balancer with a different hostname. When empty, "https://" + ServerAddr
+	// is used.
+	BaseURL string
+	// APIVersion is the default API version, e.g. "v1", used to generate
+	// absolute URLs. Host records may override this value.
+	APIVersion string
 	// AllowForwardedRequests changes how the ePoxy server evaluates and applies
 	// the Host IP whitelist to incoming requests. Typically, the ePoxy server
 	// allows an operation when the request "remote address" matches the target Host
@@ -56,17 +89,175 @@ type Env struct {
 	// then the ePoxy server substitutes the value in the "X-Forwarded-For" request
 	// header for the request "remote address".
 	AllowForwardedRequests bool
+	// TrustedProxies are the networks of the load balancers that forward
+	// requests. When AllowForwardedRequests is true and TrustedProxies is not
+	// empty, the client IP in the "X-Forwarded-For" header is only used if the
+	// last hop is within one of TrustedProxies, so that clients cannot spoof
+	// the header.
+	TrustedProxies []*net.IPNet
 	// Project is the GCP project name in which the server is running.
 	Project string
 	// StoragePrefixURL is the target URL prefix for storage proxy requests.
 	StoragePrefixURL string
+	// StorageRegionPrefixURLs maps region names to target URL prefixes for
+	// storage proxy requests. When a request names a region (see
+	// StorageRegionHeader) found in this map, the region prefix is used instead
+	// of StoragePrefixURL.
+	StorageRegionPrefixURLs map[string]string
+	// StorageContentTypes maps file suffixes, e.g. ".ipxe", to the Content-Type
+	// returned by the storage proxy when the upstream Content-Type is missing or
+	// generic, e.g. "application/octet-stream". Clients like iPXE reject some
+	// generic types.
+	StorageContentTypes map[string]string
+	// ExtensionLatencyMetrics selects the metric types that record extension
+	// request latency: "histogram" (the default), "summary", or "both".
+	ExtensionLatencyMetrics string
+	// CompactJSON controls whether JSON configs returned by GenerateJSONConfig
+	// omit indentation to reduce response size.
+	CompactJSON bool
+	// ExtensionFields maps extension operation names to the extension.V1 field
+	// names, e.g. "hostname", sent to that extension. Operations not in this
+	// map receive all fields.
+	ExtensionFields map[string][]string
+	// ExtensionRetries maps idempotent extension operation names to the number
+	// of times a request is retried after a 5xx response from the extension
+	// service. Operations not in this map are never retried.
+	ExtensionRetries map[string]int
+	// ExtensionStatusMap maps extension service response status codes to the
+	// status codes returned to clients, e.g. 404 to 502, to distinguish backend
+	// failures from ePoxy failures. Unmapped status codes are returned verbatim.
+	ExtensionStatusMap map[int]int
+	// MaxExtensionRequestBytes limits the size of the encoded extension.Request
+	// body forwarded to extension services. Larger requests are refused with
+	// 413 Request Entity Too Large. When zero, the size is unlimited.
+	MaxExtensionRequestBytes int
+	// ExtensionFlushInterval is the period between flushes of extension
+	// responses to the client while they are copied, so large responses are
+	// streamed to slow clients with bounded memory. When zero, responses are
+	// flushed after every write.
+	ExtensionFlushInterval time.Duration
+	// ExtensionTransport sends requests to extension services, e.g. using a
+	// transport from NewExtensionTransport to verify https extension servers
+	// with a dedicated CA. When nil, http.DefaultTransport is used.
+	ExtensionTransport http.RoundTripper
+	// SigningKey signs the JSON configs returned by GenerateStage1JSON and
+	// GenerateJSONConfig. The detached signature is returned in the
+	// nextboot.SignatureHeader, so clients with the pinned public key can reject
+	// forged configs. When nil, configs are not signed.
+	SigningKey ed25519.PrivateKey
+	// ReportExtension is the operation name of an extension called by
+	// ReceiveReport after a successful report, before the extension session
+	// is rotated, e.g. for post-boot bookkeeping. Failures of the extension are
+	// logged but never fail the report. When empty, no extension is called.
+	ReportExtension string
+	// AdminCredentials maps administrator user names to passwords, accepted as
+	// basic auth credentials for the status page. When empty, and no
+	// AdminCertSubjects are configured, the status page is disabled.
+	AdminCredentials map[string]string
+	// AdminCertSubjects lists the client certificate subjects accepted as
+	// administrators, in addition to AdminCredentials, as "CN=<common name>"
+	// or "O=<organization>". A verified client certificate is accepted if its
+	// CommonName or any Organization is listed. When empty, client
+	// certificates never authenticate administrators.
+	AdminCertSubjects []string
+	// Auditor records an audit event for every change of a Host record by a
+	// booting machine, e.g. new sessions and reports. When nil, no audit
+	// events are recorded.
+	Auditor *storage.Auditor
+	// SessionTTL limits how long the session URLs of a boot, e.g. the stage2,
+	// report, and extension URLs, are accepted after the stage1 request. JSON
+	// configs include the expiry time, so clients may request a new session
+	// instead. When zero, sessions do not expire.
+	SessionTTL time.Duration
+	// SessionReuseWindow is how long after a stage1 request another stage1
+	// request from the same host, e.g. stage1.json after stage1.ipxe, reuses
+	// the current session instead of generating new session IDs, so both
+	// return the same downstream URLs. When zero, every stage1 request starts
+	// a new session.
+	SessionReuseWindow time.Duration
+	// Drainer refuses stage1 requests, which start new boots, while the server
+	// drains before shutdown. When nil, the server never drains.
+	Drainer *Drainer
+}
+
+// hostnameVar returns the normalized hostname from the request URL, so that
+// hostnames differing only in case name the same Host.
+func hostnameVar(req *http.Request) string {
+	return storage.NormalizeName(mux.Vars(req)["hostname"])
 }
 
+// StorageRegionHeader is the request header used by clients to name the region
+// nearest to them for storage proxy requests.
+const StorageRegionHeader = "X-Epoxy-Region"
+
 var (
 	// ErrCannotAccessHost indicates that the request should not be allowed.
 	ErrCannotAccessHost = fmt.Errorf("Caller cannot access host")
 )
 
+// baseURL returns the external base URL used to generate absolute URLs.
+func (env *Env) baseURL() string {
+	if env.BaseURL != "" {
+		return env.BaseURL
+	}
+	return template.BaseURL(env.ServerAddr)
+}
+
+// resolveGroup adds the sequences of the HostGroup named by host to the host.
+// Hosts that do not name a group are unchanged. The host must not be saved
+// afterwards, so that later changes to the group still apply to the host.
+func (env *Env) resolveGroup(host *storage.Host) error {
+	if host.Group == "" {
+		return nil
+	}
+	if env.Groups == nil {
+		return fmt.Errorf("Host group %q cannot be loaded", host.Group)
+	}
+	g, err := env.Groups.LoadGroup(host.Group)
+	if err != nil {
+		return fmt.Errorf("Failed to load host group %q: %v", host.Group, err)
+	}
+	host.Inherit(g)
+	return nil
+}
+
+// holdForMaintenance writes a config that holds a booting machine while host
+// is in maintenance, or has BootPolicyHold, and returns true, or returns false
+// if host is not held. If ipxe is true, the config is an iPXE script,
+// otherwise it is an epoxy_client action.
+func holdForMaintenance(rw http.ResponseWriter, host *storage.Host, ipxe bool) bool {
+	remaining := host.MaintenanceRemaining()
+	if host.EffectiveBootPolicy() == storage.BootPolicyHold {
+		// Held hosts check for a new policy every MaxMaintenanceHold.
+		remaining = template.MaxMaintenanceHold
+	}
+	if remaining == 0 {
+		return false
+	}
+	script := template.CreateMaintenanceAction(host, remaining)
+	contentType := "application/json; charset=utf-8"
+	if ipxe {
+		script = template.FormatMaintenanceIPXEScript(host, remaining)
+		contentType = "text/plain; charset=us-ascii"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprint(rw, script); err != nil {
+		log.Printf("Failed to write maintenance config to %q: %v", host.Name, err)
+	}
+	return true
+}
+
+// sequenceName returns the name of the sequence served to host by
+// CurrentSequence, either "update" or "boot".
+func sequenceName(host *storage.Host) string {
+	if host.UpdateSelected() {
+		return "update"
+	}
+	return "boot"
+}
+
 // extractIP parses an "IP:port" string created by the Go http package and
 // returns the IP address portion.
 func extractIP(remoteAddr string) (string, error) {
@@ -87,7 +278,8 @@ func (env *Env) requestIsFromHost(req *http.Request, host *storage.Host) error {
 	// forwareded by a load balancer, which adds the `X-Forwarded-For` header.
 	//
 	// Depending on the value of AllowForwardedRequests, we check the X-Forwarded-For
-	// header (when true) or the value in RemoteAddr (when false).
+	// header (when true) or the value in RemoteAddr (when false). Either IP may
+	// be the host IPv4Addr, or within one of the host AllowedCIDRs.
 
 	// TODO: allow requests from an administrative network.
 	log.Println("Header:", req.Header.Get("X-Forwarded-For"), "vs", host.IPv4Addr)
@@ -97,8 +289,8 @@ func (env *Env) requestIsFromHost(req *http.Request, host *storage.Host) error {
 	fwdIPs := strings.Split(req.Header.Get("X-Forwarded-For"), ", ")
 	// Note: Since this value can be set by the original client, we must check the other IPs.
 	// There should be two IPs: one for the original client, and one for the AE load balancer.
-	if env.AllowForwardedRequests && len(fwdIPs) <= 2 && fwdIPs[0] == host.IPv4Addr {
-		// TODO: verify that fwdIPs[1] is an AppEngine load balancer.
+	if env.AllowForwardedRequests && len(fwdIPs) <= 2 && host.AllowsIP(fwdIPs[0]) &&
+		env.trustedProxy(fwdIPs) {
 		return nil
 	}
 
@@ -107,16 +299,106 @@ func (env *Env) requestIsFromHost(req *http.Request, host *storage.Host) error {
 	if err != nil {
 		return ErrCannotAccessHost
 	}
-	// Check whether remoteIP matches the registered host IPv4Addr.
-	if !env.AllowForwardedRequests && (remoteIP == host.IPv4Addr) {
+	// Check whether remoteIP matches the registered host addresses.
+	if !env.AllowForwardedRequests && host.AllowsIP(remoteIP) {
 		return nil
 	}
 	return ErrCannotAccessHost
 }
 
+// trustedProxy returns true if the last hop of the X-Forwarded-For IPs fwdIPs
+// is within one of the TrustedProxies, or if no TrustedProxies are configured.
+func (env *Env) trustedProxy(fwdIPs []string) bool {
+	if len(env.TrustedProxies) == 0 {
+		return true
+	}
+	if len(fwdIPs) < 2 {
+		return false
+	}
+	ip := net.ParseIP(strings.TrimSpace(fwdIPs[len(fwdIPs)-1]))
+	if ip == nil {
+		return false
+	}
+	for _, n := range env.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newSession generates new session IDs for the named host and saves them in a
+// single transaction, so concurrent stage1 requests cannot interleave. If the
+// current session was created within SessionReuseWindow, it is reused instead.
+// If info is not nil, it is also added to the host's collected information.
+func (env *Env) newSession(req *http.Request, hostname string, info url.Values) (*storage.Host, error) {
+	var before *storage.Host
+	host, err := env.Config.Update(hostname, func(host *storage.Host) error {
+		// Check access again, since the host record may have changed.
+		if err := env.requestIsFromHost(req, host); err != nil {
+			return err
+		}
+		before = host.Clone()
+		if info != nil {
+			host.AddInformation(info)
+			// Persist the firmware type so the matching stage1 is selected.
+			host.SetFirmware(info)
+		}
+		if host.SessionIsRecent(env.SessionReuseWindow) {
+			// Keep the session IDs and nonce already returned to this host,
+			// and count the update attempt only once.
+			return nil
+		}
+		host.GenerateSessionIDs()
+		host.StartUpdateAttempt()
+		return host.SetNonce(req.PostForm.Get("nonce"))
+	})
+	if err != nil {
+		return nil, err
+	}
+	env.Auditor.Record(env.auditActor(req), storage.AuditSession, before, host)
+	return host, nil
+}
+
+// auditActor returns the actor recorded in audit events for req: the common
+// name of a verified client certificate if present, or else the IP of the
+// booting machine.
+func (env *Env) auditActor(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		if cn := req.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	if env.AllowForwardedRequests {
+		return strings.Split(req.Header.Get("X-Forwarded-For"), ", ")[0]
+	}
+	ip, err := extractIP(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// sessionErrorStatus returns the HTTP status code for errors from newSession.
+func sessionErrorStatus(err error) int {
+	switch err {
+	case ErrCannotAccessHost:
+		return http.StatusForbidden
+	case storage.ErrInvalidNonce:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 // GenerateStage1IPXE creates the stage1 iPXE script for booting machines.
+// Requests authenticated with AdminCredentials may add allowed iPXE commands
+// to the script with "directive" query parameters.
 func (env *Env) GenerateStage1IPXE(rw http.ResponseWriter, req *http.Request) {
-	hostname := mux.Vars(req)["hostname"]
+	// New boots are refused while draining.
+	if env.refuseNewBoot(rw) {
+		return
+	}
+	hostname := hostnameVar(req)
 
 	// Use hostname as key to load record from Datastore.
 	host, err := env.Config.Load(hostname)
@@ -131,30 +413,58 @@ func (env *Env) GenerateStage1IPXE(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Hosts in maintenance wait instead of starting a new boot.
+	if holdForMaintenance(rw, host, true) {
+		return
+	}
+
+	// Administrators may add iPXE directives to this script only, e.g. for a
+	// one-off recovery from the console. Directives are never saved.
+	directives := req.URL.Query()["directive"]
+	if len(directives) > 0 {
+		if !env.isAdmin(req) {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="epoxy"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		for _, d := range directives {
+			if !template.ValidIPXEDirective(d) {
+				http.Error(rw, "Invalid iPXE directive: "+d, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	// Save client information sent in PostForm. Results can never be more than a
 	// megabyte and should never be close to that.
 	req.ParseMultipartForm(1024 * 1024)
-	host.AddInformation(req.PostForm)
 
-	// Generate new session IDs.
-	host.GenerateSessionIDs()
+	// Generate and save new session IDs to Datastore.
+	host, err = env.newSession(req, hostname, req.PostForm)
+	if err != nil {
+		http.Error(rw, err.Error(), sessionErrorStatus(err))
+		return
+	}
 
 	// Count all requests for the stage1 target.
 	metrics.Stage1Total.WithLabelValues(host.Name).Inc()
+	metrics.Stage1SequenceTotal.WithLabelValues(sequenceName(host)).Inc()
 
-	// Save host record to Datastore to commit session IDs.
-	if err := env.Config.Save(host); err != nil {
+	// Sequences inherited from a group are resolved after saving the session.
+	if err := env.resolveGroup(host); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Generate iPXE script.
-	script := template.FormatStage1IPXEScript(host, env.ServerAddr)
+	script := template.FormatStage1IPXEScript(host, env.baseURL(), env.APIVersion, directives...)
 
-	// Complete request as successful.
+	// Complete request as successful. The script embeds session IDs that are
+	// unique to this request, so it must never be cached.
 	rw.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+	rw.Header().Set("Cache-Control", "no-store")
 	rw.WriteHeader(http.StatusOK)
-	_, err = fmt.Fprintf(rw, script)
+	_, err = io.WriteString(rw, script)
 	if err != nil {
 		log.Printf("Failed to write response to %q: %v", hostname, err)
 	}
@@ -166,7 +476,11 @@ func (env *Env) GenerateStage1IPXE(rw http.ResponseWriter, req *http.Request) {
 // GenerateStage1JSON creates the stage1 JSON epoxy_client script for booting
 // machines.
 func (env *Env) GenerateStage1JSON(rw http.ResponseWriter, req *http.Request) {
-	hostname := mux.Vars(req)["hostname"]
+	// New boots are refused while draining.
+	if env.refuseNewBoot(rw) {
+		return
+	}
+	hostname := hostnameVar(req)
 
 	// Use hostname as key to load record from Datastore.
 	host, err := env.Config.Load(hostname)
@@ -181,38 +495,85 @@ func (env *Env) GenerateStage1JSON(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Hosts in maintenance wait instead of starting a new boot.
+	if holdForMaintenance(rw, host, false) {
+		return
+	}
+
 	// TODO(soltesz):
 	// * Save information sent in PostForm.
+	req.ParseForm()
 
-	// Generate new session IDs.
-	host.GenerateSessionIDs()
+	// Generate and save new session IDs to Datastore.
+	host, err = env.newSession(req, hostname, nil)
+	if err != nil {
+		http.Error(rw, err.Error(), sessionErrorStatus(err))
+		return
+	}
 
 	// Count all requests for the stage1 target.
 	metrics.Stage1Total.WithLabelValues(host.Name).Inc()
+	metrics.Stage1SequenceTotal.WithLabelValues(sequenceName(host)).Inc()
 
-	// Save host record to Datastore to commit session IDs.
-	if err := env.Config.Save(host); err != nil {
+	// Sequences inherited from a group are resolved after saving the session.
+	if err := env.resolveGroup(host); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Generate epoxy client JSON action.
-	script := template.CreateStage1Action(host, env.ServerAddr)
+	script := template.CreateStage1Action(host, env.baseURL(), env.APIVersion, env.SessionTTL)
 
-	// Complete request as successful.
+	// Complete request as successful. The action embeds session IDs that are
+	// unique to this request, so it must never be cached.
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	env.signConfig(rw, script)
 	rw.WriteHeader(http.StatusOK)
-	_, err = fmt.Fprintf(rw, script)
+	_, err = io.WriteString(rw, script)
 	if err != nil {
 		log.Printf("Failed to write response to %q: %v", hostname, err)
 	}
 	return
 }
 
+// sessionExpired returns true if env has a SessionTTL and the current session
+// of host was created more than SessionTTL ago.
+func (env *Env) sessionExpired(host *storage.Host) bool {
+	return env.SessionTTL > 0 && time.Since(host.LastSessionCreation) > env.SessionTTL
+}
+
+// signConfig sets the nextboot.SignatureHeader to the signature of the config
+// content, if env has a SigningKey. The content must be written verbatim.
+func (env *Env) signConfig(rw http.ResponseWriter, content string) {
+	if env.SigningKey == nil {
+		return
+	}
+	rw.Header().Set(nextboot.SignatureHeader, nextboot.Sign(env.SigningKey, []byte(content)))
+}
+
+// configETag returns a strong ETag derived from the content of a config.
+func configETag(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatches returns true if the value of an If-None-Match header matches
+// etag. Weak comparison is used, as defined for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateJSONConfig creates and returns a JSON serialized nextboot.Config
 // suitable for responding to stage2 or stage3 requests.
 func (env *Env) GenerateJSONConfig(rw http.ResponseWriter, req *http.Request) {
-	hostname := mux.Vars(req)["hostname"]
+	hostname := hostnameVar(req)
 	// TODO: Verify that the sessionID matches the host.CurrentSessionIDs.Stage2ID.
 	// sessionID := mux.Vars(req)["sessionID"]
 
@@ -228,22 +589,92 @@ func (env *Env) GenerateJSONConfig(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if env.sessionExpired(host) {
+		http.Error(rw, "Session expired", http.StatusForbidden)
+		return
+	}
+
+	// If the client gave a nonce during stage1, verify that the request includes
+	// the same nonce. This prevents replay of stage URLs from earlier boots.
+	nonce := host.CurrentSessionIDs.Nonce
+	if nonce != "" && req.URL.Query().Get("nonce") != nonce {
+		http.Error(rw, "Given nonce does not match host record", http.StatusForbidden)
+		return
+	}
+
+	// Hosts entering maintenance during a boot wait before the next stage.
+	if holdForMaintenance(rw, host, false) {
+		return
+	}
+
 	// TODO(soltesz):
 	// * Save information sent in PostForm, e.g. ssh host key.
 	stage := path.Base(req.URL.Path)
 
-	script := template.FormatJSONConfig(host, stage)
+	if err := env.resolveGroup(host); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	script := template.FormatJSONConfig(host, stage, env.CompactJSON, env.SessionTTL)
+
+	// Stage2 and stage3 configs do not embed session IDs, so the same config
+	// always has the same ETag. Clients must revalidate before reusing a copy.
+	etag := configETag(script)
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	// Complete request as successful.
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	env.signConfig(rw, script)
 	rw.WriteHeader(http.StatusOK)
-	_, err = fmt.Fprintf(rw, script)
+	_, err = io.WriteString(rw, script)
 	if err != nil {
 		log.Printf("Failed to write response to %q: %v", hostname, err)
 	}
 	return
 }
 
+// clientCertFingerprint returns the hex encoded sha256 fingerprint of the
+// verified client certificate of req, or "" if the request has no verified
+// client certificate, e.g. because client certificates are not requested.
+func clientCertFingerprint(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(req.TLS.VerifiedChains[0][0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordClientCert saves the fingerprint of the verified client certificate
+// of req in the host. A change from a previously recorded certificate is
+// logged and counted, since it may indicate a replaced or cloned machine.
+func (env *Env) recordClientCert(req *http.Request, host *storage.Host) {
+	fingerprint := clientCertFingerprint(req)
+	if fingerprint == "" {
+		return
+	}
+	previous := host.ClientCertFingerprint
+	if host.SetClientCertFingerprint(fingerprint) {
+		log.Printf("WARNING: client certificate changed for %s: from %s to %s",
+			host.Name, previous, fingerprint)
+		metrics.ClientCertChanges.WithLabelValues(host.Name).Inc()
+	}
+}
+
+// HandleSchema returns the JSON Schema of nextboot configs, so that tooling can
+// validate configs before deployment.
+func HandleSchema(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/schema+json")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(rw, nextboot.Schema); err != nil {
+		log.Printf("Failed to write schema: %v", err)
+	}
+}
+
 // ReceiveReport handles the last step of a boot sequence when the epoxy client reports
 // success or failure. In both cases, the session ids are invalidated. In all cases,
 // epoxy_client is expected to report the server's public host key.
@@ -252,7 +683,7 @@ func (env *Env) ReceiveReport(rw http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 
 	// Use hostname as key to load record from Datastore.
-	hostname := mux.Vars(req)["hostname"]
+	hostname := hostnameVar(req)
 	host, err := env.Config.Load(hostname)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusNotFound)
@@ -270,14 +701,31 @@ func (env *Env) ReceiveReport(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Given session ID does not match host record", http.StatusForbidden)
 		return
 	}
+	if env.sessionExpired(host) {
+		http.Error(rw, "Session expired", http.StatusForbidden)
+		return
+	}
 
+	before := host.Clone()
 	host.LastReport = time.Now()
 	status := req.PostForm.Get("message")
+	// Retain recent reports, and any failed command output, for debugging.
+	host.AddBootLog(status, req.PostForm.Get("output"), status == "success")
 	if status == "success" {
-		// When the status is success, disable the "update" and mark the time.
+		// When the status is success, reset the boot policy, e.g. disable a
+		// one time "update", and mark the time.
 		host.LastSuccess = host.LastReport
-		host.UpdateEnabled = false
-		// TODO: invalidate session ids.
+		host.ResetAfterSuccess()
+		env.recordClientCert(req, host)
+		// Run post-boot bookkeeping while the current sessions are still valid.
+		if env.ReportExtension != "" {
+			env.callReportExtension(req, host)
+		}
+		// Rotate only the extension ID so that extension URLs, e.g. for token
+		// allocation, cannot be reused once boot completes. Later reports with
+		// the current report ID are still accepted.
+		// TODO: invalidate remaining session ids.
+		host.GenerateExtensionSessionID()
 	}
 
 	// Save the new host state.
@@ -285,6 +733,7 @@ func (env *Env) ReceiveReport(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	env.Auditor.Record(env.auditActor(req), storage.AuditReport, before, host)
 
 	// TODO: log using structured JSON.
 	log.Println(req.PostForm)
@@ -310,15 +759,242 @@ func newReverseProxy(target *url.URL, content string) *httputil.ReverseProxy {
 		req.URL = target
 		req.Body = ioutil.NopCloser(strings.NewReader(content))
 		req.ContentLength = int64(len(content))
+		// Allow the request to be sent again, e.g. by retryTransport.
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		}
 	}
 	return &httputil.ReverseProxy{Director: director}
 }
 
+// retryTransport is an http.RoundTripper that retries requests that receive
+// a 5xx response, up to retries times. Only idempotent requests should use
+// retryTransport, and requests must define GetBody.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+}
+
+// RoundTrip sends req, retrying after 5xx responses. The last response is
+// returned.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode < 500 || attempt >= t.retries {
+			return resp, err
+		}
+		log.Printf("Retrying %s after status %d", req.URL, resp.StatusCode)
+		// Discard the failed response and reset the request body.
+		resp.Body.Close()
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+}
+
+// failoverTransport is an http.RoundTripper that sends a request to each
+// backup URL in order, after a connection failure or 5xx response from the
+// previous URL. Requests must define GetBody.
+type failoverTransport struct {
+	base    http.RoundTripper
+	backups []*url.URL
+}
+
+// RoundTrip sends req, failing over to the backup URLs. The last response or
+// error is returned.
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		resp, err := t.base.RoundTrip(req)
+		if (err == nil && resp.StatusCode < 500) || i >= len(t.backups) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err != nil {
+			log.Printf("Failing over from %s to %s after error: %v", req.URL, t.backups[i], err)
+		} else {
+			log.Printf("Failing over from %s to %s after status %d", req.URL, t.backups[i], resp.StatusCode)
+			resp.Body.Close()
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.URL = t.backups[i]
+		req.Body = body
+	}
+}
+
+// parseURLs parses each of the raw URLs. parseURLs returns an error if any
+// URL is invalid or there are no URLs.
+func parseURLs(rawURLs []string) ([]*url.URL, error) {
+	if len(rawURLs) == 0 {
+		return nil, fmt.Errorf("No URLs given")
+	}
+	urls := make([]*url.URL, len(rawURLs))
+	for i, raw := range rawURLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = u
+	}
+	return urls, nil
+}
+
+// mapStatus returns a ReverseProxy.ModifyResponse function that replaces the
+// response status using statusMap, then calls next.
+func mapStatus(statusMap map[int]int, next func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if code, ok := statusMap[resp.StatusCode]; ok {
+			log.Printf("Mapping extension status %d to %d", resp.StatusCode, code)
+			resp.StatusCode = code
+			resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+		}
+		return next(resp)
+	}
+}
+
+// NewExtensionTransport creates an http.Transport for requests to extension
+// services. When caFile is not empty, extension server certificates must be
+// signed by a CA in the PEM encoded caFile; otherwise, the system CAs are
+// trusted. When certFile and keyFile are not empty, the PEM encoded client
+// certificate and key are presented to extension servers that require mTLS.
+func NewExtensionTransport(caFile, certFile, keyFile string) (*http.Transport, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No CA certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = config
+	return t, nil
+}
+
+// NewClientCertTLSConfig returns a server TLS config that requests client
+// certificates and verifies any presented certificate against the CA
+// certificates in caFile. Verified certificates are recorded by ReceiveReport,
+// and may authenticate administrators listed in Env.AdminCertSubjects.
+func NewClientCertTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No CA certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}, nil
+}
+
+// extensionTransport returns the transport for requests to extension services.
+func (env *Env) extensionTransport() http.RoundTripper {
+	if env.ExtensionTransport != nil {
+		return env.ExtensionTransport
+	}
+	return http.DefaultTransport
+}
+
+// extensionRequest returns the extension request sent for host to the
+// extension for operation, limited to the ExtensionFields for the operation.
+func (env *Env) extensionRequest(host *storage.Host, operation, rawQuery string) extension.Request {
+	webreq := extension.Request{
+		V1: &extension.V1{
+			Hostname:    host.Name,
+			IPv4Address: host.IPv4Addr,
+			IPv6Address: host.IPv6Addr,
+			LastBoot:    host.LastSessionCreation,
+			RawQuery:    rawQuery,
+		},
+	}
+	if fields, ok := env.ExtensionFields[operation]; ok {
+		webreq.V1 = webreq.V1.Filter(fields)
+	}
+	return webreq
+}
+
+// reportExtensionTimeout limits the time ReceiveReport waits for the
+// ReportExtension service.
+const reportExtensionTimeout = 10 * time.Second
+
+// extensionRequestTooLarge returns true if the encoded extension request body
+// exceeds MaxExtensionRequestBytes.
+func (env *Env) extensionRequestTooLarge(body string) bool {
+	return env.MaxExtensionRequestBytes > 0 && len(body) > env.MaxExtensionRequestBytes
+}
+
+// callReportExtension sends the extension request for host to the
+// ReportExtension service. The call is best-effort: failures are logged and
+// otherwise ignored, so that a failing extension never blocks a report.
+func (env *Env) callReportExtension(req *http.Request, host *storage.Host) {
+	operation := env.ReportExtension
+	extensionURLs, ok := storage.Extensions.URLs(operation)
+	if !ok {
+		log.Printf("Unknown report extension for operation: %s", operation)
+		return
+	}
+	extURLs, err := parseURLs(extensionURLs)
+	if err != nil {
+		log.Printf("Failed to parse report extension URL for %s: %v", operation, err)
+		return
+	}
+	webreq := env.extensionRequest(host, operation, req.URL.RawQuery)
+	body := webreq.Encode()
+	if env.extensionRequestTooLarge(body) {
+		log.Printf("Report extension request for %s is too large: %d bytes", host.Name, len(body))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), reportExtensionTimeout)
+	defer cancel()
+	ereq, err := http.NewRequestWithContext(ctx, http.MethodPost, extURLs[0].String(), strings.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to create report extension request for %s: %v", host.Name, err)
+		return
+	}
+	if tp := req.Header.Get(TraceParentHeader); tp != "" {
+		ereq.Header.Set(TraceParentHeader, tp)
+	}
+	client := &http.Client{Transport: env.extensionTransport()}
+	if len(extURLs) > 1 {
+		client.Transport = &failoverTransport{base: client.Transport, backups: extURLs[1:]}
+	}
+	resp, err := client.Do(ereq)
+	if err != nil {
+		log.Printf("Report extension %s failed for %s (trace %s): %v", operation, host.Name, traceID(req), err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("Report extension %s failed for %s (trace %s): status %d",
+			operation, host.Name, traceID(req), resp.StatusCode)
+	}
+}
+
 // HandleExtension handles client requests to ePoxy extension URLs. The handler creates
 // and sends a request to the extension service registered for the operation.
 func (env *Env) HandleExtension(rw http.ResponseWriter, req *http.Request) {
 	// Use hostname as key to load record from Datastore.
-	hostname := mux.Vars(req)["hostname"]
+	hostname := hostnameVar(req)
 	host, err := env.Config.Load(hostname)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusNotFound)
@@ -337,44 +1013,225 @@ func (env *Env) HandleExtension(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Given session ID does not match host record", http.StatusForbidden)
 		return
 	}
+	if env.sessionExpired(host) {
+		http.Error(rw, "Session expired", http.StatusForbidden)
+		return
+	}
 
 	operation := mux.Vars(req)["operation"]
-	if len(operation) == 0 {
-		http.Error(rw, "Zero length operation is invalid", http.StatusBadRequest)
+	if !storage.ValidOperationName(operation) {
+		http.Error(rw, "Invalid extension operation: "+operation, http.StatusBadRequest)
 		return
 	}
 	// TODO: load extension URL from datastore.
-	if _, ok := storage.Extensions[operation]; !ok {
+	extensionURLs, ok := storage.Extensions.URLs(operation)
+	if !ok {
 		http.Error(rw, "Unknown Extension for operation: "+operation, http.StatusInternalServerError)
 		return
 	}
 
-	webreq := extension.Request{
-		V1: &extension.V1{
-			Hostname:    host.Name,
-			IPv4Address: host.IPv4Addr,
-			LastBoot:    host.LastSessionCreation,
-			RawQuery:    req.URL.RawQuery,
-		},
+	webreq := env.extensionRequest(host, operation, req.URL.RawQuery)
+	body := webreq.Encode()
+	if env.extensionRequestTooLarge(body) {
+		http.Error(rw, "Extension request is too large for operation: "+operation, http.StatusRequestEntityTooLarge)
+		return
 	}
 
-	extURL, err := url.Parse(storage.Extensions[operation])
+	extURLs, err := parseURLs(extensionURLs)
 	if err != nil {
 		http.Error(rw, "Failed to parse extension URL for operation: "+operation, http.StatusInternalServerError)
 		return
 	}
+	extURL := extURLs[0]
+
+	// The proxy forwards the client headers, including any trace context.
+	log.Printf("Extension %s request for %s: trace %s", operation, hostname, traceID(req))
+	proxy := newReverseProxy(extURL, body)
+	proxy.ModifyResponse = mapStatus(env.ExtensionStatusMap, env.saveCollectedInformation(hostname, operation))
+	proxy.Transport = env.extensionTransport()
+	proxy.FlushInterval = env.ExtensionFlushInterval
+	if proxy.FlushInterval == 0 {
+		// A negative interval flushes after every write.
+		proxy.FlushInterval = -1
+	}
+	if retries := env.ExtensionRetries[operation]; retries > 0 {
+		proxy.Transport = &retryTransport{base: proxy.Transport, retries: retries}
+	}
+	if len(extURLs) > 1 {
+		proxy.Transport = &failoverTransport{base: proxy.Transport, backups: extURLs[1:]}
+	}
 
-	// TODO: track metrics about extension requests:
-	//  * histogram of request latencies,
-	//  * counts status codes,
-	srv := newReverseProxy(extURL, webreq.Encode())
+	// Record extension request latencies and status codes for the operation.
+	var srv http.Handler = proxy
+	for _, obs := range metrics.ExtensionDurationObservers(env.ExtensionLatencyMetrics) {
+		srv = promhttp.InstrumentHandlerDuration(
+			obs.MustCurryWith(prometheus.Labels{"operation": operation}), srv)
+	}
 	srv.ServeHTTP(rw, req)
 }
 
+// maxCollectedResponseBytes is the largest extension response searched for
+// collected values. Larger responses are forwarded without saving them.
+const maxCollectedResponseBytes = 1024 * 1024
+
+// collectingBody forwards an extension response body while retaining up to
+// maxCollectedResponseBytes of it. Once the whole body has been read, done is
+// called with the retained body, unless the body was too large.
+type collectingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	overflow bool
+	done     func(body []byte)
+}
+
+func (b *collectingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if b.buf.Len()+n > maxCollectedResponseBytes {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && b.done != nil {
+		if !b.overflow {
+			b.done(b.buf.Bytes())
+		}
+		b.done = nil
+	}
+	return n, err
+}
+
+// saveCollectedInformation returns a ReverseProxy.ModifyResponse function that
+// saves any collected values from a successful extension response to the
+// host record. The response body is streamed to the client unchanged, and the
+// values are saved once the client has received the whole body.
+func (env *Env) saveCollectedInformation(hostname, operation string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil
+		}
+		resp.Body = &collectingBody{
+			ReadCloser: resp.Body,
+			done: func(body []byte) {
+				env.saveCollectedValues(hostname, operation, body)
+			},
+		}
+		return nil
+	}
+}
+
+// saveCollectedValues saves the collected values in the extension response
+// body, if any, to the host record.
+func (env *Env) saveCollectedValues(hostname, operation string, body []byte) {
+	extResp := &extension.Response{}
+	if extResp.Decode(bytes.NewReader(body)) != nil || len(extResp.Collected) == 0 {
+		// Responses are not required to include collected values.
+		return
+	}
+	values := url.Values{}
+	for key, value := range extResp.Collected {
+		values.Set(key, value)
+	}
+	_, err := env.Config.Update(hostname, func(host *storage.Host) error {
+		host.AddInformation(values)
+		return nil
+	})
+	if err != nil {
+		// The extension already completed, so the client still receives the response.
+		log.Printf("Failed to save collected information from %q for %q: %v",
+			operation, hostname, err)
+	}
+}
+
+// genericContentTypes are upstream Content-Types replaced by the storage proxy
+// when a more specific type is known for the file suffix.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// setContentType returns a ModifyResponse function that replaces a generic
+// response Content-Type with the type in contentTypes for the file suffix of
+// the request path.
+func setContentType(contentTypes map[string]string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if !genericContentTypes[resp.Header.Get("Content-Type")] {
+			return nil
+		}
+		if t, ok := contentTypes[path.Ext(resp.Request.URL.Path)]; ok {
+			resp.Header.Set("Content-Type", t)
+		}
+		return nil
+	}
+}
+
+// storageErrorStatus returns the status returned to clients for an upstream
+// storage response, and true if the response is an error. Upstream server
+// errors become 502 Bad Gateway. Some buckets answer missing objects with an
+// HTML error page and status 200, so HTML responses for any file that is not
+// itself HTML are reported as 404 Not Found; boot artifacts are never HTML.
+func storageErrorStatus(resp *http.Response) (int, bool) {
+	switch {
+	case resp.StatusCode >= 500:
+		return http.StatusBadGateway, true
+	case resp.StatusCode >= 400:
+		return resp.StatusCode, true
+	case resp.StatusCode == http.StatusOK &&
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"):
+		switch path.Ext(resp.Request.URL.Path) {
+		case ".html", ".htm":
+			return resp.StatusCode, false
+		}
+		return http.StatusNotFound, true
+	}
+	return resp.StatusCode, false
+}
+
+// normalizeStorageError replaces an upstream storage error response with a
+// plain text error that clients and caches will not mistake for content, and
+// returns true. Non-error responses are unchanged and return false.
+func normalizeStorageError(resp *http.Response) bool {
+	status, isErr := storageErrorStatus(resp)
+	if !isErr {
+		return false
+	}
+	log.Printf("StorageProxy upstream error: %s %s; returning %d",
+		resp.Request.URL, resp.Status, status)
+	resp.Body.Close()
+	body := http.StatusText(status) + "\n"
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	resp.Header = http.Header{}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(strings.NewReader(body))
+	return true
+}
+
+// storageModifyResponse returns a ModifyResponse function for the storage
+// proxy that normalizes upstream errors and sets the Content-Type of all other
+// responses using contentTypes.
+func storageModifyResponse(contentTypes map[string]string) func(*http.Response) error {
+	setType := setContentType(contentTypes)
+	return func(resp *http.Response) error {
+		if normalizeStorageError(resp) {
+			return nil
+		}
+		return setType(resp)
+	}
+}
+
 // newStorageReverseProxy creates an httputil.ReverseProxy that forwards requests
 // to the given target URL prefix. Client request paths are concatenated onto the
-// target prefix URL path.
-func newStorageReverseProxy(storagePrefixURL string) *httputil.ReverseProxy {
+// target prefix URL path. Upstream errors are normalized, and generic response
+// Content-Types are replaced using contentTypes.
+func newStorageReverseProxy(storagePrefixURL string, contentTypes map[string]string) *httputil.ReverseProxy {
 	target, err := url.Parse(storagePrefixURL)
 	rtx.Must(err, "Failed to parse static GCS URL")
 
@@ -391,15 +1248,28 @@ func newStorageReverseProxy(storagePrefixURL string) *httputil.ReverseProxy {
 			req.Header.Set("User-Agent", "")
 		}
 		log.Println(req.RemoteAddr, req.Method, req.Host, req.Header, req.RequestURI)
-		log.Println("StorageProxy request:", req.URL)
+		log.Printf("StorageProxy request: %s trace %s", req.URL, traceID(req))
 	}
-	return &httputil.ReverseProxy{Director: director}
+	return &httputil.ReverseProxy{Director: director, ModifyResponse: storageModifyResponse(contentTypes)}
+}
+
+// storagePrefixURL returns the storage prefix URL for the region named in the
+// request. If the request names no region, or the region is unknown, then the
+// default StoragePrefixURL is returned.
+func (env *Env) storagePrefixURL(req *http.Request) string {
+	region := req.Header.Get(StorageRegionHeader)
+	if prefix, ok := env.StorageRegionPrefixURLs[region]; ok && region != "" {
+		return prefix
+	}
+	return env.StoragePrefixURL
 }
 
 // HandleStorageProxy creates a pass-through proxy for GET requests
-// by concatenating the request "path" to the environment's StoragePrefixURL.
+// by concatenating the request "path" to the environment's StoragePrefixURL,
+// or the region-specific prefix from StorageRegionPrefixURLs.
 func (env *Env) HandleStorageProxy(rw http.ResponseWriter, req *http.Request) {
-	if env.StoragePrefixURL == "" {
+	prefix := env.storagePrefixURL(req)
+	if prefix == "" {
 		// When no storage prefix url is given, then signal that this is unsupported.
 		http.Error(rw, "StoragePrefixURL is not specified", http.StatusNotImplemented)
 		return
@@ -413,6 +1283,6 @@ func (env *Env) HandleStorageProxy(rw http.ResponseWriter, req *http.Request) {
 	path := mux.Vars(req)["path"]
 	req.URL.Path = "/" + path
 
-	srv := newStorageReverseProxy(env.StoragePrefixURL)
+	srv := newStorageReverseProxy(prefix, env.StorageContentTypes)
 	srv.ServeHTTP(rw, req)
 }
@@ -16,20 +16,43 @@
 package handler
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/m-lab/epoxy/datastorex"
 	"github.com/m-lab/epoxy/extension"
+	"github.com/m-lab/epoxy/metrics"
 	"github.com/m-lab/epoxy/nextboot"
 	"github.com/m-lab/epoxy/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // fakeConfig is a minimal Config implementation that emulates Host storage with a
@@ -40,8 +63,17 @@ type fakeConfig struct {
 	failOnSave bool
 }
 
+// fakeConfigMu serializes access to fakeConfig hosts to emulate a transaction.
+var fakeConfigMu sync.Mutex
+
 // Save copies the host parameter to the fakeConfig.
 func (f fakeConfig) Save(host *storage.Host) error {
+	fakeConfigMu.Lock()
+	defer fakeConfigMu.Unlock()
+	return f.save(host)
+}
+
+func (f fakeConfig) save(host *storage.Host) error {
 	if f.failOnSave {
 		return errors.New("Failed to save: " + host.Name)
 	}
@@ -51,6 +83,12 @@ func (f fakeConfig) Save(host *storage.Host) error {
 
 // Save returns a copy of the fakeConfig host.
 func (f fakeConfig) Load(name string) (*storage.Host, error) {
+	fakeConfigMu.Lock()
+	defer fakeConfigMu.Unlock()
+	return f.load(name)
+}
+
+func (f fakeConfig) load(name string) (*storage.Host, error) {
 	if f.failOnLoad {
 		return nil, errors.New("Failed to load: " + name)
 	}
@@ -59,6 +97,92 @@ func (f fakeConfig) Load(name string) (*storage.Host, error) {
 	return h, nil
 }
 
+// Update loads a copy of the fakeConfig host, applies mutate, and saves it.
+func (f fakeConfig) Update(name string, mutate func(host *storage.Host) error) (*storage.Host, error) {
+	fakeConfigMu.Lock()
+	defer fakeConfigMu.Unlock()
+	h, err := f.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := mutate(h); err != nil {
+		return nil, err
+	}
+	if err := f.save(h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// exactNameConfig is a fakeConfig that, like Datastore keys, only loads the
+// host by its exact name.
+type exactNameConfig struct {
+	fakeConfig
+}
+
+func (e exactNameConfig) Load(name string) (*storage.Host, error) {
+	if name != e.host.Name {
+		return nil, errors.New("No such host: " + name)
+	}
+	return e.fakeConfig.Load(name)
+}
+
+func (e exactNameConfig) Update(name string, mutate func(host *storage.Host) error) (*storage.Host, error) {
+	if name != e.host.Name {
+		return nil, errors.New("No such host: " + name)
+	}
+	return e.fakeConfig.Update(name, mutate)
+}
+
+func TestEnv_MixedCaseHostname(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.json",
+			storage.Stage2:     "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.json",
+		},
+	}
+	tests := []struct {
+		name     string
+		handler  func(env *Env) http.HandlerFunc
+		hostname string
+	}{
+		{
+			name:     "stage1-json-upper-case",
+			handler:  func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+			hostname: "MLAB1.IAD1T.MEASUREMENT-LAB.ORG",
+		},
+		{
+			name:     "stage2-mixed-case",
+			handler:  func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+			hostname: "Mlab1.Iad1t.measurement-lab.org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{
+				Config:                 exactNameConfig{fakeConfig{host: h}},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+			req := httptest.NewRequest("POST", "/v1/boot/"+tt.hostname+"/stage2", nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": tt.hostname, "sessionID": "12345"})
+			rec := httptest.NewRecorder()
+
+			tt.handler(env).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s wrong HTTP status: got %d; want %d: %s", tt.name, rec.Code, http.StatusOK, rec.Body.String())
+			}
+			if h.Name != "mlab1.iad1t.measurement-lab.org" {
+				t.Errorf("%s changed host name to %q", tt.name, h.Name)
+			}
+		})
+	}
+}
+
 // TestGenerateStage1IPXE performs an integration test with an httptest server and a
 // fakeConfig providing Host storage.
 func TestGenerateStage1IPXE(t *testing.T) {
@@ -216,446 +340,3032 @@ func TestEnv_GenerateStage1IPXE(t *testing.T) {
 	}
 }
 
-func TestEnv_GenerateJSONConfig(t *testing.T) {
+func TestEnv_GenerateStage1IPXEMessage(t *testing.T) {
 	h := &storage.Host{
 		Name:     "mlab1.iad1t.measurement-lab.org",
 		IPv4Addr: "165.117.240.9",
 		Boot: datastorex.Map{
-			"stage2": "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.ipxe",
+			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
 		},
-		CurrentSessionIDs: storage.SessionIDs{
-			Stage2ID: "12345",
+		Message: "disk 100% full, replace %s",
+	}
+	env := &Env{
+		Config:                 fakeConfig{host: h},
+		ServerAddr:             "example.com:4321",
+		AllowForwardedRequests: true,
+	}
+	req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+	req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+	req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+	rec := httptest.NewRecorder()
+	env.GenerateStage1IPXE(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GenerateStage1IPXE() wrong HTTP status: got %v; want %v", rec.Code, http.StatusOK)
+	}
+	// The script is written verbatim, not interpreted as a format string.
+	if !strings.Contains(rec.Body.String(), "echo disk 100% full, replace %s") {
+		t.Errorf("GenerateStage1IPXE() did not write message verbatim:\n%s", rec.Body.String())
+	}
+}
+
+func TestEnv_GenerateStage1IPXEUpdateFallback(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/boot.ipxe",
 		},
+		Update: datastorex.Map{
+			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/update.ipxe",
+		},
+		UpdateEnabled:     true,
+		MaxUpdateAttempts: 2,
+	}
+	env := &Env{
+		Config:                 fakeConfig{host: h},
+		ServerAddr:             "example.com:4321",
+		AllowForwardedRequests: true,
+	}
+	// Without a successful report, the third boot falls back to the Boot sequence.
+	want := []string{"update.ipxe", "update.ipxe", "boot.ipxe"}
+	for i, name := range want {
+		req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+		req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+		req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+		rec := httptest.NewRecorder()
+		env.GenerateStage1IPXE(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GenerateStage1IPXE() wrong HTTP status: got %v; want %v", rec.Code, http.StatusOK)
+		}
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("GenerateStage1IPXE() boot %d does not chain to %q:\n%s", i+1, name, rec.Body.String())
+		}
 	}
+	if h.UpdateAttempts != 3 {
+		t.Errorf("GenerateStage1IPXE() wrong UpdateAttempts: got %d; want 3", h.UpdateAttempts)
+	}
+}
+
+func TestEnv_SessionReuseWindow(t *testing.T) {
 	tests := []struct {
-		name     string
-		config   fakeConfig
-		status   int
-		from     string
-		expected string
+		name    string
+		window  time.Duration
+		elapsed time.Duration
+		reused  bool
 	}{
 		{
-			name:     "okay",
-			config:   fakeConfig{host: h, failOnLoad: false, failOnSave: false},
-			status:   http.StatusOK,
-			from:     h.IPv4Addr,
-			expected: (&nextboot.Config{V1: &nextboot.V1{Chain: h.Boot["stage2"]}}).String(),
+			name:   "reuse-disabled",
+			reused: false,
 		},
 		{
-			name:     "fail-on-load",
-			config:   fakeConfig{host: h, failOnLoad: true, failOnSave: false},
-			status:   http.StatusNotFound,
-			from:     h.IPv4Addr,
-			expected: "Failed to load: mlab1.iad1t.measurement-lab.org\n",
+			name:    "within-window",
+			window:  time.Minute,
+			elapsed: 10 * time.Second,
+			reused:  true,
 		},
 		{
-			name:     "fail-from-wrong-ip",
-			config:   fakeConfig{host: h},
-			status:   http.StatusForbidden,
-			from:     "192.168.0.1",
-			expected: "Caller cannot access host\n",
+			name:    "beyond-window",
+			window:  time.Minute,
+			elapsed: 2 * time.Minute,
+			reused:  false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			vars := map[string]string{"hostname": h.Name, "sessionID": h.CurrentSessionIDs.Stage2ID}
-			path := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/stage2"
-			req := httptest.NewRequest("POST", path, nil)
-			req.Header.Set("X-Forwarded-For", tt.from)
-			rec := httptest.NewRecorder()
-
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				Boot: datastorex.Map{
+					storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+					storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.json",
+				},
+			}
 			env := &Env{
-				Config:                 tt.config,
+				Config:                 fakeConfig{host: h},
 				ServerAddr:             "example.com:4321",
 				AllowForwardedRequests: true,
+				SessionReuseWindow:     tt.window,
+			}
+			stage1 := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/"+target, nil)
+				req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+				req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+				rec := httptest.NewRecorder()
+				handler(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s wrong HTTP status: got %d; want %d", target, rec.Code, http.StatusOK)
+				}
+				return rec
 			}
-			req = mux.SetURLVars(req, vars)
-			env.GenerateJSONConfig(rec, req)
 
-			if rec.Code != tt.status {
-				t.Errorf("GenerateJSONConfig() wrong HTTP status: got %v; want %v", rec.Code, tt.status)
+			stage1(env.GenerateStage1IPXE, "stage1.ipxe")
+			first := h.CurrentSessionIDs
+			// Emulate the time between the two stage1 requests.
+			h.LastSessionCreation = h.LastSessionCreation.Add(-tt.elapsed)
+			rec := stage1(env.GenerateStage1JSON, "stage1.json")
+
+			if reused := h.CurrentSessionIDs == first; reused != tt.reused {
+				t.Errorf("session reused = %t; want %t", reused, tt.reused)
 			}
-			if tt.expected != rec.Body.String() {
-				t.Errorf("GenerateJSONConfig() wrong response: got %v\n; want %v\n", rec.Body.String(), tt.expected)
+			if reused := strings.Contains(rec.Body.String(), first.Stage2ID); reused != tt.reused {
+				t.Errorf("stage1.json contains first Stage2ID = %t; want %t:\n%s",
+					reused, tt.reused, rec.Body.String())
 			}
 		})
 	}
 }
 
-func TestEnv_ReceiveReport(t *testing.T) {
-	h := &storage.Host{
-		Name:     "mlab1.iad1t.measurement-lab.org",
-		IPv4Addr: "165.117.240.9",
-		CurrentSessionIDs: storage.SessionIDs{
-			ReportID: "12345",
-		},
-	}
+func TestEnv_GenerateStage1IPXEDirectives(t *testing.T) {
 	tests := []struct {
-		name            string
-		sessionID       string
-		from            string
-		expectedStatus  int
-		expectedEnabled bool
-		form            url.Values
+		name       string
+		query      string
+		admin      bool
+		wantStatus int
+		wantLine   string
 	}{
 		{
-			name:            "disable-update-enabled-on-success",
-			sessionID:       "12345",
-			from:            h.IPv4Addr,
-			expectedStatus:  http.StatusNoContent,
-			expectedEnabled: false,
-			form: url.Values{
-				"message": []string{"success"},
-			},
+			name:       "no-directives",
+			wantStatus: http.StatusOK,
 		},
 		{
-			name:            "preserve-update-enabled-on-failure",
-			sessionID:       "12345",
-			from:            h.IPv4Addr,
-			expectedStatus:  http.StatusNoContent,
-			expectedEnabled: true,
-			form: url.Values{
-				"message": []string{"error: something failed"},
-			},
+			name:       "allowed-directive",
+			query:      "?directive=ifstat&directive=dhcp",
+			admin:      true,
+			wantStatus: http.StatusOK,
+			wantLine:   "ifstat\ndhcp\n",
 		},
 		{
-			name:            "bad-session-returns-forbidden",
-			sessionID:       "mismatched-session-id",
-			from:            h.IPv4Addr,
-			expectedStatus:  http.StatusForbidden,
-			expectedEnabled: true,
-			form:            url.Values{},
+			name:       "disallowed-directive",
+			query:      "?directive=shell",
+			admin:      true,
+			wantStatus: http.StatusBadRequest,
 		},
 		{
-			name:            "fail-from-wrong-ip",
-			sessionID:       "12345",
-			from:            "192.168.0.1",
-			expectedStatus:  http.StatusForbidden,
-			expectedEnabled: true,
-			form:            url.Values{},
+			name:       "unauthenticated-directive",
+			query:      "?directive=ifstat",
+			wantStatus: http.StatusUnauthorized,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			vars := map[string]string{"hostname": h.Name, "sessionID": tt.sessionID}
-			path := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/report"
-			h.UpdateEnabled = true
-
-			req := httptest.NewRequest("POST", path, strings.NewReader(tt.form.Encode()))
-			// Mark the body as form content to be read by ParseForm.
-			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-			req.Header.Set("X-Forwarded-For", tt.from)
-			rec := httptest.NewRecorder()
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				Boot: datastorex.Map{
+					storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+				},
+			}
 			env := &Env{
-				Config:                 fakeConfig{host: h, failOnLoad: false, failOnSave: false},
+				Config:                 fakeConfig{host: h},
 				ServerAddr:             "example.com:4321",
 				AllowForwardedRequests: true,
+				AdminCredentials:       map[string]string{"admin": "secret"},
 			}
-			req = mux.SetURLVars(req, vars)
-			env.ReceiveReport(rec, req)
-
-			if rec.Code != tt.expectedStatus {
-				t.Errorf("ReceiveReport() wrong HTTP status: got %v; want %v", rec.Code, tt.expectedStatus)
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe"+tt.query, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			if tt.admin {
+				req.SetBasicAuth("admin", "secret")
 			}
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+			rec := httptest.NewRecorder()
 
-			if h.UpdateEnabled != tt.expectedEnabled {
-				t.Errorf("ReceiveReport() failed to change UpdateEnabled: got %t; want %t",
-					h.UpdateEnabled, tt.expectedEnabled)
+			env.GenerateStage1IPXE(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("GenerateStage1IPXE() wrong HTTP status: got %d; want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				// Rejected requests never start a session.
+				if !h.LastSessionCreation.IsZero() {
+					t.Errorf("GenerateStage1IPXE() started a session for a rejected request")
+				}
+				return
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantLine) {
+				t.Errorf("GenerateStage1IPXE() missing directives %q:\n%s", tt.wantLine, rec.Body.String())
+			}
+			if tt.wantLine == "" {
+				return
+			}
+			// Directives only apply to one script, and are never saved.
+			req = httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+			rec = httptest.NewRecorder()
+			env.GenerateStage1IPXE(rec, req)
+			if strings.Contains(rec.Body.String(), tt.wantLine) {
+				t.Errorf("GenerateStage1IPXE() repeated directives %q:\n%s", tt.wantLine, rec.Body.String())
 			}
 		})
 	}
 }
 
-func TestEnv_HandleExtension(t *testing.T) {
-	// Generic Host record for all tests.
-	h := &storage.Host{
-		Name:     "mlab1.iad1t.measurement-lab.org",
-		IPv4Addr: "165.117.240.9",
-		CurrentSessionIDs: storage.SessionIDs{
-			ExtensionID: "12345",
-		},
-		LastSessionCreation: time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
-	}
-	// The request that should be received by the extension server.
-	expectedRequest := &extension.Request{
-		V1: &extension.V1{
-			Hostname:    h.Name,
-			IPv4Address: h.IPv4Addr,
-			LastBoot:    h.LastSessionCreation,
-		},
-	}
+func TestEnv_Maintenance(t *testing.T) {
 	tests := []struct {
 		name            string
-		sessionID       string
-		operation       string
-		failOnLoad      bool
-		urlPrefix       string
-		from            string
-		expectedStatus  int
-		expectedResult  string
-		expectedRequest *extension.Request
+		handler         func(env *Env) http.HandlerFunc
+		path            string
+		until           time.Duration
+		wantMaintenance bool
 	}{
 		{
-			name:            "successful-request",
-			sessionID:       "12345",
-			operation:       "foobar",
-			from:            h.IPv4Addr,
-			expectedStatus:  http.StatusOK,
-			expectedResult:  "okay",
-			expectedRequest: expectedRequest,
-		},
-		{
-			name:            "failure-backend-returns-notfound",
-			sessionID:       "12345",
-			operation:       "foobar",
-			from:            h.IPv4Addr,
-			expectedStatus:  http.StatusNotFound,
-			expectedResult:  "not found",
-			expectedRequest: expectedRequest,
-		},
-		{
-			name:           "failure-failonload",
-			failOnLoad:     true,
-			expectedStatus: http.StatusNotFound,
+			name:            "stage1-ipxe-before-maintenance-ends",
+			handler:         func(env *Env) http.HandlerFunc { return env.GenerateStage1IPXE },
+			path:            "stage1.ipxe",
+			until:           time.Hour,
+			wantMaintenance: true,
 		},
 		{
-			name:           "failure-bad-sessionid",
-			sessionID:      "54321",
-			from:           h.IPv4Addr,
-			expectedStatus: http.StatusForbidden,
+			name:    "stage1-ipxe-after-maintenance-ends",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateStage1IPXE },
+			path:    "stage1.ipxe",
+			until:   -time.Minute,
 		},
 		{
-			name:           "failure-from-wrong-ip",
-			sessionID:      "54321",
-			from:           "192.168.0.1",
-			expectedStatus: http.StatusForbidden,
+			name:            "stage1-json-before-maintenance-ends",
+			handler:         func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+			path:            "stage1.json",
+			until:           time.Hour,
+			wantMaintenance: true,
 		},
 		{
-			name:           "failure-zerolength-operation",
-			sessionID:      "12345",
-			operation:      "",
-			from:           h.IPv4Addr,
-			expectedStatus: http.StatusBadRequest,
+			name:    "stage1-json-after-maintenance-ends",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+			path:    "stage1.json",
+			until:   -time.Minute,
 		},
 		{
-			name:           "failure-unknown-operation",
-			sessionID:      "12345",
-			operation:      "unknown",
-			from:           h.IPv4Addr,
-			expectedStatus: http.StatusInternalServerError,
+			name:            "stage2-before-maintenance-ends",
+			handler:         func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+			path:            "12345/stage2",
+			until:           time.Hour,
+			wantMaintenance: true,
 		},
 		{
-			name:           "failure-parsing-extension-url",
-			sessionID:      "12345",
-			operation:      "foobar",
-			from:           h.IPv4Addr,
-			urlPrefix:      ":", // with this character, the backend URL will fail to parse.
-			expectedStatus: http.StatusInternalServerError,
+			name:    "stage2-after-maintenance-ends",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+			path:    "12345/stage2",
+			until:   -time.Minute,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Pseudo variables for mux.Vars.
-			vars := map[string]string{
-				"hostname":  h.Name,
-				"sessionID": tt.sessionID,
-				"operation": tt.operation,
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				Boot: datastorex.Map{
+					storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+					storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.json",
+					storage.Stage2:     "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.json",
+				},
+				CurrentSessionIDs: storage.SessionIDs{Stage2ID: "12345"},
+				MaintenanceUntil:  time.Now().Add(tt.until),
 			}
-			extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/foobar"
-
-			req := httptest.NewRequest("POST", extURL, nil)
-			req.Header.Set("X-Forwarded-For", tt.from)
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/"+tt.path, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name, "sessionID": "12345"})
 			rec := httptest.NewRecorder()
+
+			tt.handler(env).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s wrong HTTP status: got %d; want %d", tt.name, rec.Code, http.StatusOK)
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, "Maintenance until"); got != tt.wantMaintenance {
+				t.Errorf("%s returned maintenance config = %t; want %t:\n%s", tt.name, got, tt.wantMaintenance, body)
+			}
+			// Sessions only start when the host is not in maintenance.
+			if started := h.CurrentSessionIDs.Stage2ID != "12345"; strings.HasPrefix(tt.path, "stage1") &&
+				started == tt.wantMaintenance {
+				t.Errorf("%s started new session = %t; want %t", tt.name, started, !tt.wantMaintenance)
+			}
+		})
+	}
+}
+
+func TestEnv_Stage1SequenceMetrics(t *testing.T) {
+	tests := []struct {
+		name          string
+		handler       func(env *Env) http.HandlerFunc
+		target        string
+		updateEnabled bool
+		attempts      int
+		want          string
+	}{
+		{
+			name:    "ipxe-boot",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateStage1IPXE },
+			target:  "stage1.ipxe",
+			want:    "boot",
+		},
+		{
+			name:          "ipxe-update",
+			handler:       func(env *Env) http.HandlerFunc { return env.GenerateStage1IPXE },
+			target:        "stage1.ipxe",
+			updateEnabled: true,
+			want:          "update",
+		},
+		{
+			name:    "json-boot",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+			target:  "stage1.json",
+			want:    "boot",
+		},
+		{
+			name:          "json-update",
+			handler:       func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+			target:        "stage1.json",
+			updateEnabled: true,
+			want:          "update",
+		},
+		{
+			name:          "json-update-attempts-exhausted",
+			handler:       func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+			target:        "stage1.json",
+			updateEnabled: true,
+			attempts:      2,
+			want:          "boot",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				Boot: datastorex.Map{
+					storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/boot.ipxe",
+					storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/boot.json",
+				},
+				Update: datastorex.Map{
+					storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/update.ipxe",
+					storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/update.json",
+				},
+				UpdateEnabled:     tt.updateEnabled,
+				UpdateAttempts:    tt.attempts,
+				MaxUpdateAttempts: 2,
+			}
 			env := &Env{
-				Config:                 fakeConfig{host: h, failOnLoad: tt.failOnLoad},
+				Config:                 fakeConfig{host: h},
 				ServerAddr:             "example.com:4321",
 				AllowForwardedRequests: true,
 			}
-			req = mux.SetURLVars(req, vars)
-			// Setup a fake extension server to handle the Request.
-			ts := httptest.NewServer(
-				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					ext := &extension.Request{}
-					err := ext.Decode(r.Body)
-					if err != nil {
-						// Decode failed, bad request.
-						w.WriteHeader(http.StatusBadRequest)
-						return
-					}
-					// Decode was successful, so make sure it's what we expect.
-					if !tt.expectedRequest.V1.LastBoot.Equal(ext.V1.LastBoot) ||
-						tt.expectedRequest.V1.Hostname != ext.V1.Hostname ||
-						tt.expectedRequest.V1.IPv4Address != ext.V1.IPv4Address ||
-						tt.expectedRequest.V1.IPv6Address != ext.V1.IPv6Address {
-						t.Errorf("HandleExtension() malformed request: got %#v, want %#v",
-							ext.V1, tt.expectedRequest.V1)
-					}
-					// Unconditionally report the test-defined status.
-					w.WriteHeader(tt.expectedStatus)
-					w.Write([]byte(tt.expectedResult))
-				}))
-			defer ts.Close()
-			// TODO: this modifies a global variable, which may have side-effects.
-			// This will be eliminated once Extensions are read from datastore.
-			storage.Extensions["foobar"] = tt.urlPrefix + ts.URL
+			boot := metrics.Stage1SequenceTotal.WithLabelValues("boot")
+			update := metrics.Stage1SequenceTotal.WithLabelValues("update")
+			before := map[string]float64{"boot": testutil.ToFloat64(boot), "update": testutil.ToFloat64(update)}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/"+tt.target, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+			rec := httptest.NewRecorder()
 
-			// Run the extension handler.
-			env.HandleExtension(rec, req)
+			tt.handler(env).ServeHTTP(rec, req)
 
-			if tt.expectedStatus != rec.Code {
-				t.Errorf("HandleExtension() wrong HTTP status: got %v; want %v",
-					rec.Code, tt.expectedStatus)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s wrong HTTP status: got %d; want %d", tt.target, rec.Code, http.StatusOK)
 			}
-			if tt.expectedResult != "" && tt.expectedResult != rec.Body.String() {
-				t.Errorf("HandleExtension() wrong result forwarded: got %v\n; want %v\n",
-					rec.Body.String(), tt.expectedResult)
+			after := map[string]float64{"boot": testutil.ToFloat64(boot), "update": testutil.ToFloat64(update)}
+			for _, name := range []string{"boot", "update"} {
+				want := before[name]
+				if name == tt.want {
+					want++
+				}
+				if after[name] != want {
+					t.Errorf("epoxy_stage1_sequence_total{sequence=%q} = %v; want %v", name, after[name], want)
+				}
 			}
 		})
 	}
 }
 
-func TestEnv_GenerateStage1JSON(t *testing.T) {
+// fakeGroups is a GroupConfig implementation with a fixed set of groups.
+type fakeGroups map[string]*storage.HostGroup
+
+func (f fakeGroups) LoadGroup(name string) (*storage.HostGroup, error) {
+	g, ok := f[name]
+	if !ok {
+		return nil, errors.New("Failed to load group: " + name)
+	}
+	return g, nil
+}
+
+func TestEnv_GroupSequences(t *testing.T) {
+	groups := fakeGroups{
+		"physical": &storage.HostGroup{
+			Name: "physical",
+			Boot: datastorex.Map{
+				storage.Stage1IPXE: "https://storage.googleapis.com/epoxy/group/stage1to2.ipxe",
+				storage.Stage2:     "https://storage.googleapis.com/epoxy/group/stage2to3.json",
+				storage.Stage3:     "https://storage.googleapis.com/epoxy/group/stage3post.json",
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		group      string
+		groups     GroupConfig
+		status     int
+		wantStage1 string
+		wantStage2 string
+		wantStage3 string
+	}{
+		{
+			name:       "inherit-group-and-override-stage2",
+			group:      "physical",
+			groups:     groups,
+			status:     http.StatusOK,
+			wantStage1: "https://storage.googleapis.com/epoxy/group/stage1to2.ipxe",
+			wantStage2: "https://storage.googleapis.com/epoxy/host/stage2to3.json",
+			wantStage3: "https://storage.googleapis.com/epoxy/group/stage3post.json",
+		},
+		{
+			name:   "missing-group",
+			group:  "virtual",
+			groups: groups,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "groups-unavailable",
+			group:  "physical",
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				Group:    tt.group,
+				Boot: datastorex.Map{
+					storage.Stage2: "https://storage.googleapis.com/epoxy/host/stage2to3.json",
+				},
+			}
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				Groups:                 tt.groups,
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+			rec := httptest.NewRecorder()
+			env.GenerateStage1IPXE(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("GenerateStage1IPXE() wrong HTTP status: got %v; want %v", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantStage1) {
+				t.Errorf("GenerateStage1IPXE() missing group stage1 %q in:\n%s", tt.wantStage1, rec.Body.String())
+			}
+			// Inherited stages are never saved to the host record.
+			if len(h.Boot) != 1 {
+				t.Errorf("GenerateStage1IPXE() saved inherited stages: got %v", h.Boot)
+			}
+
+			for stage, want := range map[string]string{"stage2": tt.wantStage2, "stage3": tt.wantStage3} {
+				path := "/v1/boot/" + h.Name + "/12345/" + stage
+				req := httptest.NewRequest("POST", path, nil)
+				req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+				req = mux.SetURLVars(req, map[string]string{"hostname": h.Name, "sessionID": "12345"})
+				rec := httptest.NewRecorder()
+				env.GenerateJSONConfig(rec, req)
+
+				expected := (&nextboot.Config{V1: &nextboot.V1{Chain: want}}).String()
+				if rec.Body.String() != expected {
+					t.Errorf("GenerateJSONConfig(%s) wrong response: got %v\n; want %v\n", stage, rec.Body.String(), expected)
+				}
+			}
+		})
+	}
+}
+
+func TestEnv_GenerateStage1IPXEFirmware(t *testing.T) {
 	h := &storage.Host{
 		Name:     "mlab1.iad1t.measurement-lab.org",
 		IPv4Addr: "165.117.240.9",
 		Boot: datastorex.Map{
-			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+			storage.Stage1IPXE:          "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+			storage.Stage1IPXE + ".efi": "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2-efi.ipxe",
+		},
+	}
+	env := &Env{
+		Config:                 fakeConfig{host: h},
+		ServerAddr:             "example.com:4321",
+		AllowForwardedRequests: true,
+	}
+	form := url.Values{"platform": {"efi"}, "secureboot": {"false"}}
+	req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+	req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+	rec := httptest.NewRecorder()
+	env.GenerateStage1IPXE(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GenerateStage1IPXE() wrong HTTP status: got %v; want %v", rec.Code, http.StatusOK)
+	}
+	if h.Firmware != storage.FirmwareEFI || h.SecureBoot {
+		t.Errorf("GenerateStage1IPXE() saved firmware %q, secure boot %t; want %q, false",
+			h.Firmware, h.SecureBoot, storage.FirmwareEFI)
+	}
+	if h.CollectedInformation["secureboot"] != "false" {
+		t.Errorf("GenerateStage1IPXE() did not collect secureboot: got %v", h.CollectedInformation)
+	}
+	if want := h.Boot[storage.Stage1IPXE+".efi"]; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("GenerateStage1IPXE() does not chain to %q:\n%s", want, rec.Body.String())
+	}
+}
+
+func TestEnv_GenerateJSONConfig(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			"stage2": "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.ipxe",
+		},
+		CurrentSessionIDs: storage.SessionIDs{
+			Stage2ID: "12345",
 		},
 	}
 	tests := []struct {
-		name   string
-		vars   map[string]string
-		req    *http.Request
-		config fakeConfig
-		from   string
-		status int
+		name     string
+		config   fakeConfig
+		status   int
+		from     string
+		expected string
 	}{
 		{
-			name:   "okay",
-			vars:   map[string]string{"hostname": h.Name},
-			config: fakeConfig{host: h, failOnLoad: false, failOnSave: false},
-			from:   h.IPv4Addr,
-			status: http.StatusOK,
+			name:     "okay",
+			config:   fakeConfig{host: h, failOnLoad: false, failOnSave: false},
+			status:   http.StatusOK,
+			from:     h.IPv4Addr,
+			expected: (&nextboot.Config{V1: &nextboot.V1{Chain: h.Boot["stage2"]}}).String(),
 		},
 		{
-			name:   "fail-on-load",
-			vars:   map[string]string{"hostname": h.Name},
-			config: fakeConfig{host: h, failOnLoad: true, failOnSave: false},
-			from:   h.IPv4Addr,
-			status: http.StatusNotFound,
+			name:     "fail-on-load",
+			config:   fakeConfig{host: h, failOnLoad: true, failOnSave: false},
+			status:   http.StatusNotFound,
+			from:     h.IPv4Addr,
+			expected: "Failed to load: mlab1.iad1t.measurement-lab.org\n",
 		},
 		{
-			name:   "fail-on-save",
-			config: fakeConfig{host: h, failOnLoad: false, failOnSave: true},
-			from:   h.IPv4Addr,
-			status: http.StatusInternalServerError,
+			name:     "fail-from-wrong-ip",
+			config:   fakeConfig{host: h},
+			status:   http.StatusForbidden,
+			from:     "192.168.0.1",
+			expected: "Caller cannot access host\n",
 		},
-		// TODO(soltesz): enable once plc-updates are complete.
-		/*
-			{
-				name:   "fail-from-wrong-ip",
-				config: fakeConfig{host: h},
-				from:   "192.168.0.1",
-				status: http.StatusForbidden,
-			},
-		*/
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			vars := map[string]string{"hostname": h.Name}
-			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+			vars := map[string]string{"hostname": h.Name, "sessionID": h.CurrentSessionIDs.Stage2ID}
+			path := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/stage2"
+			req := httptest.NewRequest("POST", path, nil)
 			req.Header.Set("X-Forwarded-For", tt.from)
 			rec := httptest.NewRecorder()
+
 			env := &Env{
 				Config:                 tt.config,
 				ServerAddr:             "example.com:4321",
 				AllowForwardedRequests: true,
 			}
 			req = mux.SetURLVars(req, vars)
-			env.GenerateStage1JSON(rec, req)
+			env.GenerateJSONConfig(rec, req)
 
 			if rec.Code != tt.status {
-				t.Errorf("GenerateStage1JSON() wrong HTTP status: got %v; want %v", rec.Code, tt.status)
+				t.Errorf("GenerateJSONConfig() wrong HTTP status: got %v; want %v", rec.Code, tt.status)
+			}
+			if tt.expected != rec.Body.String() {
+				t.Errorf("GenerateJSONConfig() wrong response: got %v\n; want %v\n", rec.Body.String(), tt.expected)
 			}
 		})
 	}
 }
 
-func TestEnv_HandleStorageProxy(t *testing.T) {
+func TestEnv_ReceiveReport(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		CurrentSessionIDs: storage.SessionIDs{
+			ReportID: "12345",
+		},
+	}
 	tests := []struct {
-		name           string
-		storagePath    string
-		method         string
-		expectedStatus int
-		expectedResult string
-		disableStorage bool
+		name             string
+		sessionID        string
+		from             string
+		expectedStatus   int
+		expectedEnabled  bool
+		expectedRotation bool
+		form             url.Values
 	}{
 		{
-			name:           "success",
-			storagePath:    "/stage1/vmlinuz",
-			method:         "GET",
-			expectedStatus: http.StatusOK,
-			expectedResult: "ok",
+			name:             "disable-update-enabled-on-success",
+			sessionID:        "12345",
+			from:             h.IPv4Addr,
+			expectedStatus:   http.StatusNoContent,
+			expectedEnabled:  false,
+			expectedRotation: true,
+			form: url.Values{
+				"message": []string{"success"},
+			},
 		},
 		{
-			name:           "failure-not-implemented",
-			storagePath:    "/stage1/vmlinuz",
-			method:         "GET",
-			expectedStatus: http.StatusNotImplemented,
-			disableStorage: true,
+			name:            "preserve-update-enabled-on-failure",
+			sessionID:       "12345",
+			from:            h.IPv4Addr,
+			expectedStatus:  http.StatusNoContent,
+			expectedEnabled: true,
+			form: url.Values{
+				"message": []string{"error: something failed"},
+				"output":  []string{"flashing\nerror: no device\n"},
+			},
 		},
 		{
-			name:           "failure-method-not-allowed",
-			storagePath:    "/stage1/vmlinuz",
-			method:         "POST",
-			expectedStatus: http.StatusMethodNotAllowed,
+			name:            "bad-session-returns-forbidden",
+			sessionID:       "mismatched-session-id",
+			from:            h.IPv4Addr,
+			expectedStatus:  http.StatusForbidden,
+			expectedEnabled: true,
+			form:            url.Values{},
+		},
+		{
+			name:            "fail-from-wrong-ip",
+			sessionID:       "12345",
+			from:            "192.168.0.1",
+			expectedStatus:  http.StatusForbidden,
+			expectedEnabled: true,
+			form:            url.Values{},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-
-			// Setup a fake storage server to handle the proxy request.
+			vars := map[string]string{"hostname": h.Name, "sessionID": tt.sessionID}
+			path := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/report"
+			h.UpdateEnabled = true
+			h.UpdateAttempts = 2
+			h.CurrentSessionIDs.ExtensionID = "67890"
+			h.BootLogs = nil
+
+			req := httptest.NewRequest("POST", path, strings.NewReader(tt.form.Encode()))
+			// Mark the body as form content to be read by ParseForm.
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", tt.from)
+			rec := httptest.NewRecorder()
+			env := &Env{
+				Config:                 fakeConfig{host: h, failOnLoad: false, failOnSave: false},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+			req = mux.SetURLVars(req, vars)
+			env.ReceiveReport(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("ReceiveReport() wrong HTTP status: got %v; want %v", rec.Code, tt.expectedStatus)
+			}
+
+			if h.UpdateEnabled != tt.expectedEnabled {
+				t.Errorf("ReceiveReport() failed to change UpdateEnabled: got %t; want %t",
+					h.UpdateEnabled, tt.expectedEnabled)
+			}
+			// A successful boot resets the count of failed update attempts.
+			wantAttempts := 2
+			if !tt.expectedEnabled {
+				wantAttempts = 0
+			}
+			if h.UpdateAttempts != wantAttempts {
+				t.Errorf("ReceiveReport() wrong UpdateAttempts: got %d; want %d", h.UpdateAttempts, wantAttempts)
+			}
+			if rotated := h.CurrentSessionIDs.ExtensionID != "67890"; rotated != tt.expectedRotation {
+				t.Errorf("ReceiveReport() wrong ExtensionID rotation: got %t; want %t",
+					rotated, tt.expectedRotation)
+			}
+			// The report ID is never rotated.
+			if h.CurrentSessionIDs.ReportID != "12345" {
+				t.Errorf("ReceiveReport() changed ReportID: got %q; want %q",
+					h.CurrentSessionIDs.ReportID, "12345")
+			}
+			// Accepted reports are retained in the boot logs.
+			wantLogs := 0
+			if tt.expectedStatus == http.StatusNoContent {
+				wantLogs = 1
+			}
+			if len(h.BootLogs) != wantLogs {
+				t.Fatalf("ReceiveReport() wrong BootLogs: got %v; want %d entries", h.BootLogs, wantLogs)
+			}
+			if wantLogs == 1 && (h.BootLogs[0].Message != tt.form.Get("message") ||
+				h.BootLogs[0].Output != tt.form.Get("output") ||
+				h.BootLogs[0].Success == tt.expectedEnabled) {
+				t.Errorf("ReceiveReport() wrong BootLog: got %v; want message %q and output %q",
+					h.BootLogs[0], tt.form.Get("message"), tt.form.Get("output"))
+			}
+		})
+	}
+}
+
+func TestEnv_BootPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		wantStage1 string
+		wantReset  string
+	}{
+		{
+			name:       "normal",
+			policy:     storage.BootPolicyNormal,
+			wantStage1: "boot/stage1to2.ipxe",
+			wantReset:  storage.BootPolicyNormal,
+		},
+		{
+			name:       "update-once",
+			policy:     storage.BootPolicyUpdateOnce,
+			wantStage1: "update/stage1to2.ipxe",
+			wantReset:  storage.BootPolicyNormal,
+		},
+		{
+			name:       "update-always",
+			policy:     storage.BootPolicyUpdateAlways,
+			wantStage1: "update/stage1to2.ipxe",
+			wantReset:  storage.BootPolicyUpdateAlways,
+		},
+		{
+			name:       "hold",
+			policy:     storage.BootPolicyHold,
+			wantStage1: "Held by boot policy",
+			wantReset:  storage.BootPolicyHold,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				Boot:     datastorex.Map{storage.Stage1IPXE: "https://example.com/boot/stage1to2.ipxe"},
+				Update:   datastorex.Map{storage.Stage1IPXE: "https://example.com/update/stage1to2.ipxe"},
+			}
+			h.SetBootPolicy(tt.policy)
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+
+			// The policy selects the stage1 config.
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+			rec := httptest.NewRecorder()
+			env.GenerateStage1IPXE(rec, req)
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tt.wantStage1) {
+				t.Errorf("GenerateStage1IPXE() = %d, %q; want %d with %q",
+					rec.Code, rec.Body.String(), http.StatusOK, tt.wantStage1)
+			}
+
+			// A successful report resets the policy.
+			h.CurrentSessionIDs.ReportID = "12345"
+			form := url.Values{"message": []string{"success"}}
+			req = httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/12345/report", strings.NewReader(form.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name, "sessionID": "12345"})
+			rec = httptest.NewRecorder()
+			env.ReceiveReport(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("ReceiveReport() wrong HTTP status: got %d; want %d", rec.Code, http.StatusNoContent)
+			}
+			if h.BootPolicy != tt.wantReset {
+				t.Errorf("ReceiveReport() BootPolicy = %q, want %q", h.BootPolicy, tt.wantReset)
+			}
+		})
+	}
+}
+
+func TestEnv_ReceiveReportExtension(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+	}
+	tests := []struct {
+		name       string
+		message    string
+		status     int
+		operation  string
+		closed     bool
+		wantCalled bool
+	}{
+		{
+			name:       "success-extension-called",
+			message:    "success",
+			status:     http.StatusOK,
+			operation:  "report_op",
+			wantCalled: true,
+		},
+		{
+			name:       "extension-error-does-not-block-report",
+			message:    "success",
+			status:     http.StatusInternalServerError,
+			operation:  "report_op",
+			wantCalled: true,
+		},
+		{
+			name:      "unreachable-extension-does-not-block-report",
+			message:   "success",
+			operation: "report_op",
+			closed:    true,
+		},
+		{
+			name:      "unknown-extension-does-not-block-report",
+			message:   "success",
+			operation: "unknown_op",
+		},
+		{
+			name:      "failed-report-does-not-call-extension",
+			message:   "error: something failed",
+			status:    http.StatusOK,
+			operation: "report_op",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.CurrentSessionIDs = storage.SessionIDs{ReportID: "12345", ExtensionID: "67890"}
+			called := false
 			ts := httptest.NewServer(
 				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					if r.URL.Path != tt.storagePath {
-						t.Errorf("Requeted and expected path does not match; got %q, want %q",
-							r.URL.Path, tt.storagePath)
+					called = true
+					ext := &extension.Request{}
+					if err := ext.Decode(r.Body); err != nil || ext.V1.Hostname != h.Name {
+						t.Errorf("report extension got bad request: %v, %v", ext, err)
 					}
-					w.WriteHeader(tt.expectedStatus)
-					w.Write([]byte(tt.expectedResult))
+					// The extension runs before the extension session is rotated.
+					if h.CurrentSessionIDs.ExtensionID != "67890" {
+						t.Errorf("report extension called after session rotation")
+					}
+					w.WriteHeader(tt.status)
 				}))
-			defer ts.Close()
+			if tt.closed {
+				ts.Close()
+			} else {
+				defer ts.Close()
+			}
+			storage.Extensions.Set("report_op", ts.URL)
+			defer storage.Extensions.Delete("report_op")
 
-			// Create a synthetic request with an original request URL to example.com.
-			req := httptest.NewRequest(
-				tt.method, "https://epoxy-boot-api.mlab-sandbox.mlab.net/v1/storage"+tt.storagePath, nil)
+			form := url.Values{"message": []string{tt.message}}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/12345/report", strings.NewReader(form.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name, "sessionID": "12345"})
 			rec := httptest.NewRecorder()
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				AllowForwardedRequests: true,
+				ReportExtension:        tt.operation,
+			}
 
-			// These variables are normally created by the gorilla request handler.
-			// An original request to:
-			//   https://epoxy-boot-api.mlab-sandbox.mlab.net/v1/storage/stage1/vmlinuz
-			// would extract the "path" after /v1/storage, i.e. "stage1/vmlinuz"
-			vars := map[string]string{"path": tt.storagePath[1:]}
-			req = mux.SetURLVars(req, vars)
+			env.ReceiveReport(rec, req)
 
-			// The env configuration is normally created by the main server.
-			// StoragePrefixURL is the only setting needed by HandleStorageProxy.
-			env := &Env{}
-			if !tt.disableStorage {
-				// Direct the proxy at our test server.
-				env.StoragePrefixURL = ts.URL
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("ReceiveReport() wrong HTTP status: got %v; want %v", rec.Code, http.StatusNoContent)
 			}
+			if called != tt.wantCalled {
+				t.Errorf("ReceiveReport() called extension = %t; want %t", called, tt.wantCalled)
+			}
+			if tt.message == "success" && h.CurrentSessionIDs.ExtensionID == "67890" {
+				t.Errorf("ReceiveReport() did not rotate ExtensionID")
+			}
+		})
+	}
+}
 
-			env.HandleStorageProxy(rec, req)
+func TestEnv_ReceiveReportClientCert(t *testing.T) {
+	dir := t.TempDir()
+	cert, _, _ := newTestCert(t, dir, "client", x509.ExtKeyUsageClientAuth)
+	sum := sha256.Sum256(cert.Leaf.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name            string
+		current         string
+		tls             *tls.ConnectionState
+		wantFingerprint string
+		wantChanged     bool
+	}{
+		{
+			name: "plain-http-not-recorded",
+		},
+		{
+			name:    "unverified-tls-not-recorded",
+			current: "abcdef",
+			tls:     &tls.ConnectionState{},
+			// The previous fingerprint is preserved.
+			wantFingerprint: "abcdef",
+		},
+		{
+			name:            "first-cert-recorded",
+			tls:             &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf}}},
+			wantFingerprint: fingerprint,
+		},
+		{
+			name:            "same-cert",
+			current:         fingerprint,
+			tls:             &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf}}},
+			wantFingerprint: fingerprint,
+		},
+		{
+			name:            "changed-cert-flagged",
+			current:         "abcdef",
+			tls:             &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf}}},
+			wantFingerprint: fingerprint,
+			wantChanged:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:                  "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr:              "165.117.240.9",
+				CurrentSessionIDs:     storage.SessionIDs{ReportID: "12345"},
+				ClientCertFingerprint: tt.current,
+			}
+			form := url.Values{"message": []string{"success"}}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/12345/report", strings.NewReader(form.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req.TLS = tt.tls
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name, "sessionID": "12345"})
+			rec := httptest.NewRecorder()
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				AllowForwardedRequests: true,
+			}
 
-			if tt.expectedStatus != rec.Code {
-				t.Errorf("HandleStorageProxy() wrong HTTP status: got %v; want %v",
-					rec.Code, tt.expectedStatus)
+			env.ReceiveReport(rec, req)
+
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("ReceiveReport() wrong HTTP status: got %v; want %v", rec.Code, http.StatusNoContent)
 			}
-			// Verify that the request and response actually came from the test server.
-			if tt.expectedResult != "" && tt.expectedResult != rec.Body.String() {
-				t.Errorf("HandleStorageProxy() wrong result forwarded: got %v\n; want %v\n",
-					rec.Body.String(), tt.expectedResult)
+			if h.ClientCertFingerprint != tt.wantFingerprint {
+				t.Errorf("ReceiveReport() fingerprint = %q; want %q", h.ClientCertFingerprint, tt.wantFingerprint)
+			}
+			if changed := !h.ClientCertChanged.IsZero(); changed != tt.wantChanged {
+				t.Errorf("ReceiveReport() flagged change = %t; want %t", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtension(t *testing.T) {
+	// Generic Host record for all tests.
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		CurrentSessionIDs: storage.SessionIDs{
+			ExtensionID: "12345",
+		},
+		LastSessionCreation: time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	// The request that should be received by the extension server.
+	expectedRequest := &extension.Request{
+		V1: &extension.V1{
+			Hostname:    h.Name,
+			IPv4Address: h.IPv4Addr,
+			LastBoot:    h.LastSessionCreation,
+		},
+	}
+	tests := []struct {
+		name            string
+		sessionID       string
+		operation       string
+		failOnLoad      bool
+		fields          map[string][]string
+		urlPrefix       string
+		from            string
+		query           string
+		expectedStatus  int
+		expectedResult  string
+		expectedRequest *extension.Request
+	}{
+		{
+			name:            "successful-request",
+			sessionID:       "12345",
+			operation:       "foobar",
+			from:            h.IPv4Addr,
+			expectedStatus:  http.StatusOK,
+			expectedResult:  "okay",
+			expectedRequest: expectedRequest,
+		},
+		{
+			name:           "successful-request-with-query",
+			sessionID:      "12345",
+			operation:      "foobar",
+			from:           h.IPv4Addr,
+			query:          "bmc_mac=00:11:22:33:44:55&slot=2",
+			expectedStatus: http.StatusOK,
+			expectedResult: "okay",
+			expectedRequest: &extension.Request{
+				V1: &extension.V1{
+					Hostname:    h.Name,
+					IPv4Address: h.IPv4Addr,
+					LastBoot:    h.LastSessionCreation,
+					RawQuery:    "bmc_mac=00:11:22:33:44:55&slot=2",
+				},
+			},
+		},
+		{
+			name:           "successful-request-without-query-field",
+			sessionID:      "12345",
+			operation:      "foobar",
+			fields:         map[string][]string{"foobar": {"hostname", "ipv4_address", "last_boot"}},
+			from:           h.IPv4Addr,
+			query:          "slot=2",
+			expectedStatus: http.StatusOK,
+			expectedResult: "okay",
+			expectedRequest: &extension.Request{
+				V1: &extension.V1{
+					Hostname:    h.Name,
+					IPv4Address: h.IPv4Addr,
+					LastBoot:    h.LastSessionCreation,
+				},
+			},
+		},
+		{
+			name:           "successful-request-without-ip",
+			sessionID:      "12345",
+			operation:      "foobar",
+			fields:         map[string][]string{"foobar": {"hostname", "last_boot"}},
+			from:           h.IPv4Addr,
+			expectedStatus: http.StatusOK,
+			expectedResult: "okay",
+			expectedRequest: &extension.Request{
+				V1: &extension.V1{
+					Hostname:    h.Name,
+					IPv4Address: "",
+					LastBoot:    h.LastSessionCreation,
+				},
+			},
+		},
+		{
+			name:            "failure-backend-returns-notfound",
+			sessionID:       "12345",
+			operation:       "foobar",
+			from:            h.IPv4Addr,
+			expectedStatus:  http.StatusNotFound,
+			expectedResult:  "not found",
+			expectedRequest: expectedRequest,
+		},
+		{
+			name:           "failure-failonload",
+			failOnLoad:     true,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "failure-bad-sessionid",
+			sessionID:      "54321",
+			from:           h.IPv4Addr,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "failure-from-wrong-ip",
+			sessionID:      "54321",
+			from:           "192.168.0.1",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "failure-zerolength-operation",
+			sessionID:      "12345",
+			operation:      "",
+			from:           h.IPv4Addr,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "failure-invalid-operation",
+			sessionID:      "12345",
+			operation:      "foo-bar",
+			from:           h.IPv4Addr,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "failure-unknown-operation",
+			sessionID:      "12345",
+			operation:      "unknown",
+			from:           h.IPv4Addr,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "failure-parsing-extension-url",
+			sessionID:      "12345",
+			operation:      "foobar",
+			from:           h.IPv4Addr,
+			urlPrefix:      ":", // with this character, the backend URL will fail to parse.
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Pseudo variables for mux.Vars.
+			vars := map[string]string{
+				"hostname":  h.Name,
+				"sessionID": tt.sessionID,
+				"operation": tt.operation,
+			}
+			extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/foobar"
+			if tt.query != "" {
+				extURL += "?" + tt.query
+			}
+
+			req := httptest.NewRequest("POST", extURL, nil)
+			req.Header.Set("X-Forwarded-For", tt.from)
+			rec := httptest.NewRecorder()
+			env := &Env{
+				Config:                 fakeConfig{host: h, failOnLoad: tt.failOnLoad},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+				ExtensionFields:        tt.fields,
+			}
+			req = mux.SetURLVars(req, vars)
+			// Setup a fake extension server to handle the Request.
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ext := &extension.Request{}
+					err := ext.Decode(r.Body)
+					if err != nil {
+						// Decode failed, bad request.
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					// Decode was successful, so make sure it's what we expect.
+					if !tt.expectedRequest.V1.LastBoot.Equal(ext.V1.LastBoot) ||
+						tt.expectedRequest.V1.Hostname != ext.V1.Hostname ||
+						tt.expectedRequest.V1.IPv4Address != ext.V1.IPv4Address ||
+						tt.expectedRequest.V1.IPv6Address != ext.V1.IPv6Address ||
+						tt.expectedRequest.V1.RawQuery != ext.V1.RawQuery {
+						t.Errorf("HandleExtension() malformed request: got %#v, want %#v",
+							ext.V1, tt.expectedRequest.V1)
+					}
+					// Unconditionally report the test-defined status.
+					w.WriteHeader(tt.expectedStatus)
+					w.Write([]byte(tt.expectedResult))
+				}))
+			defer ts.Close()
+			storage.Extensions.Set("foobar", tt.urlPrefix+ts.URL)
+			defer storage.Extensions.Delete("foobar")
+
+			// Run the extension handler.
+			env.HandleExtension(rec, req)
+
+			if tt.expectedStatus != rec.Code {
+				t.Errorf("HandleExtension() wrong HTTP status: got %v; want %v",
+					rec.Code, tt.expectedStatus)
+			}
+			if tt.expectedResult != "" && tt.expectedResult != rec.Body.String() {
+				t.Errorf("HandleExtension() wrong result forwarded: got %v\n; want %v\n",
+					rec.Body.String(), tt.expectedResult)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtensionCollected(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		wantCollected datastorex.Map
+	}{
+		{
+			name:   "saves-allowed-collected-values",
+			status: http.StatusOK,
+			body:   `{"token": "abc", "collected": {"version": "1.2.3", "unknown": "x"}}`,
+			wantCollected: datastorex.Map{
+				"version": "1.2.3",
+			},
+		},
+		{
+			name:          "ignores-plain-text",
+			status:        http.StatusOK,
+			body:          "plain text token",
+			wantCollected: datastorex.Map{},
+		},
+		{
+			name:          "ignores-failed-requests",
+			status:        http.StatusInternalServerError,
+			body:          `{"collected": {"version": "1.2.3"}}`,
+			wantCollected: datastorex.Map{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				CurrentSessionIDs: storage.SessionIDs{
+					ExtensionID: "12345",
+				},
+				CollectedInformation: datastorex.Map{},
+			}
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tt.status)
+					w.Write([]byte(tt.body))
+				}))
+			defer ts.Close()
+			storage.Extensions.Set("collect_op", ts.URL)
+			defer storage.Extensions.Delete("collect_op")
+
+			vars := map[string]string{
+				"hostname":  h.Name,
+				"sessionID": "12345",
+				"operation": "collect_op",
+			}
+			extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/collect_op"
+			req := httptest.NewRequest("POST", extURL, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, vars)
+			rec := httptest.NewRecorder()
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+
+			env.HandleExtension(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("HandleExtension() wrong HTTP status: got %v; want %v", rec.Code, tt.status)
+			}
+			// The extension response is always forwarded verbatim.
+			if rec.Body.String() != tt.body {
+				t.Errorf("HandleExtension() wrong result forwarded: got %q; want %q",
+					rec.Body.String(), tt.body)
+			}
+			if !reflect.DeepEqual(h.CollectedInformation, tt.wantCollected) {
+				t.Errorf("HandleExtension() wrong CollectedInformation: got %v; want %v",
+					h.CollectedInformation, tt.wantCollected)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtensionStreaming(t *testing.T) {
+	tests := []struct {
+		name          string
+		flushInterval time.Duration
+	}{
+		{
+			name: "flush-every-write",
+		},
+		{
+			name:          "flush-interval",
+			flushInterval: 10 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "127.0.0.1",
+				CurrentSessionIDs: storage.SessionIDs{
+					ExtensionID: "12345",
+				},
+				CollectedInformation: datastorex.Map{},
+			}
+			// The extension writes the second chunk only after the client
+			// receives the first, so a buffered response would stall.
+			received := make(chan bool)
+			stalled := make(chan bool, 1)
+			ext := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintln(w, "first")
+					w.(http.Flusher).Flush()
+					select {
+					case <-received:
+					case <-time.After(5 * time.Second):
+						stalled <- true
+					}
+					fmt.Fprintln(w, "second")
+				}))
+			defer ext.Close()
+			storage.Extensions.Set("stream_op", ext.URL)
+			defer storage.Extensions.Delete("stream_op")
+
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				ExtensionFlushInterval: tt.flushInterval,
+			}
+			vars := map[string]string{
+				"hostname":  h.Name,
+				"sessionID": "12345",
+				"operation": "stream_op",
+			}
+			ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				env.HandleExtension(rw, mux.SetURLVars(req, vars))
+			}))
+			defer ts.Close()
+
+			resp, err := http.Post(ts.URL+"/v1/boot/"+h.Name+"/12345/extension/stream_op", "", nil)
+			if err != nil {
+				t.Fatalf("HandleExtension() failed: %v", err)
+			}
+			defer resp.Body.Close()
+			r := bufio.NewReader(resp.Body)
+			first, err := r.ReadString('\n')
+			close(received)
+			rest, _ := ioutil.ReadAll(r)
+
+			if resp.StatusCode != http.StatusOK || err != nil || first+string(rest) != "first\nsecond\n" {
+				t.Errorf("HandleExtension() = %d, %q, %v; want %d, %q",
+					resp.StatusCode, first+string(rest), err, http.StatusOK, "first\nsecond\n")
+			}
+			select {
+			case <-stalled:
+				t.Errorf("HandleExtension() did not deliver the first chunk before the response ended")
+			default:
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtensionStatusPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		statusMap    map[int]int
+		wantStatus   int
+		wantAttempts int32
+	}{
+		{
+			name:         "no-retry-by-default",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusOK},
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 1,
+		},
+		{
+			name:         "retry-on-5xx-succeeds",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK},
+			retries:      2,
+			wantStatus:   http.StatusOK,
+			wantAttempts: 3,
+		},
+		{
+			name:         "retries-exhausted",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			retries:      1,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 2,
+		},
+		{
+			name:         "no-retry-on-4xx",
+			statuses:     []int{http.StatusNotFound, http.StatusOK},
+			retries:      2,
+			wantStatus:   http.StatusNotFound,
+			wantAttempts: 1,
+		},
+		{
+			name:         "map-404-to-502",
+			statuses:     []int{http.StatusNotFound},
+			statusMap:    map[int]int{http.StatusNotFound: http.StatusBadGateway},
+			wantStatus:   http.StatusBadGateway,
+			wantAttempts: 1,
+		},
+		{
+			name:         "map-after-retries-exhausted",
+			statuses:     []int{http.StatusInternalServerError, http.StatusInternalServerError},
+			retries:      1,
+			statusMap:    map[int]int{http.StatusInternalServerError: http.StatusBadGateway},
+			wantStatus:   http.StatusBadGateway,
+			wantAttempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				CurrentSessionIDs: storage.SessionIDs{
+					ExtensionID: "12345",
+				},
+			}
+			var attempts int32
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					n := atomic.AddInt32(&attempts, 1)
+					// Every attempt receives the complete extension request.
+					ext := &extension.Request{}
+					if err := ext.Decode(r.Body); err != nil || ext.V1.Hostname != h.Name {
+						t.Errorf("HandleExtension() attempt %d malformed request: %v", n, err)
+					}
+					w.WriteHeader(tt.statuses[n-1])
+				}))
+			defer ts.Close()
+			storage.Extensions.Set("policy_op", ts.URL)
+			defer storage.Extensions.Delete("policy_op")
+
+			vars := map[string]string{
+				"hostname":  h.Name,
+				"sessionID": "12345",
+				"operation": "policy_op",
+			}
+			extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/policy_op"
+			req := httptest.NewRequest("POST", extURL, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, vars)
+			rec := httptest.NewRecorder()
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+				ExtensionRetries:       map[string]int{"policy_op": tt.retries},
+				ExtensionStatusMap:     tt.statusMap,
+			}
+
+			env.HandleExtension(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("HandleExtension() wrong HTTP status: got %v; want %v", rec.Code, tt.wantStatus)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("HandleExtension() wrong number of attempts: got %d; want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// newTestCert creates a self-signed certificate for 127.0.0.1 with the given
+// extended key usage, and writes the PEM encoded certificate and key to files
+// in dir. The certificate may be used as its own CA.
+func newTestCert(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (cert tls.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leaf is only set automatically by newer Go versions.
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestNewExtensionTransport(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := newTestCert(t, dir, "client", x509.ExtKeyUsageClientAuth)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		caFile   string
+		certFile string
+		keyFile  string
+		wantErr  bool
+	}{
+		{
+			name: "system-trust",
+		},
+		{
+			name:     "ca-and-client-cert",
+			caFile:   certFile,
+			certFile: certFile,
+			keyFile:  keyFile,
+		},
+		{
+			name:    "missing-ca-file",
+			caFile:  filepath.Join(dir, "missing.pem"),
+			wantErr: true,
+		},
+		{
+			name:    "ca-file-without-certs",
+			caFile:  empty,
+			wantErr: true,
+		},
+		{
+			name:     "client-cert-without-key",
+			certFile: certFile,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := NewExtensionTransport(tt.caFile, tt.certFile, tt.keyFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewExtensionTransport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (tr.TLSClientConfig.RootCAs == nil) != (tt.caFile == "") {
+				t.Errorf("NewExtensionTransport() RootCAs = %v, want system trust %t",
+					tr.TLSClientConfig.RootCAs, tt.caFile == "")
+			}
+			if len(tr.TLSClientConfig.Certificates) > 0 != (tt.certFile != "") {
+				t.Errorf("NewExtensionTransport() got %d client certificates",
+					len(tr.TLSClientConfig.Certificates))
+			}
+		})
+	}
+}
+
+func TestNewClientCertTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	_, caFile, _ := newTestCert(t, dir, "ca", x509.ExtKeyUsageClientAuth)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		caFile  string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			caFile: caFile,
+		},
+		{
+			name:    "missing-ca-file",
+			caFile:  filepath.Join(dir, "missing.pem"),
+			wantErr: true,
+		},
+		{
+			name:    "ca-file-without-certs",
+			caFile:  empty,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := NewClientCertTLSConfig(tt.caFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewClientCertTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if config.ClientAuth != tls.VerifyClientCertIfGiven || config.ClientCAs == nil {
+				t.Errorf("NewClientCertTLSConfig() = %v, want verified client certs", config)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtensionTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, caFile, _ := newTestCert(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, certFile, keyFile := newTestCert(t, dir, "client", x509.ExtKeyUsageClientAuth)
+	tests := []struct {
+		name       string
+		mtls       bool
+		caFile     string
+		certFile   string
+		keyFile    string
+		wantStatus int
+	}{
+		{
+			name:       "system-trust-rejects-test-ca",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "dedicated-ca",
+			caFile:     caFile,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "mtls-without-client-cert",
+			mtls:       true,
+			caFile:     caFile,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "mtls-with-client-cert",
+			mtls:       true,
+			caFile:     caFile,
+			certFile:   certFile,
+			keyFile:    keyFile,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:     "mlab1.iad1t.measurement-lab.org",
+				IPv4Addr: "165.117.240.9",
+				CurrentSessionIDs: storage.SessionIDs{
+					ExtensionID: "12345",
+				},
+			}
+			ts := httptest.NewUnstartedServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}))
+			ts.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+			if tt.mtls {
+				ts.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+				ts.TLS.ClientCAs = x509.NewCertPool()
+				ts.TLS.ClientCAs.AddCert(clientCert.Leaf)
+			}
+			// Suppress TLS handshake errors logged by the server.
+			ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			ts.StartTLS()
+			defer ts.Close()
+			storage.Extensions.Set("tls_op", ts.URL)
+			defer storage.Extensions.Delete("tls_op")
+
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+			if tt.caFile != "" {
+				tr, err := NewExtensionTransport(tt.caFile, tt.certFile, tt.keyFile)
+				if err != nil {
+					t.Fatalf("NewExtensionTransport() error = %v", err)
+				}
+				env.ExtensionTransport = tr
+			}
+			vars := map[string]string{
+				"hostname":  h.Name,
+				"sessionID": "12345",
+				"operation": "tls_op",
+			}
+			extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/tls_op"
+			req := httptest.NewRequest("POST", extURL, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, vars)
+			rec := httptest.NewRecorder()
+
+			env.HandleExtension(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("HandleExtension() wrong HTTP status: got %v; want %v", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtensionFailover(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		CurrentSessionIDs: storage.SessionIDs{
+			ExtensionID: "12345",
+		},
+	}
+	// A closed server refuses connections, like a backend that is down.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name          string
+		firstStatus   int
+		firstDown     bool
+		secondStatus  int
+		wantStatus    int
+		wantFirst     int32
+		wantSecond    int32
+		wantHostnames bool
+	}{
+		{
+			name:          "first-down-second-serves",
+			firstDown:     true,
+			secondStatus:  http.StatusOK,
+			wantStatus:    http.StatusOK,
+			wantSecond:    1,
+			wantHostnames: true,
+		},
+		{
+			name:          "first-5xx-second-serves",
+			firstStatus:   http.StatusServiceUnavailable,
+			secondStatus:  http.StatusOK,
+			wantStatus:    http.StatusOK,
+			wantFirst:     1,
+			wantSecond:    1,
+			wantHostnames: true,
+		},
+		{
+			name:         "first-4xx-is-returned",
+			firstStatus:  http.StatusNotFound,
+			secondStatus: http.StatusOK,
+			wantStatus:   http.StatusNotFound,
+			wantFirst:    1,
+		},
+		{
+			name:         "all-backends-fail",
+			firstDown:    true,
+			secondStatus: http.StatusInternalServerError,
+			wantStatus:   http.StatusInternalServerError,
+			wantSecond:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var first, second int32
+			var hostname string
+			newBackend := func(count *int32, status int) *httptest.Server {
+				return httptest.NewServer(
+					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						atomic.AddInt32(count, 1)
+						ext := &extension.Request{}
+						if err := ext.Decode(r.Body); err == nil && ext.V1 != nil {
+							hostname = ext.V1.Hostname
+						}
+						w.WriteHeader(status)
+					}))
+			}
+			ts1 := newBackend(&first, tt.firstStatus)
+			defer ts1.Close()
+			ts2 := newBackend(&second, tt.secondStatus)
+			defer ts2.Close()
+			firstURL := ts1.URL
+			if tt.firstDown {
+				firstURL = down.URL
+			}
+			storage.Extensions.SetURLs("failover_op", []string{firstURL, ts2.URL})
+			defer storage.Extensions.Delete("failover_op")
+
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+			vars := map[string]string{
+				"hostname":  h.Name,
+				"sessionID": "12345",
+				"operation": "failover_op",
+			}
+			extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/failover_op"
+			req := httptest.NewRequest("POST", extURL, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, vars)
+			rec := httptest.NewRecorder()
+
+			env.HandleExtension(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("HandleExtension() wrong HTTP status: got %v; want %v", rec.Code, tt.wantStatus)
+			}
+			if first != tt.wantFirst || second != tt.wantSecond {
+				t.Errorf("HandleExtension() sent %d and %d requests to backends; want %d and %d",
+					first, second, tt.wantFirst, tt.wantSecond)
+			}
+			// The backup receives the complete extension request.
+			if tt.wantHostnames && hostname != h.Name {
+				t.Errorf("HandleExtension() sent hostname %q to backup; want %q", hostname, h.Name)
+			}
+		})
+	}
+}
+
+func TestEnv_SessionTTL(t *testing.T) {
+	created := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage3: "https://storage.googleapis.com/epoxy-boot-server/stage3/stage3.json",
+		},
+		LastSessionCreation: created,
+	}
+	tests := []struct {
+		name          string
+		handler       func(env *Env) http.HandlerFunc
+		path          string
+		sessionTTL    time.Duration
+		wantStatus    int
+		wantExpiresAt string
+	}{
+		{
+			name:       "stage3-without-ttl",
+			handler:    func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+			path:       "/v1/boot/" + h.Name + "/12345/stage3",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "stage3-before-expiry",
+			handler:       func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+			path:          "/v1/boot/" + h.Name + "/12345/stage3",
+			sessionTTL:    2 * time.Hour,
+			wantStatus:    http.StatusOK,
+			wantExpiresAt: created.Add(2 * time.Hour).Format(time.RFC3339),
+		},
+		{
+			name:       "stage3-after-expiry",
+			handler:    func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+			path:       "/v1/boot/" + h.Name + "/12345/stage3",
+			sessionTTL: 30 * time.Minute,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "report-after-expiry",
+			handler:    func(env *Env) http.HandlerFunc { return env.ReceiveReport },
+			path:       "/v1/boot/" + h.Name + "/12345/report",
+			sessionTTL: 30 * time.Minute,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "extension-after-expiry",
+			handler:    func(env *Env) http.HandlerFunc { return env.HandleExtension },
+			path:       "/v1/boot/" + h.Name + "/12345/extension/ttl_op",
+			sessionTTL: 30 * time.Minute,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.CurrentSessionIDs = storage.SessionIDs{ReportID: "12345", ExtensionID: "12345"}
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+				SessionTTL:             tt.sessionTTL,
+			}
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader("message=success"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{
+				"hostname": h.Name, "sessionID": "12345", "operation": "ttl_op"})
+			rec := httptest.NewRecorder()
+
+			tt.handler(env).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("%s wrong HTTP status: got %d; want %d", tt.name, rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			c := &nextboot.Config{}
+			if err := json.Unmarshal(rec.Body.Bytes(), c); err != nil {
+				t.Fatalf("%s returned invalid JSON: %v", tt.name, err)
+			}
+			if c.V1.ExpiresAt != tt.wantExpiresAt {
+				t.Errorf("%s expires_at = %q; want %q", tt.name, c.V1.ExpiresAt, tt.wantExpiresAt)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtensionRequestLimit(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		CurrentSessionIDs: storage.SessionIDs{
+			ExtensionID: "12345",
+		},
+	}
+	tests := []struct {
+		name       string
+		limit      int
+		rawQuery   string
+		wantStatus int
+		wantCalls  int32
+	}{
+		{
+			name:       "unlimited",
+			rawQuery:   "data=" + strings.Repeat("x", 4096),
+			wantStatus: http.StatusOK,
+			wantCalls:  1,
+		},
+		{
+			name:       "under-limit",
+			limit:      1024,
+			rawQuery:   "data=small",
+			wantStatus: http.StatusOK,
+			wantCalls:  1,
+		},
+		{
+			name:       "large-raw-query-exceeds-limit",
+			limit:      1024,
+			rawQuery:   "data=" + strings.Repeat("x", 4096),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&calls, 1)
+				}))
+			defer ts.Close()
+			storage.Extensions.Set("limit_op", ts.URL)
+			defer storage.Extensions.Delete("limit_op")
+
+			env := &Env{
+				Config:                   fakeConfig{host: h},
+				ServerAddr:               "example.com:4321",
+				AllowForwardedRequests:   true,
+				MaxExtensionRequestBytes: tt.limit,
+			}
+			vars := map[string]string{
+				"hostname":  h.Name,
+				"sessionID": "12345",
+				"operation": "limit_op",
+			}
+			extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/limit_op?" + tt.rawQuery
+			req := httptest.NewRequest("POST", extURL, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, vars)
+			rec := httptest.NewRecorder()
+
+			env.HandleExtension(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("HandleExtension() wrong HTTP status: got %v; want %v", rec.Code, tt.wantStatus)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("HandleExtension() sent %d requests to extension; want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleExtensionLatencySummary(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		CurrentSessionIDs: storage.SessionIDs{
+			ExtensionID: "12345",
+		},
+	}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("okay"))
+		}))
+	defer ts.Close()
+	storage.Extensions.Set("summary_op", ts.URL)
+	defer storage.Extensions.Delete("summary_op")
+
+	vars := map[string]string{
+		"hostname":  h.Name,
+		"sessionID": "12345",
+		"operation": "summary_op",
+	}
+	extURL := "/v1/boot/mlab1.iad1t.measurement-lab.org/12345/extension/summary_op"
+	req := httptest.NewRequest("POST", extURL, nil)
+	req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+	req = mux.SetURLVars(req, vars)
+	rec := httptest.NewRecorder()
+	env := &Env{
+		Config:                  fakeConfig{host: h},
+		ServerAddr:              "example.com:4321",
+		AllowForwardedRequests:  true,
+		ExtensionLatencyMetrics: "summary",
+	}
+
+	env.HandleExtension(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HandleExtension() wrong HTTP status: got %v; want %v", rec.Code, http.StatusOK)
+	}
+	// Only this test selects the summary, so exactly one series should exist.
+	if got := testutil.CollectAndCount(metrics.ExtensionDurationSummary); got != 1 {
+		t.Errorf("ExtensionDurationSummary series count = %d, want 1", got)
+	}
+}
+
+func TestEnv_GenerateStage1JSON(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+		},
+	}
+	tests := []struct {
+		name   string
+		vars   map[string]string
+		req    *http.Request
+		config fakeConfig
+		from   string
+		status int
+	}{
+		{
+			name:   "okay",
+			vars:   map[string]string{"hostname": h.Name},
+			config: fakeConfig{host: h, failOnLoad: false, failOnSave: false},
+			from:   h.IPv4Addr,
+			status: http.StatusOK,
+		},
+		{
+			name:   "fail-on-load",
+			vars:   map[string]string{"hostname": h.Name},
+			config: fakeConfig{host: h, failOnLoad: true, failOnSave: false},
+			from:   h.IPv4Addr,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "fail-on-save",
+			config: fakeConfig{host: h, failOnLoad: false, failOnSave: true},
+			from:   h.IPv4Addr,
+			status: http.StatusInternalServerError,
+		},
+		// TODO(soltesz): enable once plc-updates are complete.
+		/*
+			{
+				name:   "fail-from-wrong-ip",
+				config: fakeConfig{host: h},
+				from:   "192.168.0.1",
+				status: http.StatusForbidden,
+			},
+		*/
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := map[string]string{"hostname": h.Name}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+			req.Header.Set("X-Forwarded-For", tt.from)
+			rec := httptest.NewRecorder()
+			env := &Env{
+				Config:                 tt.config,
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+			}
+			req = mux.SetURLVars(req, vars)
+			env.GenerateStage1JSON(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("GenerateStage1JSON() wrong HTTP status: got %v; want %v", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestEnv_GenerateStage1BaseURL(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+			storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.json",
+		},
+	}
+	tests := []struct {
+		name    string
+		baseURL string
+		want    string
+	}{
+		{
+			name: "default-from-server-addr",
+			want: "https://example.com:4321/v1/boot/" + h.Name + "/",
+		},
+		{
+			name:    "external-base-url",
+			baseURL: "https://epoxy.example.org/boot-api",
+			want:    "https://epoxy.example.org/boot-api/v1/boot/" + h.Name + "/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				BaseURL:                tt.baseURL,
+				AllowForwardedRequests: true,
+			}
+			handlers := map[string]http.HandlerFunc{
+				"stage1.ipxe": env.GenerateStage1IPXE,
+				"stage1.json": env.GenerateStage1JSON,
+			}
+			for target, handle := range handlers {
+				req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/"+target, nil)
+				req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+				req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+				rec := httptest.NewRecorder()
+				handle(rec, req)
+
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s wrong HTTP status: got %v; want %v", target, rec.Code, http.StatusOK)
+				}
+				// Every generated URL uses the external base URL.
+				if n := strings.Count(rec.Body.String(), tt.want); n != 3 {
+					t.Errorf("%s generated %d URLs with base %q; want 3:\n%s", target, n, tt.want, rec.Body.String())
+				}
+				if tt.baseURL != "" && strings.Contains(rec.Body.String(), env.ServerAddr) {
+					t.Errorf("%s generated URLs with ServerAddr %q:\n%s", target, env.ServerAddr, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEnv_GenerateStage1JSONConcurrent(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.json",
+		},
+	}
+	env := &Env{
+		Config:                 fakeConfig{host: h},
+		ServerAddr:             "example.com:4321",
+		AllowForwardedRequests: true,
+	}
+
+	// Simulate many concurrent stage1 requests for the same host.
+	const count = 20
+	bodies := make([]string, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/v1/boot/mlab1.iad1t.measurement-lab.org/stage1.json", nil)
+			req.Header.Set("X-Forwarded-For", "165.117.240.9")
+			req = mux.SetURLVars(req, map[string]string{"hostname": "mlab1.iad1t.measurement-lab.org"})
+			rec := httptest.NewRecorder()
+			env.GenerateStage1JSON(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("GenerateStage1JSON() wrong HTTP status: got %v; want %v", rec.Code, http.StatusOK)
+			}
+			bodies[i] = rec.Body.String()
+		}(i)
+	}
+	wg.Wait()
+
+	// The saved session IDs must all come from exactly one response.
+	ids := h.CurrentSessionIDs
+	matches := 0
+	for _, body := range bodies {
+		if strings.Contains(body, ids.Stage2ID) && strings.Contains(body, ids.Stage3ID) &&
+			strings.Contains(body, ids.ReportID) {
+			matches++
+		}
+	}
+	if matches != 1 {
+		t.Errorf("GenerateStage1JSON() saved inconsistent session IDs: %d responses match %#v", matches, ids)
+	}
+}
+
+func TestEnv_HandleStorageProxy(t *testing.T) {
+	tests := []struct {
+		name           string
+		storagePath    string
+		method         string
+		expectedStatus int
+		expectedResult string
+		disableStorage bool
+	}{
+		{
+			name:           "success",
+			storagePath:    "/stage1/vmlinuz",
+			method:         "GET",
+			expectedStatus: http.StatusOK,
+			expectedResult: "ok",
+		},
+		{
+			name:           "failure-not-implemented",
+			storagePath:    "/stage1/vmlinuz",
+			method:         "GET",
+			expectedStatus: http.StatusNotImplemented,
+			disableStorage: true,
+		},
+		{
+			name:           "failure-method-not-allowed",
+			storagePath:    "/stage1/vmlinuz",
+			method:         "POST",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Setup a fake storage server to handle the proxy request.
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != tt.storagePath {
+						t.Errorf("Requeted and expected path does not match; got %q, want %q",
+							r.URL.Path, tt.storagePath)
+					}
+					w.WriteHeader(tt.expectedStatus)
+					w.Write([]byte(tt.expectedResult))
+				}))
+			defer ts.Close()
+
+			// Create a synthetic request with an original request URL to example.com.
+			req := httptest.NewRequest(
+				tt.method, "https://epoxy-boot-api.mlab-sandbox.mlab.net/v1/storage"+tt.storagePath, nil)
+			rec := httptest.NewRecorder()
+
+			// These variables are normally created by the gorilla request handler.
+			// An original request to:
+			//   https://epoxy-boot-api.mlab-sandbox.mlab.net/v1/storage/stage1/vmlinuz
+			// would extract the "path" after /v1/storage, i.e. "stage1/vmlinuz"
+			vars := map[string]string{"path": tt.storagePath[1:]}
+			req = mux.SetURLVars(req, vars)
+
+			// The env configuration is normally created by the main server.
+			// StoragePrefixURL is the only setting needed by HandleStorageProxy.
+			env := &Env{}
+			if !tt.disableStorage {
+				// Direct the proxy at our test server.
+				env.StoragePrefixURL = ts.URL
+			}
+
+			env.HandleStorageProxy(rec, req)
+
+			if tt.expectedStatus != rec.Code {
+				t.Errorf("HandleStorageProxy() wrong HTTP status: got %v; want %v",
+					rec.Code, tt.expectedStatus)
+			}
+			// Verify that the request and response actually came from the test server.
+			if tt.expectedResult != "" && tt.expectedResult != rec.Body.String() {
+				t.Errorf("HandleStorageProxy() wrong result forwarded: got %v\n; want %v\n",
+					rec.Body.String(), tt.expectedResult)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleStorageProxyRegions(t *testing.T) {
+	// Setup one fake storage server for the default prefix and one per region.
+	newStorage := func(name string) *httptest.Server {
+		return httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name))
+			}))
+	}
+	tsDefault := newStorage("default")
+	defer tsDefault.Close()
+	tsEurope := newStorage("europe")
+	defer tsEurope.Close()
+	tsAsia := newStorage("asia")
+	defer tsAsia.Close()
+
+	tests := []struct {
+		name           string
+		region         string
+		defaultPrefix  string
+		expectedStatus int
+		expectedResult string
+	}{
+		{
+			name:           "success-region-europe",
+			region:         "europe",
+			defaultPrefix:  tsDefault.URL,
+			expectedStatus: http.StatusOK,
+			expectedResult: "europe",
+		},
+		{
+			name:           "success-region-asia",
+			region:         "asia",
+			defaultPrefix:  tsDefault.URL,
+			expectedStatus: http.StatusOK,
+			expectedResult: "asia",
+		},
+		{
+			name:           "success-fallback-for-unknown-region",
+			region:         "antarctica",
+			defaultPrefix:  tsDefault.URL,
+			expectedStatus: http.StatusOK,
+			expectedResult: "default",
+		},
+		{
+			name:           "success-fallback-without-region",
+			defaultPrefix:  tsDefault.URL,
+			expectedStatus: http.StatusOK,
+			expectedResult: "default",
+		},
+		{
+			name:           "success-region-without-default",
+			region:         "europe",
+			expectedStatus: http.StatusOK,
+			expectedResult: "europe",
+		},
+		{
+			name:           "failure-not-implemented-without-default",
+			region:         "antarctica",
+			expectedStatus: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				"GET", "https://epoxy-boot-api.mlab-sandbox.mlab.net/v1/storage/stage1/vmlinuz", nil)
+			if tt.region != "" {
+				req.Header.Set(StorageRegionHeader, tt.region)
+			}
+			req = mux.SetURLVars(req, map[string]string{"path": "stage1/vmlinuz"})
+			rec := httptest.NewRecorder()
+			env := &Env{
+				StoragePrefixURL: tt.defaultPrefix,
+				StorageRegionPrefixURLs: map[string]string{
+					"europe": tsEurope.URL,
+					"asia":   tsAsia.URL,
+				},
+			}
+
+			env.HandleStorageProxy(rec, req)
+
+			if tt.expectedStatus != rec.Code {
+				t.Errorf("HandleStorageProxy() wrong HTTP status: got %v; want %v",
+					rec.Code, tt.expectedStatus)
+			}
+			if tt.expectedResult != "" && tt.expectedResult != rec.Body.String() {
+				t.Errorf("HandleStorageProxy() wrong storage server: got %q; want %q",
+					rec.Body.String(), tt.expectedResult)
+			}
+		})
+	}
+}
+
+func TestEnv_GenerateJSONConfigNonce(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+			storage.Stage2:     "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.json",
+		},
+		CollectedInformation: datastorex.Map{},
+	}
+	env := &Env{
+		Config:                 fakeConfig{host: h},
+		ServerAddr:             "example.com:4321",
+		AllowForwardedRequests: true,
+	}
+
+	// Request stage1 with a client nonce.
+	form := url.Values{"nonce": []string{"first-boot-nonce"}}
+	req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+	req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+	rec := httptest.NewRecorder()
+	env.GenerateStage1IPXE(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GenerateStage1IPXE() wrong HTTP status: got %v; want %v", rec.Code, http.StatusOK)
+	}
+	if h.CurrentSessionIDs.Nonce != "first-boot-nonce" {
+		t.Fatalf("GenerateStage1IPXE() failed to save nonce: got %q", h.CurrentSessionIDs.Nonce)
+	}
+	if !strings.Contains(rec.Body.String(), "/stage2?nonce=first-boot-nonce\n") {
+		t.Errorf("GenerateStage1IPXE() stage2 URL missing nonce:\n%s", rec.Body.String())
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{
+			name:   "success-matching-nonce",
+			query:  "?nonce=first-boot-nonce",
+			status: http.StatusOK,
+		},
+		{
+			name:   "failure-replayed-nonce",
+			query:  "?nonce=old-boot-nonce",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "failure-missing-nonce",
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/v1/boot/" + h.Name + "/" + h.CurrentSessionIDs.Stage2ID + "/stage2" + tt.query
+			req := httptest.NewRequest("POST", path, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{
+				"hostname": h.Name, "sessionID": h.CurrentSessionIDs.Stage2ID})
+			rec := httptest.NewRecorder()
+
+			env.GenerateJSONConfig(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("GenerateJSONConfig() wrong HTTP status: got %v; want %v", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestEnv_GenerateStage1IPXEInvalidNonce(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1IPXE: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.ipxe",
+		},
+		CollectedInformation: datastorex.Map{},
+	}
+	env := &Env{
+		Config:                 fakeConfig{host: h},
+		ServerAddr:             "example.com:4321",
+		AllowForwardedRequests: true,
+	}
+	form := url.Values{"nonce": []string{"abc&stage3=x"}}
+	req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+	req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+	rec := httptest.NewRecorder()
+	env.GenerateStage1IPXE(rec, req)
+
+	// A malformed nonce is rejected, rather than starting a session without one.
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GenerateStage1IPXE() wrong HTTP status: got %v; want %v", rec.Code, http.StatusBadRequest)
+	}
+	if h.CurrentSessionIDs.Stage2ID != "" {
+		t.Errorf("GenerateStage1IPXE() saved a session for a malformed nonce: %q", h.CurrentSessionIDs.Stage2ID)
+	}
+}
+
+func Test_etagMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{name: "empty", ifNoneMatch: "", want: false},
+		{name: "match", ifNoneMatch: `"abc"`, want: true},
+		{name: "mismatch", ifNoneMatch: `"def"`, want: false},
+		{name: "list", ifNoneMatch: `"def", "abc"`, want: true},
+		{name: "weak", ifNoneMatch: `W/"abc"`, want: true},
+		{name: "any", ifNoneMatch: "*", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.ifNoneMatch, `"abc"`); got != tt.want {
+				t.Errorf("etagMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnv_GenerateJSONConfigETag(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.json",
+			storage.Stage2:     "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.json",
+		},
+		CollectedInformation: datastorex.Map{},
+	}
+	env := &Env{
+		Config:                 fakeConfig{host: h},
+		ServerAddr:             "example.com:4321",
+		AllowForwardedRequests: true,
+	}
+	request := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/12345/stage2", nil)
+		req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		req = mux.SetURLVars(req, map[string]string{"hostname": h.Name, "sessionID": "12345"})
+		rec := httptest.NewRecorder()
+		env.GenerateJSONConfig(rec, req)
+		return rec
+	}
+
+	// The first request returns the config with an ETag.
+	rec := request("")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GenerateJSONConfig() = %d with ETag %q; want %d with ETag", rec.Code, etag, http.StatusOK)
+	}
+	// The ETag is stable for the same config.
+	if got := request("").Header().Get("ETag"); got != etag {
+		t.Errorf("GenerateJSONConfig() ETag = %q, want stable %q", got, etag)
+	}
+	// A matching If-None-Match returns no content.
+	rec = request(etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("GenerateJSONConfig() = %d with %q; want %d without body",
+			rec.Code, rec.Body.String(), http.StatusNotModified)
+	}
+	// A changed config has a new ETag.
+	h.Boot[storage.Stage2] = "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2-v2.json"
+	rec = request(etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("GenerateJSONConfig() = %d with ETag %q; want %d with new ETag",
+			rec.Code, rec.Header().Get("ETag"), http.StatusOK)
+	}
+
+	// Stage1 responses embed new session IDs, so they are never cached.
+	req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.json", nil)
+	req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+	req.Header.Set("If-None-Match", "*")
+	req = mux.SetURLVars(req, map[string]string{"hostname": h.Name})
+	rec = httptest.NewRecorder()
+	env.GenerateStage1JSON(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" ||
+		rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("GenerateStage1JSON() = %d with headers %v; want %d with no-store",
+			rec.Code, rec.Header(), http.StatusOK)
+	}
+}
+
+func TestEnv_GenerateJSONConfigSigned(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+		Boot: datastorex.Map{
+			storage.Stage1JSON: "https://storage.googleapis.com/epoxy-boot-server/stage1to2/stage1to2.json",
+			storage.Stage2:     "https://storage.googleapis.com/epoxy-boot-server/stage2/stage2.json",
+		},
+		CollectedInformation: datastorex.Map{},
+	}
+	tests := []struct {
+		name    string
+		key     ed25519.PrivateKey
+		path    string
+		handler func(env *Env) http.HandlerFunc
+	}{
+		{
+			name:    "stage1-json",
+			key:     priv,
+			path:    "/v1/boot/" + h.Name + "/stage1.json",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateStage1JSON },
+		},
+		{
+			name:    "stage2",
+			key:     priv,
+			path:    "/v1/boot/" + h.Name + "/12345/stage2",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+		},
+		{
+			name:    "unsigned",
+			path:    "/v1/boot/" + h.Name + "/12345/stage2",
+			handler: func(env *Env) http.HandlerFunc { return env.GenerateJSONConfig },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+				SigningKey:             tt.key,
+			}
+			req := httptest.NewRequest("POST", tt.path, nil)
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req = mux.SetURLVars(req, map[string]string{"hostname": h.Name, "sessionID": "12345"})
+			rec := httptest.NewRecorder()
+			tt.handler(env)(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("handler returned %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			sig := rec.Header().Get(nextboot.SignatureHeader)
+			if tt.key == nil {
+				if sig != "" {
+					t.Errorf("handler signed config without a key: %q", sig)
+				}
+				return
+			}
+			// The signature covers the exact response body.
+			if err := nextboot.Verify(pub, rec.Body.Bytes(), sig); err != nil {
+				t.Errorf("Verify() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleStorageProxyContentTypes(t *testing.T) {
+	// The fake storage server returns the Content-Type named by the request.
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Content-Type"] = []string{r.Header.Get("X-Upstream-Type")}
+			w.Write([]byte("content"))
+		}))
+	defer ts.Close()
+
+	contentTypes := map[string]string{
+		".ipxe": "text/plain",
+		".json": "application/json",
+	}
+	tests := []struct {
+		name         string
+		path         string
+		upstreamType string
+		want         string
+	}{
+		{
+			name:         "ipxe-generic-type",
+			path:         "stage1to2/stage1to2.ipxe",
+			upstreamType: "application/octet-stream",
+			want:         "text/plain",
+		},
+		{
+			name:         "json-generic-type",
+			path:         "stage2/stage2.json",
+			upstreamType: "binary/octet-stream",
+			want:         "application/json",
+		},
+		{
+			name: "json-missing-type",
+			path: "stage2/stage2.json",
+			want: "application/json",
+		},
+		{
+			name:         "specific-type-is-preserved",
+			path:         "stage1to2/stage1to2.ipxe",
+			upstreamType: "text/x-ipxe",
+			want:         "text/x-ipxe",
+		},
+		{
+			name:         "unknown-suffix-is-preserved",
+			path:         "stage1/vmlinuz",
+			upstreamType: "application/octet-stream",
+			want:         "application/octet-stream",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				"GET", "https://epoxy-boot-api.mlab-sandbox.mlab.net/v1/storage/"+tt.path, nil)
+			req.Header.Set("X-Upstream-Type", tt.upstreamType)
+			req = mux.SetURLVars(req, map[string]string{"path": tt.path})
+			rec := httptest.NewRecorder()
+			env := &Env{
+				StoragePrefixURL:    ts.URL,
+				StorageContentTypes: contentTypes,
+			}
+
+			env.HandleStorageProxy(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("HandleStorageProxy() wrong HTTP status: got %v; want %v",
+					rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("HandleStorageProxy() wrong Content-Type: got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnv_HandleStorageProxyUpstreamErrors(t *testing.T) {
+	// The fake storage server returns the status and Content-Type named by the
+	// request, with an HTML error page as the body.
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", r.Header.Get("X-Upstream-Type"))
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("ETag", `"abc"`)
+			status, _ := strconv.Atoi(r.Header.Get("X-Upstream-Status"))
+			w.WriteHeader(status)
+			w.Write([]byte("<html><body>upstream page</body></html>"))
+		}))
+	defer ts.Close()
+
+	tests := []struct {
+		name           string
+		path           string
+		upstreamStatus int
+		upstreamType   string
+		wantStatus     int
+		wantUpstream   bool
+	}{
+		{
+			name:           "upstream-404",
+			path:           "stage1/vmlinuz",
+			upstreamStatus: http.StatusNotFound,
+			upstreamType:   "text/html; charset=UTF-8",
+			wantStatus:     http.StatusNotFound,
+		},
+		{
+			name:           "upstream-403",
+			path:           "stage1/vmlinuz",
+			upstreamStatus: http.StatusForbidden,
+			upstreamType:   "application/xml",
+			wantStatus:     http.StatusForbidden,
+		},
+		{
+			name:           "upstream-500-is-bad-gateway",
+			path:           "stage1/vmlinuz",
+			upstreamStatus: http.StatusInternalServerError,
+			upstreamType:   "text/html",
+			wantStatus:     http.StatusBadGateway,
+		},
+		{
+			name:           "html-error-page-with-200-is-404",
+			path:           "stage2/stage2.json",
+			upstreamStatus: http.StatusOK,
+			upstreamType:   "text/html; charset=UTF-8",
+			wantStatus:     http.StatusNotFound,
+		},
+		{
+			name:           "html-file-is-content",
+			path:           "docs/index.html",
+			upstreamStatus: http.StatusOK,
+			upstreamType:   "text/html",
+			wantStatus:     http.StatusOK,
+			wantUpstream:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				"GET", "https://epoxy-boot-api.mlab-sandbox.mlab.net/v1/storage/"+tt.path, nil)
+			req.Header.Set("X-Upstream-Status", strconv.Itoa(tt.upstreamStatus))
+			req.Header.Set("X-Upstream-Type", tt.upstreamType)
+			req = mux.SetURLVars(req, map[string]string{"path": tt.path})
+			rec := httptest.NewRecorder()
+			env := &Env{StoragePrefixURL: ts.URL}
+
+			env.HandleStorageProxy(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("HandleStorageProxy() wrong HTTP status: got %v; want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantUpstream {
+				if rec.Header().Get("ETag") == "" {
+					t.Errorf("HandleStorageProxy() did not forward upstream headers: %v", rec.Header())
+				}
+				return
+			}
+			wantBody := http.StatusText(tt.wantStatus) + "\n"
+			if rec.Body.String() != wantBody {
+				t.Errorf("HandleStorageProxy() wrong body: got %q; want %q", rec.Body.String(), wantBody)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("HandleStorageProxy() wrong Cache-Control: got %q; want no-store", got)
+			}
+			if got := rec.Header().Get("ETag"); got != "" {
+				t.Errorf("HandleStorageProxy() forwarded upstream ETag %q for an error", got)
+			}
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+				t.Errorf("HandleStorageProxy() wrong Content-Type: got %q; want text/plain", got)
+			}
+		})
+	}
+}
+
+func TestHandleSchema(t *testing.T) {
+	req := httptest.NewRequest("GET", "/v1/schema", nil)
+	rec := httptest.NewRecorder()
+
+	HandleSchema(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HandleSchema() wrong HTTP status: got %v; want %v", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/schema+json" {
+		t.Errorf("HandleSchema() wrong Content-Type: got %q", ct)
+	}
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &schema); err != nil {
+		t.Fatalf("HandleSchema() returned invalid JSON: %v", err)
+	}
+	for _, key := range []string{"$schema", "title", "type", "properties", "definitions"} {
+		if _, ok := schema[key]; !ok {
+			t.Errorf("HandleSchema() missing top-level key %q", key)
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	for _, key := range []string{"kargs", "v1"} {
+		if _, ok := properties[key]; !ok {
+			t.Errorf("HandleSchema() missing property %q", key)
+		}
+	}
+}
+
+func TestEnv_requestIsFromHostCIDR(t *testing.T) {
+	h := &storage.Host{
+		Name:         "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr:     "165.117.240.9",
+		AllowedCIDRs: []string{"192.168.0.8/29"},
+	}
+	tests := []struct {
+		name       string
+		forwarded  bool
+		remoteAddr string
+		fwdFor     string
+		wantErr    error
+	}{
+		{
+			name:       "remote-exact-ip",
+			remoteAddr: "165.117.240.9:4321",
+		},
+		{
+			name:       "remote-inside-cidr",
+			remoteAddr: "192.168.0.14:4321",
+		},
+		{
+			name:       "remote-outside-cidr",
+			remoteAddr: "192.168.0.16:4321",
+			wantErr:    ErrCannotAccessHost,
+		},
+		{
+			name:      "forwarded-inside-cidr",
+			forwarded: true,
+			fwdFor:    "192.168.0.9, 10.0.0.1",
+		},
+		{
+			name:      "forwarded-outside-cidr",
+			forwarded: true,
+			fwdFor:    "192.168.0.7, 10.0.0.1",
+			wantErr:   ErrCannotAccessHost,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{AllowForwardedRequests: tt.forwarded}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if tt.fwdFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.fwdFor)
+			}
+			if err := env.requestIsFromHost(req, h); err != tt.wantErr {
+				t.Errorf("requestIsFromHost() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnv_requestIsFromHostTrustedProxies(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+	}
+	_, lb, err := net.ParseCIDR("35.191.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		proxies []*net.IPNet
+		fwdFor  string
+		wantErr error
+	}{
+		{
+			name:   "no-trusted-proxies",
+			fwdFor: "165.117.240.9, 10.0.0.1",
+		},
+		{
+			name:    "trusted-final-hop",
+			proxies: []*net.IPNet{lb},
+			fwdFor:  "165.117.240.9, 35.191.3.4",
+		},
+		{
+			name:    "untrusted-final-hop",
+			proxies: []*net.IPNet{lb},
+			fwdFor:  "165.117.240.9, 10.0.0.1",
+			wantErr: ErrCannotAccessHost,
+		},
+		{
+			name:    "missing-final-hop",
+			proxies: []*net.IPNet{lb},
+			fwdFor:  "165.117.240.9",
+			wantErr: ErrCannotAccessHost,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{AllowForwardedRequests: true, TrustedProxies: tt.proxies}
+			req := httptest.NewRequest("POST", "/v1/boot/"+h.Name+"/stage1.ipxe", nil)
+			req.Header.Set("X-Forwarded-For", tt.fwdFor)
+			if err := env.requestIsFromHost(req, h); err != tt.wantErr {
+				t.Errorf("requestIsFromHost() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnv_Audit(t *testing.T) {
+	h := &storage.Host{
+		Name:     "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr: "165.117.240.9",
+	}
+	adminCert := &x509.Certificate{Subject: pkix.Name{CommonName: "epoxy-admin"}}
+	tests := []struct {
+		name        string
+		handler     func(env *Env) http.HandlerFunc
+		path        string
+		vars        map[string]string
+		form        url.Values
+		from        string
+		cert        *x509.Certificate
+		wantActions []string
+		wantActor   string
+	}{
+		{
+			name:        "stage1-session",
+			handler:     func(env *Env) http.HandlerFunc { return env.GenerateStage1IPXE },
+			path:        "/v1/boot/" + h.Name + "/stage1.ipxe",
+			vars:        map[string]string{"hostname": h.Name},
+			from:        h.IPv4Addr,
+			wantActions: []string{storage.AuditSession},
+			wantActor:   h.IPv4Addr,
+		},
+		{
+			name:        "report-success-disables-update",
+			handler:     func(env *Env) http.HandlerFunc { return env.ReceiveReport },
+			path:        "/v1/boot/" + h.Name + "/12345/report",
+			vars:        map[string]string{"hostname": h.Name, "sessionID": "12345"},
+			form:        url.Values{"message": []string{"success"}},
+			from:        h.IPv4Addr,
+			wantActions: []string{storage.AuditReport, storage.AuditUpdateEnabled},
+			wantActor:   h.IPv4Addr,
+		},
+		{
+			name:        "report-failure-with-client-cert",
+			handler:     func(env *Env) http.HandlerFunc { return env.ReceiveReport },
+			path:        "/v1/boot/" + h.Name + "/12345/report",
+			vars:        map[string]string{"hostname": h.Name, "sessionID": "12345"},
+			form:        url.Values{"message": []string{"error: failed"}},
+			from:        h.IPv4Addr,
+			cert:        adminCert,
+			wantActions: []string{storage.AuditReport},
+			wantActor:   "epoxy-admin",
+		},
+		{
+			name:    "rejected-report-is-not-audited",
+			handler: func(env *Env) http.HandlerFunc { return env.ReceiveReport },
+			path:    "/v1/boot/" + h.Name + "/12345/report",
+			vars:    map[string]string{"hostname": h.Name, "sessionID": "12345"},
+			from:    "192.168.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.UpdateEnabled = true
+			h.CurrentSessionIDs = storage.SessionIDs{ReportID: "12345"}
+			var audit strings.Builder
+			env := &Env{
+				Config:                 fakeConfig{host: h},
+				ServerAddr:             "example.com:4321",
+				AllowForwardedRequests: true,
+				Auditor:                storage.NewAuditor(&audit, nil),
+			}
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", tt.from)
+			if tt.cert != nil {
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+			}
+			req = mux.SetURLVars(req, tt.vars)
+
+			tt.handler(env).ServeHTTP(httptest.NewRecorder(), req)
+
+			var actions []string
+			dec := json.NewDecoder(strings.NewReader(audit.String()))
+			for dec.More() {
+				e := &storage.AuditEvent{}
+				if err := dec.Decode(e); err != nil {
+					t.Fatalf("Invalid audit event: %v", err)
+				}
+				if e.Actor != tt.wantActor || e.Host != h.Name {
+					t.Errorf("Audit event actor = %q, host = %q; want %q, %q",
+						e.Actor, e.Host, tt.wantActor, h.Name)
+				}
+				actions = append(actions, e.Action)
+			}
+			if !reflect.DeepEqual(actions, tt.wantActions) {
+				t.Errorf("%s audit actions = %q, want %q", tt.name, actions, tt.wantActions)
 			}
 		})
 	}
@@ -0,0 +1,139 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+const (
+	// defaultInventoryLimit is the number of hosts in an inventory page when
+	// the request does not give a limit.
+	defaultInventoryLimit = 1000
+	// maxInventoryLimit is the largest number of hosts in an inventory page.
+	maxInventoryLimit = 10000
+)
+
+// InventoryHost is the summary of a Host returned by HandleInventory.
+type InventoryHost struct {
+	Name          string   `json:"name"`
+	IP            string   `json:"ip,omitempty"`
+	UpdateEnabled bool     `json:"update_enabled"`
+	Extensions    []string `json:"extensions,omitempty"`
+	// LastSuccess is an RFC3339 time, or empty if the host never reported success.
+	LastSuccess string `json:"last_success,omitempty"`
+}
+
+// newInventoryHost returns the inventory summary of h.
+func newInventoryHost(h *storage.Host) InventoryHost {
+	i := InventoryHost{
+		Name:          h.Name,
+		IP:            h.IPv4Addr,
+		UpdateEnabled: h.UpdateEnabled,
+		Extensions:    h.Extensions,
+	}
+	if !h.LastSuccess.IsZero() {
+		i.LastSuccess = h.LastSuccess.UTC().Format(time.RFC3339)
+	}
+	return i
+}
+
+// HandleInventory returns a compact JSON array summarizing hosts, sorted by
+// name, for administrators authenticated with AdminCredentials or
+// AdminCertSubjects. When neither, or no Hosts, are configured, the inventory
+// is disabled.
+//
+// Query parameters:
+//   - hostname: a regular expression selecting host names, like "list".
+//   - limit: the largest number of hosts returned, up to maxInventoryLimit.
+//   - after: return only hosts with names after this name.
+//
+// When more hosts are available, the response includes a Link header with
+// rel="next" naming the URL of the next page.
+func (env *Env) HandleInventory(rw http.ResponseWriter, req *http.Request) {
+	if !env.adminConfigured() || env.Hosts == nil {
+		http.Error(rw, "Inventory is not configured", http.StatusNotImplemented)
+		return
+	}
+	if !env.isAdmin(req) {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="epoxy"`)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := req.URL.Query()
+	r, err := regexp.Compile(query.Get("hostname"))
+	if err != nil {
+		http.Error(rw, "Invalid hostname pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultInventoryLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxInventoryLimit {
+			http.Error(rw, "Invalid limit: "+l, http.StatusBadRequest)
+			return
+		}
+	}
+	after := query.Get("after")
+
+	hosts, err := env.Hosts.List()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+
+	inventory := []InventoryHost{}
+	more := false
+	for _, h := range hosts {
+		if h.Name <= after || !r.MatchString(h.Name) {
+			continue
+		}
+		if len(inventory) == limit {
+			more = true
+			break
+		}
+		inventory = append(inventory, newInventoryHost(h))
+	}
+
+	b, err := json.Marshal(inventory)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if more {
+		next := *req.URL
+		query.Set("after", inventory[len(inventory)-1].Name)
+		query.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = query.Encode()
+		rw.Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := rw.Write(b); err != nil {
+		log.Printf("Failed to write inventory: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+func TestEnv_HandleInventory(t *testing.T) {
+	success := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	hosts := []*storage.Host{
+		{Name: "mlab3.iad1t.measurement-lab.org", IPv4Addr: "165.117.240.11"},
+		{
+			Name:          "mlab1.iad1t.measurement-lab.org",
+			IPv4Addr:      "165.117.240.9",
+			UpdateEnabled: true,
+			Extensions:    []string{"allocate_k8s_token"},
+			LastSuccess:   success,
+			// Session IDs are never part of the inventory.
+			CurrentSessionIDs: storage.SessionIDs{ReportID: "secret"},
+		},
+		{Name: "mlab2.iad1t.measurement-lab.org", IPv4Addr: "165.117.240.10"},
+		{Name: "mlab1.lga0t.measurement-lab.org", IPv4Addr: "4.14.159.75"},
+	}
+	creds := map[string]string{"oncall": "secret"}
+	tests := []struct {
+		name       string
+		creds      map[string]string
+		lister     HostLister
+		password   string
+		query      string
+		wantStatus int
+		wantBody   string
+		wantNext   string
+	}{
+		{
+			name:       "all-hosts",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "secret",
+			wantStatus: http.StatusOK,
+			wantBody: `[{"name":"mlab1.iad1t.measurement-lab.org","ip":"165.117.240.9","update_enabled":true,` +
+				`"extensions":["allocate_k8s_token"],"last_success":"2026-03-01T12:00:00Z"},` +
+				`{"name":"mlab1.lga0t.measurement-lab.org","ip":"4.14.159.75","update_enabled":false},` +
+				`{"name":"mlab2.iad1t.measurement-lab.org","ip":"165.117.240.10","update_enabled":false},` +
+				`{"name":"mlab3.iad1t.measurement-lab.org","ip":"165.117.240.11","update_enabled":false}]`,
+		},
+		{
+			name:       "first-page",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "secret",
+			query:      "?limit=2",
+			wantStatus: http.StatusOK,
+			wantBody: `[{"name":"mlab1.iad1t.measurement-lab.org","ip":"165.117.240.9","update_enabled":true,` +
+				`"extensions":["allocate_k8s_token"],"last_success":"2026-03-01T12:00:00Z"},` +
+				`{"name":"mlab1.lga0t.measurement-lab.org","ip":"4.14.159.75","update_enabled":false}]`,
+			wantNext: `</v1/admin/inventory?after=mlab1.lga0t.measurement-lab.org&limit=2>; rel="next"`,
+		},
+		{
+			name:       "last-page",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "secret",
+			query:      "?after=mlab1.lga0t.measurement-lab.org&limit=2",
+			wantStatus: http.StatusOK,
+			wantBody: `[{"name":"mlab2.iad1t.measurement-lab.org","ip":"165.117.240.10","update_enabled":false},` +
+				`{"name":"mlab3.iad1t.measurement-lab.org","ip":"165.117.240.11","update_enabled":false}]`,
+		},
+		{
+			name:       "hostname-filter-pages",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "secret",
+			query:      "?hostname=iad1t&limit=1",
+			wantStatus: http.StatusOK,
+			wantBody: `[{"name":"mlab1.iad1t.measurement-lab.org","ip":"165.117.240.9","update_enabled":true,` +
+				`"extensions":["allocate_k8s_token"],"last_success":"2026-03-01T12:00:00Z"}]`,
+			wantNext: `</v1/admin/inventory?after=mlab1.iad1t.measurement-lab.org&hostname=iad1t&limit=1>; rel="next"`,
+		},
+		{
+			name:       "no-matching-hosts",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "secret",
+			query:      "?hostname=mlab4",
+			wantStatus: http.StatusOK,
+			wantBody:   `[]`,
+		},
+		{
+			name:       "failure-invalid-limit",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "secret",
+			query:      "?limit=0",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "failure-invalid-hostname",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "secret",
+			query:      "?hostname=(",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "failure-wrong-password",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			password:   "wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "failure-list-error",
+			creds:      creds,
+			lister:     &fakeLister{err: errors.New("datastore unavailable")},
+			password:   "secret",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "disabled-without-credentials",
+			lister:     &fakeLister{hosts: hosts},
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{AdminCredentials: tt.creds, Hosts: tt.lister}
+			req := httptest.NewRequest("GET", "/v1/admin/inventory"+tt.query, nil)
+			req.SetBasicAuth("oncall", tt.password)
+			rec := httptest.NewRecorder()
+
+			env.HandleInventory(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("HandleInventory() wrong HTTP status: got %d; want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("HandleInventory() body =\n%s\nwant\n%s", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("Link"); got != tt.wantNext {
+				t.Errorf("HandleInventory() Link = %q; want %q", got, tt.wantNext)
+			}
+			var inventory []InventoryHost
+			if err := json.Unmarshal(rec.Body.Bytes(), &inventory); err != nil {
+				t.Fatalf("HandleInventory() returned invalid JSON: %v", err)
+			}
+		})
+	}
+}
+
+// TestEnv_HandleInventoryPages follows the next page links until every host
+// is returned exactly once.
+func TestEnv_HandleInventoryPages(t *testing.T) {
+	var hosts []*storage.Host
+	var want []string
+	for _, name := range []string{"mlab4", "mlab1", "mlab3", "mlab5", "mlab2"} {
+		hosts = append(hosts, &storage.Host{Name: name + ".iad1t.measurement-lab.org"})
+	}
+	for _, name := range []string{"mlab1", "mlab2", "mlab3", "mlab4", "mlab5"} {
+		want = append(want, name+".iad1t.measurement-lab.org")
+	}
+	env := &Env{AdminCredentials: map[string]string{"oncall": "secret"}, Hosts: &fakeLister{hosts: hosts}}
+
+	var got []string
+	next := "/v1/admin/inventory?limit=2"
+	for pages := 0; next != "" && pages < 10; pages++ {
+		req := httptest.NewRequest("GET", next, nil)
+		req.SetBasicAuth("oncall", "secret")
+		rec := httptest.NewRecorder()
+		env.HandleInventory(rec, req)
+
+		var inventory []InventoryHost
+		if err := json.Unmarshal(rec.Body.Bytes(), &inventory); err != nil {
+			t.Fatalf("HandleInventory() returned invalid JSON: %v", err)
+		}
+		for _, h := range inventory {
+			got = append(got, h.Name)
+		}
+		next = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			next = link[1 : len(link)-len(`>; rel="next"`)]
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("HandleInventory() pages returned %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+// HostLister lists all Host records.
+type HostLister interface {
+	List() ([]*storage.Host, error)
+}
+
+// statusTemplate renders the status page. html/template escapes all host
+// fields, which are partly reported by the hosts themselves.
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"formatTime": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>ePoxy status</title></head>
+<body>
+<h1>ePoxy status</h1>
+<p>{{len .}} hosts</p>
+<table>
+<tr><th>Host</th><th>Sequence</th><th>ImagesVersion</th><th>LastBoot</th><th>LastReport</th><th>LastSuccess</th><th>UpdateAttempts</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{if .Decommissioned}}decommissioned{{else if .UpdateEnabled}}update{{else}}boot{{end}}</td><td>{{.ImagesVersion}}</td><td>{{formatTime .LastSessionCreation}}</td><td>{{formatTime .LastReport}}</td><td>{{formatTime .LastSuccess}}</td><td>{{.UpdateAttempts}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ValidateCertSubjects returns an error unless every subject has the
+// "CN=<common name>" or "O=<organization>" form used by AdminCertSubjects.
+func ValidateCertSubjects(subjects []string) error {
+	for _, subject := range subjects {
+		name := strings.TrimPrefix(strings.TrimPrefix(subject, "CN="), "O=")
+		if name == subject || name == "" {
+			return fmt.Errorf("invalid certificate subject %q: want CN=<name> or O=<name>", subject)
+		}
+	}
+	return nil
+}
+
+// adminConfigured returns true if any administrator authentication is
+// configured, using AdminCredentials or AdminCertSubjects.
+func (env *Env) adminConfigured() bool {
+	return len(env.AdminCredentials) > 0 || len(env.AdminCertSubjects) > 0
+}
+
+// isAdmin returns true if the request has basic auth credentials matching one
+// of the env AdminCredentials, or a verified client certificate with a subject
+// listed in AdminCertSubjects.
+func (env *Env) isAdmin(req *http.Request) bool {
+	if env.isAdminCert(req) {
+		return true
+	}
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, found := env.AdminCredentials[user]
+	return found && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// isAdminCert returns true if the request has a verified client certificate
+// with a CommonName or Organization listed in AdminCertSubjects. Certificates
+// that are only presented, but not verified, are never accepted.
+func (env *Env) isAdminCert(req *http.Request) bool {
+	if len(env.AdminCertSubjects) == 0 || req.TLS == nil ||
+		len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	var names []string
+	if subject.CommonName != "" {
+		names = append(names, "CN="+subject.CommonName)
+	}
+	for _, o := range subject.Organization {
+		names = append(names, "O="+o)
+	}
+	for _, allowed := range env.AdminCertSubjects {
+		for _, name := range names {
+			if name == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HandleStatus returns an HTML page summarizing the boot state of all hosts,
+// for administrators authenticated with AdminCredentials or
+// AdminCertSubjects. When neither, or no Hosts, are configured, the status
+// page is disabled.
+func (env *Env) HandleStatus(rw http.ResponseWriter, req *http.Request) {
+	if !env.adminConfigured() || env.Hosts == nil {
+		http.Error(rw, "Status page is not configured", http.StatusNotImplemented)
+		return
+	}
+	if !env.isAdmin(req) {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="epoxy"`)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	hosts, err := env.Hosts.List()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+
+	// Render completely before writing, so template errors return a 500.
+	var b bytes.Buffer
+	if err := statusTemplate.Execute(&b, hosts); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := b.WriteTo(rw); err != nil {
+		log.Printf("Failed to write status page: %v", err)
+	}
+}
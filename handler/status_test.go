@@ -0,0 +1,243 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy/storage"
+)
+
+// fakeLister is a HostLister that returns fixed hosts or an error.
+type fakeLister struct {
+	hosts []*storage.Host
+	err   error
+}
+
+func (f *fakeLister) List() ([]*storage.Host, error) {
+	return f.hosts, f.err
+}
+
+func TestEnv_HandleStatus(t *testing.T) {
+	booted := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	hosts := []*storage.Host{
+		{
+			Name:          "mlab2.iad1t.measurement-lab.org",
+			UpdateEnabled: true,
+			ImagesVersion: "v2.0.0",
+		},
+		{
+			Name:                "mlab1.iad1t.measurement-lab.org",
+			ImagesVersion:       "v1.0.0<script>",
+			LastSessionCreation: booted,
+			LastSuccess:         booted,
+		},
+	}
+	creds := map[string]string{"oncall": "secret"}
+	tests := []struct {
+		name       string
+		creds      map[string]string
+		lister     HostLister
+		user       string
+		password   string
+		wantStatus int
+		wantRows   []string
+	}{
+		{
+			name:       "success",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			user:       "oncall",
+			password:   "secret",
+			wantStatus: http.StatusOK,
+			wantRows: []string{
+				"<tr><td>mlab1.iad1t.measurement-lab.org</td><td>boot</td><td>v1.0.0&lt;script&gt;</td>" +
+					"<td>2026-03-01T12:00:00Z</td><td>never</td><td>2026-03-01T12:00:00Z</td><td>0</td></tr>",
+				"<tr><td>mlab2.iad1t.measurement-lab.org</td><td>update</td><td>v2.0.0</td>" +
+					"<td>never</td><td>never</td><td>never</td><td>0</td></tr>",
+			},
+		},
+		{
+			name:       "failure-wrong-password",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			user:       "oncall",
+			password:   "guess",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "failure-no-credentials",
+			creds:      creds,
+			lister:     &fakeLister{hosts: hosts},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "failure-not-configured",
+			lister:     &fakeLister{hosts: hosts},
+			user:       "oncall",
+			password:   "secret",
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "failure-list",
+			creds:      creds,
+			lister:     &fakeLister{err: errors.New("fake list error")},
+			user:       "oncall",
+			password:   "secret",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{Hosts: tt.lister, AdminCredentials: tt.creds}
+			req := httptest.NewRequest("GET", "/status", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := httptest.NewRecorder()
+
+			env.HandleStatus(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("HandleStatus() wrong HTTP status: got %v; want %v", rec.Code, tt.wantStatus)
+			}
+			body := rec.Body.String()
+			last := -1
+			for _, row := range tt.wantRows {
+				i := strings.Index(body, row)
+				if i < 0 {
+					t.Errorf("HandleStatus() missing row %q in:\n%s", row, body)
+					continue
+				}
+				// Rows are sorted by host name.
+				if i < last {
+					t.Errorf("HandleStatus() row %q is out of order", row)
+				}
+				last = i
+			}
+		})
+	}
+}
+
+func TestEnv_HandleStatusCertSubjects(t *testing.T) {
+	oncall := &x509.Certificate{Subject: pkix.Name{CommonName: "oncall", Organization: []string{"Ops"}}}
+	dev := &x509.Certificate{Subject: pkix.Name{CommonName: "dev", Organization: []string{"Eng"}}}
+	tests := []struct {
+		name       string
+		subjects   []string
+		verified   *x509.Certificate
+		presented  *x509.Certificate
+		wantStatus int
+	}{
+		{
+			name:       "success-allowed-common-name",
+			subjects:   []string{"CN=oncall"},
+			verified:   oncall,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "success-allowed-organization",
+			subjects:   []string{"CN=someone", "O=Ops"},
+			verified:   oncall,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "failure-unlisted-subject",
+			subjects:   []string{"CN=oncall", "O=Ops"},
+			verified:   dev,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "failure-unverified-certificate",
+			subjects:   []string{"CN=oncall"},
+			presented:  oncall,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "failure-no-certificate",
+			subjects:   []string{"CN=oncall"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "failure-not-configured",
+			verified:   oncall,
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Env{Hosts: &fakeLister{}, AdminCertSubjects: tt.subjects}
+			req := httptest.NewRequest("GET", "/status", nil)
+			req.TLS = &tls.ConnectionState{}
+			if tt.verified != nil {
+				req.TLS.PeerCertificates = []*x509.Certificate{tt.verified}
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{tt.verified}}
+			}
+			if tt.presented != nil {
+				req.TLS.PeerCertificates = []*x509.Certificate{tt.presented}
+			}
+			rec := httptest.NewRecorder()
+
+			env.HandleStatus(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("HandleStatus() wrong HTTP status: got %v; want %v", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestValidateCertSubjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		subjects []string
+		wantErr  bool
+	}{
+		{
+			name:     "success",
+			subjects: []string{"CN=oncall", "O=Measurement Lab"},
+		},
+		{
+			name:     "success-empty",
+			subjects: nil,
+		},
+		{
+			name:     "error-unknown-attribute",
+			subjects: []string{"OU=Ops"},
+			wantErr:  true,
+		},
+		{
+			name:     "error-empty-name",
+			subjects: []string{"CN="},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCertSubjects(tt.subjects); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCertSubjects(%q) error = %v, wantErr %t", tt.subjects, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// TraceParentHeader is the W3C Trace Context request header. The trace context
+// of each request is forwarded to extension services and the storage backend,
+// so that a boot can be followed across services.
+const TraceParentHeader = "traceparent"
+
+// traceRandRead allows unit tests to control generated trace contexts.
+var traceRandRead = rand.Read
+
+// TraceContext is a middleware that accepts a valid incoming traceparent
+// header, or replaces a missing or invalid one with a new trace context, and
+// logs the trace ID and route of every request.
+func TraceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, ok := parseTraceParent(req.Header.Get(TraceParentHeader)); !ok {
+			tp, err := newTraceParent()
+			if err != nil {
+				log.Printf("Failed to generate trace context: %v", err)
+			} else {
+				req.Header.Set(TraceParentHeader, tp)
+			}
+		}
+		log.Printf("Trace %s: %s %s", traceID(req), req.Method, tracePath(req))
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// tracePath returns the route template matched by req, so that session IDs in
+// the request path are never logged. Requests without a matched route use the
+// request path.
+func tracePath(req *http.Request) string {
+	if route := mux.CurrentRoute(req); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return req.URL.Path
+}
+
+// traceID returns the trace ID from the traceparent header of req, or "-" if
+// the request has no valid trace context.
+func traceID(req *http.Request) string {
+	id, ok := parseTraceParent(req.Header.Get(TraceParentHeader))
+	if !ok {
+		return "-"
+	}
+	return id
+}
+
+// newTraceParent returns a new version 00 traceparent value with random trace
+// and parent IDs and the sampled flag set.
+func newTraceParent() (string, error) {
+	b := make([]byte, 24)
+	if _, err := traceRandRead(b); err != nil {
+		return "", err
+	}
+	return "00-" + hex.EncodeToString(b[:16]) + "-" + hex.EncodeToString(b[16:]) + "-01", nil
+}
+
+// parseTraceParent returns the trace ID of a version 00 traceparent value, and
+// whether the value is valid. Trace and parent IDs of all zeros are invalid.
+func parseTraceParent(tp string) (string, bool) {
+	fields := strings.Split(tp, "-")
+	if len(fields) != 4 || fields[0] != "00" {
+		return "", false
+	}
+	for i, size := range []int{2, 32, 16, 2} {
+		if !isLowerHex(fields[i], size) {
+			return "", false
+		}
+	}
+	if strings.Trim(fields[1], "0") == "" || strings.Trim(fields[2], "0") == "" {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// isLowerHex returns true if s is size lowercase hex digits.
+func isLowerHex(s string, size int) bool {
+	if len(s) != size {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
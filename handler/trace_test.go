@@ -0,0 +1,264 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/m-lab/epoxy/storage"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// captureLog redirects log output to a buffer until the returned function is
+// called.
+func captureLog() (*bytes.Buffer, func()) {
+	var b bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&b)
+	return &b, func() { log.SetOutput(orig) }
+}
+
+func Test_parseTraceParent(t *testing.T) {
+	tests := []struct {
+		name   string
+		tp     string
+		wantID string
+		wantOK bool
+	}{
+		{
+			name:   "valid",
+			tp:     testTraceParent,
+			wantID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantOK: true,
+		},
+		{
+			name: "empty",
+		},
+		{
+			name: "unsupported-version",
+			tp:   "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			name: "uppercase-hex",
+			tp:   "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		},
+		{
+			name: "short-trace-id",
+			tp:   "00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		},
+		{
+			name: "zero-trace-id",
+			tp:   "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			name: "zero-parent-id",
+			tp:   "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		},
+		{
+			name: "extra-field",
+			tp:   testTraceParent + "-01",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := parseTraceParent(tt.tp)
+			if id != tt.wantID || ok != tt.wantOK {
+				t.Errorf("parseTraceParent(%q) = %q, %t; want %q, %t", tt.tp, id, ok, tt.wantID, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		randErr  error
+		want     string
+	}{
+		{
+			name:     "incoming-trace-is-preserved",
+			incoming: testTraceParent,
+			want:     testTraceParent,
+		},
+		{
+			name: "missing-trace-is-generated",
+			want: "00-0102030405060708090a0b0c0d0e0f10-1112131415161718-01",
+		},
+		{
+			name:     "invalid-trace-is-replaced",
+			incoming: "00-bad-trace-01",
+			want:     "00-0102030405060708090a0b0c0d0e0f10-1112131415161718-01",
+		},
+		{
+			name:    "generate-failure-is-not-fatal",
+			randErr: errors.New("fake read error"),
+		},
+	}
+	orig := traceRandRead
+	defer func() { traceRandRead = orig }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traceRandRead = func(b []byte) (int, error) {
+				for i := range b {
+					b[i] = byte(i + 1)
+				}
+				return len(b), tt.randErr
+			}
+			logs, restore := captureLog()
+			defer restore()
+
+			var got string
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header.Get(TraceParentHeader)
+			})
+			req := httptest.NewRequest("GET", "/v1/storage/stage1/vmlinuz", nil)
+			if tt.incoming != "" {
+				req.Header.Set(TraceParentHeader, tt.incoming)
+			}
+
+			TraceContext(next).ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("TraceContext() traceparent = %q, want %q", got, tt.want)
+			}
+			wantID := "-"
+			if tt.want != "" {
+				wantID = strings.Split(tt.want, "-")[1]
+			}
+			if !strings.Contains(logs.String(), "Trace "+wantID+": GET /v1/storage/stage1/vmlinuz") {
+				t.Errorf("TraceContext() did not log trace ID %s: %q", wantID, logs.String())
+			}
+		})
+	}
+}
+
+func TestTraceContextRoute(t *testing.T) {
+	logs, restore := captureLog()
+	defer restore()
+
+	router := mux.NewRouter()
+	router.Use(TraceContext)
+	router.Methods("POST").Path("/v1/boot/{hostname}/{sessionID}/stage2").Handler(
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	req := httptest.NewRequest("POST", "/v1/boot/mlab1.foo01.measurement-lab.org/01234567890abcdef/stage2", nil)
+	req.Header.Set(TraceParentHeader, testTraceParent)
+
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	wantID := strings.Split(testTraceParent, "-")[1]
+	if !strings.Contains(logs.String(), "Trace "+wantID+": POST /v1/boot/{hostname}/{sessionID}/stage2") {
+		t.Errorf("TraceContext() did not log route template: %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "01234567890abcdef") {
+		t.Errorf("TraceContext() logged session ID: %q", logs.String())
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	wantID := strings.Split(testTraceParent, "-")[1]
+	h := &storage.Host{
+		Name:              "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr:          "165.117.240.9",
+		CurrentSessionIDs: storage.SessionIDs{ReportID: "12345", ExtensionID: "12345"},
+	}
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(TraceParentHeader)
+	}))
+	defer ts.Close()
+	storage.Extensions.Set("trace_op", ts.URL)
+	defer storage.Extensions.Delete("trace_op")
+
+	newEnv := func() *Env {
+		return &Env{
+			Config:                 fakeConfig{host: h},
+			AllowForwardedRequests: true,
+			StoragePrefixURL:       ts.URL,
+			ReportExtension:        "trace_op",
+		}
+	}
+	tests := []struct {
+		name    string
+		handler func(env *Env) http.HandlerFunc
+		method  string
+		path    string
+		vars    map[string]string
+		form    url.Values
+		wantLog bool
+	}{
+		{
+			name:    "storage-proxy",
+			handler: func(env *Env) http.HandlerFunc { return env.HandleStorageProxy },
+			method:  "GET",
+			path:    "/v1/storage/stage1/vmlinuz",
+			vars:    map[string]string{"path": "stage1/vmlinuz"},
+			wantLog: true,
+		},
+		{
+			name:    "extension",
+			handler: func(env *Env) http.HandlerFunc { return env.HandleExtension },
+			method:  "POST",
+			path:    "/v1/boot/" + h.Name + "/12345/extension/trace_op",
+			vars:    map[string]string{"hostname": h.Name, "sessionID": "12345", "operation": "trace_op"},
+			wantLog: true,
+		},
+		{
+			name:    "report-extension",
+			handler: func(env *Env) http.HandlerFunc { return env.ReceiveReport },
+			method:  "POST",
+			path:    "/v1/boot/" + h.Name + "/12345/report",
+			vars:    map[string]string{"hostname": h.Name, "sessionID": "12345"},
+			form:    url.Values{"message": []string{"success"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.CurrentSessionIDs = storage.SessionIDs{ReportID: "12345", ExtensionID: "12345"}
+			got = ""
+			logs, restore := captureLog()
+			defer restore()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.form.Encode()))
+			if tt.form != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			req.Header.Set("X-Forwarded-For", h.IPv4Addr)
+			req.Header.Set(TraceParentHeader, testTraceParent)
+			req = mux.SetURLVars(req, tt.vars)
+
+			TraceContext(tt.handler(newEnv())).ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != testTraceParent {
+				t.Errorf("%s forwarded traceparent = %q, want %q", tt.name, got, testTraceParent)
+			}
+			// Handlers log the trace ID of forwarded requests, in addition to
+			// the TraceContext request log.
+			if tt.wantLog && !strings.Contains(logs.String(), "trace "+wantID) {
+				t.Errorf("%s did not log trace ID %s: %q", tt.name, wantID, logs.String())
+			}
+		})
+	}
+}
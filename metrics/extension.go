@@ -0,0 +1,136 @@
+// Copyright 2016 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package metrics
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ExtensionUp reports whether each extension service URL for an operation
+	// is reachable. A value of 1 means the service responded; 0 means it did
+	// not.
+	ExtensionUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "epoxy_extension_up",
+			Help: "Whether the extension service for an operation is reachable.",
+		},
+		// Extension operation name and service URL.
+		[]string{"operation", "url"},
+	)
+
+	// ExtensionDuration is a histogram of extension request latencies.
+	ExtensionDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "epoxy_extension_duration_seconds",
+			Help: "A histogram of extension request latencies.",
+			// Note: use default buckets.
+		},
+		[]string{"operation", "code"},
+	)
+
+	// ExtensionDurationSummary summarizes extension request latencies using
+	// quantiles. Unlike the histogram, quantiles cannot be aggregated across
+	// servers, but they are cheaper to query.
+	ExtensionDurationSummary = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "epoxy_extension_latency_seconds",
+			Help:       "A summary of extension request latencies.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"operation", "code"},
+	)
+)
+
+// ExtensionDurationObservers returns the metrics that record extension request
+// latency for the given kind: "histogram", "summary", or "both". Unknown kinds,
+// including the empty string, use the histogram.
+func ExtensionDurationObservers(kind string) []prometheus.ObserverVec {
+	switch kind {
+	case "summary":
+		return []prometheus.ObserverVec{ExtensionDurationSummary}
+	case "both":
+		return []prometheus.ObserverVec{ExtensionDuration, ExtensionDurationSummary}
+	default:
+		return []prometheus.ObserverVec{ExtensionDuration}
+	}
+}
+
+// ExtensionProber periodically checks that extension services are reachable
+// and reports the result in the ExtensionUp metric.
+type ExtensionProber struct {
+	// Extensions maps operation names to extension service URLs, including
+	// failover URLs.
+	Extensions map[string][]string
+	// Client is used to send probe requests.
+	Client *http.Client
+}
+
+// NewExtensionProber creates a new ExtensionProber for the given extensions.
+// Every probe request must complete within the given timeout.
+func NewExtensionProber(extensions map[string][]string, timeout time.Duration) *ExtensionProber {
+	return &ExtensionProber{
+		Extensions: extensions,
+		Client:     &http.Client{Timeout: timeout},
+	}
+}
+
+// Probe checks every extension URL once and updates ExtensionUp. Extension
+// services only support the ePoxy extension API, so any response other than a
+// server error indicates that the service is reachable.
+func (p *ExtensionProber) Probe() {
+	for operation, urls := range p.Extensions {
+		for _, u := range urls {
+			ExtensionUp.WithLabelValues(operation, u).Set(p.probe(operation, u))
+		}
+	}
+}
+
+// probe returns 1 if the extension service at u is reachable, and 0 otherwise.
+func (p *ExtensionProber) probe(operation, u string) float64 {
+	resp, err := p.Client.Get(u)
+	if err != nil {
+		log.Printf("Extension %q is unreachable at %s: %v", operation, u, err)
+		return 0
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		log.Printf("Extension %q at %s returned status: %d", operation, u, resp.StatusCode)
+		return 0
+	}
+	return 1
+}
+
+// Run probes all extensions immediately and then after every interval until
+// the given context is canceled.
+func (p *ExtensionProber) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.Probe()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
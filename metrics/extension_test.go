@@ -0,0 +1,129 @@
+// Copyright 2016 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExtensionProber_Probe(t *testing.T) {
+	up := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Extension servers typically reject non-POST requests.
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}))
+	defer up.Close()
+	broken := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	defer broken.Close()
+	// Close the down server immediately so connections are refused.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	p := NewExtensionProber(map[string][]string{
+		"up_op":     {up.URL},
+		"broken_op": {broken.URL},
+		"down_op":   {down.URL},
+		// Every failover URL is probed, not only the primary.
+		"failover_op": {down.URL, up.URL},
+	}, time.Second)
+	p.Probe()
+
+	tests := []struct {
+		name      string
+		operation string
+		url       string
+		want      float64
+	}{
+		{name: "up", operation: "up_op", url: up.URL, want: 1},
+		{name: "broken", operation: "broken_op", url: broken.URL, want: 0},
+		{name: "down", operation: "down_op", url: down.URL, want: 0},
+		{name: "failover-primary", operation: "failover_op", url: down.URL, want: 0},
+		{name: "failover-secondary", operation: "failover_op", url: up.URL, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testutil.ToFloat64(ExtensionUp.WithLabelValues(tt.operation, tt.url))
+			if got != tt.want {
+				t.Errorf("ExtensionUp{operation=%q, url=%q} = %v, want %v", tt.operation, tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtensionProber_Run(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Probes continue until the prober stops, so never block.
+			select {
+			case requests <- struct{}{}:
+			default:
+			}
+		}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewExtensionProber(map[string][]string{"run_op": {ts.URL}}, time.Second)
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	// Wait for at least two probes before stopping the prober.
+	<-requests
+	<-requests
+	cancel()
+	<-done
+
+	if got := testutil.ToFloat64(ExtensionUp.WithLabelValues("run_op", ts.URL)); got != 1 {
+		t.Errorf("ExtensionUp{operation=\"run_op\"} = %v, want 1", got)
+	}
+}
+
+func TestExtensionDurationObservers(t *testing.T) {
+	tests := []struct {
+		kind string
+		want []prometheus.ObserverVec
+	}{
+		{kind: "", want: []prometheus.ObserverVec{ExtensionDuration}},
+		{kind: "histogram", want: []prometheus.ObserverVec{ExtensionDuration}},
+		{kind: "summary", want: []prometheus.ObserverVec{ExtensionDurationSummary}},
+		{kind: "both", want: []prometheus.ObserverVec{ExtensionDuration, ExtensionDurationSummary}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			got := ExtensionDurationObservers(tt.kind)
+			if len(got) != len(tt.want) {
+				t.Fatalf("ExtensionDurationObservers() returned %d observers, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ExtensionDurationObservers()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -18,6 +18,8 @@ package metrics
 
 import (
 	"log"
+	"sync"
+	"time"
 
 	"github.com/m-lab/epoxy/storage"
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,13 +37,56 @@ var (
 		[]string{"machine"},
 	)
 
-	// RequestDuration profiles request latency.
+	// Stage1SequenceTotal counts the number of host boots by the sequence
+	// served, either "update" or "boot".
+	Stage1SequenceTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "epoxy_stage1_sequence_total",
+			Help: "Total number of boots per boot sequence.",
+		},
+		// Sequence name.
+		[]string{"sequence"},
+	)
+
+	// RequestDuration profiles request latency of each boot stage target, e.g.
+	// "stage1.ipxe", "stage2", "report", or "extension".
 	RequestDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "epoxy_request_duration_seconds",
-			Help: "A histogram of request latencies.",
+			Help: "A histogram of request latencies by boot stage.",
 			// Note: use default buckets.
 		},
+		[]string{"stage", "code"},
+	)
+
+	// ClientCertChanges counts reports presenting a client certificate that
+	// differs from the certificate previously recorded for the machine.
+	ClientCertChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "epoxy_client_cert_changes_total",
+			Help: "Total number of client certificate changes per machine.",
+		},
+		// Machine name.
+		[]string{"machine"},
+	)
+
+	// TemplateErrors counts failures to render response templates.
+	TemplateErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "epoxy_template_errors_total",
+			Help: "Total number of template rendering errors.",
+		},
+		// Template name.
+		[]string{"template"},
+	)
+
+	// UnmatchedRequests counts requests that match no route, by response
+	// status code, e.g. 404 for unknown paths and 405 for wrong methods.
+	UnmatchedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "epoxy_unmatched_requests_total",
+			Help: "Total number of requests matching no route.",
+		},
 		[]string{"code"},
 	)
 )
@@ -51,11 +96,57 @@ type Config interface {
 	List() ([]*storage.Host, error)
 }
 
+// PagedConfig provides access to Host records in pages ordered by name, like
+// storage.DatastoreConfig.ListPage.
+type PagedConfig interface {
+	ListPage(after string, limit int) ([]*storage.Host, error)
+}
+
+// timeNow allows unit tests to control the CachedConfig clock.
+var timeNow = time.Now
+
+// CachedConfig is a Config that caches the host list for a TTL, so that
+// collectors sharing a CachedConfig read Datastore once per scrape, even when
+// scrapes overlap. List errors are not cached. CachedConfig is safe for
+// concurrent use. Callers must not modify the returned hosts.
+type CachedConfig struct {
+	config  Config
+	ttl     time.Duration
+	mu      sync.Mutex
+	hosts   []*storage.Host
+	expires time.Time
+}
+
+// NewCachedConfig creates a CachedConfig that lists hosts from config at most
+// once per ttl.
+func NewCachedConfig(config Config, ttl time.Duration) *CachedConfig {
+	return &CachedConfig{config: config, ttl: ttl}
+}
+
+// List returns the cached host list, listing hosts from the underlying Config
+// once the cache expires. Concurrent callers wait for a single List.
+func (c *CachedConfig) List() ([]*storage.Host, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := timeNow()
+	if !c.expires.IsZero() && now.Before(c.expires) {
+		return c.hosts, nil
+	}
+	hosts, err := c.config.List()
+	if err != nil {
+		return nil, err
+	}
+	c.hosts, c.expires = hosts, now.Add(c.ttl)
+	return hosts, nil
+}
+
 // Collector defines a custom collector for reading metrics from datastore.
 type Collector struct {
-	name   string
-	desc   *prometheus.Desc
-	config Config
+	name     string
+	desc     *prometheus.Desc
+	config   Config
+	pages    PagedConfig
+	pageSize int
 }
 
 // NewCollector creates a new datastore collector instance. The metricName should
@@ -68,6 +159,18 @@ func NewCollector(metricName string, config Config) *Collector {
 	}
 }
 
+// NewPagedCollector creates a new datastore collector instance that reads hosts
+// from config in pages of pageSize hosts. Metrics for each page are reported
+// before the next page is read, so no single Datastore query lists all hosts.
+func NewPagedCollector(metricName string, config PagedConfig, pageSize int) *Collector {
+	return &Collector{
+		name:     metricName,
+		desc:     nil,
+		pages:    config,
+		pageSize: pageSize,
+	}
+}
+
 // Describe satisfies the prometheus.Collector interface. Describe is called
 // immediately after registering the collector.
 func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
@@ -80,11 +183,38 @@ func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
 // Collect satisfies the prometheus.Collector interface. Collect reports values
 // from hosts datastore.
 func (col *Collector) Collect(ch chan<- prometheus.Metric) {
+	if col.pages != nil {
+		col.collectPages(ch)
+		return
+	}
 	hosts, err := col.config.List()
 	if err != nil {
 		log.Println("Failed to list hosts", err)
 		return
 	}
+	col.collectHosts(ch, hosts)
+}
+
+// collectPages reports values from each page of hosts until a page has fewer
+// than pageSize hosts.
+func (col *Collector) collectPages(ch chan<- prometheus.Metric) {
+	after := ""
+	for {
+		hosts, err := col.pages.ListPage(after, col.pageSize)
+		if err != nil {
+			log.Println("Failed to list hosts", err)
+			return
+		}
+		if !col.collectHosts(ch, hosts) || len(hosts) < col.pageSize {
+			return
+		}
+		after = hosts[len(hosts)-1].Name
+	}
+}
+
+// collectHosts reports values for hosts, and returns false if the collector
+// name is unknown.
+func (col *Collector) collectHosts(ch chan<- prometheus.Metric, hosts []*storage.Host) bool {
 	for i := range hosts {
 		var ts float64
 		if hosts[i].LastSessionCreation.IsZero() || hosts[i].LastSuccess.IsZero() {
@@ -98,9 +228,60 @@ func (col *Collector) Collect(ch chan<- prometheus.Metric) {
 			ts = float64(hosts[i].LastSuccess.UnixNano()) / 1e9
 		default:
 			log.Println("Unknown collector name:", col.name)
-			return
+			return false
 		}
 		ch <- prometheus.MustNewConstMetric(
 			col.desc, prometheus.GaugeValue, ts, hosts[i].Name)
 	}
+	return true
+}
+
+// SuccessRatioCollector reports the fraction of hosts with a successful boot
+// within a window, as the epoxy_boot_success_ratio gauge.
+type SuccessRatioCollector struct {
+	desc   *prometheus.Desc
+	config Config
+	window time.Duration
+}
+
+// NewSuccessRatioCollector creates a collector reporting the fraction of hosts
+// from config with a LastSuccess within window of the current time.
+func NewSuccessRatioCollector(config Config, window time.Duration) *SuccessRatioCollector {
+	return &SuccessRatioCollector{
+		desc: prometheus.NewDesc("epoxy_boot_success_ratio",
+			"Fraction of hosts with a successful boot within "+window.String(), nil, nil),
+		config: config,
+		window: window,
+	}
+}
+
+// Describe satisfies the prometheus.Collector interface.
+func (col *SuccessRatioCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- col.desc
+}
+
+// Collect satisfies the prometheus.Collector interface. Decommissioned hosts
+// are not counted. When there are no hosts, no ratio is reported.
+func (col *SuccessRatioCollector) Collect(ch chan<- prometheus.Metric) {
+	hosts, err := col.config.List()
+	if err != nil {
+		log.Println("Failed to list hosts", err)
+		return
+	}
+	now := timeNow()
+	total, success := 0, 0
+	for _, h := range hosts {
+		if h.Decommissioned {
+			continue
+		}
+		total++
+		if !h.LastSuccess.IsZero() && now.Sub(h.LastSuccess) <= col.window {
+			success++
+		}
+	}
+	if total == 0 {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		col.desc, prometheus.GaugeValue, float64(success)/float64(total))
 }
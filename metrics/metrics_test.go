@@ -16,10 +16,13 @@
 package metrics
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,6 +30,7 @@ import (
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // fakeConfig emulates the storage.Config interface for unit tests.
@@ -94,9 +98,213 @@ func TestNewCollector(t *testing.T) {
 	}
 }
 
+// pagedConfig emulates a PagedConfig with hosts sorted by name, recording the
+// after value of each ListPage call.
+type pagedConfig struct {
+	hosts []*storage.Host
+	calls []string
+}
+
+func (p *pagedConfig) ListPage(after string, limit int) ([]*storage.Host, error) {
+	p.calls = append(p.calls, after)
+	var page []*storage.Host
+	for _, h := range p.hosts {
+		if h.Name > after && len(page) < limit {
+			page = append(page, h)
+		}
+	}
+	return page, nil
+}
+
+func TestNewPagedCollector(t *testing.T) {
+	var hosts []*storage.Host
+	for _, name := range []string{"mlab1.abc01", "mlab1.abc02", "mlab1.abc03", "mlab1.abc04", "mlab1.abc05"} {
+		hosts = append(hosts, &storage.Host{
+			Name:                name,
+			LastSessionCreation: time.Now(),
+			LastSuccess:         time.Now(),
+		})
+	}
+	// A host that never booted is skipped.
+	hosts = append(hosts, &storage.Host{Name: "mlab1.abc06"})
+	tests := []struct {
+		name      string
+		pageSize  int
+		wantCalls []string
+	}{
+		{
+			name:      "multiple-pages",
+			pageSize:  2,
+			wantCalls: []string{"", "mlab1.abc02", "mlab1.abc04", "mlab1.abc06"},
+		},
+		{
+			name:      "single-page",
+			pageSize:  10,
+			wantCalls: []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &pagedConfig{hosts: hosts}
+			col := NewPagedCollector("epoxy_last_boot", cfg, tt.pageSize)
+
+			if got := testutil.CollectAndCount(col); got != 5 {
+				t.Errorf("Collect() reported %d metrics, want 5", got)
+			}
+			if !reflect.DeepEqual(cfg.calls, tt.wantCalls) {
+				t.Errorf("Collect() listed pages after %q, want %q", cfg.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// fleetConfig emulates a Config listing a fixed set of hosts.
+type fleetConfig []*storage.Host
+
+func (f fleetConfig) List() ([]*storage.Host, error) {
+	return f, nil
+}
+
+func TestSuccessRatioCollector(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	tests := []struct {
+		name      string
+		hosts     fleetConfig
+		want      float64
+		wantCount int
+	}{
+		{
+			name: "mixed-fleet",
+			hosts: fleetConfig{
+				{Name: "mlab1.abc01", LastSuccess: now.Add(-time.Hour)},
+				{Name: "mlab2.abc01", LastSuccess: now.Add(-23 * time.Hour)},
+				{Name: "mlab3.abc01", LastSuccess: now.Add(-48 * time.Hour)},
+				{Name: "mlab4.abc01"},
+				{Name: "mlab1.abc02", LastSuccess: now.Add(-48 * time.Hour), Decommissioned: true},
+			},
+			want:      0.5,
+			wantCount: 1,
+		},
+		{
+			name: "all-successful",
+			hosts: fleetConfig{
+				{Name: "mlab1.abc01", LastSuccess: now},
+			},
+			want:      1,
+			wantCount: 1,
+		},
+		{
+			name:      "no-hosts",
+			hosts:     fleetConfig{},
+			wantCount: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			col := NewSuccessRatioCollector(tt.hosts, 24*time.Hour)
+			if got := testutil.CollectAndCount(col); got != tt.wantCount {
+				t.Fatalf("Collect() reported %d metrics, want %d", got, tt.wantCount)
+			}
+			if tt.wantCount == 0 {
+				return
+			}
+			if got := testutil.ToFloat64(col); got != tt.want {
+				t.Errorf("epoxy_boot_success_ratio = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// countingConfig counts List calls, for testing CachedConfig.
+type countingConfig struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+}
+
+func (c *countingConfig) List() ([]*storage.Host, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []*storage.Host{{
+		Name:                "mlab1.foo01",
+		LastSessionCreation: time.Now(),
+		LastSuccess:         time.Now(),
+	}}, nil
+}
+
+func TestCachedConfig(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	counter := &countingConfig{}
+	cached := NewCachedConfig(counter, time.Minute)
+	collectors := []*Collector{
+		NewCollector("epoxy_last_boot", cached),
+		NewCollector("epoxy_last_success", cached),
+	}
+	for _, col := range collectors {
+		col.Describe(make(chan *prometheus.Desc, 1))
+	}
+	// collectAll runs concurrent Collect calls, as with overlapping scrapes,
+	// and returns the number of metrics collected.
+	collectAll := func() int {
+		var wg sync.WaitGroup
+		ch := make(chan prometheus.Metric, 100)
+		for i := 0; i < 5; i++ {
+			for _, col := range collectors {
+				wg.Add(1)
+				go func(col *Collector) {
+					defer wg.Done()
+					col.Collect(ch)
+				}(col)
+			}
+		}
+		wg.Wait()
+		return len(ch)
+	}
+
+	if got := collectAll(); got != 10 {
+		t.Errorf("Collect() collected %d metrics, want 10", got)
+	}
+	if counter.calls != 1 {
+		t.Errorf("CachedConfig called List %d times in one window, want 1", counter.calls)
+	}
+
+	// Once the cache expires, the next scrape lists hosts again.
+	now = now.Add(time.Minute)
+	collectAll()
+	if counter.calls != 2 {
+		t.Errorf("CachedConfig called List %d times in two windows, want 2", counter.calls)
+	}
+
+	// Errors are not cached.
+	now = now.Add(time.Minute)
+	counter.err = errors.New("fake list error")
+	if _, err := cached.List(); err == nil {
+		t.Errorf("CachedConfig.List() error = nil, want error")
+	}
+	counter.err = nil
+	if _, err := cached.List(); err != nil || counter.calls != 4 {
+		t.Errorf("CachedConfig.List() = %v after %d calls, want retry after error", err, counter.calls)
+	}
+}
+
 func TestMetrics(t *testing.T) {
 	// Lint the normal prometheus metrics.
 	Stage1Total.WithLabelValues("x")
-	RequestDuration.WithLabelValues("x")
+	Stage1SequenceTotal.WithLabelValues("x")
+	RequestDuration.WithLabelValues("x", "x")
+	TemplateErrors.WithLabelValues("x")
+	UnmatchedRequests.WithLabelValues("x")
+	ExtensionUp.WithLabelValues("x", "x")
+	ExtensionDuration.WithLabelValues("x", "x")
+	ExtensionDurationSummary.WithLabelValues("x", "x")
 	promtest.LintMetrics(t)
 }
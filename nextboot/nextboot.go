@@ -1,5 +1,10 @@
 package nextboot
 
+import (
+	"crypto/ed25519"
+	"time"
+)
+
 // Config contains a nextboot configuration for an ePoxy client.
 type Config struct {
 	// Kargs contains kernel command line parameters, typically read from
@@ -16,6 +21,37 @@ type Config struct {
 
 	// V1 specifies an action to be taken by an ePoxy client.
 	V1 *V1 `json:"v1,omitempty"`
+
+	// ProgressReport is the Kargs key of a report URL. When set, Run reports a
+	// brief progress message to this URL after loading each chained config.
+	// ProgressReport is local client configuration and is never serialized.
+	ProgressReport string `json:"-"`
+
+	// MaxChainHops limits the number of Chain URLs followed by Run. When zero,
+	// DefaultMaxChainHops is used. MaxChainHops is local client configuration
+	// and is never serialized.
+	MaxChainHops int `json:"-"`
+
+	// MaxConfigBytes limits the size of each config loaded by Run. When zero,
+	// DefaultMaxConfigBytes is used. MaxConfigBytes is local client
+	// configuration and is never serialized.
+	MaxConfigBytes int64 `json:"-"`
+
+	// PublicKey is the pinned Ed25519 public key of the ePoxy server. When set,
+	// Run only accepts configs loaded over the network that are signed by
+	// this key, or that match the ChainSHA256 checksum of a verified config.
+	// PublicKey is local client configuration and is never serialized.
+	PublicKey ed25519.PublicKey `json:"-"`
+
+	// ReportTimeout limits the time of each Report request. When zero,
+	// DefaultReportTimeout is used. ReportTimeout is local client configuration
+	// and is never serialized.
+	ReportTimeout time.Duration `json:"-"`
+
+	// LoadTimeout limits the time of each config and manifest download. When
+	// zero, DefaultLoadTimeout is used. LoadTimeout is local client
+	// configuration and is never serialized.
+	LoadTimeout time.Duration `json:"-"`
 }
 
 // V1 specifies an action for an ePoxy client to execute. V1 configurations
@@ -47,6 +83,11 @@ type V1 struct {
 	// refer to a config with Commands.
 	Chain string `json:"chain,omitempty"`
 
+	// ChainSHA256 is the expected hex encoded sha256 checksum of the config
+	// at the Chain URL. When set, a downloaded config that does not match
+	// the checksum is rejected.
+	ChainSHA256 string `json:"chain_sha256,omitempty"`
+
 	// Vars contains key/value pairs. Every string value is evaluated as
 	// a template. Every template value may only reference kernel parameters
 	// using the "kargs" template function. For example, if there was originally
@@ -102,6 +143,28 @@ type V1 struct {
 	// Files may be empty.
 	Files map[string]map[string]string `json:"files,omitempty"`
 
+	// Manifest is a URL to a JSON object mapping Files names to hex encoded
+	// sha256 checksums, so that all Files of a stage can be verified using a
+	// single integrity config. Before Files are downloaded, each checksum is
+	// added to the source spec of the named file. A manifest naming a file not
+	// in Files, or a checksum that differs from a "sha256" already in the source
+	// spec, is an error. Like Files URLs, the Manifest URL is evaluated as a
+	// template and may reference kernel parameters and the ".vars" namespace.
+	//
+	// For example, a manifest for the "files" example above would contain:
+	//
+	// {
+	//    "initram" : "37c0e81be3a24752fcc2bc51c20e8dae897417dfaabbdce3a8b1efc8a2d310c6"
+	// }
+	//
+	// Manifest may be empty.
+	Manifest string `json:"manifest,omitempty"`
+
+	// ManifestSHA256 is the expected hex encoded sha256 checksum of the
+	// Manifest. Like ChainSHA256, a downloaded manifest that does not match the
+	// checksum is rejected.
+	ManifestSHA256 string `json:"manifest_sha256,omitempty"`
+
 	// Env is a map of environment variable names to values. These values are
 	// added to the environment when running Commands. Values are evaluated as
 	// a template, allowing substitution of values using "kargs" template
@@ -113,6 +176,15 @@ type V1 struct {
 	//   HOME=/
 	Env map[string]string `json:"env,omitempty"`
 
+	// EnvFiles is a list of Files names. After download, each file is parsed
+	// as KEY=VALUE lines, and the variables are added to Env. Blank lines and
+	// lines starting with "#" are ignored. File values are not evaluated as
+	// templates, and never replace variables already defined in Env. EnvFiles
+	// are useful for delivering secrets that should not appear in a config.
+	//
+	// EnvFiles may be empty.
+	EnvFiles []string `json:"env_files,omitempty"`
+
 	// Commands is a list of commands to execute, using Env. Every command is
 	// evaluated as a template, allowing substitution of values from the
 	// ".kargs", ".vars", and ".files" namespaces.
@@ -144,4 +216,21 @@ type V1 struct {
 	// appear to be making progress, it will be forcibly terminated and
 	// reported as an error.
 	Commands []interface{} `json:"commands,omitempty"`
+
+	// CommandTimeout is the time limit for each of the Commands, in Go duration
+	// format, e.g. "4h". Commands that run longer are killed and reported as an
+	// error. A config loaded from a Chain URL inherits the CommandTimeout of
+	// the config naming the Chain, unless it sets its own, so the ePoxy server
+	// may set a per-host timeout for static stage configs.
+	//
+	// CommandTimeout may be empty, in which case the limit is two hours.
+	CommandTimeout string `json:"command_timeout,omitempty"`
+
+	// ExpiresAt is the RFC3339 time after which the ePoxy server no longer
+	// accepts the session URLs of this boot, e.g. the Chain URL and report URL.
+	// A client may request a new stage1 config instead of acting on a config
+	// that has expired, or will expire before its Commands complete.
+	//
+	// ExpiresAt may be empty, in which case the session URLs do not expire.
+	ExpiresAt string `json:"expires_at,omitempty"`
 }
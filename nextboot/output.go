@@ -0,0 +1,127 @@
+package nextboot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// MaxOutputTail is the maximum number of bytes of command output retained in
+// a CommandError.
+const MaxOutputTail = 4096
+
+// CommandError is returned by Run when a command fails. Args contains the
+// redacted command args, and Output contains the redacted tail of the combined
+// stdout and stderr of the failed command.
+type CommandError struct {
+	Args   []string
+	Err    error
+	Output string
+}
+
+// Error formats the command args and error, without the command output.
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%q : %v", e.Args, e.Err)
+}
+
+// Unwrap returns the underlying command error.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// tailBuffer is an io.Writer that retains only the last max bytes written.
+// Commands write stdout and stderr concurrently, so writes are serialized.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+// Write appends p to the buffer, discarding the oldest bytes beyond max.
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if n := len(t.buf) - t.max; n > 0 {
+		t.buf = append(t.buf[:0], t.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+// String returns the retained output. A multi-byte character split by
+// truncation is dropped.
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.ToValidUTF8(string(t.buf), "")
+}
+
+// secretAssignment matches assignments of likely secrets in command output,
+// e.g. "token=abc" or "Password: abc".
+var secretAssignment = regexp.MustCompile(`(?i)\b(\w*(?:token|password|secret|key))(\s*[=:]\s*)\S+`)
+
+// secretKarg matches kernel parameter names with likely secret values, e.g.
+// "epoxy.token" or "bmc_password".
+var secretKarg = regexp.MustCompile(`(?i)(token|password|secret|key)`)
+
+// RedactKarg returns value, or "[REDACTED]" if the kernel parameter name has
+// a likely secret value, e.g. "epoxy.token", so that it is safe to log.
+func RedactKarg(name, value string) string {
+	if value != "" && secretKarg.MatchString(name) {
+		return "[REDACTED]"
+	}
+	return value
+}
+
+// redactKargs returns a copy of kargs with secret values redacted, for logs.
+func redactKargs(kargs map[string]string) map[string]string {
+	r := make(map[string]string, len(kargs))
+	for name, value := range kargs {
+		r[name] = RedactKarg(name, value)
+	}
+	return r
+}
+
+// redactCmdline returns the kernel cmdline with secret values redacted.
+func redactCmdline(cmdline string) string {
+	params := strings.Split(cmdline, " ")
+	for i, param := range params {
+		if keyval := strings.SplitN(param, "=", 2); len(keyval) == 2 {
+			params[i] = keyval[0] + "=" + RedactKarg(keyval[0], keyval[1])
+		}
+	}
+	return strings.Join(params, " ")
+}
+
+// redactArgs returns a copy of command args with secret "name=value" args and
+// secrets from redactOutput redacted, for reports.
+func (c *Config) redactArgs(args []string) []string {
+	r := make([]string, len(args))
+	for i, arg := range args {
+		if keyval := strings.SplitN(arg, "=", 2); len(keyval) == 2 {
+			arg = keyval[0] + "=" + RedactKarg(keyval[0], keyval[1])
+		}
+		r[i] = c.redactOutput(arg)
+	}
+	return r
+}
+
+// redactedString returns the String form of c with secret Kargs redacted.
+func (c *Config) redactedString() string {
+	r := *c
+	r.Kargs = redactKargs(c.Kargs)
+	return r.String()
+}
+
+// redactOutput removes likely secrets from command output. Kargs values that
+// are URLs are removed because they may embed session IDs, e.g. extension
+// URLs. Values assigned to names like "token" or "password" are also removed.
+func (c *Config) redactOutput(output string) string {
+	for _, value := range c.Kargs {
+		if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+			output = strings.ReplaceAll(output, value, "[REDACTED]")
+		}
+	}
+	return secretAssignment.ReplaceAllString(output, "$1$2[REDACTED]")
+}
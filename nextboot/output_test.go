@@ -0,0 +1,192 @@
+package nextboot
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_tailBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{
+			name:   "under-limit",
+			writes: []string{"abc", "def"},
+			want:   "abcdef",
+		},
+		{
+			name:   "keeps-tail",
+			writes: []string{"abcdef", "ghij", "kl"},
+			want:   "efghijkl",
+		},
+		{
+			name:   "large-write",
+			writes: []string{strings.Repeat("x", 20) + "12345678"},
+			want:   "12345678",
+		},
+		{
+			name:   "drops-split-character",
+			writes: []string{"éfghijkl"},
+			want:   "fghijkl",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tail := &tailBuffer{max: 8}
+			for _, w := range tt.writes {
+				tail.Write([]byte(w))
+			}
+			if got := tail.String(); got != tt.want {
+				t.Errorf("tailBuffer.String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_redactOutput(t *testing.T) {
+	c := &Config{
+		Kargs: map[string]string{
+			"epoxy.allocate_k8s_token": "https://epoxy.example.com/v1/boot/mlab1/abcdef/extension/allocate_k8s_token",
+			"epoxy.images_version":     "v1.0",
+		},
+	}
+	output := "fetching https://epoxy.example.com/v1/boot/mlab1/abcdef/extension/allocate_k8s_token\n" +
+		"token=0123.4567 images v1.0\n" +
+		"BMC_PASSWORD: hunter2\n"
+	want := "fetching [REDACTED]\n" +
+		"token=[REDACTED] images v1.0\n" +
+		"BMC_PASSWORD: [REDACTED]\n"
+	if got := c.redactOutput(output); got != want {
+		t.Errorf("Config.redactOutput() = %q, want %q", got, want)
+	}
+}
+
+func TestConfig_runCommandsOutput(t *testing.T) {
+	c := &Config{
+		V1: &V1{
+			Commands: []interface{}{
+				"bash -c 'echo starting; echo token=secret123; echo failed to flash >&2; exit 1'",
+			},
+		},
+	}
+	err := c.runCommands(false)
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("Config.runCommands() error = %#v, want *CommandError", err)
+	}
+	for _, want := range []string{"starting", "failed to flash", "token=[REDACTED]"} {
+		if !strings.Contains(cmdErr.Output, want) {
+			t.Errorf("CommandError.Output = %q, missing %q", cmdErr.Output, want)
+		}
+	}
+	if strings.Contains(cmdErr.Output, "secret123") {
+		t.Errorf("CommandError.Output = %q, includes secret", cmdErr.Output)
+	}
+	// The error message is unchanged, so output only appears in reports.
+	if !strings.HasSuffix(err.Error(), "] : exit status 1") {
+		t.Errorf("CommandError.Error() = %q, want args and exit status only", err.Error())
+	}
+}
+
+func TestConfig_runCommandsArgs(t *testing.T) {
+	report := "https://epoxy.example.com/v1/boot/mlab1/abcdef/report"
+	c := &Config{
+		Kargs: map[string]string{"epoxy.report": report, "epoxy.token": "secret123"},
+		V1: &V1{
+			Commands: []interface{}{
+				// Secret karg values are substituted before the command runs.
+				[]interface{}{"false", "epoxy.token={{kargs `epoxy.token`}}", "--url", "{{kargs `epoxy.report`}}"},
+			},
+		},
+	}
+	var b bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&b)
+	defer log.SetOutput(orig)
+
+	err := c.runCommands(false)
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("Config.runCommands() error = %#v, want *CommandError", err)
+	}
+	// The command log line is redacted too.
+	if logs := b.String(); strings.Contains(logs, "secret123") || strings.Contains(logs, report) ||
+		!strings.Contains(logs, `Command: "false" "epoxy.token=[REDACTED]" "--url" "[REDACTED]"`) {
+		t.Errorf("Config.runCommands() logs = %q, want redacted command", logs)
+	}
+	want := []string{"false", "epoxy.token=[REDACTED]", "--url", "[REDACTED]"}
+	if !reflect.DeepEqual(cmdErr.Args, want) {
+		t.Errorf("CommandError.Args = %q, want %q", cmdErr.Args, want)
+	}
+	if msg := err.Error(); strings.Contains(msg, "secret123") || strings.Contains(msg, report) {
+		t.Errorf("CommandError.Error() = %q, includes secret", msg)
+	}
+}
+
+func TestConfig_redactKargsLogs(t *testing.T) {
+	const secret = "s3cr3t-0123"
+	cmdline := "epoxy.stage2=https://epoxy.example.com/v1/boot/mlab1/stage2 " +
+		"epoxy.bmc_password=" + secret + " epoxy.token=" + secret + " quiet\n"
+
+	var b bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&b)
+	defer log.SetOutput(orig)
+
+	c := &Config{}
+	if err := c.ParseCmdline(cmdline); err != nil {
+		t.Fatalf("Config.ParseCmdline() error = %v", err)
+	}
+	if c.Kargs["epoxy.token"] != secret {
+		t.Errorf("Config.ParseCmdline() redacted the parsed value: %q", c.Kargs["epoxy.token"])
+	}
+	c.Kargs["epoxy.report"] = "file:///dev/null"
+	if err := c.Report("epoxy.report", url.Values{}, true); err != nil {
+		t.Fatalf("Config.Report() error = %v", err)
+	}
+
+	logs := b.String()
+	if strings.Contains(logs, secret) {
+		t.Errorf("logs include secret karg value: %q", logs)
+	}
+	for _, want := range []string{
+		"epoxy.bmc_password=[REDACTED]",
+		"epoxy.token=[REDACTED]",
+		"epoxy.stage2=https://epoxy.example.com/v1/boot/mlab1/stage2",
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("logs = %q, missing %q", logs, want)
+		}
+	}
+}
+
+func Test_redactKargs(t *testing.T) {
+	kargs := map[string]string{
+		"epoxy.api_key":  "abc",
+		"epoxy.SECRET":   "def",
+		"epoxy.stage3":   "https://epoxy.example.com/stage3",
+		"epoxy.keyempty": "",
+	}
+	want := map[string]string{
+		"epoxy.api_key":  "[REDACTED]",
+		"epoxy.SECRET":   "[REDACTED]",
+		"epoxy.stage3":   "https://epoxy.example.com/stage3",
+		"epoxy.keyempty": "",
+	}
+	got := redactKargs(kargs)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("redactKargs()[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+	if kargs["epoxy.api_key"] != "abc" {
+		t.Errorf("redactKargs() modified its argument")
+	}
+}
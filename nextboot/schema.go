@@ -0,0 +1,107 @@
+package nextboot
+
+// Schema is a JSON Schema describing the JSON encoding of a Config, for
+// tooling that validates nextboot configs before deployment. Fields that
+// are never serialized, e.g. MaxChainHops, are not included. Unknown fields
+// are ignored by Run, but rejected by the schema to catch typos.
+const Schema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/m-lab/epoxy/nextboot/schema.json",
+  "title": "ePoxy nextboot config",
+  "description": "A nextboot configuration for an ePoxy client.",
+  "type": "object",
+  "properties": {
+    "kargs": {
+      "description": "Kernel command line parameters, which may be referenced in templates using the kargs template function.",
+      "type": "object",
+      "additionalProperties": {"type": "string"}
+    },
+    "v1": {"$ref": "#/definitions/v1"}
+  },
+  "additionalProperties": false,
+  "definitions": {
+    "templateName": {
+      "description": "Names referenced in templates must not contain '.'.",
+      "pattern": "^[^.]+$"
+    },
+    "sha256": {
+      "description": "A hex encoded sha256 checksum.",
+      "type": "string",
+      "pattern": "^[0-9a-fA-F]{64}$"
+    },
+    "stringOrArray": {
+      "oneOf": [
+        {"type": "string"},
+        {"type": "array", "items": {"type": "string"}}
+      ]
+    },
+    "v1": {
+      "description": "An action for an ePoxy client: load another config from a Chain URL, or run Commands.",
+      "type": "object",
+      "properties": {
+        "chain": {
+          "description": "URL of a new nextboot configuration. When present, Commands and related fields are ignored.",
+          "type": "string"
+        },
+        "chain_sha256": {
+          "description": "Expected checksum of the config at the Chain URL.",
+          "$ref": "#/definitions/sha256"
+        },
+        "vars": {
+          "description": "Variables evaluated as templates. Arrays are joined with spaces before evaluation.",
+          "type": "object",
+          "propertyNames": {"$ref": "#/definitions/templateName"},
+          "additionalProperties": {"$ref": "#/definitions/stringOrArray"}
+        },
+        "files": {
+          "description": "Files to download, by name. Each source spec requires a url, and may include a sha256 checksum.",
+          "type": "object",
+          "propertyNames": {"$ref": "#/definitions/templateName"},
+          "additionalProperties": {
+            "type": "object",
+            "properties": {
+              "url": {"type": "string"},
+              "sha256": {"$ref": "#/definitions/sha256"}
+            },
+            "required": ["url"],
+            "additionalProperties": {"type": "string"}
+          }
+        },
+        "manifest": {
+          "description": "URL of a JSON object mapping Files names to sha256 checksums, applied before Files are downloaded.",
+          "type": "string"
+        },
+        "manifest_sha256": {
+          "description": "Expected checksum of the Manifest.",
+          "$ref": "#/definitions/sha256"
+        },
+        "env": {
+          "description": "Environment variables for Commands, evaluated as templates.",
+          "type": "object",
+          "additionalProperties": {"type": "string"}
+        },
+        "env_files": {
+          "description": "Names of Files parsed as KEY=VALUE lines and added to Env.",
+          "type": "array",
+          "items": {"type": "string"}
+        },
+        "commands": {
+          "description": "Commands to run, as shell-style command lines or argv arrays, evaluated as templates.",
+          "type": "array",
+          "items": {"$ref": "#/definitions/stringOrArray"}
+        },
+        "command_timeout": {
+          "description": "Time limit for each of the Commands, e.g. \"4h\". Inherited by chained configs.",
+          "type": "string"
+        },
+        "expires_at": {
+          "description": "RFC3339 time after which the session URLs of this boot are no longer accepted.",
+          "type": "string",
+          "format": "date-time"
+        }
+      },
+      "additionalProperties": false
+    }
+  }
+}
+`
@@ -0,0 +1,60 @@
+package nextboot
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSchema verifies that the Schema properties match the JSON field names of
+// Config and V1, so that the Schema is updated with the structs.
+func TestSchema(t *testing.T) {
+	var schema struct {
+		Properties  map[string]interface{}
+		Definitions struct {
+			V1 struct {
+				Properties map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(Schema), &schema); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+	tests := []struct {
+		name       string
+		typ        reflect.Type
+		properties map[string]interface{}
+	}{
+		{
+			name:       "Config",
+			typ:        reflect.TypeOf(Config{}),
+			properties: schema.Properties,
+		},
+		{
+			name:       "V1",
+			typ:        reflect.TypeOf(V1{}),
+			properties: schema.Definitions.V1.Properties,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := map[string]bool{}
+			for i := 0; i < tt.typ.NumField(); i++ {
+				name := strings.Split(tt.typ.Field(i).Tag.Get("json"), ",")[0]
+				if name == "-" {
+					continue
+				}
+				fields[name] = true
+				if _, ok := tt.properties[name]; !ok {
+					t.Errorf("Schema missing %s field %q", tt.name, name)
+				}
+			}
+			for name := range tt.properties {
+				if !fields[name] {
+					t.Errorf("Schema has unknown %s field %q", tt.name, name)
+				}
+			}
+		})
+	}
+}
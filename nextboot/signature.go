@@ -0,0 +1,98 @@
+package nextboot
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// SignatureHeader is the HTTP response header carrying the base64 encoded
+// Ed25519 detached signature of a config generated by the ePoxy server.
+const SignatureHeader = "X-Epoxy-Signature"
+
+var (
+	// ErrUnsignedConfig is returned when a client requires signed configs and
+	// a config has neither a signature nor a checksum from a verified config.
+	ErrUnsignedConfig = errors.New("config is not signed")
+
+	// ErrBadSignature is returned when a config signature does not verify.
+	ErrBadSignature = errors.New("config signature is invalid")
+)
+
+// Sign returns the base64 encoded Ed25519 signature of content, suitable for
+// the SignatureHeader.
+func Sign(key ed25519.PrivateKey, content []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, content))
+}
+
+// Verify returns nil if signature is a base64 encoded Ed25519 signature of
+// content by key. Verify returns ErrUnsignedConfig for an empty signature, and
+// ErrBadSignature for any other signature that does not verify.
+func Verify(key ed25519.PublicKey, content []byte, signature string) error {
+	if signature == "" {
+		return ErrUnsignedConfig
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, content, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 Ed25519 private key from fname,
+// e.g. as created by "openssl genpkey -algorithm ed25519".
+func LoadPrivateKey(fname string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(fname, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", fname)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey reads a PEM encoded PKIX Ed25519 public key from fname, e.g.
+// as created by "openssl pkey -pubout".
+func LoadPublicKey(fname string) (ed25519.PublicKey, error) {
+	der, err := readPEM(fname, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", fname)
+	}
+	return pub, nil
+}
+
+// readPEM returns the content of the first PEM block of the given type in fname.
+func readPEM(fname, blockType string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no %q PEM block found", fname, blockType)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
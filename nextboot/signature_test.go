@@ -0,0 +1,102 @@
+package nextboot
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	content := []byte(`{"v1":{"chain":"https://example.com/stage2.json"}}`)
+	tests := []struct {
+		name      string
+		key       ed25519.PublicKey
+		content   []byte
+		signature string
+		wantErr   error
+	}{
+		{
+			name:      "success",
+			key:       pub,
+			content:   content,
+			signature: Sign(priv, content),
+		},
+		{
+			name:    "unsigned",
+			key:     pub,
+			content: content,
+			wantErr: ErrUnsignedConfig,
+		},
+		{
+			name:      "modified-content",
+			key:       pub,
+			content:   []byte(`{"v1":{"chain":"https://evil.example.com/stage2.json"}}`),
+			signature: Sign(priv, content),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "wrong-key",
+			key:       other,
+			content:   content,
+			signature: Sign(priv, content),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "bad-encoding",
+			key:       pub,
+			content:   content,
+			signature: "not-base64!",
+			wantErr:   ErrBadSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.key, tt.content, tt.signature); err != tt.wantErr {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	dir := t.TempDir()
+	writePEM := func(name, blockType string, der []byte) string {
+		fname := filepath.Join(dir, name)
+		b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		if err := os.WriteFile(fname, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	privFile := writePEM("key.pem", "PRIVATE KEY", privDER)
+	pubFile := writePEM("pub.pem", "PUBLIC KEY", pubDER)
+
+	gotPriv, err := LoadPrivateKey(privFile)
+	if err != nil || !gotPriv.Equal(priv) {
+		t.Errorf("LoadPrivateKey() = %v, %v; want original key", gotPriv, err)
+	}
+	gotPub, err := LoadPublicKey(pubFile)
+	if err != nil || !gotPub.Equal(pub) {
+		t.Errorf("LoadPublicKey() = %v, %v; want original key", gotPub, err)
+	}
+
+	// Files without the expected PEM block are rejected.
+	if _, err := LoadPublicKey(privFile); err == nil {
+		t.Errorf("LoadPublicKey(%q) error = nil, want error", privFile)
+	}
+	if _, err := LoadPrivateKey(pubFile); err == nil {
+		t.Errorf("LoadPrivateKey(%q) error = nil, want error", pubFile)
+	}
+	if _, err := LoadPublicKey(filepath.Join(dir, "missing.pem")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadPublicKey() error = %v, want %v", err, os.ErrNotExist)
+	}
+}
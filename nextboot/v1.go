@@ -2,6 +2,7 @@ package nextboot
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -29,6 +30,18 @@ var (
 
 	// ErrFileURLNotFound is returned with a file spec does not include a "url" key.
 	ErrFileURLNotFound = errors.New("URL key not found in file spec")
+
+	// ErrTooManyChainHops is returned when a config chains more than the
+	// maximum number of times, e.g. because it chains to itself.
+	ErrTooManyChainHops = errors.New("too many chain hops")
+
+	// ErrChainLoop is returned when a config chains to a URL already loaded
+	// by the same Run, e.g. when two configs chain to each other.
+	ErrChainLoop = errors.New("chain loop")
+
+	// ErrConfigTooLarge is returned when a loaded config is larger than the
+	// maximum config size.
+	ErrConfigTooLarge = errors.New("config too large")
 )
 
 // useVars and useFiles are flags for evaluating templates.
@@ -37,13 +50,39 @@ const (
 	useFiles
 )
 
+// RunKarg is the kernel parameter that selects the action run by an ePoxy
+// client, e.g. "epoxy.run=stage3" selects the "epoxy.stage3" action.
+const RunKarg = "epoxy.run"
+
+// ExtensionsKarg is the kernel parameter listing the operation names of
+// extensions enabled for a host, in the order they should run, e.g.
+// "epoxy.extensions=op1,op2". The URL for each operation is in the
+// "epoxy.<operation>" kernel parameter.
+const ExtensionsKarg = "epoxy.extensions"
+
+// DefaultMaxChainHops is the maximum number of Chain URLs followed by Run when
+// Config.MaxChainHops is zero.
+const DefaultMaxChainHops = 10
+
+// DefaultMaxConfigBytes is the largest config loaded by Run when
+// Config.MaxConfigBytes is zero.
+const DefaultMaxConfigBytes = 4 * 1024 * 1024
+
+// DefaultReportTimeout is the time limit for each Report request when the
+// Config ReportTimeout is zero.
+const DefaultReportTimeout = 10 * time.Minute
+
+// DefaultLoadTimeout is the time limit for each config and manifest download
+// when the Config LoadTimeout is zero.
+const DefaultLoadTimeout = 10 * time.Minute
+
 // largeTimeout sets an upper limit on time taken to run commands or large file downloads.
 const largeTimeout = 2 * time.Hour
 
 // ParseCmdline parses the contents of `cmdline` as kernel parameters to
 // initialize `Kargs`. The current value of Kargs is unconditionally overwritten.
 func (c *Config) ParseCmdline(cmdline string) error {
-	log.Printf("Parsing kernel parameters from: %s", cmdline)
+	log.Printf("Parsing kernel parameters from: %s", redactCmdline(cmdline))
 
 	// Trim leading and trailing whitespace, then split on spaces.
 	params := strings.Split(strings.Trim(cmdline, " \n"), " ")
@@ -66,6 +105,33 @@ func (c *Config) ParseCmdline(cmdline string) error {
 	return nil
 }
 
+// SelectAction returns the action key named by the RunKarg kernel parameter,
+// if present, or defaultAction otherwise. The RunKarg value may be a short
+// name such as "stage3" or a full action key such as "epoxy.stage3".
+func (c *Config) SelectAction(defaultAction string) string {
+	run := c.Kargs[RunKarg]
+	switch {
+	case run == "":
+		return defaultAction
+	case strings.HasPrefix(run, "epoxy."):
+		return run
+	default:
+		return "epoxy." + run
+	}
+}
+
+// Extensions returns the extension operation names listed in the
+// ExtensionsKarg kernel parameter, in order. Empty names are ignored.
+func (c *Config) Extensions() []string {
+	var operations []string
+	for _, operation := range strings.Split(c.Kargs[ExtensionsKarg], ",") {
+		if operation != "" {
+			operations = append(operations, operation)
+		}
+	}
+	return operations
+}
+
 // Run requests the URL stored in `Kargs[action]` and loads the returned config.
 // After loading the returned config, Run executes the `V1` actions until an
 // error occurs or all commands are successfully executed.
@@ -73,17 +139,18 @@ func (c *Config) ParseCmdline(cmdline string) error {
 // If dryrun is true, then configuration commands are printed but not executed.
 // Note: even in dryrun mode action URLS **may change state** in the ePoxy server.
 func (c *Config) Run(action string, addKargs, dryrun bool) error {
-	log.Printf("Loading config from: %s", c.Kargs[action])
+	log.Printf("Loading config from: %s", RedactKarg(action, c.Kargs[action]))
 	actionURL, ok := c.Kargs[action]
 	if !ok {
 		return ErrActionURLNotFound
 	}
 	// Load config from ePoxy server.
-	err := c.loadAction(actionURL, "POST", addKargs)
+	err := c.loadAction(actionURL, "POST", nil, addKargs)
 	if err != nil {
 		return err
 	}
-	err = c.maybeLoadChain()
+	c.reportProgress(1, actionURL, dryrun)
+	err = c.maybeLoadChain(actionURL, dryrun)
 	if err != nil {
 		return err
 	}
@@ -92,23 +159,84 @@ func (c *Config) Run(action string, addKargs, dryrun bool) error {
 	return c.runCommands(dryrun)
 }
 
-func (c *Config) maybeLoadChain() error {
-	for c.V1.Chain != "" {
+// maybeLoadChain follows Chain URLs, starting from the config loaded from
+// actionURL, until a config without a Chain URL is loaded. Following more than
+// MaxChainHops chains, or any URL twice, is an error.
+func (c *Config) maybeLoadChain(actionURL string, dryrun bool) error {
+	maxHops := c.MaxChainHops
+	if maxHops == 0 {
+		maxHops = DefaultMaxChainHops
+	}
+	visited := map[string]bool{actionURL: true}
+	for step := 2; c.V1.Chain != ""; step++ {
+		// Step 1 is the action config, so step-1 chains have been followed.
+		if step-1 > maxHops {
+			return fmt.Errorf("%w: more than %d chains, last %s", ErrTooManyChainHops, maxHops, c.V1.Chain)
+		}
+		if visited[c.V1.Chain] {
+			return fmt.Errorf("%w: %s loaded twice after %d chains", ErrChainLoop, c.V1.Chain, step-2)
+		}
+		visited[c.V1.Chain] = true
 		// If the Chain URL is present, run it.
 		log.Println("Running chain", c.V1.Chain)
-		err := c.loadAction(c.V1.Chain, "GET", false)
+		chain := c.V1.Chain
+		urlspec := map[string]string{}
+		if c.V1.ChainSHA256 != "" {
+			urlspec["sha256"] = c.V1.ChainSHA256
+		}
+		commandTimeout := c.V1.CommandTimeout
+		err := c.loadAction(chain, "GET", urlspec, false)
 		if err != nil {
 			return err
 		}
+		// Chained configs inherit the command timeout unless they set one.
+		if c.V1 != nil && c.V1.CommandTimeout == "" {
+			c.V1.CommandTimeout = commandTimeout
+		}
+		c.reportProgress(step, chain, dryrun)
 	}
 	return nil
 }
 
+// reportProgress posts a progress message to the ProgressReport URL, if set,
+// after loading the config for the given step from source. Progress reports
+// are informational, so failures are logged but never returned.
+func (c *Config) reportProgress(step int, source string, dryrun bool) {
+	if c.ProgressReport == "" {
+		return
+	}
+	reportURL, ok := c.Kargs[c.ProgressReport]
+	if !ok {
+		log.Printf("Skipping progress report: %v: %s", ErrActionURLNotFound, c.ProgressReport)
+		return
+	}
+	values := url.Values{}
+	values.Set("message", fmt.Sprintf("progress: loaded config %d from %s", step, source))
+	if _, local := localPath(reportURL); dryrun || local {
+		log.Print(values)
+		return
+	}
+	body, err := postDownload(reportURL, values, c.reportTimeout())
+	if err != nil {
+		log.Printf("Failed to report progress: %v", err)
+		return
+	}
+	body.Close()
+}
+
 func (c *Config) runCommands(dryrun bool) error {
 	err := c.evaluateVars()
 	if err != nil {
 		return err
 	}
+	err = c.loadManifest(dryrun)
+	if err != nil {
+		return err
+	}
+	timeout, err := c.V1.commandTimeout()
+	if err != nil {
+		return err
+	}
 	err = c.evaluateAndDownloadFiles(dryrun)
 	defer c.cleanupFiles()
 	if err != nil {
@@ -118,6 +246,10 @@ func (c *Config) runCommands(dryrun bool) error {
 	if err != nil {
 		return err
 	}
+	err = c.loadEnvFiles(dryrun)
+	if err != nil {
+		return err
+	}
 	err = c.evaluateCommands()
 	if err != nil {
 		return err
@@ -136,31 +268,64 @@ func (c *Config) runCommands(dryrun bool) error {
 			// shlex.Split on comment strings result in zero length args arrays.
 			continue
 		}
-		// Print command in a copy/paste-able form.
-		log.Printf("Command: \"%s\"", strings.Join(args, `" "`))
+		// Print command in a copy/paste-able form, without secret kargs.
+		log.Printf("Command: \"%s\"", strings.Join(c.redactArgs(args), `" "`))
 		if dryrun {
 			continue
 		}
-		// TODO: make timeout a parameter.
 		// Note: after ctx timeout, command receives SIGKILL.
-		ctx, cancel := context.WithTimeout(context.Background(), largeTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 
 		// cmd inherits the current process environment.
 		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 
-		// Use the current stdout and stderr for subcommands.
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		// Use the current stdout and stderr for subcommands, and keep the
+		// tail of both to include in errors.
+		tail := &tailBuffer{max: MaxOutputTail}
+		cmd.Stdout = io.MultiWriter(os.Stdout, tail)
+		cmd.Stderr = io.MultiWriter(os.Stderr, tail)
 
 		if err := cmd.Run(); err != nil {
-			// Report error with the command args and error.
-			return fmt.Errorf("%q : %v", args, err)
+			// Report error with the command args, error, and output.
+			return &CommandError{Args: c.redactArgs(args), Err: err, Output: c.redactOutput(tail.String())}
 		}
 	}
 	return nil
 }
 
+// Evaluate evaluates the Vars, Files, Env, and Commands of c.V1 as Run would,
+// including downloading Files, but does not run Commands. Downloaded files are
+// removed before Evaluate returns. Evaluate is useful to check that templates
+// and downloads work in a new environment.
+func (c *Config) Evaluate() error {
+	if err := c.evaluateVars(); err != nil {
+		return err
+	}
+	err := c.evaluateAndDownloadFiles(false)
+	defer c.cleanupFiles()
+	if err != nil {
+		return err
+	}
+	if err := c.evaluateEnv(); err != nil {
+		return err
+	}
+	return c.evaluateCommands()
+}
+
+// commandTimeout returns the time limit for each command, from CommandTimeout,
+// or largeTimeout if CommandTimeout is empty.
+func (v *V1) commandTimeout() (time.Duration, error) {
+	if v.CommandTimeout == "" {
+		return largeTimeout, nil
+	}
+	d, err := time.ParseDuration(v.CommandTimeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid command_timeout: %q", v.CommandTimeout)
+	}
+	return d, nil
+}
+
 // updateCurrentEnv sets variables from setenv in the current process
 // environment, deletes variables in delenv, and returns two maps indicating
 // whether variables where "changed" or "added" to the env. To restore the
@@ -211,6 +376,65 @@ func (c *Config) evaluateVars() error {
 	return nil
 }
 
+// loadManifest downloads the Manifest, if any, and adds its checksums to the
+// source specs of the named Files. When c.PublicKey is set, a manifest loaded
+// over the network must have a valid signature, unless ManifestSHA256 already
+// verified the download. In dryrun mode, files are not downloaded, so the
+// manifest is not loaded either.
+func (c *Config) loadManifest(dryrun bool) error {
+	if c.V1.Manifest == "" {
+		return nil
+	}
+	source, err := c.evaluateAsTemplate(c.V1.Manifest, useVars)
+	if err != nil {
+		return err
+	}
+	log.Println("Loading manifest", source)
+	if dryrun {
+		return nil
+	}
+	urlspec := map[string]string{}
+	if c.V1.ManifestSHA256 != "" {
+		urlspec["sha256"] = c.V1.ManifestSHA256
+	}
+	file, header, err := getDownload(source, urlspec, c.loadTimeout())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if _, local := localPath(source); c.PublicKey != nil && !local && urlspec["sha256"] == "" {
+		err = Verify(c.PublicKey, content, header.Get(SignatureHeader))
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, source)
+		}
+	}
+
+	sums := map[string]string{}
+	err = json.Unmarshal(content, &sums)
+	if err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", source, err)
+	}
+	for name, sum := range sums {
+		urlspec, ok := c.V1.Files[name]
+		if !ok {
+			return fmt.Errorf("manifest %s: file %q not found in files", source, name)
+		}
+		if raw, err := hex.DecodeString(sum); err != nil || len(raw) != sha256.Size {
+			return fmt.Errorf("manifest %s: invalid sha256 for file %q", source, name)
+		}
+		if current, ok := urlspec["sha256"]; ok && !strings.EqualFold(current, sum) {
+			return fmt.Errorf("manifest %s: sha256 for file %q conflicts with files", source, name)
+		}
+		urlspec["sha256"] = sum
+	}
+	return nil
+}
+
 // TODO: separate these operations to allow user-provided "names".
 func (c *Config) evaluateAndDownloadFiles(dryrun bool) error {
 	for name, urlspec := range c.V1.Files {
@@ -269,6 +493,59 @@ func (c *Config) evaluateEnv() error {
 	return nil
 }
 
+// loadEnvFiles adds variables from the downloaded EnvFiles to Env. Variables
+// already in Env are preserved. In dryrun mode, files are not downloaded, so
+// loadEnvFiles only verifies that each name refers to a Files entry.
+func (c *Config) loadEnvFiles(dryrun bool) error {
+	for _, name := range c.V1.EnvFiles {
+		urlspec, ok := c.V1.Files[name]
+		if !ok {
+			return fmt.Errorf("env file %q not found in files", name)
+		}
+		if dryrun {
+			continue
+		}
+		env, err := parseEnvFile(urlspec["name"])
+		if err != nil {
+			return err
+		}
+		if c.V1.Env == nil {
+			c.V1.Env = map[string]string{}
+		}
+		for key, value := range env {
+			if _, found := c.V1.Env[key]; found {
+				log.Printf("Warning: ignoring %q from env file %q; preserving current value", key, name)
+				continue
+			}
+			c.V1.Env[key] = value
+		}
+	}
+	return nil
+}
+
+// parseEnvFile reads KEY=VALUE lines from the named file. Blank lines and
+// lines starting with "#" are ignored.
+func parseEnvFile(fname string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyval := strings.SplitN(line, "=", 2)
+		if len(keyval) != 2 || keyval[0] == "" {
+			// Do not include the line, which may contain a secret.
+			return nil, fmt.Errorf("invalid env file %s: line %d is not KEY=VALUE", fname, i+1)
+		}
+		env[keyval[0]] = keyval[1]
+	}
+	return env, nil
+}
+
 // evaluateCommands normalizes the underlying Commands types, converting
 // every element to []interface{}.
 func (c *Config) evaluateCommands() error {
@@ -372,24 +649,34 @@ func (c *Config) evaluateAsTemplate(value string, flags uint32) (string, error)
 	return b.String(), nil
 }
 
-func (c *Config) loadAction(source, method string, addKargs bool) error {
+// loadAction loads a new config from source using the given method. For GET
+// requests, urlspec may include a "sha256" checksum to verify the download.
+// Responses with a gzip Content-Encoding are decompressed before decoding.
+// When c.PublicKey is set, configs loaded over the network must have a valid
+// signature, unless a "sha256" checksum already verified the download.
+func (c *Config) loadAction(source, method string, urlspec map[string]string, addKargs bool) error {
 	var err error
 	var body io.ReadCloser
 	var file *os.File
+	header := http.Header{}
+	path, local := localPath(source)
 	switch {
-	case strings.HasPrefix(source, "file://"):
-		// Useful for testing and possibly stage1 legacy boot CDs.
-		// Strip off the file:// prefix before opening named file.
-		body, err = os.Open(source[7:])
+	case local:
+		// Useful for testing, offline lab setups, and possibly stage1 legacy
+		// boot CDs. Local configs are read directly regardless of method.
+		body, err = os.Open(path)
 	case method == "POST":
 		// TODO: send additional host metadata in values.
-		// TODO: make timeout configurable.
 		// Note: this will typically be a state-changing request to the ePoxy server.
-		body, err = postDownload(source, url.Values{}, 10*time.Minute)
+		var resp *http.Response
+		resp, err = postResponse(source, url.Values{}, c.loadTimeout())
+		if err == nil {
+			header = resp.Header
+			body, err = decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+		}
 	case method == "GET":
-		// TODO: make timeout configurable.
 		// Note: this will typically be a simple file download from GCS.
-		file, err = getDownload(source, 10*time.Minute)
+		file, header, err = getDownload(source, urlspec, c.loadTimeout())
 		body = file
 		if file != nil {
 			defer os.Remove(file.Name())
@@ -400,8 +687,30 @@ func (c *Config) loadAction(source, method string, addKargs bool) error {
 	}
 	defer body.Close()
 
+	maxBytes := c.MaxConfigBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxConfigBytes
+	}
+	// Read one byte past the limit, so larger configs are detected without
+	// reading the rest of the body into memory.
+	content, err := ioutil.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > maxBytes {
+		return fmt.Errorf("%w: more than %d bytes: %s", ErrConfigTooLarge, maxBytes, source)
+	}
+	// Local configs are provided by the operator and a checksum from a verified
+	// config is as strong as a signature, so neither requires a signature.
+	if c.PublicKey != nil && !local && urlspec["sha256"] == "" {
+		err = Verify(c.PublicKey, content, header.Get(SignatureHeader))
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, source)
+		}
+	}
+
 	n := &Config{}
-	err = json.NewDecoder(body).Decode(&n)
+	err = json.Unmarshal(content, &n)
 	if err != nil {
 		return err
 	}
@@ -409,35 +718,122 @@ func (c *Config) loadAction(source, method string, addKargs bool) error {
 		// Only add new keys to c.Kargs; never overwrite existing keys.
 		for k, v := range n.Kargs {
 			if _, found := c.Kargs[k]; !found {
-				log.Printf("Info: %q=%q", k, v)
+				log.Printf("Info: %q=%q", k, RedactKarg(k, v))
 				c.Kargs[k] = v
 			} else {
 				log.Printf("Warning: ignoring %q=%q; preserving current value %q",
-					k, v, c.Kargs[k])
+					k, RedactKarg(k, v), RedactKarg(k, c.Kargs[k]))
 			}
 		}
 	}
-	fmt.Println(c.Kargs)
+	fmt.Println(redactKargs(c.Kargs))
 	// Note: Overwrite the V1 action with what we just loaded above.
 	c.V1 = n.V1
 	return nil
 }
 
-func getDownload(source string, timeout time.Duration) (*os.File, error) {
+// localPath returns the local file path named by source and true if source is
+// a "file://" URL or an absolute file path. Otherwise, localPath returns false.
+func localPath(source string) (string, bool) {
+	switch {
+	case strings.HasPrefix(source, "file://"):
+		// Strip off the file:// prefix.
+		return source[7:], true
+	case strings.HasPrefix(source, "/"):
+		return source, true
+	}
+	return "", false
+}
+
+// getDownload downloads source to a new tempfile and returns the tempfile with
+// the response header. If the response has a gzip Content-Encoding, the
+// tempfile contains the decompressed content. Any "sha256" checksum in urlspec
+// applies to the content as served.
+func getDownload(source string, urlspec map[string]string, timeout time.Duration) (*os.File, http.Header, error) {
 	// Create a tempfile for saving file locally.
+	tmpfile, err := ioutil.TempFile("", "getdownload-")
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := download(tmpfile.Name(), source, urlspec, timeout)
+	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return nil, nil, err
+	}
+	if header.Get("Content-Encoding") != "gzip" {
+		return tmpfile, header, nil
+	}
+	defer os.Remove(tmpfile.Name())
+	body, err := decodeBody(tmpfile, "gzip")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	file, err := saveTempFile(body)
+	return file, header, err
+}
+
+// saveTempFile copies r to a new tempfile, and returns the tempfile ready for
+// reading from the beginning.
+func saveTempFile(r io.Reader) (*os.File, error) {
 	tmpfile, err := ioutil.TempFile("", "getdownload-")
 	if err != nil {
 		return nil, err
 	}
-	err = fileDownload(tmpfile.Name(), source, nil, timeout)
+	_, err = io.Copy(tmpfile, r)
+	if err == nil {
+		_, err = tmpfile.Seek(0, io.SeekStart)
+	}
 	if err != nil {
+		tmpfile.Close()
 		os.Remove(tmpfile.Name())
 		return nil, err
 	}
 	return tmpfile, nil
 }
 
+// decodeBody returns a reader for the decompressed content of body when the
+// encoding is "gzip", or body otherwise. Closing the returned reader also
+// closes body. The Go http client only decompresses responses transparently
+// when it requested compression itself, so content a server always sends
+// compressed, e.g. a storage object saved with "Content-Encoding: gzip", must
+// be decompressed here.
+func decodeBody(body io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	if encoding != "gzip" {
+		return body, nil
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: zr, body: body}, nil
+}
+
+// gzipReadCloser reads decompressed content from a gzip compressed body.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the gzip reader and the underlying body.
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
 func postDownload(source string, values url.Values, timeout time.Duration) (io.ReadCloser, error) {
+	resp, err := postResponse(source, values, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// postResponse posts values to source and returns the response. Responses
+// without a 2xx status code are closed and returned as errors.
+func postResponse(source string, values url.Values, timeout time.Duration) (*http.Response, error) {
 	resp, err := postWithTimeout(source, values, timeout)
 	if err != nil {
 		return nil, err
@@ -445,9 +841,10 @@ func postDownload(source string, values url.Values, timeout time.Duration) (io.R
 	// TODO: what statuses should we support?
 	// Note: the go client automatically handles standard redirects.
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("Bad status code: got %d, expected 200 code", resp.StatusCode)
 	}
-	return resp.Body, nil
+	return resp, nil
 }
 
 func watchDownload(resp *grab.Response, update time.Duration) {
@@ -478,10 +875,20 @@ func watchDownload(resp *grab.Response, update time.Duration) {
 }
 
 func fileDownload(dest, source string, urlspec map[string]string, timeout time.Duration) error {
+	_, err := download(dest, source, urlspec, timeout)
+	return err
+}
+
+// download saves source to dest and returns the response header. Local files
+// have no response header, so an empty header is returned for them.
+func download(dest, source string, urlspec map[string]string, timeout time.Duration) (http.Header, error) {
+	if path, ok := localPath(source); ok {
+		return http.Header{}, fileCopy(dest, path, urlspec)
+	}
 	client := grab.NewClient()
 	req, err := grab.NewRequest(dest, source)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if timeout > 0 {
@@ -493,7 +900,7 @@ func fileDownload(dest, source string, urlspec map[string]string, timeout time.D
 	if checksum, ok := urlspec["sha256"]; ok {
 		rawSum, err := hex.DecodeString(checksum)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		req.SetChecksum(sha256.New(), rawSum, true)
 	}
@@ -508,16 +915,48 @@ func fileDownload(dest, source string, urlspec map[string]string, timeout time.D
 	// Check for errors.
 	if err := resp.Err(); err != nil {
 		log.Printf("Download failed: %v", err)
-		return err
+		return nil, err
 	}
 
 	log.Printf("Download saved to: %v", resp.Filename)
-	return nil
+	if resp.HTTPResponse == nil {
+		return http.Header{}, nil
+	}
+	return resp.HTTPResponse.Header, nil
+}
+
+// fileCopy copies the local file source to dest. If urlspec includes a
+// "sha256" checksum, the copied content must match it.
+func fileCopy(dest, source string, urlspec map[string]string) error {
+	log.Printf("Copy from: %v", source)
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return err
+	}
+	if checksum, ok := urlspec["sha256"]; ok {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != checksum {
+			return fmt.Errorf("Checksum mismatch for %s: got %s, want %s", source, actual, checksum)
+		}
+	}
+	log.Printf("Copy saved to: %v", dest)
+	return out.Close()
 }
 
 // Report reports values to the URL stored in `Kargs[report]`.
 func (c *Config) Report(report string, values url.Values, dryrun bool) error {
-	log.Printf("Reporting values using %s=%s", report, c.Kargs[report])
+	log.Printf("Reporting values using %s=%s", report, RedactKarg(report, c.Kargs[report]))
 	reportURL, ok := c.Kargs[report]
 	if !ok {
 		return ErrActionURLNotFound
@@ -525,11 +964,21 @@ func (c *Config) Report(report string, values url.Values, dryrun bool) error {
 	// Add the current config as a debug parameter on every Report.
 	values.Set("debug.config", c.String())
 
+	// Logged values include the config, so log them with Kargs redacted.
+	logged := url.Values{}
+	for k, v := range values {
+		logged[k] = v
+	}
+	logged.Set("debug.config", c.redactedString())
+
 	if dryrun {
-		log.Print(values)
+		log.Print(logged)
+	} else if _, ok := localPath(reportURL); ok {
+		// There is no server to receive reports when running from local files.
+		log.Printf("Skipping report to local path: %s", reportURL)
+		log.Print(logged)
 	} else {
-		// TODO: make timeout configurable.
-		body, err := postDownload(reportURL, values, 10*time.Minute)
+		body, err := postDownload(reportURL, values, c.reportTimeout())
 		if err != nil {
 			return err
 		}
@@ -539,22 +988,56 @@ func (c *Config) Report(report string, values url.Values, dryrun bool) error {
 	return nil
 }
 
+// reportTimeout returns the time limit for each report request.
+func (c *Config) reportTimeout() time.Duration {
+	if c.ReportTimeout == 0 {
+		return DefaultReportTimeout
+	}
+	return c.ReportTimeout
+}
+
+// loadTimeout returns the time limit for each config and manifest download.
+func (c *Config) loadTimeout() time.Duration {
+	if c.LoadTimeout == 0 {
+		return DefaultLoadTimeout
+	}
+	return c.LoadTimeout
+}
+
 func postWithTimeout(url string, values url.Values, timeout time.Duration) (*http.Response, error) {
 	req, err := http.NewRequest("POST", url, strings.NewReader(values.Encode()))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	// TODO: handle timeout cancel appropriately. https://github.com/m-lab/epoxy/issues/34
-	// defer cancel() // cancel the context if Do() returns before timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	req = req.WithContext(ctx)
 
 	client := &http.Client{}
-	return client.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The context must remain valid until the caller finishes reading the body.
+	resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelReadCloser cancels the request context once the body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the underlying body and cancels the request context.
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
 }
 
-// String converts the Config instance into a string representation.
+// String converts the Config instance into an indented string representation.
 func (c *Config) String() string {
 	b, err := json.MarshalIndent(c, "", "    ")
 	if err != nil {
@@ -563,3 +1046,13 @@ func (c *Config) String() string {
 	}
 	return string(b)
 }
+
+// CompactString converts the Config instance into a string representation
+// without insignificant whitespace. This is preferred for network responses.
+func (c *Config) CompactString() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -1,8 +1,13 @@
 package nextboot
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,6 +15,9 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -88,6 +96,77 @@ func TestConfig_ParseCmdline(t *testing.T) {
 	}
 }
 
+func TestConfig_SelectAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdline string
+		want    string
+	}{
+		{
+			name:    "default-action",
+			cmdline: "epoxy.stage2=https://example.com/stage2",
+			want:    "epoxy.stage2",
+		},
+		{
+			name:    "select-short-name",
+			cmdline: "epoxy.stage3=https://example.com/stage3 epoxy.run=stage3",
+			want:    "epoxy.stage3",
+		},
+		{
+			name:    "select-full-key",
+			cmdline: "epoxy.run=epoxy.recovery epoxy.recovery=file:///recovery.json",
+			want:    "epoxy.recovery",
+		},
+		{
+			name:    "empty-run-uses-default",
+			cmdline: "epoxy.run= epoxy.stage2=https://example.com/stage2",
+			want:    "epoxy.stage2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{}
+			c.ParseCmdline(tt.cmdline)
+			if got := c.SelectAction("epoxy.stage2"); got != tt.want {
+				t.Errorf("Config.SelectAction() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Extensions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdline string
+		want    []string
+	}{
+		{
+			name:    "no-extensions",
+			cmdline: "epoxy.stage2=https://example.com/stage2",
+			want:    nil,
+		},
+		{
+			name:    "ordered-extensions",
+			cmdline: "epoxy.extensions=op2,op1,op3",
+			want:    []string{"op2", "op1", "op3"},
+		},
+		{
+			name:    "ignore-empty-names",
+			cmdline: "epoxy.extensions=,op1,,op2,",
+			want:    []string{"op1", "op2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{}
+			c.ParseCmdline(tt.cmdline)
+			if got := c.Extensions(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Config.Extensions() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestConfig_String(t *testing.T) {
 	type fields struct {
 		Kargs map[string]string
@@ -173,6 +252,98 @@ func TestConfig_String(t *testing.T) {
 	}
 }
 
+func TestConfig_CompactString(t *testing.T) {
+	c := &Config{
+		Kargs: map[string]string{"key": "val"},
+		V1: &V1{
+			Chain:    "http://foo.com/post",
+			Commands: []interface{}{"true"},
+		},
+	}
+	want := `{"kargs":{"key":"val"},"v1":{"chain":"http://foo.com/post","commands":["true"]}}`
+	if got := c.CompactString(); got != want {
+		t.Errorf("Config.CompactString() = %s, want %s", got, want)
+	}
+}
+
+func TestConfig_ReportTimeout(t *testing.T) {
+	// The fake server responds after a delay, or when the client gives up.
+	const delay = 200 * time.Millisecond
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{
+			name: "default-timeout",
+		},
+		{
+			name:    "timeout-longer-than-response",
+			timeout: 10 * delay,
+		},
+		{
+			name:    "timeout-shorter-than-response",
+			timeout: delay / 10,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Kargs:         map[string]string{"epoxy.report": ts.URL},
+				ReportTimeout: tt.timeout,
+			}
+			err := c.Report("epoxy.report", url.Values{}, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Config.Report() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Config.Report() error = %v, want %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+func TestConfig_LoadAndProgressTimeout(t *testing.T) {
+	// The fake server responds after a delay, or when the client gives up.
+	const delay = 500 * time.Millisecond
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer ts.Close()
+
+	c := &Config{
+		Kargs:          map[string]string{"epoxy.report": ts.URL},
+		ProgressReport: "epoxy.report",
+		ReportTimeout:  delay / 10,
+		LoadTimeout:    delay / 10,
+	}
+	start := time.Now()
+	c.reportProgress(1, ts.URL, false)
+	if d := time.Since(start); d >= delay {
+		t.Errorf("Config.reportProgress() took %s, want less than %s", d, delay)
+	}
+	err := c.loadAction(ts.URL, "GET", nil, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Config.loadAction() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
 func TestConfig_Report(t *testing.T) {
 	expectedValues := url.Values{
 		"message": {"success"},
@@ -232,6 +403,18 @@ func TestConfig_Report(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "local-file-noop",
+			kargs: map[string]string{
+				// Reports to local paths are skipped.
+				"epoxy.report": "file:///does/not/exist",
+			},
+			args: args{
+				report: "epoxy.report",
+				values: url.Values{},
+			},
+			wantErr: false,
+		},
 		{
 			name: "bad-action-key",
 			kargs: map[string]string{
@@ -349,6 +532,616 @@ func TestConfig_Run(t *testing.T) {
 	}
 }
 
+func TestConfig_RunChainChecksum(t *testing.T) {
+	chained := &Config{V1: &V1{Commands: []interface{}{"true okay"}}}
+	sum := sha256.Sum256([]byte(chained.String()))
+	tests := []struct {
+		name     string
+		checksum string
+		wantErr  bool
+	}{
+		{
+			name:     "matching-checksum",
+			checksum: hex.EncodeToString(sum[:]),
+		},
+		{
+			name:     "mismatched-checksum",
+			checksum: hex.EncodeToString(sum[:16]) + hex.EncodeToString(sum[:16]),
+			wantErr:  true,
+		},
+		{
+			name: "no-checksum",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsGet := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, chained.String())
+				}))
+			defer tsGet.Close()
+			tsPost := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					c := &Config{V1: &V1{Chain: tsGet.URL, ChainSHA256: tt.checksum}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer tsPost.Close()
+
+			c := &Config{Kargs: map[string]string{"epoxy.stage2": tsPost.URL}}
+			if err := c.Run("epoxy.stage2", false, false); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_RunCommandTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		serverTimeout  string
+		chainedTimeout string
+		command        string
+		wantErr        bool
+	}{
+		{
+			name:    "default-timeout",
+			command: "sleep 0.2",
+		},
+		{
+			name:          "server-timeout-is-inherited",
+			serverTimeout: "100ms",
+			command:       "sleep 5",
+			wantErr:       true,
+		},
+		{
+			name:           "chained-timeout-overrides-server-timeout",
+			serverTimeout:  "100ms",
+			chainedTimeout: "10s",
+			command:        "sleep 0.2",
+		},
+		{
+			name:          "invalid-timeout",
+			serverTimeout: "forever",
+			command:       "true",
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chained := &Config{V1: &V1{
+				CommandTimeout: tt.chainedTimeout,
+				Commands:       []interface{}{tt.command},
+			}}
+			tsGet := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, chained.String())
+				}))
+			defer tsGet.Close()
+			tsPost := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					c := &Config{V1: &V1{Chain: tsGet.URL, CommandTimeout: tt.serverTimeout}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer tsPost.Close()
+
+			c := &Config{Kargs: map[string]string{"epoxy.stage2": tsPost.URL}}
+			start := time.Now()
+			err := c.Run("epoxy.stage2", false, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Config.Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// A command killed after the timeout does not run to completion.
+			if d := time.Since(start); d > 3*time.Second {
+				t.Errorf("Config.Run() took %s; want command killed after timeout", d)
+			}
+		})
+	}
+}
+
+// gzipBytes returns b compressed with gzip.
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestConfig_RunGzip(t *testing.T) {
+	chained := &Config{V1: &V1{Commands: []interface{}{"true gzip"}}}
+	tsGet := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipBytes([]byte(chained.String())))
+		}))
+	defer tsGet.Close()
+	tsPost := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := &Config{V1: &V1{Chain: tsGet.URL}}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipBytes([]byte(c.String())))
+		}))
+	defer tsPost.Close()
+
+	c := &Config{Kargs: map[string]string{"epoxy.stage2": tsPost.URL}}
+	if err := c.Run("epoxy.stage2", false, false); err != nil {
+		t.Fatalf("Config.Run() error = %v, want nil", err)
+	}
+	// Commands are replaced by their evaluated arguments after running.
+	if got := fmt.Sprint(c.V1.Commands); got != "[[true gzip]]" {
+		t.Errorf("Config.Run() loaded commands %s, want [[true gzip]]", got)
+	}
+}
+
+func TestConfig_RunSigned(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, forger, _ := ed25519.GenerateKey(nil)
+	chained := (&Config{V1: &V1{Commands: []interface{}{"true signed"}}}).String()
+	sum := sha256.Sum256([]byte(chained))
+	tests := []struct {
+		name        string
+		postKey     ed25519.PrivateKey
+		getKey      ed25519.PrivateKey
+		chainSHA256 string
+		wantErr     error
+	}{
+		{
+			name:    "success-signed-chain",
+			postKey: priv,
+			getKey:  priv,
+		},
+		{
+			name:        "success-chain-checksum",
+			postKey:     priv,
+			chainSHA256: hex.EncodeToString(sum[:]),
+		},
+		{
+			name:    "unsigned-config",
+			wantErr: ErrUnsignedConfig,
+		},
+		{
+			name:    "forged-config",
+			postKey: forger,
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "unsigned-chain",
+			postKey: priv,
+			wantErr: ErrUnsignedConfig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsGet := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if tt.getKey != nil {
+						w.Header().Set(SignatureHeader, Sign(tt.getKey, []byte(chained)))
+					}
+					w.Write([]byte(chained))
+				}))
+			defer tsGet.Close()
+			tsPost := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					c := (&Config{V1: &V1{Chain: tsGet.URL, ChainSHA256: tt.chainSHA256}}).String()
+					if tt.postKey != nil {
+						w.Header().Set(SignatureHeader, Sign(tt.postKey, []byte(c)))
+					}
+					w.Write([]byte(c))
+				}))
+			defer tsPost.Close()
+
+			c := &Config{
+				Kargs:     map[string]string{"epoxy.stage2": tsPost.URL},
+				PublicKey: pub,
+			}
+			err := c.Run("epoxy.stage2", false, false)
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("Config.Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && fmt.Sprint(c.V1.Commands) != "[[true signed]]" {
+				t.Errorf("Config.Run() loaded commands %v, want [[true signed]]", c.V1.Commands)
+			}
+		})
+	}
+}
+
+func Test_decodeBody(t *testing.T) {
+	content := []byte(`{"v1": {"commands": ["true"]}}`)
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		wantErr  bool
+	}{
+		{
+			name:     "gzip-encoding",
+			body:     gzipBytes(content),
+			encoding: "gzip",
+		},
+		{
+			name: "no-encoding",
+			body: content,
+		},
+		{
+			name:     "invalid-gzip-content",
+			body:     content,
+			encoding: "gzip",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := decodeBody(ioutil.NopCloser(bytes.NewReader(tt.body)), tt.encoding)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer body.Close()
+			got, err := ioutil.ReadAll(body)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("decodeBody() = %q, %v; want %q", got, err, content)
+			}
+		})
+	}
+}
+
+func TestConfig_RunChainHopLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxHops  int
+		wantHops int32
+	}{
+		{
+			name:     "default-limit",
+			wantHops: DefaultMaxChainHops,
+		},
+		{
+			name:     "configured-limit",
+			maxHops:  3,
+			wantHops: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The chained config always chains to a new URL.
+			var hops int32
+			var tsGet *httptest.Server
+			tsGet = httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// Only count downloads, not HEAD requests.
+					if r.Method == http.MethodGet {
+						hops++
+					}
+					c := &Config{V1: &V1{Chain: fmt.Sprintf("%s/%d", tsGet.URL, hops)}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer tsGet.Close()
+			tsPost := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					c := &Config{V1: &V1{Chain: tsGet.URL}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer tsPost.Close()
+
+			c := &Config{
+				Kargs:        map[string]string{"epoxy.stage2": tsPost.URL},
+				MaxChainHops: tt.maxHops,
+			}
+			err := c.Run("epoxy.stage2", false, false)
+			if !errors.Is(err, ErrTooManyChainHops) {
+				t.Errorf("Config.Run() error = %v, want %v", err, ErrTooManyChainHops)
+			}
+			if hops != tt.wantHops {
+				t.Errorf("Config.Run() followed %d chains, want %d", hops, tt.wantHops)
+			}
+		})
+	}
+}
+
+func TestConfig_Evaluate(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(dir, "marker")
+	c := &Config{
+		Kargs: map[string]string{"epoxy.value": "value"},
+		V1: &V1{
+			Vars:     map[string]interface{}{"value": "{{kargs `epoxy.value`}}"},
+			Files:    map[string]map[string]string{"source": {"url": source}},
+			Env:      map[string]string{"SOURCE": "{{.files.source.name}}"},
+			Commands: []interface{}{"touch " + marker + " {{.vars.value}}"},
+		},
+	}
+
+	if err := c.Evaluate(); err != nil {
+		t.Fatalf("Config.Evaluate() = %v", err)
+	}
+
+	name := c.V1.Files["source"]["name"]
+	want := []interface{}{"touch", marker, "value"}
+	if !reflect.DeepEqual(c.V1.Commands[0], want) || c.V1.Env["SOURCE"] != name {
+		t.Errorf("Config.Evaluate() = %q, %q; want %q, %q", c.V1.Commands[0], c.V1.Env["SOURCE"], want, name)
+	}
+	// Commands are not run, and downloaded files are removed.
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("Config.Evaluate() ran commands: %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Config.Evaluate() did not remove %s: %v", name, err)
+	}
+}
+
+func TestConfig_RunChainLoop(t *testing.T) {
+	tests := []struct {
+		name      string
+		chains    map[string]string
+		wantLoads int32
+	}{
+		{
+			name:      "chain-to-self",
+			chains:    map[string]string{"/a": "/a"},
+			wantLoads: 1,
+		},
+		{
+			name:      "two-url-cycle",
+			chains:    map[string]string{"/a": "/b", "/b": "/a"},
+			wantLoads: 2,
+		},
+		{
+			name:      "chain-to-action",
+			chains:    map[string]string{"/a": "/action"},
+			wantLoads: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var loads int32
+			var ts *httptest.Server
+			ts = httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					next := "/a"
+					if r.URL.Path != "/action" {
+						// Only count downloads, not HEAD requests.
+						if r.Method == http.MethodGet {
+							loads++
+						}
+						next = tt.chains[r.URL.Path]
+					}
+					c := &Config{V1: &V1{Chain: ts.URL + next}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer ts.Close()
+
+			c := &Config{
+				Kargs: map[string]string{"epoxy.stage2": ts.URL + "/action"},
+			}
+			err := c.Run("epoxy.stage2", false, false)
+			if !errors.Is(err, ErrChainLoop) {
+				t.Errorf("Config.Run() error = %v, want %v", err, ErrChainLoop)
+			}
+			if loads != tt.wantLoads {
+				t.Errorf("Config.Run() loaded %d chains, want %d", loads, tt.wantLoads)
+			}
+		})
+	}
+}
+
+func TestConfig_RunConfigTooLarge(t *testing.T) {
+	// A small config that chains to a config with a large command.
+	large := (&Config{V1: &V1{Commands: []interface{}{"echo " + strings.Repeat("x", 1024)}}}).String()
+	tests := []struct {
+		name     string
+		maxBytes int64
+		action   string
+		wantErr  error
+	}{
+		{
+			name:   "success-default-limit",
+			action: "/large",
+		},
+		{
+			name:     "success-within-limit",
+			maxBytes: int64(len(large)),
+			action:   "/small",
+		},
+		{
+			name:     "oversized-action",
+			maxBytes: 512,
+			action:   "/large",
+			wantErr:  ErrConfigTooLarge,
+		},
+		{
+			name:     "oversized-chain",
+			maxBytes: 512,
+			action:   "/small",
+			wantErr:  ErrConfigTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ts *httptest.Server
+			ts = httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/small" {
+						fmt.Fprint(w, (&Config{V1: &V1{Chain: ts.URL + "/large"}}).String())
+						return
+					}
+					fmt.Fprint(w, large)
+				}))
+			defer ts.Close()
+
+			c := &Config{
+				Kargs:          map[string]string{"epoxy.stage2": ts.URL + tt.action},
+				MaxConfigBytes: tt.maxBytes,
+			}
+			err := c.Run("epoxy.stage2", false, true)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Config.Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && c.V1 != nil && len(c.V1.Commands) != 0 {
+				t.Errorf("Config.Run() decoded oversized config: %v", c.V1.Commands)
+			}
+		})
+	}
+}
+
+func TestConfig_RunProgressReport(t *testing.T) {
+	tests := []struct {
+		name           string
+		progressReport string
+		wantMessages   []string
+	}{
+		{
+			name:           "reports-each-chain-step",
+			progressReport: "epoxy.report",
+			wantMessages: []string{
+				"progress: loaded config 1 from ",
+				"progress: loaded config 2 from ",
+				"progress: loaded config 3 from ",
+			},
+		},
+		{
+			name: "disabled",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var messages []string
+			tsReport := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					r.ParseForm()
+					messages = append(messages, r.PostForm.Get("message"))
+					w.WriteHeader(http.StatusNoContent)
+				}))
+			defer tsReport.Close()
+			// Chain three configs: the POST action, then two GETs.
+			tsCommands := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					c := &Config{V1: &V1{Commands: []interface{}{"true okay"}}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer tsCommands.Close()
+			tsChain := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					c := &Config{V1: &V1{Chain: tsCommands.URL}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer tsChain.Close()
+			tsPost := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					c := &Config{V1: &V1{Chain: tsChain.URL}}
+					fmt.Fprint(w, c.String())
+				}))
+			defer tsPost.Close()
+
+			c := &Config{
+				Kargs: map[string]string{
+					"epoxy.stage2": tsPost.URL,
+					"epoxy.report": tsReport.URL,
+				},
+				ProgressReport: tt.progressReport,
+			}
+			if err := c.Run("epoxy.stage2", false, false); err != nil {
+				t.Fatalf("Config.Run() error = %v, want nil", err)
+			}
+			if len(messages) != len(tt.wantMessages) {
+				t.Fatalf("Config.Run() sent %d progress reports, want %d: %q",
+					len(messages), len(tt.wantMessages), messages)
+			}
+			sources := []string{tsPost.URL, tsChain.URL, tsCommands.URL}
+			for i, want := range tt.wantMessages {
+				if messages[i] != want+sources[i] {
+					t.Errorf("Config.Run() progress report %d = %q, want %q",
+						i, messages[i], want+sources[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_RunOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfig_RunOffline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A local file that stands in for a kernel or initram image.
+	image := "fake vmlinuz"
+	sum := sha256.Sum256([]byte(image))
+	writeFile := func(name, content string) string {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	imagePath := writeFile("vmlinuz", image)
+	stage3 := &Config{V1: &V1{
+		Files: map[string]map[string]string{
+			"vmlinuz": {"url": "file://" + imagePath, "sha256": hex.EncodeToString(sum[:])},
+		},
+		Commands: []interface{}{"test -s {{.files.vmlinuz.name}}"},
+	}}
+	stage3Path := writeFile("stage3.json", stage3.String())
+	badStage3 := &Config{V1: &V1{
+		Files: map[string]map[string]string{
+			"vmlinuz": {"url": "file://" + imagePath, "sha256": hex.EncodeToString(sum[1:])},
+		},
+		Commands: []interface{}{"true"},
+	}}
+	badStage3Path := writeFile("bad-stage3.json", badStage3.String())
+
+	tests := []struct {
+		name    string
+		source  string
+		chain   string
+		wantErr bool
+	}{
+		{
+			name:   "success-file-url",
+			source: "file://",
+			chain:  "file://" + stage3Path,
+		},
+		{
+			name:  "success-file-path",
+			chain: stage3Path,
+		},
+		{
+			name:    "bad-chain-missing",
+			chain:   filepath.Join(dir, "missing.json"),
+			wantErr: true,
+		},
+		{
+			name:    "bad-checksum",
+			chain:   badStage3Path,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage2 := &Config{V1: &V1{Chain: tt.chain}}
+			stage2Path := writeFile(tt.name+".json", stage2.String())
+			c := &Config{
+				Kargs: map[string]string{
+					"epoxy.stage2": tt.source + stage2Path,
+					"epoxy.report": "file://" + filepath.Join(dir, "report"),
+				},
+			}
+			if err := c.Run("epoxy.stage2", false, false); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := c.Report("epoxy.report", url.Values{}, false); err != nil {
+				t.Errorf("Config.Report() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
 func TestConfig_evaluateVars(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -741,12 +1534,22 @@ func Test_fileDownload(t *testing.T) {
 	sum := sha256.Sum256([]byte(msg))
 	csum := hex.EncodeToString(sum[:])
 
+	local, err := ioutil.TempFile("", "Test_fileDownload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(local.Name())
+	local.WriteString(msg)
+	local.Close()
+	localSource := "file://" + local.Name()
+
 	tests := []struct {
 		name      string
 		urlspec   map[string]string
 		delay     time.Duration
 		timeout   time.Duration
 		urlPrefix string
+		source    string
 		wantErr   bool
 	}{
 		{
@@ -774,6 +1577,26 @@ func Test_fileDownload(t *testing.T) {
 			urlPrefix: ":",
 			wantErr:   true,
 		},
+		{
+			name:   "successful-local-file",
+			source: localSource,
+		},
+		{
+			name:    "successful-local-file-checksum",
+			source:  localSource,
+			urlspec: map[string]string{"sha256": csum},
+		},
+		{
+			name:    "bad-local-file-checksum",
+			source:  localSource,
+			urlspec: map[string]string{"sha256": csum[1:]},
+			wantErr: true,
+		},
+		{
+			name:    "bad-local-file-missing",
+			source:  localSource + ".missing",
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		tsGet := httptest.NewServer(
@@ -791,7 +1614,11 @@ func Test_fileDownload(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			err = fileDownload(tmpfile.Name(), tt.urlPrefix+tsGet.URL, tt.urlspec, tt.timeout)
+			source := tt.urlPrefix + tsGet.URL
+			if tt.source != "" {
+				source = tt.source
+			}
+			err = fileDownload(tmpfile.Name(), source, tt.urlspec, tt.timeout)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("fileDownload() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -800,3 +1627,217 @@ func Test_fileDownload(t *testing.T) {
 		tsGet.Close()
 	}
 }
+
+func TestConfig_runCommandsEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfig_runCommandsEnvFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	valid := write("valid.env", "# Secrets for stage2.\nSECRET_TOKEN=abc=123\n\nINLINE=from-file\n")
+	invalid := write("invalid.env", "SECRET_TOKEN=abc\nnot-an-assignment\n")
+
+	tests := []struct {
+		name     string
+		source   string
+		envFiles []string
+		wantErr  bool
+	}{
+		{
+			name:     "success-env-from-file",
+			source:   valid,
+			envFiles: []string{"secrets"},
+		},
+		{
+			name:     "error-env-file-not-in-files",
+			source:   valid,
+			envFiles: []string{"missing"},
+			wantErr:  true,
+		},
+		{
+			name:     "error-invalid-env-file",
+			source:   invalid,
+			envFiles: []string{"secrets"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				V1: &V1{
+					Files: map[string]map[string]string{
+						"secrets": {"url": tt.source},
+					},
+					EnvFiles: tt.envFiles,
+					// Inline values take precedence over env file values.
+					Env: map[string]string{"INLINE": "inline"},
+					Commands: []interface{}{
+						`bash -c 'test "$SECRET_TOKEN" = "abc=123" && test "$INLINE" = inline'`,
+					},
+				},
+			}
+			if err := c.runCommands(false); (err != nil) != tt.wantErr {
+				t.Errorf("Config.runCommands() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// Env file values are only present while running commands.
+			if v, ok := os.LookupEnv("SECRET_TOKEN"); ok {
+				t.Errorf("SECRET_TOKEN = %q remains in the environment", v)
+			}
+		})
+	}
+}
+
+func TestConfig_runCommandsManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfig_runCommandsManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	checksum := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	kernel := write("vmlinuz", "fake vmlinuz")
+	initram := write("initram", "fake initram")
+	good := fmt.Sprintf(`{"vmlinuz": %q, "initram": %q}`, checksum("fake vmlinuz"), checksum("fake initram"))
+	goodManifest := write("good.json", good)
+	badManifest := write("bad.json", fmt.Sprintf(`{"vmlinuz": %q}`, checksum("other vmlinuz")))
+	unknownManifest := write("unknown.json", fmt.Sprintf(`{"kernel": %q}`, checksum("fake vmlinuz")))
+	invalidSum := write("invalid-sum.json", `{"vmlinuz": "not-a-checksum"}`)
+	invalidJSON := write("invalid.json", `["vmlinuz"]`)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/signed.json" {
+			w.Header().Set(SignatureHeader, Sign(priv, []byte(good)))
+		}
+		fmt.Fprint(w, good)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name           string
+		manifest       string
+		manifestSHA256 string
+		kernelSHA256   string
+		publicKey      ed25519.PublicKey
+		wantErr        bool
+	}{
+		{
+			name:     "success-manifest-checksums",
+			manifest: "file://" + goodManifest,
+		},
+		{
+			name:         "success-matching-file-checksum",
+			manifest:     goodManifest,
+			kernelSHA256: checksum("fake vmlinuz"),
+		},
+		{
+			name:           "success-manifest-checksum",
+			manifest:       goodManifest,
+			manifestSHA256: checksum(good),
+		},
+		{
+			name:      "success-signed-manifest",
+			manifest:  ts.URL + "/signed.json",
+			publicKey: pub,
+		},
+		{
+			name:           "success-unsigned-manifest-with-checksum",
+			manifest:       ts.URL + "/unsigned.json",
+			manifestSHA256: checksum(good),
+			publicKey:      pub,
+		},
+		{
+			name:     "error-file-fails-verification",
+			manifest: badManifest,
+			wantErr:  true,
+		},
+		{
+			name:         "error-conflicting-file-checksum",
+			manifest:     goodManifest,
+			kernelSHA256: checksum("other vmlinuz"),
+			wantErr:      true,
+		},
+		{
+			name:     "error-unknown-file",
+			manifest: unknownManifest,
+			wantErr:  true,
+		},
+		{
+			name:     "error-invalid-checksum",
+			manifest: invalidSum,
+			wantErr:  true,
+		},
+		{
+			name:     "error-invalid-manifest",
+			manifest: invalidJSON,
+			wantErr:  true,
+		},
+		{
+			name:           "error-manifest-checksum-mismatch",
+			manifest:       goodManifest,
+			manifestSHA256: checksum("other manifest"),
+			wantErr:        true,
+		},
+		{
+			name:     "error-missing-manifest",
+			manifest: filepath.Join(dir, "missing.json"),
+			wantErr:  true,
+		},
+		{
+			name:      "error-unsigned-manifest",
+			manifest:  ts.URL + "/unsigned.json",
+			publicKey: pub,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]map[string]string{
+				"vmlinuz": {"url": kernel},
+				"initram": {"url": initram},
+			}
+			if tt.kernelSHA256 != "" {
+				files["vmlinuz"]["sha256"] = tt.kernelSHA256
+			}
+			c := &Config{
+				PublicKey: tt.publicKey,
+				V1: &V1{
+					Files:          files,
+					Manifest:       tt.manifest,
+					ManifestSHA256: tt.manifestSHA256,
+					Commands:       []interface{}{"test -s {{.files.vmlinuz.name}}"},
+				},
+			}
+			if err := c.runCommands(false); (err != nil) != tt.wantErr {
+				t.Errorf("Config.runCommands() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for name, urlspec := range files {
+				if urlspec["sha256"] == "" {
+					t.Errorf("Config.runCommands() did not apply manifest checksum for %q", name)
+				}
+			}
+		})
+	}
+}
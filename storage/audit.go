@@ -0,0 +1,175 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/m-lab/epoxy/datastorex"
+)
+
+// auditKind is the Datastore kind of AuditEvent entities, saved as children of
+// the Host entity they describe.
+const auditKind = "AuditEvent"
+
+// Audit actions recorded in AuditEvents.
+const (
+	AuditCreate        = "create"
+	AuditUpdate        = "update"
+	AuditDelete        = "delete"
+	AuditSession       = "session"
+	AuditUpdateEnabled = "update_enabled"
+	AuditReport        = "report"
+)
+
+// An AuditEvent records a single change to a Host record.
+type AuditEvent struct {
+	// Time is when the change was made.
+	Time time.Time `json:"time"`
+	// Actor identifies who made the change, e.g. the common name of an admin
+	// client certificate, or the IP of a booting machine.
+	Actor string `json:"actor"`
+	// Action is one of the Audit actions, e.g. AuditCreate.
+	Action string `json:"action"`
+	// Host is the name of the changed Host.
+	Host string `json:"host"`
+	// Before and After summarize the Host before and after the change. Before
+	// is empty for AuditCreate, and After is empty for AuditDelete.
+	Before string `json:"before,omitempty" datastore:",noindex"`
+	After  string `json:"after,omitempty" datastore:",noindex"`
+}
+
+// auditSummary contains the Host fields recorded in AuditEvents. Session IDs
+// authorize boot requests, so they are never recorded.
+type auditSummary struct {
+	IPv4Addr            string         `json:",omitempty"`
+	Boot                datastorex.Map `json:",omitempty"`
+	Update              datastorex.Map `json:",omitempty"`
+	Group               string         `json:",omitempty"`
+	ImagesVersion       string         `json:",omitempty"`
+	BootPolicy          string         `json:",omitempty"`
+	UpdateEnabled       bool
+	UpdateAttempts      int
+	Decommissioned      bool
+	Extensions          []string `json:",omitempty"`
+	LastSessionCreation time.Time
+	LastReport          time.Time
+	LastSuccess         time.Time
+}
+
+// AuditSummary returns a compact JSON summary of the configuration and boot
+// state of h, for AuditEvents. AuditSummary returns an empty string if h is nil.
+func AuditSummary(h *Host) string {
+	if h == nil {
+		return ""
+	}
+	b, _ := json.Marshal(auditSummary{
+		IPv4Addr:            h.IPv4Addr,
+		Boot:                h.Boot,
+		Update:              h.Update,
+		Group:               h.Group,
+		ImagesVersion:       h.ImagesVersion,
+		BootPolicy:          h.BootPolicy,
+		UpdateEnabled:       h.UpdateEnabled,
+		UpdateAttempts:      h.UpdateAttempts,
+		Decommissioned:      h.Decommissioned,
+		Extensions:          h.Extensions,
+		LastSessionCreation: h.LastSessionCreation,
+		LastReport:          h.LastReport,
+		LastSuccess:         h.LastSuccess,
+	})
+	return string(b)
+}
+
+// An Auditor records AuditEvents as JSON lines, and optionally as Datastore
+// entities. A nil *Auditor discards all events.
+type Auditor struct {
+	// Writer receives one JSON line for each AuditEvent.
+	Writer io.Writer
+	// Datastore, when not nil, also saves each AuditEvent as a child entity of
+	// the Host entity it describes.
+	Datastore *DatastoreConfig
+
+	mu sync.Mutex
+}
+
+// NewAuditor creates a new Auditor that writes events to w and, if ds is not
+// nil, saves events to Datastore.
+func NewAuditor(w io.Writer, ds *DatastoreConfig) *Auditor {
+	return &Auditor{Writer: w, Datastore: ds}
+}
+
+// Record records an AuditEvent for the change of a Host by actor from before
+// to after. Before is nil for new Hosts, and after is nil for deleted Hosts.
+// If the change toggles UpdateEnabled or changes the effective BootPolicy, an
+// AuditUpdateEnabled event is also recorded. Failures to record events are logged, but do not fail the change,
+// which was already saved.
+func (a *Auditor) Record(actor, action string, before, after *Host) {
+	if a == nil {
+		return
+	}
+	e := &AuditEvent{
+		Time:   timeNow().UTC(),
+		Actor:  actor,
+		Action: action,
+		Before: AuditSummary(before),
+		After:  AuditSummary(after),
+	}
+	if after != nil {
+		e.Host = after.Name
+	} else if before != nil {
+		e.Host = before.Name
+	}
+	a.save(e)
+	if before != nil && after != nil && action != AuditUpdateEnabled &&
+		(before.UpdateEnabled != after.UpdateEnabled ||
+			before.EffectiveBootPolicy() != after.EffectiveBootPolicy()) {
+		toggle := *e
+		toggle.Action = AuditUpdateEnabled
+		a.save(&toggle)
+	}
+}
+
+// save writes e to the Writer and, if configured, to Datastore.
+func (a *Auditor) save(e *AuditEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode audit event for %s: %v", e.Host, err)
+		return
+	}
+	a.mu.Lock()
+	_, err = a.Writer.Write(append(b, '\n'))
+	a.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to write audit event for %s: %v", e.Host, err)
+	}
+	if a.Datastore == nil {
+		return
+	}
+	parent := datastore.NameKey(a.Datastore.Kind, e.Host, nil)
+	parent.Namespace = a.Datastore.Namespace
+	key := datastore.IncompleteKey(auditKind, parent)
+	key.Namespace = a.Datastore.Namespace
+	if _, err := a.Datastore.Client.Put(context.Background(), key, e); err != nil {
+		log.Printf("Failed to save audit event for %s: %v", e.Host, err)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// auditDatastoreClient records the AuditEvents saved with Put.
+type auditDatastoreClient struct {
+	fakeDatastoreClient
+	keys   []*datastore.Key
+	events []*AuditEvent
+}
+
+func (f *auditDatastoreClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if e, ok := src.(*AuditEvent); ok {
+		f.keys = append(f.keys, key)
+		f.events = append(f.events, e)
+		return key, nil
+	}
+	return f.fakeDatastoreClient.Put(ctx, key, src)
+}
+
+func TestAuditorRecord(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	host := &Host{
+		Name:              "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr:          "165.117.240.9",
+		CurrentSessionIDs: SessionIDs{ReportID: "secret-report-id"},
+	}
+	enabled := *host
+	enabled.UpdateEnabled = true
+	held := *host
+	held.SetBootPolicy(BootPolicyHold)
+
+	tests := []struct {
+		name        string
+		action      string
+		before      *Host
+		after       *Host
+		wantActions []string
+		wantBefore  bool
+		wantAfter   bool
+	}{
+		{
+			name:        "create",
+			action:      AuditCreate,
+			after:       host,
+			wantActions: []string{AuditCreate},
+			wantAfter:   true,
+		},
+		{
+			name:        "delete",
+			action:      AuditDelete,
+			before:      host,
+			wantActions: []string{AuditDelete},
+			wantBefore:  true,
+		},
+		{
+			name:        "session",
+			action:      AuditSession,
+			before:      host,
+			after:       host,
+			wantActions: []string{AuditSession},
+			wantBefore:  true,
+			wantAfter:   true,
+		},
+		{
+			name:        "update-toggles-update-enabled",
+			action:      AuditUpdate,
+			before:      host,
+			after:       &enabled,
+			wantActions: []string{AuditUpdate, AuditUpdateEnabled},
+			wantBefore:  true,
+			wantAfter:   true,
+		},
+		{
+			name:        "update-changes-boot-policy",
+			action:      AuditUpdate,
+			before:      host,
+			after:       &held,
+			wantActions: []string{AuditUpdate, AuditUpdateEnabled},
+			wantBefore:  true,
+			wantAfter:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			client := &auditDatastoreClient{}
+			a := NewAuditor(&b, NewDatastoreConfig(client))
+
+			a.Record("192.168.0.1", tt.action, tt.before, tt.after)
+
+			lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+			if len(lines) != len(tt.wantActions) || len(client.events) != len(tt.wantActions) {
+				t.Fatalf("Record() wrote %d lines and saved %d events, want %d: %q",
+					len(lines), len(client.events), len(tt.wantActions), b.String())
+			}
+			for i, line := range lines {
+				if strings.Contains(line, "secret-report-id") {
+					t.Errorf("Record() logged a session ID: %s", line)
+				}
+				e := &AuditEvent{}
+				if err := json.Unmarshal([]byte(line), e); err != nil {
+					t.Fatalf("Record() wrote invalid JSON %q: %v", line, err)
+				}
+				if e.Action != tt.wantActions[i] || e.Actor != "192.168.0.1" ||
+					e.Host != host.Name || !e.Time.Equal(now) {
+					t.Errorf("Record() event = %#v, want action %q", e, tt.wantActions[i])
+				}
+				if (e.Before != "") != tt.wantBefore || (e.After != "") != tt.wantAfter {
+					t.Errorf("Record() before = %q, after = %q", e.Before, e.After)
+				}
+				// Events are saved as children of the Host entity.
+				key := client.keys[i]
+				if key.Kind != auditKind || key.Parent == nil || key.Parent.Name != host.Name ||
+					key.Namespace != namespace {
+					t.Errorf("Record() saved event with key %v", key)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditSummaryBootPolicy(t *testing.T) {
+	h := &Host{Name: "mlab1.iad1t.measurement-lab.org"}
+	h.SetBootPolicy(BootPolicyUpdateAlways)
+	if got := AuditSummary(h); !strings.Contains(got, `"BootPolicy":"update-always"`) {
+		t.Errorf("AuditSummary() = %q, missing BootPolicy", got)
+	}
+}
+
+func TestAuditorRecordNil(t *testing.T) {
+	var a *Auditor
+	// A nil Auditor discards events.
+	a.Record("admin", AuditCreate, nil, &Host{Name: "mlab1.iad1t.measurement-lab.org"})
+}
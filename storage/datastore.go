@@ -17,9 +17,16 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/m-lab/epoxy/storage/iface"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -36,39 +43,231 @@ type DatastoreConfig struct {
 	Kind string
 	// Namespace is the datastore namespace for all storage operations.
 	Namespace string
+	// MaxCollectedAge is the maximum age of Host CollectedInformation values.
+	// When non-zero, older values are cleared when a Host record is loaded.
+	MaxCollectedAge time.Duration
+	// SaveRetries is the number of times Save retries after a transient error,
+	// e.g. contention with a concurrent write. Permanent errors are never
+	// retried.
+	SaveRetries int
+	// SaveRetryBackoff is the delay before the first Save retry. The delay
+	// doubles for each later retry.
+	SaveRetryBackoff time.Duration
 }
 
+// Defaults for DatastoreConfig retries.
+const (
+	defaultSaveRetries      = 3
+	defaultSaveRetryBackoff = 100 * time.Millisecond
+)
+
 // NewDatastoreConfig creates a new DatastoreConfig instance from a *datastore.Client.
 func NewDatastoreConfig(client iface.DatastoreClient) *DatastoreConfig {
 	return &DatastoreConfig{
-		Client:    client,
-		Kind:      entityKind,
-		Namespace: namespace,
+		Client:           client,
+		Kind:             entityKind,
+		Namespace:        namespace,
+		SaveRetries:      defaultSaveRetries,
+		SaveRetryBackoff: defaultSaveRetryBackoff,
 	}
 }
 
-// Load retrieves a Host record from the datastore.
-func (c *DatastoreConfig) Load(name string) (*Host, error) {
-	h := &Host{}
+// isTransient returns true if err is a Datastore error that may succeed when
+// retried, e.g. contention between concurrent writes to the same entity.
+func isTransient(err error) bool {
+	if errors.Is(err, datastore.ErrConcurrentTransaction) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Aborted, codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// NormalizeName returns the canonical, lower case form of a Host name. Host
+// names are DNS names, so names differing only in case name the same Host.
+func NormalizeName(name string) string {
+	return strings.ToLower(name)
+}
+
+// rawKey returns the Datastore key of the Host record saved with name.
+func (c *DatastoreConfig) rawKey(name string) *datastore.Key {
 	key := datastore.NameKey(c.Kind, name, nil)
 	key.Namespace = c.Namespace
+	return key
+}
+
+// key returns the Datastore key of the named Host record. Keys always use the
+// normalized name, so lookups are case-insensitive.
+func (c *DatastoreConfig) key(name string) *datastore.Key {
+	return c.rawKey(NormalizeName(name))
+}
+
+// Load retrieves a Host record from the datastore. The name is case-insensitive.
+func (c *DatastoreConfig) Load(name string) (*Host, error) {
+	h := &Host{}
+	key := c.key(name)
 	if err := c.Client.Get(context.Background(), key, h); err != nil {
 		return nil, err
 	}
+	if c.MaxCollectedAge > 0 {
+		h.ExpireInformation(c.MaxCollectedAge)
+	}
+	return h, nil
+}
+
+// Update loads the named Host record, applies mutate, and saves the result
+// within a single transaction, so that concurrent updates are not lost. If
+// mutate returns an error, the transaction is aborted and the error returned.
+// Because the transaction may be retried, mutate may run more than once.
+func (c *DatastoreConfig) Update(name string, mutate func(h *Host) error) (*Host, error) {
+	key := c.key(name)
+	var h *Host
+	err := c.Client.RunInTransaction(context.Background(), func(tx iface.Transaction) error {
+		h = &Host{}
+		if err := tx.Get(key, h); err != nil {
+			return err
+		}
+		if c.MaxCollectedAge > 0 {
+			h.ExpireInformation(c.MaxCollectedAge)
+		}
+		if err := mutate(h); err != nil {
+			return err
+		}
+		if NormalizeName(h.Name) != key.Name {
+			return fmt.Errorf("cannot rename host %q to %q", name, h.Name)
+		}
+		h.Name = key.Name
+		_, err := tx.Put(key, h)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 	return h, nil
 }
 
-// Save stores a Host record to Datastore. Host names are globally unique. If
-// a Host record already exists, then it is overwritten.
+// Save stores a Host record to Datastore. Host names are globally unique, and
+// are normalized to lower case before saving. If a Host record already exists,
+// then it is overwritten. Transient errors are retried up to SaveRetries times
+// with backoff.
 func (c *DatastoreConfig) Save(host *Host) error {
-	key := datastore.NameKey(c.Kind, host.Name, nil)
-	key.Namespace = c.Namespace
-	if _, err := c.Client.Put(context.Background(), key, host); err != nil {
+	host.Name = NormalizeName(host.Name)
+	key := c.key(host.Name)
+	return c.retrySave(host.Name, func() error {
+		_, err := c.Client.Put(context.Background(), key, host)
 		return err
+	})
+}
+
+// MaxSaveMulti is the largest number of Host records SaveMulti writes in a
+// single Datastore call. Datastore rejects larger batches.
+const MaxSaveMulti = 500
+
+// SaveMulti stores many Host records to Datastore, like Save, using one
+// Datastore call for every MaxSaveMulti hosts. When SaveMulti returns an
+// error, some batches may already have been saved.
+func (c *DatastoreConfig) SaveMulti(hosts []*Host) error {
+	for len(hosts) > 0 {
+		n := len(hosts)
+		if n > MaxSaveMulti {
+			n = MaxSaveMulti
+		}
+		batch := hosts[:n]
+		hosts = hosts[n:]
+		keys := make([]*datastore.Key, len(batch))
+		for i, h := range batch {
+			h.Name = NormalizeName(h.Name)
+			keys[i] = c.key(h.Name)
+		}
+		desc := fmt.Sprintf("%d hosts starting with %s", len(batch), batch[0].Name)
+		err := c.retrySave(desc, func() error {
+			_, err := c.Client.PutMulti(context.Background(), keys, batch)
+			return err
+		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// retrySave calls put until it succeeds, returns a permanent error, or
+// SaveRetries retries have failed. desc names what put saves in log messages.
+func (c *DatastoreConfig) retrySave(desc string, put func() error) error {
+	backoff := c.SaveRetryBackoff
+	for retry := 0; ; retry++ {
+		err := put()
+		if err == nil {
+			return nil
+		}
+		if retry >= c.SaveRetries || !isTransient(err) {
+			return err
+		}
+		log.Printf("Retrying save of %s after transient error: %v", desc, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Delete removes the named Host record from Datastore. The name is
+// case-insensitive.
+func (c *DatastoreConfig) Delete(name string) error {
+	return c.Client.Delete(context.Background(), c.key(name))
+}
+
+// NormalizeNames migrates Host records saved before names were normalized. A
+// record whose name is not lower case is saved under the normalized name, and
+// the original record is deleted. NormalizeNames returns the original names
+// of the migrated records. A record is never migrated over an existing record
+// with the normalized name; such conflicts must be resolved manually.
+func (c *DatastoreConfig) NormalizeNames() ([]string, error) {
+	hosts, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var migrated []string
+	for _, h := range hosts {
+		name := h.Name
+		if name == NormalizeName(name) {
+			continue
+		}
+		if _, err := c.Load(name); err == nil {
+			return migrated, fmt.Errorf("cannot migrate %q: %q already exists", name, NormalizeName(name))
+		} else if err != datastore.ErrNoSuchEntity {
+			return migrated, err
+		}
+		if err := c.Save(h); err != nil {
+			return migrated, err
+		}
+		if err := c.Client.Delete(context.Background(), c.rawKey(name)); err != nil {
+			return migrated, err
+		}
+		migrated = append(migrated, name)
+	}
+	return migrated, nil
+}
+
+// ListPage retrieves up to limit Host records, ordered by name, with names
+// after the given name. An empty after starts from the first Host. Callers
+// read all Host records in batches by passing the name of the last Host of
+// each page as the next after, until a page has fewer than limit records.
+func (c *DatastoreConfig) ListPage(after string, limit int) ([]*Host, error) {
+	var hosts []*Host
+	q := datastore.NewQuery(c.Kind).Namespace(c.Namespace).Order("__key__").Limit(limit)
+	if after != "" {
+		// Records saved before names were normalized may have mixed case keys,
+		// so the cursor must use the name as saved to preserve key order.
+		q = q.Filter("__key__ >", c.rawKey(after))
+	}
+	_, err := c.Client.GetAll(context.Background(), q, &hosts)
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
 // List retrieves all Host records currently in the Datastore.
 // TODO(soltesz): support some simple query filtering or subsets.
 func (c *DatastoreConfig) List() ([]*Host, error) {
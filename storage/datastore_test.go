@@ -19,20 +19,35 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/storage/iface"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // fakeDatastoreClient implements the datastoreClient interface for testing.
 // Every operation should be successful.
 type fakeDatastoreClient struct {
-	host *Host
+	host  *Host
+	group *HostGroup
+	// batches records the number of hosts in each PutMulti call.
+	batches []int
+	// mu serializes transactions.
+	mu sync.Mutex
 }
 
 // Get reads the Host value from f.host and copies it to dst.
 func (f *fakeDatastoreClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if g, ok := dst.(*HostGroup); ok {
+		*g = *f.group
+		return nil
+	}
 	// Copy the host from f.host into dst.
 	h, ok := dst.(*Host)
 	if !ok {
@@ -44,6 +59,10 @@ func (f *fakeDatastoreClient) Get(ctx context.Context, key *datastore.Key, dst i
 
 // Put reads the Host value from src and copies it to f.host.
 func (f *fakeDatastoreClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if g, ok := src.(*HostGroup); ok {
+		*f.group = *g
+		return nil, nil
+	}
 	// Copy the host from src into f.host.
 	h, ok := src.(*Host)
 	if !ok {
@@ -53,6 +72,21 @@ func (f *fakeDatastoreClient) Put(ctx context.Context, key *datastore.Key, src i
 	return nil, nil
 }
 
+// PutMulti records the size of the batch, and copies the last Host value from
+// src to f.host.
+func (f *fakeDatastoreClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	hosts, ok := src.([]*Host)
+	if !ok {
+		return nil, fmt.Errorf("type assertion failed: got %T; want []*Host", src)
+	}
+	if len(keys) != len(hosts) {
+		return nil, fmt.Errorf("got %d keys for %d hosts", len(keys), len(hosts))
+	}
+	f.batches = append(f.batches, len(hosts))
+	*f.host = *hosts[len(hosts)-1]
+	return keys, nil
+}
+
 func (f *fakeDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
 	// Extract the pointer to a list of *Host, and append f.host to the list.
 	hosts, ok := dst.(*[]*Host)
@@ -63,6 +97,34 @@ func (f *fakeDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, ds
 	return nil, nil
 }
 
+// Delete clears f.host.
+func (f *fakeDatastoreClient) Delete(ctx context.Context, key *datastore.Key) error {
+	*f.host = Host{}
+	return nil
+}
+
+// RunInTransaction runs f while holding f.mu, so transactions never overlap.
+func (f *fakeDatastoreClient) RunInTransaction(ctx context.Context, fn func(tx iface.Transaction) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fn(&fakeTransaction{client: f})
+}
+
+// fakeTransaction implements the iface.Transaction interface using the
+// operations of a fakeDatastoreClient.
+type fakeTransaction struct {
+	client *fakeDatastoreClient
+}
+
+func (t *fakeTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return t.client.Get(context.Background(), key, dst)
+}
+
+func (t *fakeTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	_, err := t.client.Put(context.Background(), key, src)
+	return nil, err
+}
+
 // errDatastoreClient implements a datastoreClient interface where every call fails with an error.
 // The error returned is defined in errDatastoreClient.err.
 type errDatastoreClient struct {
@@ -77,15 +139,143 @@ func (f *errDatastoreClient) Put(ctx context.Context, key *datastore.Key, src in
 	return nil, f.err
 }
 
+func (f *errDatastoreClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return nil, f.err
+}
+
 func (f *errDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
 	return nil, f.err
 }
 
+func (f *errDatastoreClient) Delete(ctx context.Context, key *datastore.Key) error {
+	return f.err
+}
+
+func (f *errDatastoreClient) RunInTransaction(ctx context.Context, fn func(tx iface.Transaction) error) error {
+	return f.err
+}
+
+// flakyDatastoreClient is a fakeDatastoreClient where Put first returns each
+// error in errs, in order, before succeeding.
+type flakyDatastoreClient struct {
+	fakeDatastoreClient
+	errs []error
+	puts int
+}
+
+func (f *flakyDatastoreClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	f.puts++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	return f.fakeDatastoreClient.Put(ctx, key, src)
+}
+
+func TestDatastoreSaveRetries(t *testing.T) {
+	contention := status.Error(codes.Aborted, "too much contention on these datastore entities")
+	permanent := status.Error(codes.InvalidArgument, "entity is too big")
+	tests := []struct {
+		name     string
+		errs     []error
+		wantErr  error
+		wantPuts int
+	}{
+		{
+			name:     "success-after-contention",
+			errs:     []error{contention, contention},
+			wantPuts: 3,
+		},
+		{
+			name:     "success-after-concurrent-transaction",
+			errs:     []error{datastore.ErrConcurrentTransaction},
+			wantPuts: 2,
+		},
+		{
+			name:     "failure-retries-exhausted",
+			errs:     []error{contention, contention, contention, contention},
+			wantErr:  contention,
+			wantPuts: 4,
+		},
+		{
+			name:     "failure-permanent-error-is-not-retried",
+			errs:     []error{permanent},
+			wantErr:  permanent,
+			wantPuts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Host{Name: "mlab1.iad1t.measurement-lab.org"}
+			f := &flakyDatastoreClient{fakeDatastoreClient: fakeDatastoreClient{host: &Host{}}, errs: tt.errs}
+			c := NewDatastoreConfig(f)
+			c.SaveRetryBackoff = time.Millisecond
+
+			err := c.Save(h)
+			if err != tt.wantErr {
+				t.Errorf("Save() error = %v, want %v", err, tt.wantErr)
+			}
+			if f.puts != tt.wantPuts {
+				t.Errorf("Save() called Put %d times, want %d", f.puts, tt.wantPuts)
+			}
+			if tt.wantErr == nil && f.host.Name != h.Name {
+				t.Errorf("Save() did not store host: got %q", f.host.Name)
+			}
+		})
+	}
+}
+
+func TestDatastoreSaveMulti(t *testing.T) {
+	tests := []struct {
+		name        string
+		count       int
+		wantBatches []int
+	}{
+		{
+			name:  "empty",
+			count: 0,
+		},
+		{
+			name:        "one-batch",
+			count:       3,
+			wantBatches: []int{3},
+		},
+		{
+			name:        "many-batches",
+			count:       2*MaxSaveMulti + 1,
+			wantBatches: []int{MaxSaveMulti, MaxSaveMulti, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeDatastoreClient{host: &Host{}}
+			c := NewDatastoreConfig(f)
+			var hosts []*Host
+			for i := 0; i < tt.count; i++ {
+				hosts = append(hosts, &Host{Name: fmt.Sprintf("MLAB%d.IAD1T.measurement-lab.org", i)})
+			}
+			if err := c.SaveMulti(hosts); err != nil {
+				t.Fatalf("SaveMulti() = %v", err)
+			}
+			if !reflect.DeepEqual(f.batches, tt.wantBatches) {
+				t.Errorf("SaveMulti() batches = %v, want %v", f.batches, tt.wantBatches)
+			}
+			// Host names are normalized before saving.
+			for _, h := range hosts {
+				if h.Name != NormalizeName(h.Name) {
+					t.Errorf("SaveMulti() did not normalize name %q", h.Name)
+				}
+			}
+		})
+	}
+}
+
 func TestNewDatastoreClient(t *testing.T) {
 	h := Host{
 		Name: "mlab1.iad1t.measurement-lab.org",
 	}
-	f := &fakeDatastoreClient{&h}
+	f := &fakeDatastoreClient{host: &h}
 	c := NewDatastoreConfig(f)
 
 	h2, err := c.Load("mlab1.iad1t.measurement-lab.org")
@@ -110,7 +300,7 @@ func TestDatastore(t *testing.T) {
 		},
 	}
 	// Declare the fake datastore client outside the function below so we can access member elements.
-	f := &fakeDatastoreClient{&h}
+	f := &fakeDatastoreClient{host: &h}
 	c := &DatastoreConfig{
 		Client:    f,
 		Kind:      entityKind,
@@ -143,6 +333,303 @@ func TestDatastore(t *testing.T) {
 	if len(hosts) != 1 {
 		t.Fatalf("Failed to list hosts: got %d; want 1\n", len(hosts))
 	}
+
+	// Delete host record.
+	err = c.Delete("mlab1.iad1t.measurement-lab.org")
+	if err != nil {
+		t.Fatalf("Failed to delete host: %s", err)
+	}
+	if f.host.Name != "" {
+		t.Fatalf("Failed to delete host: got %#v\n", f.host)
+	}
+}
+
+// keyDatastoreClient records the key names used by Get, Put, and Delete.
+type keyDatastoreClient struct {
+	*fakeDatastoreClient
+	names []string
+}
+
+func (k *keyDatastoreClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	k.names = append(k.names, key.Name)
+	return k.fakeDatastoreClient.Get(ctx, key, dst)
+}
+
+func (k *keyDatastoreClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	k.names = append(k.names, key.Name)
+	return k.fakeDatastoreClient.Put(ctx, key, src)
+}
+
+func (k *keyDatastoreClient) Delete(ctx context.Context, key *datastore.Key) error {
+	k.names = append(k.names, key.Name)
+	return k.fakeDatastoreClient.Delete(ctx, key)
+}
+
+func TestDatastoreCaseInsensitive(t *testing.T) {
+	const name = "mlab1.iad1t.measurement-lab.org"
+	f := &keyDatastoreClient{fakeDatastoreClient: &fakeDatastoreClient{host: &Host{}}}
+	c := NewDatastoreConfig(f)
+
+	h := &Host{Name: "MLAB1.IAD1T.measurement-lab.org", IPv4Addr: "165.117.240.9"}
+	if err := c.Save(h); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	if h.Name != name || f.host.Name != name {
+		t.Errorf("Save() saved name %q, want %q", f.host.Name, name)
+	}
+	if _, err := c.Load("Mlab1.Iad1t.Measurement-Lab.Org"); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	updated, err := c.Update("MLAB1.iad1t.measurement-lab.org", func(h *Host) error {
+		h.IPv4Addr = "165.117.240.10"
+		return nil
+	})
+	if err != nil || updated.Name != name {
+		t.Fatalf("Update() = %v, %v; want host %q", updated, err, name)
+	}
+	if err := c.Delete("mlab1.IAD1T.measurement-lab.org"); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	// Save, Load, and Delete all use the normalized key.
+	want := []string{name, name, name}
+	if !reflect.DeepEqual(f.names, want) {
+		t.Errorf("used keys %q, want %q", f.names, want)
+	}
+}
+
+// pageDatastoreClient is a fakeDatastoreClient where each GetAll returns the
+// next page of hosts.
+type pageDatastoreClient struct {
+	fakeDatastoreClient
+	pages [][]*Host
+	calls int
+}
+
+func (p *pageDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	hosts, ok := dst.(*[]*Host)
+	if !ok {
+		return nil, fmt.Errorf("type assertion failed: got %T; want *[]*Host", dst)
+	}
+	if p.calls < len(p.pages) {
+		*hosts = append(*hosts, p.pages[p.calls]...)
+	}
+	p.calls++
+	return nil, nil
+}
+
+func TestDatastoreListPage(t *testing.T) {
+	f := &pageDatastoreClient{
+		pages: [][]*Host{
+			{{Name: "mlab1.abc01"}, {Name: "mlab2.abc01"}},
+			{{Name: "mlab3.abc01"}},
+		},
+	}
+	c := NewDatastoreConfig(f)
+
+	var names []string
+	after := ""
+	for {
+		hosts, err := c.ListPage(after, 2)
+		if err != nil {
+			t.Fatalf("ListPage() = %v", err)
+		}
+		for _, h := range hosts {
+			names = append(names, h.Name)
+		}
+		if len(hosts) < 2 {
+			break
+		}
+		after = hosts[len(hosts)-1].Name
+	}
+	want := []string{"mlab1.abc01", "mlab2.abc01", "mlab3.abc01"}
+	if !reflect.DeepEqual(names, want) || f.calls != 2 {
+		t.Errorf("ListPage() listed %q in %d pages, want %q in 2 pages", names, f.calls, want)
+	}
+
+	e := NewDatastoreConfig(&errDatastoreClient{err: fmt.Errorf("fake error")})
+	if _, err := e.ListPage("", 2); err == nil {
+		t.Errorf("ListPage() error = nil, want error")
+	}
+}
+
+// orderedDatastoreClient is a fakeDatastoreClient where GetAll returns pages of
+// hosts in byte-wise key order, like Datastore.
+type orderedDatastoreClient struct {
+	fakeDatastoreClient
+	config *DatastoreConfig
+	hosts  []*Host
+	limit  int
+}
+
+func (o *orderedDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	hosts, ok := dst.(*[]*Host)
+	if !ok {
+		return nil, fmt.Errorf("type assertion failed: got %T; want *[]*Host", dst)
+	}
+	sort.Slice(o.hosts, func(i, j int) bool { return o.hosts[i].Name < o.hosts[j].Name })
+	query := func() *datastore.Query {
+		return datastore.NewQuery(o.config.Kind).Namespace(o.config.Namespace).Order("__key__").Limit(o.limit)
+	}
+	// Find the cursor key among the saved and normalized names.
+	start := -1
+	if reflect.DeepEqual(q, query()) {
+		start = 0
+	}
+	for _, h := range o.hosts {
+		for _, name := range []string{h.Name, NormalizeName(h.Name)} {
+			if reflect.DeepEqual(q, query().Filter("__key__ >", o.config.rawKey(name))) {
+				start = sort.Search(len(o.hosts), func(i int) bool { return o.hosts[i].Name > name })
+			}
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("unexpected query: %v", q)
+	}
+	for i := start; i < len(o.hosts) && i < start+o.limit; i++ {
+		*hosts = append(*hosts, o.hosts[i])
+	}
+	return nil, nil
+}
+
+func TestDatastoreListPageMixedCase(t *testing.T) {
+	// Records saved before names were normalized keep mixed case keys, which
+	// sort before lower case keys.
+	f := &orderedDatastoreClient{
+		hosts: []*Host{
+			{Name: "mlab4.abc01"}, {Name: "MLAB3.abc01"}, {Name: "MLAB1.abc01"}, {Name: "MLAB2.abc01"},
+		},
+		limit: 2,
+	}
+	c := NewDatastoreConfig(f)
+	f.config = c
+
+	var names []string
+	after := ""
+	for {
+		hosts, err := c.ListPage(after, f.limit)
+		if err != nil {
+			t.Fatalf("ListPage() = %v", err)
+		}
+		for _, h := range hosts {
+			names = append(names, h.Name)
+		}
+		if len(hosts) < f.limit {
+			break
+		}
+		after = hosts[len(hosts)-1].Name
+	}
+	want := []string{"MLAB1.abc01", "MLAB2.abc01", "MLAB3.abc01", "mlab4.abc01"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("ListPage() listed %q, want %q", names, want)
+	}
+}
+
+func TestDatastoreLoadExpiresInformation(t *testing.T) {
+	h := Host{
+		Name: "mlab1.iad1t.measurement-lab.org",
+		CollectedInformation: datastorex.Map{
+			"version":  "3.4.1234",
+			"platform": "pcbios",
+		},
+		LastCollected: datastorex.Map{
+			"version":  time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+			"platform": time.Now().Format(time.RFC3339),
+		},
+	}
+	c := NewDatastoreConfig(&fakeDatastoreClient{host: &h})
+	c.MaxCollectedAge = 24 * time.Hour
+
+	h2, err := c.Load(h.Name)
+	if err != nil {
+		t.Fatalf("Failed to load host: %s", err)
+	}
+	if _, ok := h2.CollectedInformation["version"]; ok {
+		t.Errorf("Load() did not expire stale value: %v", h2.CollectedInformation)
+	}
+	if _, ok := h2.CollectedInformation["platform"]; !ok {
+		t.Errorf("Load() expired a fresh value: %v", h2.CollectedInformation)
+	}
+}
+
+func TestDatastoreUpdate(t *testing.T) {
+	h := Host{
+		Name:          "mlab1.iad1t.measurement-lab.org",
+		IPv4Addr:      "165.117.240.9",
+		UpdateEnabled: true,
+	}
+	c := NewDatastoreConfig(&fakeDatastoreClient{host: &h})
+
+	h2, err := c.Update(h.Name, func(h *Host) error {
+		h.ImagesVersion = "v2.0"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v, want nil", err)
+	}
+	if h2.ImagesVersion != "v2.0" || h.ImagesVersion != "v2.0" {
+		t.Errorf("Update() did not save change: got %q, want v2.0", h.ImagesVersion)
+	}
+	// Fields not changed by the mutation are preserved.
+	if !h.UpdateEnabled || h.IPv4Addr != "165.117.240.9" {
+		t.Errorf("Update() changed other fields: %#v", h)
+	}
+
+	// Errors from the mutation abort the update.
+	errMutate := fmt.Errorf("fake mutate failure")
+	_, err = c.Update(h.Name, func(h *Host) error {
+		h.ImagesVersion = "v3.0"
+		return errMutate
+	})
+	if err != errMutate {
+		t.Errorf("Update() error = %v, want %v", err, errMutate)
+	}
+	if h.ImagesVersion != "v2.0" {
+		t.Errorf("Update() saved aborted change: got %q, want v2.0", h.ImagesVersion)
+	}
+
+	// Host names may not change.
+	_, err = c.Update(h.Name, func(h *Host) error {
+		h.Name = "mlab2.iad1t.measurement-lab.org"
+		return nil
+	})
+	if err == nil {
+		t.Errorf("Update() renamed host without error")
+	}
+}
+
+func TestDatastoreUpdateConcurrent(t *testing.T) {
+	name := "mlab1.iad1t.measurement-lab.org"
+	h := Host{
+		Name: name,
+	}
+	c := NewDatastoreConfig(&fakeDatastoreClient{host: &h})
+
+	// Every update adds a unique extension. A lost update would drop one.
+	const count = 50
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.Update(name, func(h *Host) error {
+				h.Extensions = append(h.Extensions, fmt.Sprintf("ext%d", i))
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Update() error = %v, want nil", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, ext := range h.Extensions {
+		seen[ext] = true
+	}
+	if len(h.Extensions) != count || len(seen) != count {
+		t.Errorf("Update() lost updates: got %d extensions (%d unique), want %d",
+			len(h.Extensions), len(seen), count)
+	}
 }
 
 func TestDatastoreFailures(t *testing.T) {
@@ -171,6 +658,12 @@ func TestDatastoreFailures(t *testing.T) {
 		t.Fatalf("Saved without error: got %q; want %q\n", err, f.err)
 	}
 
+	// Store many host records.
+	err = c.SaveMulti([]*Host{&h})
+	if err != f.err {
+		t.Fatalf("SaveMulti without error: got %q; want %q\n", err, f.err)
+	}
+
 	// Retrieve host record.
 	_, err = c.Load("mlab1.iad1t.measurement-lab.org")
 	if err != f.err {
@@ -182,4 +675,16 @@ func TestDatastoreFailures(t *testing.T) {
 	if err != f.err {
 		t.Fatalf("List without error: got %q; want %q\n", err, f.err)
 	}
+
+	// Update host record.
+	_, err = c.Update(h.Name, func(h *Host) error { return nil })
+	if err != f.err {
+		t.Fatalf("Update without error: got %q; want %q\n", err, f.err)
+	}
+
+	// Delete host record.
+	err = c.Delete(h.Name)
+	if err != f.err {
+		t.Fatalf("Delete without error: got %q; want %q\n", err, f.err)
+	}
 }
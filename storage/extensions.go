@@ -17,12 +17,15 @@ package storage
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 )
 
 // ExtentionOperation maps an operation name (used in URLs) to an extension service URL.
 type ExtentionOperation struct {
 	// Name is the operation name. This will appear in URLs to the ePoxy server.
-	// Name should only use characters [a-zA-Z0-9].
+	// Name may only use characters [a-zA-Z0-9_], see ValidOperationName.
 	Name string
 
 	// URL references a service that implements the extension operation. During
@@ -33,22 +36,146 @@ type ExtentionOperation struct {
 	URL string
 }
 
+// validOperationName matches operation names that are safe to use in URLs.
+var validOperationName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// ValidOperationName returns true if name is a valid extension operation name,
+// i.e. it is not empty and only uses characters [a-zA-Z0-9_].
+func ValidOperationName(name string) bool {
+	return validOperationName.MatchString(name)
+}
+
+// ValidateOperationNames returns an error naming the first invalid extension
+// operation name in names.
+func ValidateOperationNames(names []string) error {
+	for _, name := range names {
+		if !ValidOperationName(name) {
+			return fmt.Errorf("invalid extension operation name: %q", name)
+		}
+	}
+	return nil
+}
+
+// ExtensionRegistry maps extension operation names to extension service URLs.
+// An operation may have several URLs, which are tried in order when an earlier
+// service is unavailable. An ExtensionRegistry is safe for concurrent use.
+type ExtensionRegistry struct {
+	mu   sync.RWMutex
+	urls map[string][]string
+}
+
+// NewExtensionRegistry creates a new ExtensionRegistry with a copy of urls.
+func NewExtensionRegistry(urls map[string]string) *ExtensionRegistry {
+	r := &ExtensionRegistry{urls: make(map[string][]string, len(urls))}
+	for operation, url := range urls {
+		r.urls[operation] = []string{url}
+	}
+	return r
+}
+
+// Get returns the primary extension service URL for operation, and whether
+// the operation is registered.
+func (r *ExtensionRegistry) Get(operation string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	urls, ok := r.urls[operation]
+	if !ok {
+		return "", false
+	}
+	return urls[0], true
+}
+
+// URLs returns a copy of all extension service URLs for operation, in
+// failover order, and whether the operation is registered.
+func (r *ExtensionRegistry) URLs(operation string) ([]string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	urls, ok := r.urls[operation]
+	return append([]string(nil), urls...), ok
+}
+
+// Set registers url as the only extension service URL for operation. Set
+// returns an error if operation is not a valid operation name.
+func (r *ExtensionRegistry) Set(operation, url string) error {
+	return r.SetURLs(operation, []string{url})
+}
+
+// SetURLs registers the extension service URLs for operation, in failover
+// order. An empty list removes operation from the registry. SetURLs returns an
+// error if operation is not a valid operation name.
+func (r *ExtensionRegistry) SetURLs(operation string, urls []string) error {
+	if err := ValidateOperationNames([]string{operation}); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(urls) == 0 {
+		delete(r.urls, operation)
+		return nil
+	}
+	r.urls[operation] = append([]string(nil), urls...)
+	return nil
+}
+
+// Delete removes operation from the registry.
+func (r *ExtensionRegistry) Delete(operation string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.urls, operation)
+}
+
+// AllURLs returns a copy of all registered operations and their extension
+// service URLs, in failover order.
+func (r *ExtensionRegistry) AllURLs() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	urls := make(map[string][]string, len(r.urls))
+	for operation, u := range r.urls {
+		urls[operation] = append([]string(nil), u...)
+	}
+	return urls
+}
+
+// All returns a copy of all registered operations and their primary extension
+// service URLs.
+func (r *ExtensionRegistry) All() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	urls := make(map[string]string, len(r.urls))
+	for operation, u := range r.urls {
+		urls[operation] = u[0]
+	}
+	return urls
+}
+
 var (
-	// Extensions is a static map of operation names to extension URLS for testing.
+	// Extensions is a static registry of operation names to extension URLS for testing.
 	// TODO: save/retrieve extension configuration in/from datastore.
-	Extensions = map[string]string{
-		"allocate_k8s_token":    "http://epoxy-extension-server.%s.measurementlab.net:8800/v2/allocate_k8s_token",
-		"bmc_store_password":    "http://epoxy-extension-server.%s.measurementlab.net:8800/v1/bmc_store_password",
-		"test_op":               "http://soltesz-epoxy-testing-instance-1.c.%s.internal:8001/operation",
-	}
+	Extensions = NewExtensionRegistry(map[string]string{
+		"allocate_k8s_token": "http://epoxy-extension-server.%s.measurementlab.net:8800/v2/allocate_k8s_token",
+		"bmc_store_password": "http://epoxy-extension-server.%s.measurementlab.net:8800/v1/bmc_store_password",
+		"test_op":            "http://soltesz-epoxy-testing-instance-1.c.%s.internal:8001/operation",
+	})
 )
 
 func init() {
-	// TODO: Remove this logic once the allocate_k8s_token URL is stored/read from datastore.
-	projectID := os.Getenv("GCLOUD_PROJECT")
-	if projectID != "" {
-		for key, value := range Extensions {
-			Extensions[key] = fmt.Sprintf(value, projectID)
+	if projectID := os.Getenv("GCLOUD_PROJECT"); projectID != "" {
+		SetProject(projectID)
+	}
+}
+
+// SetProject formats the project ID into the default Extensions URLs. URLs
+// that were already formatted are left unchanged, so SetProject may be called
+// after init when the project ID is discovered from another source.
+// TODO: Remove this logic once the allocate_k8s_token URL is stored/read from datastore.
+func SetProject(projectID string) {
+	for key := range Extensions.All() {
+		urls, _ := Extensions.URLs(key)
+		for i := range urls {
+			if strings.Contains(urls[i], "%s") {
+				urls[i] = fmt.Sprintf(urls[i], projectID)
+			}
 		}
+		Extensions.SetURLs(key, urls)
 	}
 }
@@ -0,0 +1,174 @@
+// Copyright 2016 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestExtensionRegistry(t *testing.T) {
+	urls := map[string]string{"op1": "http://example.com/op1"}
+	r := NewExtensionRegistry(urls)
+
+	// The registry keeps a copy of the original map.
+	urls["op2"] = "http://example.com/op2"
+	if _, ok := r.Get("op2"); ok {
+		t.Errorf("NewExtensionRegistry() did not copy urls")
+	}
+
+	r.Set("op3", "http://example.com/op3")
+	if got, ok := r.Get("op3"); !ok || got != "http://example.com/op3" {
+		t.Errorf("Get() = %q, %t; want %q, true", got, ok, "http://example.com/op3")
+	}
+	want := map[string]string{
+		"op1": "http://example.com/op1",
+		"op3": "http://example.com/op3",
+	}
+	all := r.All()
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("All() = %v; want %v", all, want)
+	}
+	// Changes to the result of All do not change the registry.
+	all["op4"] = "http://example.com/op4"
+	if _, ok := r.Get("op4"); ok {
+		t.Errorf("All() did not return a copy")
+	}
+
+	r.Delete("op1")
+	if _, ok := r.Get("op1"); ok {
+		t.Errorf("Delete() did not remove op1")
+	}
+}
+
+func TestExtensionRegistryURLs(t *testing.T) {
+	r := NewExtensionRegistry(map[string]string{"op1": "http://example.com/op1"})
+	if got, ok := r.URLs("op1"); !ok || !reflect.DeepEqual(got, []string{"http://example.com/op1"}) {
+		t.Errorf("URLs() = %q, %t; want one URL", got, ok)
+	}
+
+	failover := []string{"http://a.example.com/op2", "http://b.example.com/op2"}
+	r.SetURLs("op2", failover)
+	// The registry keeps a copy of the given URLs.
+	failover[0] = "http://c.example.com/op2"
+	got, ok := r.URLs("op2")
+	want := []string{"http://a.example.com/op2", "http://b.example.com/op2"}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("URLs() = %q, %t; want %q, true", got, ok, want)
+	}
+	// Changes to the result of URLs do not change the registry.
+	got[0] = "http://c.example.com/op2"
+	if primary, _ := r.Get("op2"); primary != want[0] {
+		t.Errorf("Get() = %q; want primary URL %q", primary, want[0])
+	}
+	if all := r.All(); all["op2"] != want[0] {
+		t.Errorf("All() = %v; want primary URL %q for op2", all, want[0])
+	}
+
+	all := r.AllURLs()
+	if !reflect.DeepEqual(all["op2"], want) {
+		t.Errorf("AllURLs() = %v; want %q for op2", all, want)
+	}
+	// Changes to the result of AllURLs do not change the registry.
+	all["op2"][0] = "http://c.example.com/op2"
+	if primary, _ := r.Get("op2"); primary != want[0] {
+		t.Errorf("Get() = %q; want primary URL %q", primary, want[0])
+	}
+
+	r.SetURLs("op2", nil)
+	if _, ok := r.URLs("op2"); ok {
+		t.Errorf("SetURLs() with no URLs did not remove op2")
+	}
+}
+
+func TestSetProject(t *testing.T) {
+	orig := Extensions
+	defer func() { Extensions = orig }()
+	Extensions = NewExtensionRegistry(map[string]string{
+		"op1": "http://extension.%s.example.com/op1",
+		"op2": "http://extension.example.com/op2",
+	})
+
+	SetProject("mlab-sandbox")
+	// A second call does not change the formatted URLs.
+	SetProject("mlab-staging")
+	want := map[string]string{
+		"op1": "http://extension.mlab-sandbox.example.com/op1",
+		"op2": "http://extension.example.com/op2",
+	}
+	if got := Extensions.All(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SetProject() Extensions = %v; want %v", got, want)
+	}
+}
+
+func TestValidOperationName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "allocate_k8s_token", want: true},
+		{name: "op1", want: true},
+		{name: "TestOp", want: true},
+		{name: "", want: false},
+		{name: "bmc-store-password", want: false},
+		{name: "op/../admin", want: false},
+		{name: "op?x=1", want: false},
+		{name: "op%20", want: false},
+	}
+	for _, tt := range tests {
+		if got := ValidOperationName(tt.name); got != tt.want {
+			t.Errorf("ValidOperationName(%q) = %t, want %t", tt.name, got, tt.want)
+		}
+		r := NewExtensionRegistry(nil)
+		err := r.Set(tt.name, "http://example.com/op")
+		if (err == nil) != tt.want {
+			t.Errorf("Set(%q) error = %v, want valid %t", tt.name, err, tt.want)
+		}
+		if _, ok := r.Get(tt.name); ok != tt.want {
+			t.Errorf("Set(%q) registered = %t, want %t", tt.name, ok, tt.want)
+		}
+	}
+	if err := ValidateOperationNames([]string{"op1", "op 2"}); err == nil {
+		t.Errorf("ValidateOperationNames() = nil, want error for \"op 2\"")
+	}
+}
+
+// TestExtensionRegistryConcurrent is meaningful when run with the race
+// detector, e.g. "go test -race".
+func TestExtensionRegistryConcurrent(t *testing.T) {
+	r := NewExtensionRegistry(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			op := fmt.Sprintf("op%d", i)
+			for j := 0; j < 100; j++ {
+				r.Set(op, fmt.Sprintf("http://example.com/%d", j))
+				r.Get(op)
+				r.All()
+				r.Delete(op)
+			}
+			r.Set(op, "http://example.com/"+op)
+		}(i)
+	}
+	wg.Wait()
+	if n := len(r.All()); n != 10 {
+		t.Errorf("All() returned %d operations; want 10", n)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/m-lab/epoxy/datastorex"
+)
+
+// groupKind categorizes the Datastore HostGroup records.
+const groupKind = "HostGroup"
+
+// A HostGroup holds default boot sequences shared by many Hosts. A Host
+// naming the group in Host.Group inherits every stage of the group Boot and
+// Update sequences that the Host does not set itself.
+type HostGroup struct {
+	// Name uniquely identifies the group, e.g. "mlab-physical".
+	Name string
+	// Boot is the default Boot sequence for Hosts in this group.
+	Boot datastorex.Map
+	// Update is the default Update sequence for Hosts in this group.
+	Update datastorex.Map
+}
+
+// Inherit adds stages from the HostGroup sequences that are missing or empty in
+// the Host sequences. Stages set on the Host are preserved as overrides. The Host
+// sequences are replaced by new maps, so the original maps are not modified.
+// Inherit is intended for generating configs, and its result should not be
+// saved, so that later changes to the group still apply to the Host.
+func (h *Host) Inherit(g *HostGroup) {
+	h.Boot = inheritSequence(h.Boot, g.Boot)
+	h.Update = inheritSequence(h.Update, g.Update)
+}
+
+// inheritSequence returns a new map with all stages from defaults, replaced by
+// the non-empty stages in overrides. Tools like epoxy_admin save unset stages
+// as empty URLs, so an empty URL never overrides a default.
+func inheritSequence(overrides, defaults datastorex.Map) datastorex.Map {
+	s := make(datastorex.Map, len(defaults)+len(overrides))
+	for stage, url := range defaults {
+		s[stage] = url
+	}
+	for stage, url := range overrides {
+		if url != "" || s[stage] == "" {
+			s[stage] = url
+		}
+	}
+	return s
+}
+
+// LoadGroup retrieves a HostGroup record from the datastore.
+func (c *DatastoreConfig) LoadGroup(name string) (*HostGroup, error) {
+	g := &HostGroup{}
+	key := datastore.NameKey(groupKind, name, nil)
+	key.Namespace = c.Namespace
+	if err := c.Client.Get(context.Background(), key, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// SaveGroup stores a HostGroup record to Datastore. If a HostGroup record
+// with the same name already exists, then it is overwritten.
+func (c *DatastoreConfig) SaveGroup(g *HostGroup) error {
+	key := datastore.NameKey(groupKind, g.Name, nil)
+	key.Namespace = c.Namespace
+	_, err := c.Client.Put(context.Background(), key, g)
+	return err
+}
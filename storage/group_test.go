@@ -0,0 +1,125 @@
+// Copyright 2026 ePoxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/epoxy/datastorex"
+)
+
+func TestHostInherit(t *testing.T) {
+	g := &HostGroup{
+		Name: "physical",
+		Boot: datastorex.Map{
+			Stage1IPXE: "https://example.com/group/boot/stage1to2.ipxe",
+			Stage2:     "https://example.com/group/boot/stage2to3.json",
+			Stage3:     "https://example.com/group/boot/stage3post.json",
+		},
+		Update: datastorex.Map{
+			Stage1IPXE: "https://example.com/group/update/stage1to2.ipxe",
+		},
+	}
+	tests := []struct {
+		name       string
+		boot       datastorex.Map
+		wantBoot   datastorex.Map
+		wantUpdate datastorex.Map
+	}{
+		{
+			name:       "inherit-all-stages",
+			wantBoot:   g.Boot,
+			wantUpdate: g.Update,
+		},
+		{
+			name: "override-one-stage",
+			boot: datastorex.Map{
+				Stage2: "https://example.com/host/stage2to3.json",
+			},
+			wantBoot: datastorex.Map{
+				Stage1IPXE: "https://example.com/group/boot/stage1to2.ipxe",
+				Stage2:     "https://example.com/host/stage2to3.json",
+				Stage3:     "https://example.com/group/boot/stage3post.json",
+			},
+			wantUpdate: g.Update,
+		},
+		{
+			name: "empty-stage-does-not-override",
+			boot: datastorex.Map{
+				Stage1IPXE: "",
+				Stage1JSON: "",
+			},
+			wantBoot: datastorex.Map{
+				Stage1IPXE: "https://example.com/group/boot/stage1to2.ipxe",
+				Stage1JSON: "",
+				Stage2:     "https://example.com/group/boot/stage2to3.json",
+				Stage3:     "https://example.com/group/boot/stage3post.json",
+			},
+			wantUpdate: g.Update,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Host{Name: "mlab1.iad1t.measurement-lab.org", Group: g.Name, Boot: tt.boot}
+			h.Inherit(g)
+			if !reflect.DeepEqual(h.Boot, tt.wantBoot) {
+				t.Errorf("Inherit() Boot got %v; want %v", h.Boot, tt.wantBoot)
+			}
+			if !reflect.DeepEqual(h.Update, tt.wantUpdate) {
+				t.Errorf("Inherit() Update got %v; want %v", h.Update, tt.wantUpdate)
+			}
+		})
+	}
+
+	// The group sequences are never modified by a host override.
+	h := &Host{Boot: datastorex.Map{Stage2: "https://example.com/host/stage2to3.json"}}
+	h.Inherit(g)
+	if g.Boot[Stage2] != "https://example.com/group/boot/stage2to3.json" {
+		t.Errorf("Inherit() modified group Boot: got %v", g.Boot)
+	}
+}
+
+func TestDatastoreGroup(t *testing.T) {
+	g := HostGroup{
+		Name: "physical",
+		Boot: datastorex.Map{
+			Stage1IPXE: "https://example.com/group/boot/stage1to2.ipxe",
+		},
+	}
+	f := &fakeDatastoreClient{group: &HostGroup{}}
+	c := NewDatastoreConfig(f)
+
+	if err := c.SaveGroup(&g); err != nil {
+		t.Fatalf("Failed to save group: %s", err)
+	}
+	g2, err := c.LoadGroup(g.Name)
+	if err != nil {
+		t.Fatalf("Failed to load group: %s", err)
+	}
+	if !reflect.DeepEqual(&g, g2) {
+		t.Errorf("Group records do not match: got %#v; want %#v", g2, &g)
+	}
+
+	c = NewDatastoreConfig(&errDatastoreClient{err: errors.New("fake error")})
+	if _, err := c.LoadGroup(g.Name); err == nil {
+		t.Errorf("LoadGroup() error = nil, want error")
+	}
+	if err := c.SaveGroup(&g); err == nil {
+		t.Errorf("SaveGroup() error = nil, want error")
+	}
+}
@@ -21,14 +21,22 @@ package storage
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/m-lab/epoxy/datastorex"
+	"golang.org/x/crypto/ssh"
 )
 
 // These variables provide indirection for the default function implementations.
@@ -53,8 +61,35 @@ var allowedCollectedInformation = map[string]bool{
 	"ip":                  true,
 	"version":             true,
 	"public_ssh_host_key": true,
+	"firmware":            true,
+	"secureboot":          true,
 }
 
+// collectedInformationValidators check the format of CollectedInformation
+// values that are consumed by other tools, so malformed values are never saved.
+var collectedInformationValidators = map[string]func(string) error{
+	"public_ssh_host_key": validSSHPublicKey,
+}
+
+// validSSHPublicKey returns an error unless value is a single SSH public key in
+// authorized_keys format, e.g. "ssh-ed25519 AAAA... root@host".
+func validSSHPublicKey(value string) error {
+	_, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(value))
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("unexpected data after SSH public key")
+	}
+	return nil
+}
+
+// Firmware types reported by booting machines.
+const (
+	FirmwareBIOS = "bios"
+	FirmwareEFI  = "efi"
+)
+
 // Constant names for standard boot & update sequence maps.
 const (
 	Stage1IPXE = "stage1.ipxe"
@@ -63,6 +98,31 @@ const (
 	Stage3     = "stage3"
 )
 
+// Boot policies select the sequence served to a Host, and what happens after
+// a successful boot.
+const (
+	// BootPolicyNormal serves the Boot sequence.
+	BootPolicyNormal = "normal"
+	// BootPolicyUpdateOnce serves the Update sequence until the first
+	// successful report, then changes to BootPolicyNormal.
+	BootPolicyUpdateOnce = "update-once"
+	// BootPolicyUpdateAlways serves the Update sequence for every boot.
+	BootPolicyUpdateAlways = "update-always"
+	// BootPolicyHold serves no sequence. The Host waits and reboots until the
+	// policy changes.
+	BootPolicyHold = "hold"
+)
+
+// ValidBootPolicy returns true if policy may be used as a Host BootPolicy. An
+// empty policy is valid and selects a policy from UpdateEnabled.
+func ValidBootPolicy(policy string) bool {
+	switch policy {
+	case "", BootPolicyNormal, BootPolicyUpdateOnce, BootPolicyUpdateAlways, BootPolicyHold:
+		return true
+	}
+	return false
+}
+
 // TODO: SessionIDs structs should be map[string]string, that
 // store target stage names as keys. This prevents hard-coding the target names,
 // the SessionID names.
@@ -74,6 +134,39 @@ type SessionIDs struct {
 	ReportID string // Needed for requesting the report target.
 	// TODO: support multiple extensions.
 	ExtensionID string // Needed for requesting the extension target.
+	// Nonce is an optional value provided by the client when requesting the
+	// stage1 target. When present, the nonce is added to the stage2 and stage3
+	// URLs and must be given with those requests.
+	Nonce string
+}
+
+// MaxBootLogs is the maximum number of reports retained in Host.BootLogs.
+const MaxBootLogs = 10
+
+// maxBootLogMessage is the maximum length in bytes of a BootLog Message.
+const maxBootLogMessage = 1024
+
+// maxBootLogOutput is the maximum length in bytes of a BootLog Output.
+const maxBootLogOutput = 4096
+
+// maxCollectedValue is the maximum length in bytes of one CollectedInformation
+// value. Larger values, e.g. an SSH host key, are far bigger than expected.
+const maxCollectedValue = 4096
+
+// maxCollectedTotal is the maximum length in bytes of all CollectedInformation
+// values for a Host.
+const maxCollectedTotal = 16384
+
+// A BootLog records a single report received from a booting machine.
+type BootLog struct {
+	// Time is when the report was received.
+	Time time.Time
+	// Message is the message reported by the client, e.g. "success".
+	Message string `datastore:",noindex"`
+	// Success is true if the report indicated a successful boot.
+	Success bool
+	// Output is the tail of output from a failed command, if reported.
+	Output string `datastore:",noindex"`
 }
 
 // A Host represents the configuration of a server managed by ePoxy.
@@ -82,24 +175,87 @@ type Host struct {
 	Name string
 	// IPv4Addr is the IPv4 address the booting machine will use to connect to the API.
 	IPv4Addr string
-
-	// TODO: add IPv6Addr.
+	// IPv6Addr is the IPv6 address of the booting machine, if any.
+	IPv6Addr string
+	// AllowedCIDRs are optional IP ranges, e.g. "192.168.0.8/29", from which
+	// the booting machine may also connect to the API, e.g. from a second NIC
+	// or the BMC.
+	AllowedCIDRs []string
+	// MachineType is the machine type reported by siteinfo, e.g. "physical".
+	MachineType string
+	// Firmware is the firmware type most recently reported by the booting
+	// machine, FirmwareBIOS or FirmwareEFI. When empty, the firmware is unknown.
+	Firmware string
+	// SecureBoot is true if the booting machine most recently reported that EFI
+	// secure boot is enabled.
+	SecureBoot bool
 
 	// Boot is the typical boot sequence for this Host.
 	Boot datastorex.Map
 	// Update is an alternate boot sequence, typically used to update the system, e.g. reinstall, reflash.
 	Update datastorex.Map
+	// PreviousBoot and PreviousUpdate are snapshots of the Boot and Update
+	// sequences from before their most recent change, to roll back to.
+	PreviousBoot   datastorex.Map
+	PreviousUpdate datastorex.Map
+	// Group optionally names a HostGroup whose Boot and Update sequences
+	// provide the stages not set in this Host's sequences.
+	Group string
 	// ImagesVersion is the version of epoxy-images to use when booting the
 	// machines in all stages (1-3).
 	ImagesVersion string
+	// APIVersion pins the ePoxy server API version, e.g. "v1", used in URLs
+	// generated for this Host. When empty, the server default is used.
+	APIVersion string
+	// ChainChecksums maps Chain URLs from the Boot or Update sequences to the
+	// expected sha256 checksum of their content. URLs without a checksum are
+	// not verified by clients.
+	ChainChecksums datastorex.Map
+	// ChainCommand is the iPXE command, with options, used by the stage1 script
+	// to chain to the stage1 URL, e.g. "chain --autofree". When empty, the
+	// stage1 script uses "chain".
+	ChainCommand string
+	// CommandTimeout is the time limit for each command run by epoxy_client
+	// in the stage configs for this Host, e.g. "4h" for machines with a slow
+	// disk wipe. When empty, the client default is used.
+	CommandTimeout string
 
+	// BootPolicy selects the sequence served to the host, e.g.
+	// BootPolicyUpdateOnce. When empty, records saved before BootPolicy
+	// existed use UpdateEnabled instead; see EffectiveBootPolicy.
+	BootPolicy string
 	// UpdateEnabled controls whether ePoxy returns the Update sequence (true)
-	// or Boot sequence (false) Chain URLs.
+	// or Boot sequence (false) Chain URLs when BootPolicy is empty. Otherwise,
+	// it is kept set for policies that serve the Update sequence.
 	UpdateEnabled bool
+	// MaxUpdateAttempts is the number of update boots allowed without a
+	// successful report before ePoxy falls back to the Boot sequence. When zero,
+	// update attempts are unlimited.
+	MaxUpdateAttempts int
+	// UpdateAttempts counts the stage1 requests served the Update sequence
+	// since the last successful report.
+	UpdateAttempts int
+
+	// Decommissioned is set by epoxy_admin prune when the host is no longer
+	// present in siteinfo.
+	Decommissioned bool
 
 	// Extensions is an array of extension operation names enabled for this host.
 	Extensions []string
 
+	// Labels are free-form key/value metadata, e.g. an owner, cost center, or
+	// ticket, for integration with inventory systems. ePoxy does not interpret
+	// labels.
+	Labels datastorex.Map
+
+	// Message is an optional banner, e.g. describing planned maintenance, that
+	// is displayed on the console of the booting machine during stage1.
+	Message string
+	// MaintenanceUntil, when in the future, holds the host in maintenance:
+	// boot requests return a config that waits and reboots instead of the
+	// boot sequence. Normal boots resume automatically afterward.
+	MaintenanceUntil time.Time
+
 	// CurrentSessionIDs are the most recently generated session ids for a booting machine.
 	CurrentSessionIDs SessionIDs
 	// LastSessionCreation is the time when CurrentSessionIDs was generated.
@@ -108,8 +264,21 @@ type Host struct {
 	LastReport time.Time
 	// LastSuccess is the time of the most recent successful report from this host.
 	LastSuccess time.Time
+	// ClientCertFingerprint is the hex encoded sha256 fingerprint of the
+	// verified client certificate most recently presented in a report. It is
+	// only recorded when the server verifies client certificates.
+	ClientCertFingerprint string
+	// ClientCertChanged is the time when a report last presented a client
+	// certificate different from a previously recorded ClientCertFingerprint.
+	ClientCertChanged time.Time
+	// BootLogs are the most recent reports from this host, oldest first. At
+	// most MaxBootLogs reports are retained.
+	BootLogs []BootLog
 	// CollectedInformation reported by the host. CollectedInformation must be non-nil.
 	CollectedInformation datastorex.Map
+	// LastCollected maps CollectedInformation keys to the time (RFC3339) when
+	// the value was most recently reported by the host.
+	LastCollected datastorex.Map
 }
 
 // String serializes a Host record. All string type Host fields should be UTF8.
@@ -119,50 +288,458 @@ func (h *Host) String() string {
 	return string(b)
 }
 
+// AllowsIP returns true if ip equals the IPv4Addr of the host, or is within
+// one of the AllowedCIDRs. Invalid CIDRs match no address.
+func (h *Host) AllowsIP(ip string) bool {
+	if ip == h.IPv4Addr {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, cidr := range h.AllowedCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err == nil && ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateSessionIDs creates new random session IDs for the host's CurrentSessionIDs.
-// On success, the host LastSessionCreation is updated to the current time.
+// Any previous client nonce is cleared. On success, the host LastSessionCreation
+// is updated to the current time.
 func (h *Host) GenerateSessionIDs() {
+	h.CurrentSessionIDs.Nonce = ""
 	h.CurrentSessionIDs.Stage2ID = generateSessionID()
 	h.CurrentSessionIDs.Stage3ID = generateSessionID()
 	h.CurrentSessionIDs.ReportID = generateSessionID()
-	h.CurrentSessionIDs.ExtensionID = generateSessionID()
+	h.GenerateExtensionSessionID()
 	h.LastSessionCreation = timeNow()
 }
 
-// CurrentSequence returns the currently enabled boot sequence.
+// SessionIsRecent returns true if the host's current session was created less
+// than window ago, so that it may be reused instead of generating new session
+// IDs. When window is zero, sessions are never reused.
+func (h *Host) SessionIsRecent(window time.Duration) bool {
+	if window <= 0 || h.CurrentSessionIDs.Stage2ID == "" || h.LastSessionCreation.IsZero() {
+		return false
+	}
+	return timeNow().Sub(h.LastSessionCreation) < window
+}
+
+// SetLabels adds the given labels to the host, replacing existing values for
+// the same keys. Labels with an empty value are removed.
+func (h *Host) SetLabels(labels map[string]string) {
+	for k, v := range labels {
+		if v == "" {
+			delete(h.Labels, k)
+			continue
+		}
+		if h.Labels == nil {
+			h.Labels = datastorex.Map{}
+		}
+		h.Labels[k] = v
+	}
+}
+
+// HasLabels returns true if the host has every label in selector, with the
+// same value. An empty selector matches every host.
+func (h *Host) HasLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if got, ok := h.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MaintenanceRemaining returns the time until MaintenanceUntil, or zero if
+// the host is not in maintenance.
+func (h *Host) MaintenanceRemaining() time.Duration {
+	if remaining := h.MaintenanceUntil.Sub(timeNow()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// GenerateExtensionSessionID creates a new random ExtensionID for the host's
+// CurrentSessionIDs. All other session IDs are unchanged, so only extension
+// URLs generated with the previous ExtensionID become invalid.
+func (h *Host) GenerateExtensionSessionID() {
+	h.CurrentSessionIDs.ExtensionID = generateSessionID()
+}
+
+// EffectiveBootPolicy returns the BootPolicy of the host. Records without a
+// BootPolicy use BootPolicyUpdateOnce when UpdateEnabled is set, since updates
+// were always disabled by a successful report, and BootPolicyNormal otherwise.
+func (h *Host) EffectiveBootPolicy() string {
+	switch {
+	case h.BootPolicy != "":
+		return h.BootPolicy
+	case h.UpdateEnabled:
+		return BootPolicyUpdateOnce
+	default:
+		return BootPolicyNormal
+	}
+}
+
+// SetBootPolicy sets the BootPolicy of the host, and sets UpdateEnabled for
+// policies that serve the Update sequence. Newly enabled updates start with a
+// full set of attempts.
+func (h *Host) SetBootPolicy(policy string) {
+	update := policy == BootPolicyUpdateOnce || policy == BootPolicyUpdateAlways
+	if update && !h.updatePolicy() {
+		h.UpdateAttempts = 0
+	}
+	h.BootPolicy = policy
+	h.UpdateEnabled = update
+}
+
+// SetUpdateEnabled enables or disables updates, like the UpdateEnabled field
+// did before BootPolicy existed. For hosts with a BootPolicy, enabling selects
+// BootPolicyUpdateOnce and disabling selects BootPolicyNormal. Update attempts
+// are always reset.
+func (h *Host) SetUpdateEnabled(enabled bool) {
+	switch {
+	case h.BootPolicy == "":
+		h.UpdateEnabled = enabled
+	case enabled:
+		h.SetBootPolicy(BootPolicyUpdateOnce)
+	default:
+		h.SetBootPolicy(BootPolicyNormal)
+	}
+	h.UpdateAttempts = 0
+}
+
+// ResetAfterSuccess updates the boot policy state of the host after a
+// successful report. Update attempts are reset, and BootPolicyUpdateOnce
+// changes to BootPolicyNormal. Other policies are unchanged.
+func (h *Host) ResetAfterSuccess() {
+	h.UpdateAttempts = 0
+	if h.EffectiveBootPolicy() != BootPolicyUpdateOnce {
+		return
+	}
+	h.UpdateEnabled = false
+	if h.BootPolicy != "" {
+		h.BootPolicy = BootPolicyNormal
+	}
+}
+
+// updatePolicy reports whether the effective boot policy of the host serves
+// the Update sequence.
+func (h *Host) updatePolicy() bool {
+	policy := h.EffectiveBootPolicy()
+	return policy == BootPolicyUpdateOnce || policy == BootPolicyUpdateAlways
+}
+
+// UpdateSelected reports whether CurrentSequence returns the Update sequence.
+func (h *Host) UpdateSelected() bool {
+	return h.updatePolicy() && !h.UpdateAttemptsExhausted()
+}
+
+// CurrentSequence returns the currently enabled boot sequence. When the boot
+// policy serves updates but MaxUpdateAttempts have already failed, the Boot
+// sequence is returned so a host with a broken update can still boot normally.
 func (h *Host) CurrentSequence() datastorex.Map {
-	if h.UpdateEnabled {
+	if h.UpdateSelected() {
 		return h.Update
 	}
 	return h.Boot
 }
 
+// ErrNoSnapshot is returned by Rollback when a Host has no previous sequences.
+var ErrNoSnapshot = errors.New("no previous boot sequences to roll back to")
+
+// SnapshotSequences saves copies of the current Boot and Update sequences as
+// PreviousBoot and PreviousUpdate. It should be called before a change to the
+// sequences that may need to be rolled back.
+func (h *Host) SnapshotSequences() {
+	h.PreviousBoot = copyMap(h.Boot)
+	h.PreviousUpdate = copyMap(h.Update)
+}
+
+// Rollback restores the Boot and Update sequences from PreviousBoot and
+// PreviousUpdate. The replaced sequences become the new snapshot, so a second
+// Rollback undoes the first. Rollback returns ErrNoSnapshot if both previous
+// sequences are empty.
+func (h *Host) Rollback() error {
+	if len(h.PreviousBoot) == 0 && len(h.PreviousUpdate) == 0 {
+		return ErrNoSnapshot
+	}
+	h.Boot, h.PreviousBoot = h.PreviousBoot, h.Boot
+	h.Update, h.PreviousUpdate = h.PreviousUpdate, h.Update
+	return nil
+}
+
+// Clone returns a copy of h that shares no maps or slices with h, e.g. to
+// compare a Host before and after a change.
+func (h *Host) Clone() *Host {
+	c := *h
+	c.AllowedCIDRs = append([]string(nil), h.AllowedCIDRs...)
+	c.Boot = copyMap(h.Boot)
+	c.Update = copyMap(h.Update)
+	c.PreviousBoot = copyMap(h.PreviousBoot)
+	c.PreviousUpdate = copyMap(h.PreviousUpdate)
+	c.ChainChecksums = copyMap(h.ChainChecksums)
+	c.Extensions = append([]string(nil), h.Extensions...)
+	c.Labels = copyMap(h.Labels)
+	c.BootLogs = append([]BootLog(nil), h.BootLogs...)
+	c.CollectedInformation = copyMap(h.CollectedInformation)
+	c.LastCollected = copyMap(h.LastCollected)
+	return &c
+}
+
+// copyMap returns a copy of m, or nil if m is nil.
+func copyMap(m datastorex.Map) datastorex.Map {
+	if m == nil {
+		return nil
+	}
+	c := datastorex.Map{}
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// UpdateAttemptsExhausted reports whether the host has used more than
+// MaxUpdateAttempts update boots without a successful report.
+func (h *Host) UpdateAttemptsExhausted() bool {
+	return h.MaxUpdateAttempts > 0 && h.UpdateAttempts > h.MaxUpdateAttempts
+}
+
+// StartUpdateAttempt counts a new update boot for a host with updates enabled.
+// It should be called once per stage1 request, before CurrentSequence. Once
+// attempts are exhausted, the count is no longer incremented.
+func (h *Host) StartUpdateAttempt() {
+	if h.UpdateSelected() {
+		h.UpdateAttempts++
+	}
+}
+
+// SetClientCertFingerprint records the fingerprint of the client certificate
+// presented in a report. If a different fingerprint was recorded before, the
+// time of the change is saved in ClientCertChanged and SetClientCertFingerprint
+// returns true.
+func (h *Host) SetClientCertFingerprint(fingerprint string) bool {
+	changed := h.ClientCertFingerprint != "" && h.ClientCertFingerprint != fingerprint
+	if changed {
+		h.ClientCertChanged = timeNow()
+	}
+	h.ClientCertFingerprint = fingerprint
+	return changed
+}
+
+// AddBootLog appends a report message and command output to the host's
+// BootLogs, discarding the oldest reports beyond MaxBootLogs. Long messages
+// are truncated, and only the tail of long output is kept.
+func (h *Host) AddBootLog(message, output string, success bool) {
+	if len(message) > maxBootLogMessage {
+		message = strings.ToValidUTF8(message[:maxBootLogMessage], "")
+	}
+	if len(output) > maxBootLogOutput {
+		output = strings.ToValidUTF8(output[len(output)-maxBootLogOutput:], "")
+	}
+	h.BootLogs = append(h.BootLogs, BootLog{
+		Time:    timeNow(),
+		Message: message,
+		Success: success,
+		Output:  output,
+	})
+	if n := len(h.BootLogs) - MaxBootLogs; n > 0 {
+		h.BootLogs = append([]BootLog(nil), h.BootLogs[n:]...)
+	}
+}
+
 // AddInformation adds values to the Host's CollectedInformation. Only key
-// names in CollectedInformationWhitelist will be added.
+// names in CollectedInformationWhitelist will be added. Values longer than
+// maxCollectedValue, or that would make all values longer than
+// maxCollectedTotal, are rejected, since truncated values would be misleading.
 func (h *Host) AddInformation(values url.Values) {
-	for key, values := range values {
-		value := strings.TrimSpace(strings.Join(values, " "))
+	// Visit keys in order, so the same values are rejected at the total limit.
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.TrimSpace(strings.Join(values[key], " "))
 		if !utf8.ValidString(value) {
 			log.Printf("Skipping invalid value for: %s CollectedInformation.%s\n", h.Name, key)
 			continue
 		}
-		if allowedCollectedInformation[key] && value != "" {
-			h.CollectedInformation[key] = value
+		if !allowedCollectedInformation[key] || value == "" {
+			continue
+		}
+		if len(value) > maxCollectedValue {
+			log.Printf("Skipping oversized value (%d bytes) for: %s CollectedInformation.%s\n",
+				len(value), h.Name, key)
+			continue
+		}
+		if validate, ok := collectedInformationValidators[key]; ok {
+			if err := validate(value); err != nil {
+				log.Printf("Skipping invalid value for: %s CollectedInformation.%s: %v\n", h.Name, key, err)
+				continue
+			}
+		}
+		if total := h.collectedSize() - len(h.CollectedInformation[key]) + len(value); total > maxCollectedTotal {
+			log.Printf("Skipping value exceeding total size (%d bytes) for: %s CollectedInformation.%s\n",
+				total, h.Name, key)
+			continue
+		}
+		if h.CollectedInformation == nil {
+			h.CollectedInformation = datastorex.Map{}
+		}
+		h.CollectedInformation[key] = value
+		if h.LastCollected == nil {
+			h.LastCollected = datastorex.Map{}
+		}
+		h.LastCollected[key] = timeNow().UTC().Format(time.RFC3339)
+	}
+}
+
+// collectedSize returns the length in bytes of all CollectedInformation values.
+func (h *Host) collectedSize() int {
+	n := 0
+	for _, value := range h.CollectedInformation {
+		n += len(value)
+	}
+	return n
+}
+
+// ExpireInformation removes CollectedInformation values last reported more
+// than maxAge ago. Values without a LastCollected time are preserved, since
+// their age is unknown.
+func (h *Host) ExpireInformation(maxAge time.Duration) {
+	cutoff := timeNow().Add(-maxAge)
+	for key := range h.CollectedInformation {
+		t, err := time.Parse(time.RFC3339, h.LastCollected[key])
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		log.Printf("Expiring stale value for: %s CollectedInformation.%s\n", h.Name, key)
+		delete(h.CollectedInformation, key)
+		delete(h.LastCollected, key)
+	}
+}
+
+// SetFirmware updates the Host Firmware and SecureBoot fields from values
+// reported by a booting machine. An explicit "firmware" value, e.g. "efi",
+// takes precedence over the iPXE "platform", e.g. "pcbios". Missing or
+// unrecognized values leave the current fields unchanged.
+func (h *Host) SetFirmware(values url.Values) {
+	firmware := values.Get("firmware")
+	if firmware == "" {
+		firmware = values.Get("platform")
+	}
+	switch strings.ToLower(strings.TrimSpace(firmware)) {
+	case "":
+	case "bios", "pcbios":
+		h.Firmware = FirmwareBIOS
+	case "efi", "uefi":
+		h.Firmware = FirmwareEFI
+	default:
+		log.Printf("Skipping unknown firmware for: %s %q\n", h.Name, firmware)
+	}
+	if secureboot := values.Get("secureboot"); secureboot != "" {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(secureboot))
+		if err != nil {
+			log.Printf("Skipping invalid secureboot for: %s %q\n", h.Name, secureboot)
+			return
 		}
+		h.SecureBoot = enabled
 	}
 }
 
-// randomSessionByteCount is the number of bytes used to generate random session IDs.
-const randomSessionByteCount = 20
+// FirmwareVariants returns the names of boot sequence stage variants for the
+// Host firmware, most specific first, e.g. "efi-secureboot" then "efi". A
+// stage variant, e.g. "stage1.ipxe.efi", is preferred to the plain stage.
+// Hosts with unknown firmware have no variants.
+func (h *Host) FirmwareVariants() []string {
+	switch {
+	case h.Firmware == "":
+		return nil
+	case h.Firmware == FirmwareEFI && h.SecureBoot:
+		return []string{FirmwareEFI + "-secureboot", FirmwareEFI}
+	default:
+		return []string{h.Firmware}
+	}
+}
+
+// validNonce matches client-provided nonces that may be used in URLs without
+// escaping, e.g. base64url or hex encoded random values.
+var validNonce = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+// ErrInvalidNonce is returned by SetNonce for malformed client nonces.
+var ErrInvalidNonce = errors.New("invalid nonce")
+
+// SetNonce saves the client-provided nonce in the host's CurrentSessionIDs.
+// An empty nonce is ignored, since most clients do not send one. A malformed
+// nonce returns ErrInvalidNonce and leaves the host unchanged.
+func (h *Host) SetNonce(nonce string) error {
+	if nonce == "" {
+		return nil
+	}
+	if !validNonce.MatchString(nonce) {
+		return ErrInvalidNonce
+	}
+	h.CurrentSessionIDs.Nonce = nonce
+	return nil
+}
+
+// MinSessionByteCount is the default and minimum number of random bytes used
+// to generate session IDs.
+const MinSessionByteCount = 20
+
+// Session ID alphabets. Both are URL-safe without escaping.
+const (
+	// SessionAlphabetBase64URL encodes session IDs using unpadded base64url,
+	// the default.
+	SessionAlphabetBase64URL = "base64url"
+	// SessionAlphabetHex encodes session IDs using lowercase hexadecimal, for
+	// clients that do not accept mixed case or punctuation.
+	SessionAlphabetHex = "hex"
+)
+
+// sessionEncodings maps supported alphabets to their encoding functions.
+var sessionEncodings = map[string]func([]byte) string{
+	// RawURLEncoding does not pad encoded string with "=".
+	SessionAlphabetBase64URL: base64.RawURLEncoding.EncodeToString,
+	SessionAlphabetHex:       hex.EncodeToString,
+}
+
+// The session ID format used by generateSessionID. See SetSessionIDFormat.
+var (
+	sessionByteCount = MinSessionByteCount
+	sessionEncode    = sessionEncodings[SessionAlphabetBase64URL]
+)
+
+// SetSessionIDFormat sets the number of random bytes and the alphabet used to
+// generate new session IDs. To never weaken session IDs, byteCount must be at
+// least MinSessionByteCount. SetSessionIDFormat is not safe for concurrent use
+// with GenerateSessionIDs, so it should only be called during startup.
+func SetSessionIDFormat(byteCount int, alphabet string) error {
+	if byteCount < MinSessionByteCount {
+		return fmt.Errorf("session ID byte count %d is less than the minimum %d",
+			byteCount, MinSessionByteCount)
+	}
+	encode, ok := sessionEncodings[alphabet]
+	if !ok {
+		return fmt.Errorf("unsupported session ID alphabet: %q", alphabet)
+	}
+	sessionByteCount = byteCount
+	sessionEncode = encode
+	return nil
+}
 
 // generateSessionId creates a random session ID.
 func generateSessionID() string {
-	b := make([]byte, randomSessionByteCount)
+	b := make([]byte, sessionByteCount)
 	_, err := randRead(b)
 	if err != nil {
 		// Only possible if randRead fails to read len(b) bytes.
 		panic(err)
 	}
-	// RawURLEncoding does not pad encoded string with "=".
-	return base64.RawURLEncoding.EncodeToString(b)
+	return sessionEncode(b)
 }
@@ -7,10 +7,40 @@ import (
 )
 
 // DatastoreClient is an interface to make testing possible. The default
-// implementation is the actual *datastore.Client as returned by
-// datastore.NewClient.
+// implementation is a Client wrapping the actual *datastore.Client as returned
+// by datastore.NewClient.
 type DatastoreClient interface {
 	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
 	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
 	GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error) error
+}
+
+// Transaction is the subset of *datastore.Transaction operations used within
+// DatastoreClient.RunInTransaction.
+type Transaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
+}
+
+// Client adapts a *datastore.Client to the DatastoreClient interface.
+type Client struct {
+	*datastore.Client
+}
+
+// NewClient creates a new Client from the given *datastore.Client.
+func NewClient(client *datastore.Client) *Client {
+	return &Client{Client: client}
+}
+
+// RunInTransaction runs f in a Datastore transaction. If f returns nil, the
+// transaction is committed. Datastore may retry f on commit conflicts, so f
+// must be safe to run more than once.
+func (c *Client) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	_, err := c.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(tx)
+	})
+	return err
 }
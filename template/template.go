@@ -21,8 +21,12 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"log"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/m-lab/epoxy/metrics"
 	"github.com/m-lab/epoxy/nextboot"
 	"github.com/m-lab/epoxy/storage"
 )
@@ -38,87 +42,363 @@ set images_version {{ .ImagesVersion }}
 {{- range $key, $value := .Extensions }}
 set {{ $key }}_url {{ $value }}
 {{- end }}
+{{- with .Message }}
+
+echo {{ . }}
+{{- end }}
+{{- range .Directives }}
+{{ . }}
+{{- end }}
+
+{{ .ChainCommand }} ${stage1chain_url}
+`
+
+// maintenanceIpxeTemplate is a template for an iPXE script that holds a host
+// in maintenance, then reboots to request a new stage1 script.
+const maintenanceIpxeTemplate = `#!ipxe
+
+echo {{ .Message }}
+sleep {{ .Seconds }}
+reboot
+`
+
+// fallbackIpxeScript is the format of a static iPXE script that chains to
+// FallbackStage1URL when the stage1 template cannot be rendered.
+const fallbackIpxeScript = `#!ipxe
+
+set stage1chain_url %s
 
 chain ${stage1chain_url}
 `
 
 var (
-	stage1Ipxe = template.Must(template.New("stage1").Parse(stage1IpxeTemplate))
+	stage1Ipxe      = template.Must(template.New("stage1").Parse(stage1IpxeTemplate))
+	maintenanceIpxe = template.Must(template.New("maintenance").Parse(maintenanceIpxeTemplate))
 )
 
-// FormatStage1IPXEScript generates a stage1 iPXE boot script using values from Host.
-func FormatStage1IPXEScript(h *storage.Host, serverAddr string) string {
-	var b bytes.Buffer
+// FallbackStage1URL, when not empty, is the absolute URL of a safe stage1to2
+// script used by FormatStage1IPXEScript when a host's boot sequence has no
+// stage1 URL or the stage1 template cannot be rendered, so machines always
+// receive a recoverable boot.
+var FallbackStage1URL string
+
+// MaxMaintenanceHold is the longest time a maintenance config waits before
+// rebooting, so held hosts regularly check whether maintenance has ended.
+const MaxMaintenanceHold = 10 * time.Minute
+
+// DefaultChainCommand is the iPXE command used to chain to the stage1 URL when
+// a Host does not specify one.
+const DefaultChainCommand = "chain"
+
+// validChainCommand matches iPXE commands that download and execute an image,
+// with the options supported by those commands.
+var validChainCommand = regexp.MustCompile(
+	`^(chain|imgexec)( (--autofree|--replace|-a|-r|--timeout[ =][0-9]+|-t [0-9]+))*$`)
+
+// ValidChainCommand returns true if cmd may be used as a Host ChainCommand.
+// An empty cmd is valid and selects DefaultChainCommand.
+func ValidChainCommand(cmd string) bool {
+	return cmd == "" || validChainCommand.MatchString(cmd)
+}
+
+// validIPXEDirective matches iPXE commands that may be added to a single
+// stage1 script, e.g. to diagnose the network during a one-off recovery. None
+// of them change the image the script chains to.
+var validIPXEDirective = regexp.MustCompile(
+	`^(dhcp|ifstat|route|imgstat|prompt|sleep [0-9]{1,3})$`)
+
+// ValidIPXEDirective returns true if directive may be added to a stage1 script.
+func ValidIPXEDirective(directive string) bool {
+	return validIPXEDirective.MatchString(directive)
+}
+
+// selectChainCommand returns the Host ChainCommand, or DefaultChainCommand if
+// the Host ChainCommand is empty or invalid.
+func selectChainCommand(h *storage.Host) string {
+	if h.ChainCommand == "" {
+		return DefaultChainCommand
+	}
+	if !ValidChainCommand(h.ChainCommand) {
+		log.Printf("Ignoring invalid chain command for %s: %q", h.Name, h.ChainCommand)
+		return DefaultChainCommand
+	}
+	return h.ChainCommand
+}
 
+// DefaultAPIVersion is the ePoxy server API version used in generated URLs
+// when neither the server nor the Host specify one.
+const DefaultAPIVersion = "v1"
+
+// validAPIVersion matches API versions served by the ePoxy server, e.g. "v1".
+var validAPIVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// ValidAPIVersion returns true if version may be used as a Host APIVersion.
+// An empty version is valid and selects the server API version.
+func ValidAPIVersion(version string) bool {
+	return version == "" || validAPIVersion.MatchString(version)
+}
+
+// selectAPIVersion returns the API version for URLs generated for the given
+// host. A Host APIVersion takes precedence over the server apiVersion.
+func selectAPIVersion(h *storage.Host, apiVersion string) string {
+	switch {
+	case h.APIVersion != "":
+		return h.APIVersion
+	case apiVersion != "":
+		return apiVersion
+	default:
+		return DefaultAPIVersion
+	}
+}
+
+// BaseURL returns the default external base URL for an ePoxy server with the
+// given public host:port.
+func BaseURL(serverAddr string) string {
+	return "https://" + serverAddr
+}
+
+// bootURL formats an absolute URL for a session-based boot target on the
+// ePoxy server, e.g. "stage2" or "extension/<operation>". The baseURL, e.g.
+// "https://epoxy.example.com", may include a path prefix.
+func bootURL(baseURL, apiVersion string, h *storage.Host, sessionID, target string) string {
+	return fmt.Sprintf("%s/%s/boot/%s/%s/%s",
+		strings.TrimSuffix(baseURL, "/"), apiVersion, h.Name, sessionID, target)
+}
+
+// stageURL formats an absolute URL for a stage target on the ePoxy server. If
+// the client provided a nonce, it is added to the URL query. Nonces are
+// URL-safe (see Host.SetNonce), so no escaping is necessary.
+func stageURL(baseURL, apiVersion string, h *storage.Host, sessionID, target string) string {
+	u := bootURL(baseURL, apiVersion, h, sessionID, target)
+	if h.CurrentSessionIDs.Nonce != "" {
+		u += "?nonce=" + h.CurrentSessionIDs.Nonce
+	}
+	return u
+}
+
+// ChainURL returns the URL for the given stage, e.g. "stage2", of the host's
+// current boot sequence, with the Host ImagesVersion substituted for any
+// "{{VERSION}}" placeholder. When the sequence includes a variant of the stage
+// for the Host firmware, e.g. "stage1.ipxe.efi", the variant URL is used.
+func ChainURL(h *storage.Host, stage string) string {
 	// Chose the current boot sequence from host.
 	s := h.CurrentSequence()
+	for _, variant := range h.FirmwareVariants() {
+		if s[stage+"."+variant] != "" {
+			stage = stage + "." + variant
+			break
+		}
+	}
+	return strings.Replace(s[stage], "{{VERSION}}", h.ImagesVersion, 1)
+}
+
+// SessionURLs returns the absolute URLs generated for the host's current
+// session IDs, keyed by kernel argument name, e.g. "epoxy.stage2". Extension
+// URLs are keyed by "epoxy.<operation>". Generated URLs start with baseURL and
+// use the Host APIVersion, or the given apiVersion.
+func SessionURLs(h *storage.Host, baseURL, apiVersion string) map[string]string {
+	v := selectAPIVersion(h, apiVersion)
+	urls := map[string]string{
+		"epoxy.stage2": stageURL(baseURL, v, h, h.CurrentSessionIDs.Stage2ID, "stage2"),
+		"epoxy.stage3": stageURL(baseURL, v, h, h.CurrentSessionIDs.Stage3ID, "stage3"),
+		"epoxy.report": bootURL(baseURL, v, h, h.CurrentSessionIDs.ReportID, "report"),
+	}
+	// Construct an extension URL for all extensions this host supports.
+	// TODO: verify that extensions actually exist. e.g. do not generate invalid urls.
+	for _, operation := range h.Extensions {
+		urls["epoxy."+operation] = bootURL(
+			baseURL, v, h, h.CurrentSessionIDs.ExtensionID, "extension/"+operation)
+	}
+	return urls
+}
+
+// validMessage matches Host messages that are safe to echo in iPXE scripts.
+// iPXE expands settings like "${name}" and treats "||" and "&&" as command
+// separators, so "$", "|" and "&" are not allowed.
+var validMessage = regexp.MustCompile(`^[\pL\pN\s.,:;!?'"()\[\]/@#%*+=_~<>-]*$`)
+
+// ValidMessage returns true if msg may be used as a Host Message. An empty msg
+// is valid and displays no banner.
+func ValidMessage(msg string) bool {
+	return validMessage.MatchString(msg)
+}
+
+// bannerMessage formats msg as a single line for an iPXE echo command. Line
+// breaks would end the echo command, so all whitespace is collapsed, and iPXE
+// script syntax characters are dropped from messages saved before they were
+// validated. The result is not HTML escaped, so the message appears on the
+// console as given.
+func bannerMessage(msg string) template.HTML {
+	msg = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("$|&", r) {
+			return -1
+		}
+		return r
+	}, msg)
+	return template.HTML(strings.Join(strings.Fields(msg), " "))
+}
+
+// FormatStage1IPXEScript generates a stage1 iPXE boot script using values from
+// Host. Generated URLs start with baseURL and use the Host APIVersion, or the
+// given apiVersion. Valid directives, if any, run before chaining; invalid
+// directives are ignored. If FallbackStage1URL is
+// set, it replaces a missing stage1 URL, and a template error returns a
+// script that chains to it instead of panicking.
+func FormatStage1IPXEScript(h *storage.Host, baseURL, apiVersion string, directives ...string) string {
+	var b bytes.Buffer
+
+	urls := SessionURLs(h, baseURL, apiVersion)
 
 	// Prepare a map for evaluating template.
 	vals := make(map[string]interface{}, 5)
-	vals["Stage1ChainURL"] = strings.Replace(s[storage.Stage1IPXE], "{{VERSION}}", h.ImagesVersion, 1)
-	vals["Stage2URL"] = fmt.Sprintf("https://%s/v1/boot/%s/%s/stage2",
-		serverAddr, h.Name, h.CurrentSessionIDs.Stage2ID)
-	vals["Stage3URL"] = fmt.Sprintf("https://%s/v1/boot/%s/%s/stage3",
-		serverAddr, h.Name, h.CurrentSessionIDs.Stage3ID)
-	vals["ReportURL"] = fmt.Sprintf("https://%s/v1/boot/%s/%s/report",
-		serverAddr, h.Name, h.CurrentSessionIDs.ReportID)
+	vals["Stage1ChainURL"] = ChainURL(h, storage.Stage1IPXE)
+	if vals["Stage1ChainURL"] == "" && FallbackStage1URL != "" {
+		log.Printf("Using fallback stage1 URL for %s: incomplete boot sequence", h.Name)
+		vals["Stage1ChainURL"] = FallbackStage1URL
+	}
+	vals["Stage2URL"] = urls["epoxy.stage2"]
+	vals["Stage3URL"] = urls["epoxy.stage3"]
+	vals["ReportURL"] = urls["epoxy.report"]
 	vals["ImagesVersion"] = h.ImagesVersion
 
-	// Construct an extension URL for all extensions this host supports.
+	// Collect the extension URLs by operation name.
 	extensionURLs := make(map[string]string, len(h.Extensions))
-	// TODO: verify that extensions actually exist. e.g. do not generate invalid urls.
 	for _, operation := range h.Extensions {
-		extensionURLs[operation] = fmt.Sprintf("https://%s/v1/boot/%s/%s/extension/%s",
-			serverAddr, h.Name, h.CurrentSessionIDs.ExtensionID, operation)
+		extensionURLs[operation] = urls["epoxy."+operation]
 	}
 	vals["Extensions"] = extensionURLs
+	vals["Message"] = bannerMessage(h.Message)
+	vals["ChainCommand"] = selectChainCommand(h)
+	var valid []string
+	for _, d := range directives {
+		if !ValidIPXEDirective(d) {
+			log.Printf("Ignoring invalid iPXE directive for %s: %q", h.Name, d)
+			continue
+		}
+		valid = append(valid, d)
+	}
+	vals["Directives"] = valid
 
 	err := stage1Ipxe.Execute(&b, vals)
 	if err != nil {
+		// Count the error before panicking, so that alerts can fire.
+		metrics.TemplateErrors.WithLabelValues(stage1Ipxe.Name()).Inc()
+		if FallbackStage1URL != "" {
+			log.Printf("Using fallback stage1 URL for %s: %v", h.Name, err)
+			return fmt.Sprintf(fallbackIpxeScript, FallbackStage1URL)
+		}
 		// Unit tests should catch this case due to bad template.
 		// Use panic instead of log.Fatal so the server can recover.
 		panic(err)
-		// TODO: return a static fallback configuration via the stage1to2_url.
 	}
 
 	return b.String()
 }
 
-// CreateStage1Action generates a stage1 epoxy-client action using values from Host.
-func CreateStage1Action(h *storage.Host, serverAddr string) string {
-	// Chose the current boot sequence from host.
-	s := h.CurrentSequence()
+// sessionExpiry returns the RFC3339 time when the current session of h expires
+// after sessionTTL, or "" if sessionTTL is zero.
+func sessionExpiry(h *storage.Host, sessionTTL time.Duration) string {
+	if sessionTTL <= 0 {
+		return ""
+	}
+	return h.LastSessionCreation.Add(sessionTTL).UTC().Format(time.RFC3339)
+}
 
+// CreateStage1Action generates a stage1 epoxy-client action using values from
+// Host. Generated URLs start with baseURL and use the Host APIVersion, or the
+// given apiVersion. If sessionTTL is not zero, the action includes the time
+// when the session URLs expire.
+func CreateStage1Action(h *storage.Host, baseURL, apiVersion string, sessionTTL time.Duration) string {
+	chain := ChainURL(h, storage.Stage1JSON)
 	c := nextboot.Config{
 		// clients receiving this configuration must support merging local and given Kargs.
-		Kargs: map[string]string{
-			"epoxy.stage2":         fmt.Sprintf("https://%s/v1/boot/%s/%s/stage2", serverAddr, h.Name, h.CurrentSessionIDs.Stage2ID),
-			"epoxy.stage3":         fmt.Sprintf("https://%s/v1/boot/%s/%s/stage3", serverAddr, h.Name, h.CurrentSessionIDs.Stage3ID),
-			"epoxy.report":         fmt.Sprintf("https://%s/v1/boot/%s/%s/report", serverAddr, h.Name, h.CurrentSessionIDs.ReportID),
-			"epoxy.images_version": h.ImagesVersion,
-		},
+		Kargs: SessionURLs(h, baseURL, apiVersion),
 		V1: &nextboot.V1{
-			Chain: strings.Replace(s["stage1.json"], "{{VERSION}}", h.ImagesVersion, 1),
+			Chain:          chain,
+			ChainSHA256:    h.ChainChecksums[chain],
+			CommandTimeout: h.CommandTimeout,
+			ExpiresAt:      sessionExpiry(h, sessionTTL),
 		},
 	}
+	c.Kargs["epoxy.images_version"] = h.ImagesVersion
 
-	// Construct an extension URL for all extensions this host supports.
-	// TODO: verify that extensions actually exist. e.g. do not generate invalid urls.
-	for _, operation := range h.Extensions {
-		c.Kargs["epoxy."+operation] = fmt.Sprintf(
-			"https://%s/v1/boot/%s/%s/extension/%s", serverAddr, h.Name, h.CurrentSessionIDs.ExtensionID, operation)
+	// Kargs are unordered, so also list the extensions in the order to run them.
+	if len(h.Extensions) > 0 {
+		c.Kargs[nextboot.ExtensionsKarg] = strings.Join(h.Extensions, ",")
 	}
 
 	return c.String()
 }
 
 // FormatStage2JSONConfig generates a stage2 JSON configuration for an epoxy client.
-func FormatJSONConfig(h *storage.Host, stage string) string {
-	// Chose the current boot sequence from host.
-	s := h.CurrentSequence()
+// If compact is true, the JSON is returned without indentation. If sessionTTL
+// is not zero, the config includes the time when the session URLs expire.
+func FormatJSONConfig(h *storage.Host, stage string, compact bool, sessionTTL time.Duration) string {
+	chain := ChainURL(h, stage)
+	c := nextboot.Config{
+		V1: &nextboot.V1{
+			Chain:          chain,
+			ChainSHA256:    h.ChainChecksums[chain],
+			CommandTimeout: h.CommandTimeout,
+			ExpiresAt:      sessionExpiry(h, sessionTTL),
+		},
+	}
+	if compact {
+		return c.CompactString()
+	}
+	return c.String()
+}
+
+// maintenanceHold returns the number of seconds a host in maintenance for
+// remaining should wait before rebooting, at most MaxMaintenanceHold.
+func maintenanceHold(remaining time.Duration) int {
+	if remaining > MaxMaintenanceHold {
+		remaining = MaxMaintenanceHold
+	}
+	// Round up, so the host does not reboot just before maintenance ends.
+	return int((remaining + time.Second - 1) / time.Second)
+}
+
+// maintenanceMessage describes the maintenance of h for the console.
+func maintenanceMessage(h *storage.Host) string {
+	msg := "Maintenance until " + h.MaintenanceUntil.UTC().Format(time.RFC3339)
+	if h.EffectiveBootPolicy() == storage.BootPolicyHold {
+		msg = "Held by boot policy"
+	}
+	if h.Message != "" {
+		msg += ": " + h.Message
+	}
+	return msg
+}
+
+// FormatMaintenanceIPXEScript generates an iPXE script for a Host in
+// maintenance for remaining time. The script waits, then reboots.
+func FormatMaintenanceIPXEScript(h *storage.Host, remaining time.Duration) string {
+	var b bytes.Buffer
+	vals := map[string]interface{}{
+		"Message": bannerMessage(maintenanceMessage(h)),
+		"Seconds": maintenanceHold(remaining),
+	}
+	err := maintenanceIpxe.Execute(&b, vals)
+	if err != nil {
+		// Count the error before panicking, so that alerts can fire.
+		metrics.TemplateErrors.WithLabelValues(maintenanceIpxe.Name()).Inc()
+		panic(err)
+	}
+	return b.String()
+}
+
+// CreateMaintenanceAction generates an epoxy-client action for a Host in
+// maintenance for remaining time. The action waits, then reboots the same way
+// epoxy_client does after a failure, so it never reports success.
+func CreateMaintenanceAction(h *storage.Host, remaining time.Duration) string {
 	c := nextboot.Config{
 		V1: &nextboot.V1{
-			Chain: strings.Replace(s[stage], "{{VERSION}}", h.ImagesVersion, 1),
+			Commands: []interface{}{
+				[]interface{}{"echo", maintenanceMessage(h)},
+				[]interface{}{"sleep", fmt.Sprint(maintenanceHold(remaining))},
+				[]interface{}{"/bin/sh", "-c", "echo 1 > /proc/sys/kernel/sysrq; echo b > /proc/sysrq-trigger"},
+			},
 		},
 	}
 	return c.String()
